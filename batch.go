@@ -0,0 +1,238 @@
+package fastcache
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"github.com/zerodha/fastglue"
+)
+
+// BatchHandler is the handler for "batch" endpoints wrapped by CachedBatch().
+// It is invoked only with the IDs that were not found in the cache and should
+// return the JSON body for each ID. IDs missing from the returned map and
+// those whose bodies aren't valid JSON are omitted from the response and are
+// not cached. The TTL of the cached IDs can be set by the handler like that
+// of Cached() responses, for instance, with the Cache-Control header. Stale
+// IDs (past their TTLs, or marked stale by DelGroup()) aren't served and are
+// fetched from the handler again.
+type BatchHandler func(r *fastglue.Request, ids []string) (map[string][]byte, error)
+
+// CachedBatch middleware caches "batch" endpoints such as /quotes?ids=a,b,c
+// where the response is a merge of individual results per ID. The
+// comma separated IDs in the query param are split and each ID is cached
+// individually under the group, keyed like a Cached() response with
+// IncludeQueryString to the request with the param set to the ID. Responses
+// that Cached() wouldn't cache (for instance, those with "no-store" or a
+// non-cacheable status) aren't cached. The cached IDs are fetched in one go
+// (using GetMulti() if the store implements MultiGetter) and the handler
+// is invoked only with the IDs that were missing.
+//
+// The response is a JSON object of the form {"id": <body>, ...} where body
+// is the raw JSON returned by the handler for the ID.
+func (f *FastCache) CachedBatch(h BatchHandler, o *Options, param, group string) fastglue.FastRequestHandler {
+	o = f.options(o).compile()
+
+	// The IDs are keyed by the query string with the param set to the ID,
+	// so that the other params of the request are part of their keys.
+	ko := *o
+	ko.IncludeQueryString = true
+
+	return func(r *fastglue.Request) error {
+		ids := splitIDs(string(r.RequestCtx.QueryArgs().Peek(param)))
+		if len(ids) == 0 {
+			return r.SendErrorEnvelope(fasthttp.StatusBadRequest, "invalid `"+param+"`", nil, "")
+		}
+
+		namespace, err := o.namespace(r)
+		if err != nil {
+			o.Logger.Printf("%v", err)
+		}
+		group := o.group(r, group)
+
+		var (
+			uris = batchURIs(r, &ko, param, ids)
+			out  = make(map[string][]byte, len(ids))
+		)
+
+		// Fetch the cached IDs from the store.
+		if namespace != "" {
+			items, err := f.getMulti(namespace, group, uris)
+			if err != nil {
+				o.Logger.Printf("error reading cache: %v", err)
+			}
+
+			now := o.Clock.Now()
+			for n, it := range items {
+				if len(it.Blob) == 0 || it.stale(now) {
+					continue
+				}
+
+				b := it.Blob
+				if it.Compression != "" {
+					if b, err = decompress(it.Compression, b); err != nil {
+						o.Logger.Printf("error decompressing blob: %v", err)
+						continue
+					}
+				}
+				out[ids[n]] = b
+			}
+		}
+
+		// Execute the actual handler for the missing IDs.
+		var missing []string
+		for _, id := range ids {
+			if _, ok := out[id]; !ok {
+				missing = append(missing, id)
+			}
+		}
+
+		if len(missing) > 0 {
+			start := time.Now()
+			res, err := h(r, missing)
+			if err != nil {
+				o.Logger.Printf("error running middleware: %v", err)
+				return r.SendErrorEnvelope(fasthttp.StatusInternalServerError, "error fetching data", nil, "")
+			}
+
+			// The TTL of the IDs is that of the handler's response.
+			ttl, cache, err := o.responseTTL(r, time.Since(start))
+			if err != nil {
+				o.Logger.Printf("%v", err)
+			}
+
+			// The TTL override is internal and never sent to the client.
+			r.RequestCtx.Response.Header.Del(headerTTL)
+
+			// Apply the checks of Cached() to the handler's response.
+			cache = cache && o.shouldCache(r)
+
+			for n, id := range ids {
+				b, ok := res[id]
+				if !ok {
+					continue
+				}
+				if !json.Valid(b) {
+					o.Logger.Printf("invalid JSON for batch ID '%s'", id)
+					continue
+				}
+				out[id] = b
+
+				if namespace == "" || !cache || (o.CacheBodyIf != nil && !o.CacheBodyIf("application/json", b)) {
+					continue
+				}
+
+				// Cache each ID separately.
+				item := Item{
+					ContentType: "application/json",
+					Blob:        b,
+					CreatedAt:   o.Clock.Now(),
+				}
+				if (o.StaleWhileRevalidate > 0 || o.Grace > 0) && ttl > 0 {
+					item.StaleAt = item.CreatedAt.Add(ttl)
+				}
+				f.compress(group, &item, o)
+
+				if err := f.put(namespace, group, uris[n], item, o.storeTTL(ttl)); err != nil {
+					o.Logger.Printf("error writing cache to store: %v", err)
+				}
+			}
+		}
+
+		// Merge the results in the order of the requested IDs.
+		var buf bytes.Buffer
+		buf.WriteByte('{')
+		for _, id := range ids {
+			b, ok := out[id]
+			if !ok {
+				continue
+			}
+			if buf.Len() > 1 {
+				buf.WriteByte(',')
+			}
+
+			k, _ := json.Marshal(id)
+			buf.Write(k)
+			buf.WriteByte(':')
+			buf.Write(b)
+		}
+		buf.WriteByte('}')
+
+		return r.SendBytes(fasthttp.StatusOK, "application/json", buf.Bytes())
+	}
+}
+
+// batchURIs returns the hashed URIs under which the IDs of a batch request
+// are cached. The URI of each ID is the cacheURI() of the request with param
+// set to the ID.
+func batchURIs(r *fastglue.Request, o *Options, param string, ids []string) []string {
+	var (
+		u     = r.RequestCtx.URI()
+		query = string(u.QueryString())
+		args  = fasthttp.AcquireArgs()
+		out   = make([]string, len(ids))
+	)
+	defer fasthttp.ReleaseArgs(args)
+
+	// The request's query string is swapped for that of each ID so that
+	// KeyGenerator, if set, sees the single ID too.
+	defer u.SetQueryString(query)
+	for n, id := range ids {
+		args.Parse(query)
+		args.Set(param, id)
+		u.SetQueryStringBytes(args.QueryString())
+		out[n] = cacheURI(r, o)
+	}
+
+	return out
+}
+
+// getMulti fetches multiple URIs from the store, using GetMulti() if the
+// store supports it, or individual Get()s otherwise.
+func (f *FastCache) getMulti(namespace, group string, uris []string) ([]Item, error) {
+	if m, ok := f.s.(MultiGetter); ok {
+		l, err := f.acquire()
+		if err != nil {
+			return nil, err
+		}
+		defer l.release()
+
+		return m.GetMulti(namespace, group, uris...)
+	}
+
+	out := make([]Item, len(uris))
+	for n, u := range uris {
+		// Missing items are errors in some stores. Ignore them.
+		it, err := f.get(namespace, group, u)
+		if err != nil {
+			continue
+		}
+		out[n] = it
+	}
+
+	return out, nil
+}
+
+// splitIDs splits a comma separated list of IDs, dropping empty
+// and duplicate values.
+func splitIDs(s string) []string {
+	var (
+		out  []string
+		seen = map[string]struct{}{}
+	)
+	for _, id := range strings.Split(s, ",") {
+		id = strings.TrimSpace(id)
+		if id == "" {
+			continue
+		}
+		if _, ok := seen[id]; ok {
+			continue
+		}
+		seen[id] = struct{}{}
+		out = append(out, id)
+	}
+
+	return out
+}
@@ -0,0 +1,64 @@
+package fastcache
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// NotEmptyJSON is an Options.CacheBodyIf predicate that rejects empty JSON
+// bodies ([], {}, null), including the data of fastglue envelopes such as
+// {"status": "success", "data": []}. Non-JSON bodies are accepted.
+func NotEmptyJSON(contentType string, body []byte) bool {
+	if !isJSON(contentType) {
+		return true
+	}
+	if isEmptyJSON(body) {
+		return false
+	}
+
+	// Is it an envelope?
+	var e struct {
+		Status string          `json:"status"`
+		Data   json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(body, &e); err != nil || e.Status == "" {
+		return true
+	}
+
+	return !isEmptyJSON(e.Data)
+}
+
+// BodyNotContains returns an Options.CacheBodyIf predicate that rejects
+// bodies containing the given substring, for instance, `"status":"error"`.
+func BodyNotContains(sub string) func(contentType string, body []byte) bool {
+	s := []byte(sub)
+	return func(contentType string, body []byte) bool {
+		return !bytes.Contains(body, s)
+	}
+}
+
+// AllBodyIf returns an Options.CacheBodyIf predicate that accepts a body
+// only if all the given predicates accept it.
+func AllBodyIf(preds ...func(contentType string, body []byte) bool) func(contentType string, body []byte) bool {
+	return func(contentType string, body []byte) bool {
+		for _, p := range preds {
+			if !p(contentType, body) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// isEmptyJSON checks if a JSON value is empty ([], {}, null or nothing).
+func isEmptyJSON(b []byte) bool {
+	b = bytes.TrimSpace(b)
+	if len(b) == 0 || string(b) == "null" {
+		return true
+	}
+	if len(b) < 2 || !((b[0] == '[' && b[len(b)-1] == ']') || (b[0] == '{' && b[len(b)-1] == '}')) {
+		return false
+	}
+
+	return len(bytes.TrimSpace(b[1:len(b)-1])) == 0
+}
@@ -0,0 +1,228 @@
+package fastcache
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/zerodha/fastglue"
+)
+
+// CDNPurger purges the objects tagged with surrogate keys from the edge
+// cache of a CDN.
+type CDNPurger interface {
+	PurgeKeys(keys []string) error
+}
+
+// CDNOptions configure the purging of the CDN's edge cache along with the
+// groups deleted with DelGroup() (SetCDN()).
+type CDNOptions struct {
+	Purger CDNPurger
+
+	// Header is the response header in which the surrogate key of cached
+	// responses is sent to the CDN, for instance, "Surrogate-Key" (Fastly)
+	// or "Cache-Tag" (Cloudflare). If it's empty, the responses are expected
+	// to be tagged by the application.
+	Header string
+
+	// Groups are the groups that are cached by the CDN. Deletions of other
+	// groups aren't purged from the CDN. All the groups are purged if it's
+	// empty.
+	Groups []string
+
+	// SurrogateKey returns the surrogate key of a namespace->group. By
+	// default, it's namespace/group.
+	SurrogateKey func(namespace, group string) string
+
+	// Async purges the CDN in the background so that DelGroup() doesn't wait
+	// on the CDN's API. Purge errors are then written to Logger instead of
+	// being returned.
+	Async bool
+
+	// Logger is the optional logger to which async purge errors are written.
+	Logger *log.Logger
+
+	// groups is the set of Groups.
+	groups map[string]struct{}
+}
+
+// SetCDN makes DelGroup() (and ClearGroup(), InvalidationHandler()) purge
+// the surrogate keys of the deleted groups from the CDN after deleting them
+// from the store, so that an invalidation clears both the caches coherently.
+// Glob patterns in group names can't be translated to surrogate keys and
+// aren't purged. If the purge fails, DelGroup() returns the error after the
+// groups are deleted from the store, unless the purge is Async.
+//
+// With a Header, the responses of the groups that are cached, that is, hits
+// and the misses that are written to the store, are tagged with their
+// surrogate keys.
+func (f *FastCache) SetCDN(o CDNOptions) error {
+	if o.Purger == nil {
+		return errors.New("fastcache: no CDN purger")
+	}
+	if o.SurrogateKey == nil {
+		o.SurrogateKey = func(namespace, group string) string {
+			return namespace + "/" + group
+		}
+	}
+	if o.Logger == nil {
+		o.Logger = log.New(io.Discard, "", 0)
+	}
+	o.groups = stringSet(o.Groups, false)
+
+	f.cdn.Store(&o)
+	return nil
+}
+
+// cdnOptions returns the CDN set with SetCDN(), if any.
+func (f *FastCache) cdnOptions() *CDNOptions {
+	o, _ := f.cdn.Load().(*CDNOptions)
+	return o
+}
+
+// cached checks if a group is cached by the CDN.
+func (o *CDNOptions) cached(group string) bool {
+	if o.groups == nil {
+		return true
+	}
+	_, ok := o.groups[group]
+	return ok
+}
+
+// purge purges the surrogate keys of the groups of a namespace from the CDN.
+func (o *CDNOptions) purge(namespace string, groups []string) error {
+	var keys []string
+	for _, g := range groups {
+		if o.cached(g) && !strings.ContainsAny(g, "*?[") {
+			keys = append(keys, o.SurrogateKey(namespace, g))
+		}
+	}
+	return o.purgeKeys(keys)
+}
+
+// purgeKeys purges surrogate keys from the CDN.
+func (o *CDNOptions) purgeKeys(keys []string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	if o.Async {
+		go func() {
+			if err := o.Purger.PurgeKeys(keys); err != nil {
+				o.Logger.Printf("error purging CDN: %v", err)
+			}
+		}()
+		return nil
+	}
+
+	if err := o.Purger.PurgeKeys(keys); err != nil {
+		return fmt.Errorf("error purging CDN: %w", err)
+	}
+	return nil
+}
+
+// tag sets the surrogate key header of a cached response.
+func (o *CDNOptions) tag(r *fastglue.Request, namespace, group string) {
+	if o.Header != "" && o.cached(group) {
+		r.RequestCtx.Response.Header.Set(o.Header, o.SurrogateKey(namespace, group))
+	}
+}
+
+// FastlyPurger purges surrogate keys from a Fastly service.
+type FastlyPurger struct {
+	ServiceID string
+	Token     string
+
+	// Soft marks the objects as stale instead of evicting them.
+	Soft bool
+
+	// Client is the HTTP client of the API requests. It defaults to a client
+	// with a 10 second timeout.
+	Client *http.Client
+
+	// Endpoint is the API's base URL. It defaults to https://api.fastly.com.
+	Endpoint string
+}
+
+// PurgeKeys purges surrogate keys with the Fastly API.
+func (p *FastlyPurger) PurgeKeys(keys []string) error {
+	endpoint := p.Endpoint
+	if endpoint == "" {
+		endpoint = "https://api.fastly.com"
+	}
+
+	hdr := map[string]string{"Fastly-Key": p.Token}
+	if p.Soft {
+		hdr["Fastly-Soft-Purge"] = "1"
+	}
+	return postPurge(p.Client, endpoint+"/service/"+p.ServiceID+"/purge", hdr,
+		map[string][]string{"surrogate_keys": keys})
+}
+
+// CloudflarePurger purges cache tags from a Cloudflare zone.
+type CloudflarePurger struct {
+	ZoneID string
+	Token  string
+
+	// Client is the HTTP client of the API requests. It defaults to a client
+	// with a 10 second timeout.
+	Client *http.Client
+
+	// Endpoint is the API's base URL. It defaults to
+	// https://api.cloudflare.com/client/v4.
+	Endpoint string
+}
+
+// PurgeKeys purges cache tags with the Cloudflare API.
+func (p *CloudflarePurger) PurgeKeys(keys []string) error {
+	endpoint := p.Endpoint
+	if endpoint == "" {
+		endpoint = "https://api.cloudflare.com/client/v4"
+	}
+
+	return postPurge(p.Client, endpoint+"/zones/"+p.ZoneID+"/purge_cache",
+		map[string]string{"Authorization": "Bearer " + p.Token},
+		map[string][]string{"tags": keys})
+}
+
+// purgeClient is the default HTTP client of the purgers. Purges block
+// DelGroup(), so they're never left to hang on the CDN's API.
+var purgeClient = &http.Client{Timeout: 10 * time.Second}
+
+// postPurge posts a JSON purge request to a CDN's API.
+func postPurge(c *http.Client, url string, headers map[string]string, body interface{}) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	if c == nil {
+		c = purgeClient
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("purge failed with %d: %s", resp.StatusCode, msg)
+	}
+	return nil
+}
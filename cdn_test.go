@@ -0,0 +1,110 @@
+package fastcache
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// purgeRecorder is a CDN API that records purge requests.
+type purgeRecorder struct {
+	path   string
+	header http.Header
+	body   map[string][]string
+}
+
+func (p *purgeRecorder) server(t *testing.T) *httptest.Server {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p.path, p.header, p.body = r.URL.Path, r.Header, nil
+		if err := json.NewDecoder(r.Body).Decode(&p.body); err != nil {
+			t.Error(err)
+		}
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func TestCDNPurgers(t *testing.T) {
+	var (
+		p = &purgeRecorder{}
+		s = p.server(t)
+	)
+
+	fp := &FastlyPurger{ServiceID: "svc", Token: "tok", Soft: true, Endpoint: s.URL}
+	if err := fp.PurgeKeys([]string{"a", "b"}); err != nil {
+		t.Fatal(err)
+	}
+	if p.path != "/service/svc/purge" || p.header.Get("Fastly-Key") != "tok" || p.header.Get("Fastly-Soft-Purge") != "1" ||
+		!reflect.DeepEqual(p.body["surrogate_keys"], []string{"a", "b"}) {
+		t.Fatalf("unexpected Fastly purge: %s %v %v", p.path, p.header, p.body)
+	}
+
+	cp := &CloudflarePurger{ZoneID: "zone", Token: "tok", Endpoint: s.URL}
+	if err := cp.PurgeKeys([]string{"a"}); err != nil {
+		t.Fatal(err)
+	}
+	if p.path != "/zones/zone/purge_cache" || p.header.Get("Authorization") != "Bearer tok" ||
+		!reflect.DeepEqual(p.body["tags"], []string{"a"}) {
+		t.Fatalf("unexpected Cloudflare purge: %s %v %v", p.path, p.header, p.body)
+	}
+}
+
+// keysPurger is a CDNPurger that records the purged keys.
+type keysPurger struct {
+	keys []string
+}
+
+func (p *keysPurger) PurgeKeys(keys []string) error {
+	p.keys = append(p.keys, keys...)
+	return nil
+}
+
+func TestDelGroupCDN(t *testing.T) {
+	var (
+		p = &keysPurger{}
+		f = New(&delGroupStore{})
+	)
+	if err := f.SetCDN(CDNOptions{Groups: []string{"mw", "orders:*"}}); err == nil {
+		t.Fatal("expected an error without a purger")
+	}
+	if err := f.SetCDN(CDNOptions{Purger: p, Groups: []string{"mw", "orders:*"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Groups not cached by the CDN and glob patterns aren't purged.
+	if err := f.DelGroup("public", "mw", "orders", "orders:*"); err != nil {
+		t.Fatal(err)
+	}
+	if exp := []string{"public/mw"}; !reflect.DeepEqual(p.keys, exp) {
+		t.Fatalf("expected purged keys %v but got %v", exp, p.keys)
+	}
+}
+
+// chanPurger is a CDNPurger that sends the purged keys on a channel and fails.
+type chanPurger chan []string
+
+func (p chanPurger) PurgeKeys(keys []string) error {
+	p <- keys
+	return errors.New("purge failed")
+}
+
+func TestDelGroupCDNAsync(t *testing.T) {
+	var (
+		p = make(chanPurger, 1)
+		f = New(&delGroupStore{})
+	)
+	if err := f.SetCDN(CDNOptions{Purger: p, Async: true}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Errors of async purges aren't returned.
+	if err := f.DelGroup("public", "mw"); err != nil {
+		t.Fatal(err)
+	}
+	if keys := <-p; !reflect.DeepEqual(keys, []string{"public/mw"}) {
+		t.Fatalf("expected purged keys [public/mw] but got %v", keys)
+	}
+}
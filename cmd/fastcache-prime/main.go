@@ -0,0 +1,195 @@
+// fastcache-prime warms the caches of a service by replaying a list of
+// request URIs against it, for instance, after deploys or DelGroup storms.
+//
+// URIs are read from a file or stdin, one per line, optionally prefixed with
+// the namespace to inject into the request with the namespace header.
+// Blank lines and lines starting with # are ignored.
+//
+//	/marketwatch
+//	XX1234 /orders?page=1
+//	XX5678 /orders?page=1
+//
+// Duplicate URIs under a namespace are replayed only once. As the keys of
+// IncludeQueryString routes are the raw URIs, /orders?q=a+b and
+// /orders?q=a%20b aren't duplicates.
+//
+//	cat urls.txt | fastcache-prime -url http://localhost:8080 -namespace-header X-User-ID
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// target is a single request to replay.
+type target struct {
+	namespace string
+	uri       string
+}
+
+// parseTargets reads the targets from a list, skipping duplicates.
+func parseTargets(r io.Reader, namespace string) ([]target, error) {
+	var (
+		out  []target
+		seen = make(map[string]struct{})
+		sc   = bufio.NewScanner(r)
+	)
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		t := target{namespace: namespace, uri: line}
+		if f := strings.Fields(line); len(f) == 2 {
+			t.namespace, t.uri = f[0], f[1]
+		} else if len(f) > 2 {
+			return nil, fmt.Errorf("invalid line: %s", line)
+		}
+		if !strings.HasPrefix(t.uri, "/") {
+			return nil, fmt.Errorf("invalid URI: %s", t.uri)
+		}
+
+		key := t.namespace + " " + t.uri
+		if _, ok := seen[key]; ok {
+			continue
+		}
+		seen[key] = struct{}{}
+		out = append(out, t)
+	}
+
+	return out, sc.Err()
+}
+
+// prime replays the targets against the root URL with the given number of
+// workers and returns the number of failed requests.
+func prime(client *http.Client, root, nsHeader string, headers http.Header, targets []target, workers int, lo *log.Logger) int64 {
+	var (
+		ch     = make(chan target)
+		failed int64
+		wg     sync.WaitGroup
+	)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for t := range ch {
+				if err := replay(client, root, nsHeader, headers, t); err != nil {
+					lo.Printf("error priming %s %s: %v", t.namespace, t.uri, err)
+					atomic.AddInt64(&failed, 1)
+				}
+			}
+		}()
+	}
+
+	for _, t := range targets {
+		ch <- t
+	}
+	close(ch)
+	wg.Wait()
+
+	return failed
+}
+
+// replay makes a single GET request and discards the response.
+func replay(client *http.Client, root, nsHeader string, headers http.Header, t target) error {
+	req, err := http.NewRequest(http.MethodGet, root+t.uri, nil)
+	if err != nil {
+		return err
+	}
+	for k, v := range headers {
+		req.Header[k] = v
+	}
+	if nsHeader != "" && t.namespace != "" {
+		req.Header.Set(nsHeader, t.namespace)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if _, err := io.Copy(io.Discard, resp.Body); err != nil {
+		return err
+	}
+
+	if resp.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// headerFlags collects repeated -H flags.
+type headerFlags []string
+
+func (h *headerFlags) String() string {
+	return strings.Join(*h, ", ")
+}
+
+func (h *headerFlags) Set(v string) error {
+	if !strings.Contains(v, ":") {
+		return fmt.Errorf("invalid header (Name: value): %s", v)
+	}
+	*h = append(*h, v)
+	return nil
+}
+
+func main() {
+	var (
+		root      = flag.String("url", "http://localhost:8080", "root URL of the service to prime")
+		file      = flag.String("file", "-", "file with the list of URIs to replay; - for stdin")
+		nsHeader  = flag.String("namespace-header", "", "request header to inject the namespaces into")
+		namespace = flag.String("namespace", "", "namespace for URIs without one")
+		workers   = flag.Int("concurrency", 4, "number of concurrent requests")
+		timeout   = flag.Duration("timeout", time.Second*10, "request timeout")
+		hdrs      headerFlags
+	)
+	flag.Var(&hdrs, "H", "additional request header (Name: value); can be repeated")
+	flag.Parse()
+
+	lo := log.New(os.Stderr, "", log.Ldate|log.Ltime)
+
+	in := os.Stdin
+	if *file != "-" {
+		f, err := os.Open(*file)
+		if err != nil {
+			lo.Fatalf("error opening file: %v", err)
+		}
+		defer f.Close()
+		in = f
+	}
+
+	targets, err := parseTargets(in, *namespace)
+	if err != nil {
+		lo.Fatalf("error reading URIs: %v", err)
+	}
+
+	headers := http.Header{}
+	for _, h := range hdrs {
+		kv := strings.SplitN(h, ":", 2)
+		headers.Add(strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1]))
+	}
+
+	if *workers < 1 {
+		*workers = 1
+	}
+
+	var (
+		client = &http.Client{Timeout: *timeout}
+		start  = time.Now()
+		failed = prime(client, strings.TrimRight(*root, "/"), *nsHeader, headers, targets, *workers, lo)
+	)
+	lo.Printf("primed %d URIs (%d failed) in %v", len(targets)-int(failed), failed, time.Since(start).Round(time.Millisecond))
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
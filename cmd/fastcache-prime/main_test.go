@@ -0,0 +1,77 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestParseTargets(t *testing.T) {
+	list := `
+# Comment.
+/marketwatch
+XX1234 /orders?q=a+b
+XX1234 /orders?q=a%20b
+XX5678 /orders?q=a%20b
+/marketwatch
+`
+	targets, err := parseTargets(strings.NewReader(list), "default")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exp := []target{
+		{"default", "/marketwatch"},
+		{"XX1234", "/orders?q=a+b"},
+		{"XX1234", "/orders?q=a%20b"},
+		{"XX5678", "/orders?q=a%20b"},
+	}
+	if !reflect.DeepEqual(targets, exp) {
+		t.Fatalf("expected %v but got %v", exp, targets)
+	}
+
+	for _, l := range []string{"a b c", "orders"} {
+		if _, err := parseTargets(strings.NewReader(l), ""); err == nil {
+			t.Fatalf("expected error for '%s'", l)
+		}
+	}
+}
+
+func TestPrime(t *testing.T) {
+	var (
+		mu   sync.Mutex
+		reqs []string
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		reqs = append(reqs, r.Header.Get("X-User-ID")+" "+r.Header.Get("X-Prime")+" "+r.URL.RequestURI())
+		mu.Unlock()
+
+		if r.URL.Path == "/fail" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer srv.Close()
+
+	targets := []target{{"XX1234", "/orders"}, {"", "/fail"}}
+	failed := prime(srv.Client(), srv.URL, "X-User-ID", http.Header{"X-Prime": []string{"1"}}, targets, 2, log.New(io.Discard, "", 0))
+	if failed != 1 {
+		t.Fatalf("expected 1 failed request but got %d", failed)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(reqs) != 2 {
+		t.Fatalf("expected 2 requests but got %v", reqs)
+	}
+	for _, r := range []string{"XX1234 1 /orders", " 1 /fail"} {
+		if reqs[0] != r && reqs[1] != r {
+			t.Fatalf("expected request '%s' in %v", r, reqs)
+		}
+	}
+}
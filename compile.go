@@ -0,0 +1,76 @@
+package fastcache
+
+import (
+	"io"
+	"log"
+	"strings"
+)
+
+// compiled is the config of a middleware registration that is precomputed
+// from its Options when the middleware is wrapped, so that it isn't
+// re-evaluated on every request.
+type compiled struct {
+	// includeParams and excludeParams are the sets of IncludeQueryParams and
+	// ExcludeQueryParams.
+	includeParams map[string]struct{}
+	excludeParams map[string]struct{}
+
+	// cacheMethods is the set of CacheMethods in upper case.
+	cacheMethods map[string]struct{}
+}
+
+// compile returns a copy of the Options with the defaults applied and the
+// lookups precomputed, which is immutable for the lifetime of a middleware.
+// Changes to the Options after the middleware is wrapped have no effect.
+func (o *Options) compile() *Options {
+	c := *o
+	if c.Logger == nil {
+		c.Logger = log.New(io.Discard, "", 0)
+	}
+	if c.Clock == nil {
+		c.Clock = SystemClock
+	}
+	if c.Compression.Enabled && c.Compression.MinLength < 1 {
+		c.Compression.MinLength = 500
+	}
+	if c.MaxBodyBytes < 1 {
+		c.MaxBodyBytes = 64 * 1024
+	}
+	if c.MaxRawKeyLength < 1 {
+		c.MaxRawKeyLength = 256
+	}
+
+	c.compiled = &compiled{
+		includeParams: stringSet(o.IncludeQueryParams, false),
+		excludeParams: stringSet(o.ExcludeQueryParams, false),
+		cacheMethods:  stringSet(o.CacheMethods, true),
+	}
+
+	return &c
+}
+
+// paramSets returns the sets of IncludeQueryParams and ExcludeQueryParams.
+// They're computed if the Options aren't compiled.
+func (o *Options) paramSets() (include, exclude map[string]struct{}) {
+	if o.compiled != nil {
+		return o.compiled.includeParams, o.compiled.excludeParams
+	}
+	return stringSet(o.IncludeQueryParams, false), stringSet(o.ExcludeQueryParams, false)
+}
+
+// stringSet returns the set of a list of strings, optionally upper cased.
+// It's nil for empty lists.
+func stringSet(list []string, upper bool) map[string]struct{} {
+	if len(list) == 0 {
+		return nil
+	}
+
+	out := make(map[string]struct{}, len(list))
+	for _, s := range list {
+		if upper {
+			s = strings.ToUpper(s)
+		}
+		out[s] = struct{}{}
+	}
+	return out
+}
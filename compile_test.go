@@ -0,0 +1,33 @@
+package fastcache
+
+import (
+	"testing"
+)
+
+func TestCompile(t *testing.T) {
+	o := &Options{
+		Compression:        CompressionsOptions{Enabled: true},
+		CacheMethods:       []string{"post"},
+		ExcludeQueryParams: []string{"utm_source"},
+	}
+	c := o.compile()
+
+	// The defaults are applied to the copy only.
+	if o.Logger != nil || o.Clock != nil || o.Compression.MinLength != 0 || o.compiled != nil {
+		t.Fatal("expected the Options to be left as-is")
+	}
+	if c.Logger == nil || c.Clock == nil || c.Compression.MinLength != 500 || c.MaxBodyBytes != 64*1024 {
+		t.Fatalf("expected the defaults to be applied but got %+v", c)
+	}
+
+	if !c.cacheableMethod([]byte("POST")) || c.cacheableMethod([]byte("PUT")) {
+		t.Fatal("expected only POST to be cacheable")
+	}
+
+	// Compiled and uncompiled Options produce the same keys.
+	for _, opt := range []*Options{o, c} {
+		if k := string(queryKey([]byte("/q"), []byte("utm_source=x&b=1&a=2"), opt)); k != "/q?a=2&b=1" {
+			t.Fatalf("expected /q?a=2&b=1 but got %q", k)
+		}
+	}
+}
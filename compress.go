@@ -0,0 +1,174 @@
+package fastcache
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/zerodha/fastglue"
+)
+
+var (
+	// zstdEncoder is safe for concurrent use with EncodeAll().
+	zstdEncoder, _ = zstd.NewWriter(nil)
+
+	// zstdDecoders and gzipWriters are pools for streaming transcoding.
+	zstdDecoders = sync.Pool{
+		New: func() interface{} {
+			d, _ := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1))
+			return d
+		},
+	}
+	gzipWriters = sync.Pool{
+		New: func() interface{} {
+			return gzip.NewWriter(nil)
+		},
+	}
+)
+
+func compressZstd(b []byte) []byte {
+	return zstdEncoder.EncodeAll(b, make([]byte, 0, len(b)/2))
+}
+
+func decompressZstd(b []byte) ([]byte, error) {
+	d := zstdDecoders.Get().(*zstd.Decoder)
+	defer zstdDecoders.Put(d)
+
+	return d.DecodeAll(b, nil)
+}
+
+// decompress decompresses a blob compressed with the given algorithm.
+func decompress(comp string, b []byte) ([]byte, error) {
+	if comp == compZstd {
+		return decompressZstd(b)
+	}
+	return decompressGzip(b)
+}
+
+// streamZstdToGzip streams a zstd compressed blob to the response as gzip,
+// decompressing and recompressing it on the fly with pooled coders so that
+// the whole body isn't buffered twice.
+func streamZstdToGzip(r *fastglue.Request, b []byte, o *Options) {
+	r.RequestCtx.Response.Header.Set("Content-Encoding", compGzip)
+	r.RequestCtx.SetBodyStreamWriter(func(w *bufio.Writer) {
+		var (
+			d  = zstdDecoders.Get().(*zstd.Decoder)
+			gw = gzipWriters.Get().(*gzip.Writer)
+		)
+		defer func() {
+			// Release the references to the blob and the writer.
+			d.Reset(nil)
+			gw.Reset(io.Discard)
+			zstdDecoders.Put(d)
+			gzipWriters.Put(gw)
+		}()
+
+		if err := d.Reset(bytes.NewReader(b)); err != nil {
+			o.Logger.Printf("error transcoding blob: %v", err)
+			return
+		}
+		gw.Reset(w)
+		if _, err := io.Copy(gw, d); err != nil {
+			o.Logger.Printf("error transcoding blob: %v", err)
+		}
+		if err := gw.Close(); err != nil {
+			o.Logger.Printf("error transcoding blob: %v", err)
+		}
+	})
+}
+
+const (
+	// ratioMinSamples is the number of blobs of a content type that are
+	// compressed before its compression can be skipped.
+	ratioMinSamples = 20
+
+	// ratioResample is the interval (in blobs) at which the blobs of a
+	// skipped content type are still compressed to update its ratio.
+	ratioResample = 100
+)
+
+// ratioStats is the running compression ratio of a content type.
+type ratioStats struct {
+	samples int64
+	skipped int64
+
+	// saved is the moving average of the fraction of bytes saved.
+	saved float64
+}
+
+// ratioTracker tracks the compression ratios of content types. The zero
+// value is ready to use.
+type ratioTracker struct {
+	types map[string]*ratioStats
+	mu    sync.Mutex
+}
+
+// skip checks if the compression of a blob of a content type should be
+// skipped as the content type's blobs consistently compress under minRatio.
+func (t *ratioTracker) skip(ctype string, minRatio float64) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	s, ok := t.types[mediaType(ctype)]
+	if !ok || s.samples < ratioMinSamples || s.saved >= minRatio {
+		return false
+	}
+
+	// Occasionally sample skipped types.
+	s.skipped++
+	return s.skipped%ratioResample != 0
+}
+
+// record records the compression of a blob of a content type.
+func (t *ratioTracker) record(ctype string, n, compressed int) {
+	if n == 0 {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.types == nil {
+		t.types = make(map[string]*ratioStats)
+	}
+	ctype = mediaType(ctype)
+	s, ok := t.types[ctype]
+	if !ok {
+		s = &ratioStats{}
+		t.types[ctype] = s
+	}
+
+	saved := 1 - float64(compressed)/float64(n)
+	if s.samples == 0 {
+		s.saved = saved
+	} else {
+		s.saved += (saved - s.saved) / 10
+	}
+	s.samples++
+}
+
+// CompressionRatios returns the moving averages of the fraction of bytes
+// saved by compressing the blobs of content types, as tracked with
+// CompressionsOptions.MinRatio.
+func (f *FastCache) CompressionRatios() map[string]float64 {
+	f.ratios.mu.Lock()
+	defer f.ratios.mu.Unlock()
+
+	out := make(map[string]float64, len(f.ratios.types))
+	for t, s := range f.ratios.types {
+		out[t] = s.saved
+	}
+	return out
+}
+
+// mediaType returns the media type of a content type without parameters.
+func mediaType(ctype string) string {
+	if i := strings.IndexByte(ctype, ';'); i >= 0 {
+		ctype = ctype[:i]
+	}
+	return strings.ToLower(strings.TrimSpace(ctype))
+}
@@ -0,0 +1,59 @@
+package fastcache
+
+import (
+	"bytes"
+	"crypto/rand"
+	"log"
+	"os"
+	"testing"
+)
+
+func TestCompressMinRatio(t *testing.T) {
+	var (
+		f = New(nil)
+		o = &Options{
+			Compression: CompressionsOptions{Enabled: true, MinLength: 10, MinRatio: 0.1},
+			Logger:      log.New(os.Stdout, "", 0),
+		}
+		text = bytes.Repeat([]byte("compressible "), 100)
+		rnd  = make([]byte, 1000)
+	)
+	if _, err := rand.Read(rnd); err != nil {
+		t.Fatal(err)
+	}
+
+	compress := func(ctype string, b []byte) string {
+		it := Item{ContentType: ctype, Blob: b}
+		f.compress("", &it, o)
+		return it.CompressionReason
+	}
+
+	// Incompressible types are compressed till there are enough samples.
+	for i := 0; i < ratioMinSamples; i++ {
+		if r := compress("image/png", rnd); r != CompressionReasonCompressed {
+			t.Fatalf("%d: expected '%s' but got '%s'", i, CompressionReasonCompressed, r)
+		}
+		if r := compress("text/plain; charset=utf-8", text); r != CompressionReasonCompressed {
+			t.Fatalf("%d: expected '%s' but got '%s'", i, CompressionReasonCompressed, r)
+		}
+	}
+
+	// And then skipped, except for occasional samples.
+	compressed := 0
+	for i := 0; i < ratioResample; i++ {
+		if compress("image/png", rnd) == CompressionReasonCompressed {
+			compressed++
+		}
+		if r := compress("text/plain", text); r != CompressionReasonCompressed {
+			t.Fatalf("%d: expected '%s' but got '%s'", i, CompressionReasonCompressed, r)
+		}
+	}
+	if compressed != 1 {
+		t.Fatalf("expected 1 sample of the skipped type but got %d", compressed)
+	}
+
+	ratios := f.CompressionRatios()
+	if ratios["image/png"] >= 0.1 || ratios["text/plain"] < 0.5 {
+		t.Fatalf("unexpected ratios: %v", ratios)
+	}
+}
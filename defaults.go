@@ -0,0 +1,131 @@
+package fastcache
+
+import (
+	"time"
+
+	"github.com/zerodha/fastglue"
+)
+
+// Override is a per-route override of the default Options passed to New().
+// Zero values (and nil pointers) inherit the defaults. The durations and
+// bools are pointers so that they can be overridden with their zero values,
+// for instance, TTL: Duration(0) for no TTL.
+type Override struct {
+	TTL                  *time.Duration
+	NegativeTTL          *time.Duration
+	StaleWhileRevalidate *time.Duration
+	Grace                *time.Duration
+
+	ETag               *bool
+	LastModified       *bool
+	IncludeQueryString *bool
+	NoBlob             *bool
+	Coalesce           *bool
+
+	// IncludeQueryParams, ExcludeQueryParams and IncludeHeaders replace
+	// the defaults if they're set.
+	IncludeQueryParams []string
+	ExcludeQueryParams []string
+	IncludeHeaders     []string
+
+	NamespaceKey string
+	GroupHook    func(r *fastglue.Request) string
+	KeyGenerator func(r *fastglue.Request) string
+	TTLHook      func(r *fastglue.Request) time.Duration
+}
+
+// Override returns a copy of the default Options passed to New() with the
+// per-route override applied, for passing to Cached(), for instance:
+//
+//	fc.Cached(h, fc.Override(fastcache.Override{TTL: fastcache.Duration(time.Minute)}), "orders")
+//
+// Passing nil Options to the middlewares uses the defaults as they are.
+func (f *FastCache) Override(ov Override) *Options {
+	o := f.options(nil)
+
+	for _, d := range []struct {
+		ov  *time.Duration
+		dst *time.Duration
+	}{
+		{ov.TTL, &o.TTL},
+		{ov.NegativeTTL, &o.NegativeTTL},
+		{ov.StaleWhileRevalidate, &o.StaleWhileRevalidate},
+		{ov.Grace, &o.Grace},
+	} {
+		if d.ov != nil {
+			*d.dst = *d.ov
+		}
+	}
+
+	for _, b := range []struct {
+		ov  *bool
+		dst *bool
+	}{
+		{ov.ETag, &o.ETag},
+		{ov.LastModified, &o.LastModified},
+		{ov.IncludeQueryString, &o.IncludeQueryString},
+		{ov.NoBlob, &o.NoBlob},
+		{ov.Coalesce, &o.Coalesce},
+	} {
+		if b.ov != nil {
+			*b.dst = *b.ov
+		}
+	}
+
+	if ov.IncludeQueryParams != nil {
+		o.IncludeQueryParams = ov.IncludeQueryParams
+	}
+	if ov.ExcludeQueryParams != nil {
+		o.ExcludeQueryParams = ov.ExcludeQueryParams
+	}
+	if ov.IncludeHeaders != nil {
+		o.IncludeHeaders = ov.IncludeHeaders
+	}
+	if ov.NamespaceKey != "" {
+		o.NamespaceKey = ov.NamespaceKey
+	}
+	if ov.GroupHook != nil {
+		o.GroupHook = ov.GroupHook
+	}
+	if ov.KeyGenerator != nil {
+		o.KeyGenerator = ov.KeyGenerator
+	}
+	if ov.TTLHook != nil {
+		o.TTLHook = ov.TTLHook
+	}
+
+	return o
+}
+
+// options returns the Options of a middleware, which are a copy of the
+// defaults if o is nil.
+func (f *FastCache) options(o *Options) *Options {
+	if o != nil {
+		return o
+	}
+
+	var d Options
+	if f.defaults != nil {
+		d = *f.defaults
+	}
+	return &d
+}
+
+// clock returns the Clock of the default Options passed to New(), which is
+// the Clock of the APIs that don't take Options, such as GetOrFill().
+func (f *FastCache) clock() Clock {
+	if f.defaults != nil && f.defaults.Clock != nil {
+		return f.defaults.Clock
+	}
+	return SystemClock
+}
+
+// Bool returns a pointer to a bool for Override fields.
+func Bool(v bool) *bool {
+	return &v
+}
+
+// Duration returns a pointer to a time.Duration for Override fields.
+func Duration(v time.Duration) *time.Duration {
+	return &v
+}
@@ -0,0 +1,45 @@
+package fastcache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestOverride(t *testing.T) {
+	f := New(nil, &Options{
+		NamespaceKey:       "user_id",
+		TTL:                time.Hour,
+		ETag:               true,
+		IncludeQueryString: true,
+		IncludeHeaders:     []string{"Accept"},
+	})
+
+	o := f.Override(Override{TTL: Duration(time.Minute), ETag: Bool(false)})
+	if o.TTL != time.Minute || o.ETag {
+		t.Fatalf("expected overridden TTL and ETag but got %v, %v", o.TTL, o.ETag)
+	}
+	if o.NamespaceKey != "user_id" || !o.IncludeQueryString || len(o.IncludeHeaders) != 1 {
+		t.Fatalf("expected inherited defaults but got %+v", o)
+	}
+
+	// Durations can be overridden with 0.
+	if o := f.Override(Override{TTL: Duration(0)}); o.TTL != 0 {
+		t.Fatalf("expected no TTL but got %v", o.TTL)
+	}
+
+	// The defaults aren't modified.
+	if d := f.options(nil); d.TTL != time.Hour || !d.ETag {
+		t.Fatalf("expected unmodified defaults but got %+v", d)
+	}
+
+	// Routes can have their own Options.
+	own := &Options{TTL: time.Second}
+	if f.options(own) != own {
+		t.Fatal("expected the route's own Options")
+	}
+
+	// Without defaults, the Options are empty.
+	if o := New(nil).Override(Override{TTL: Duration(time.Minute)}); o.TTL != time.Minute || o.ETag {
+		t.Fatalf("expected only the override but got %+v", o)
+	}
+}
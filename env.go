@@ -0,0 +1,29 @@
+package fastcache
+
+import (
+	"os"
+	"strings"
+)
+
+// EnvPrefix composes a store key prefix from base and the values of the
+// given environment variables, separated by colons, so that deployments
+// such as staging and canaries that share a store never collide. For
+// instance, with ENV=staging and SERVICE=orders,
+// EnvPrefix("CACHE", "ENV", "SERVICE") returns "CACHE:staging:orders:".
+// Unset variables are skipped.
+func EnvPrefix(base string, vars ...string) string {
+	parts := make([]string, 0, len(vars)+1)
+	if base != "" {
+		parts = append(parts, strings.TrimSuffix(base, ":"))
+	}
+	for _, v := range vars {
+		if val := os.Getenv(v); val != "" {
+			parts = append(parts, val)
+		}
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+
+	return strings.Join(parts, ":") + ":"
+}
@@ -0,0 +1,24 @@
+package fastcache
+
+import "testing"
+
+func TestEnvPrefix(t *testing.T) {
+	t.Setenv("FC_TEST_ENV", "staging")
+	t.Setenv("FC_TEST_SERVICE", "orders")
+
+	for _, c := range []struct {
+		base string
+		vars []string
+		exp  string
+	}{
+		{"CACHE", []string{"FC_TEST_ENV", "FC_TEST_SERVICE"}, "CACHE:staging:orders:"},
+		{"CACHE:", []string{"FC_TEST_ENV"}, "CACHE:staging:"},
+		{"CACHE", []string{"FC_TEST_UNSET", "FC_TEST_SERVICE"}, "CACHE:orders:"},
+		{"", []string{"FC_TEST_ENV"}, "staging:"},
+		{"", []string{"FC_TEST_UNSET"}, ""},
+	} {
+		if p := EnvPrefix(c.base, c.vars...); p != c.exp {
+			t.Fatalf("expected '%s' for %s %v but got '%s'", c.exp, c.base, c.vars, p)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package fastcache
+
+import (
+	"encoding/json"
+)
+
+// envelopeStatusError is the status of fastglue's error envelopes.
+const envelopeStatusError = "error"
+
+// envelope is the part of fastglue's Envelope that is needed to
+// decide whether a response is cacheable.
+type envelope struct {
+	Status string `json:"status"`
+}
+
+// EnvelopeSuccess is an Options.CacheBodyIf predicate for handlers that
+// respond with fastglue's SendEnvelope() and SendErrorEnvelope(). It rejects
+// error envelopes ({"status": "error", ...}) which are commonly sent with a 200
+// status and hence would otherwise be cached. Non-JSON bodies are accepted.
+//
+// Success envelopes are cached as-is along with their status code, and are
+// served byte for byte from the cache.
+func EnvelopeSuccess(contentType string, body []byte) bool {
+	if !isJSON(contentType) {
+		return true
+	}
+
+	var e envelope
+	if err := json.Unmarshal(body, &e); err != nil {
+		// Not an envelope.
+		return true
+	}
+
+	return e.Status != envelopeStatusError
+}
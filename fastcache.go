@@ -5,14 +5,21 @@ package fastcache
 import (
 	"bytes"
 	"compress/gzip"
-	"crypto/md5"
+	"context"
 	"crypto/rand"
+	"crypto/sha1"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log"
+	"net/textproto"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/valyala/fasthttp"
@@ -22,6 +29,69 @@ import (
 // FastCache is the cache controller.
 type FastCache struct {
 	s Store
+
+	// The optional components and callbacks below can be set at runtime and
+	// are read by requests, so they're stored atomically.
+
+	// lim optionally limits concurrent store operations (*limiter,
+	// LimitStore()).
+	lim atomic.Value
+
+	// rep optionally aggregates hit/miss reports (*reporter,
+	// StartReporter()).
+	rep atomic.Value
+
+	// readOnly is 1 if writes to the store are disabled (SetReadOnly()).
+	readOnly int32
+
+	// shed is 1 if the load shedding mode is enabled (SetShedding()) and
+	// shedSignal is the optional load signal (func() bool,
+	// SetShedSignal()).
+	shed       int32
+	shedSignal atomic.Value
+
+	// delGroupGrace is the window (time.Duration) for which groups deleted
+	// with DelGroup() are retained as stale (SetDelGroupGrace()).
+	delGroupGrace int64
+
+	// onInvalidate is the optional callback invoked on DelGroup()
+	// (func(namespace string, groups []string), OnInvalidate()).
+	onInvalidate atomic.Value
+
+	// cdn optionally purges the CDN along with DelGroup() (*CDNOptions,
+	// SetCDN()).
+	cdn atomic.Value
+
+	// refreshing is the set of URIs being refreshed in the background
+	// (Options.StaleWhileRevalidate).
+	refreshing sync.Map
+
+	// graceServes counts the grace serves (*graceCount) of URIs
+	// (Options.GraceLimit). Counts whose grace windows have ended are swept
+	// every graceSweepFreq, at the UnixNano graceSweep.
+	graceServes sync.Map
+	graceSweep  int64
+
+	// sf deduplicates concurrent fills of the same URI.
+	sf singleflight
+
+	// ratios tracks the compression ratios of content types
+	// (CompressionsOptions.MinRatio).
+	ratios ratioTracker
+
+	// purges are the deduplicated purges in their windows, with whether a
+	// trailing purge is due at the end of the window
+	// (Options.PurgeDedupWindow).
+	purges  map[string]bool
+	purgeMu sync.Mutex
+
+	// defaults are the default Options of routes (New()).
+	defaults *Options
+
+	// streaming is the set of route paths marked as streaming with
+	// MarkStreaming() that cannot be cached.
+	streaming map[string]struct{}
+	mu        sync.RWMutex
 }
 
 // CompressionsOptions defines gzip compression options.
@@ -38,8 +108,114 @@ type CompressionsOptions struct {
 	// appropriate blob, compressed or uncompressed is returned. When set to false,
 	// the stored response is always decompressed and the resultant decompressed data is served.
 	RespectHeaders bool
+
+	// MinRatio, if set, automatically skips compression for content types
+	// whose blobs consistently shrink by less than this fraction (eg: 0.1
+	// for 10%), saving CPU on already compact payloads such as images.
+	// Skipped content types are still sampled occasionally so that changes
+	// in their payloads are picked up.
+	MinRatio float64
+
+	// Algorithm is the compression algorithm, "gzip" (default) or "zstd".
+	// zstd blobs are served as is to clients that accept zstd and are
+	// transcoded to gzip on the fly for clients that only accept gzip.
+	Algorithm string
+}
+
+// AdaptiveTTLOptions defines latency-aware adaptive TTL options. When
+// enabled, the TTL of a response is scaled by the latency of the handler
+// that generated it relative to Baseline, so that expensive responses are
+// cached for longer and cheap ones for shorter, within MinTTL and MaxTTL.
+type AdaptiveTTLOptions struct {
+	Enabled bool
+
+	// Baseline is the handler latency at which responses get the unscaled
+	// TTL. For instance, with a Baseline of 100ms and a TTL of 1m, a response
+	// that took 300ms to generate is cached for 3m and one that took 50ms
+	// for 30s.
+	Baseline time.Duration
+
+	// MinTTL and MaxTTL bound the scaled TTLs. Either can be 0 for no bound.
+	MinTTL time.Duration
+	MaxTTL time.Duration
+}
+
+// scale scales a TTL by the handler latency.
+func (a AdaptiveTTLOptions) scale(ttl, latency time.Duration) time.Duration {
+	if !a.Enabled || a.Baseline <= 0 || ttl <= 0 {
+		return ttl
+	}
+
+	ttl = time.Duration(float64(ttl) * float64(latency) / float64(a.Baseline))
+	if a.MinTTL > 0 && ttl < a.MinTTL {
+		ttl = a.MinTTL
+	}
+	if a.MaxTTL > 0 && ttl > a.MaxTTL {
+		ttl = a.MaxTTL
+	}
+
+	// A zero TTL means no expiry.
+	if ttl <= 0 {
+		ttl = time.Millisecond
+	}
+	return ttl
+}
+
+// PathNormalization are the normalizations applied to request paths before
+// cache keys are computed.
+type PathNormalization struct {
+	// TrimTrailingSlash trims trailing slashes (/orders/ is /orders).
+	TrimTrailingSlash bool
+
+	// MergeSlashes merges duplicate slashes (/orders//1 is /orders/1). The
+	// fasthttp server already does this unless DisablePathNormalizing is set.
+	MergeSlashes bool
+
+	// Lowercase lowercases paths (/Orders is /orders).
+	Lowercase bool
+}
+
+// QueryNormalization are the normalizations applied to query strings before
+// cache keys are computed with IncludeQueryString. With any of the query
+// options, query strings are also percent-decoded and re-encoded canonically,
+// so ?q=a%20b and ?q=a+b share a key regardless.
+type QueryNormalization struct {
+	// LowercaseKeys lowercases param names (?Page=1 is ?page=1).
+	LowercaseKeys bool
+
+	// DropEmpty drops params without values (?page=1&q= is ?page=1).
+	DropEmpty bool
+
+	// Sort sorts params by name and the values of repeated params
+	// (?b=1&a=2 is ?a=2&b=1).
+	Sort bool
 }
 
+// DuplicateParams is the treatment of repeated query params (?id=1&id=2) in
+// cache keys with IncludeQueryString.
+type DuplicateParams uint8
+
+const (
+	// DuplicateParamsKeepAll keeps all the values of repeated params in
+	// their order, so ?id=1&id=2 and ?id=2&id=1 have different keys.
+	DuplicateParamsKeepAll DuplicateParams = iota
+
+	// DuplicateParamsJoin joins the values of repeated params with commas
+	// (?id=1&id=2 is ?id=1,2), which can be canonicalized further with
+	// QueryValueCanonicalizers (eg: CanonicalCSV).
+	DuplicateParamsJoin
+
+	// DuplicateParamsFirst keeps the first value of repeated params.
+	DuplicateParamsFirst
+
+	// DuplicateParamsLast keeps the last value of repeated params.
+	DuplicateParamsLast
+
+	// DuplicateParamsError responds to requests with repeated params with
+	// 400 (Bad Request) without invoking the handler.
+	DuplicateParamsError
+)
+
 // Options has FastCache options.
 type Options struct {
 	// namespaceKey is the namespace that is used to namespace and store cache values.
@@ -50,13 +226,61 @@ type Options struct {
 	// the user's namespace.
 	NamespaceKey string
 
+	// NamespaceHook, if set, computes the namespace of a request instead of
+	// NamespaceKey, for instance, from JWT claims or headers, without a
+	// middleware to copy them into UserValue(). Requests for which it returns
+	// an error or an empty namespace aren't cached.
+	NamespaceHook func(r *fastglue.Request) (string, error)
+
+	// SharedNamespace, if set, is the namespace under which requests without
+	// a namespace (eg: unauthenticated requests) are cached instead of
+	// bypassing the cache, for instance, "public". Responses cached under it
+	// are served to all such requests, so it should only be set on routes
+	// whose responses aren't user specific.
+	SharedNamespace string
+
+	// ShareAuthorized, if enabled, lets requests with Authorization headers
+	// be cached under SharedNamespace. By default, as per the shared cache
+	// rules of RFC 9111, they're treated as private and require a namespace,
+	// so that authorized responses are never served to other users.
+	ShareAuthorized bool
+
+	// PurgeDedupWindow, if set, deduplicates identical purges (of the same
+	// namespace and groups) by ClearGroup() within the window, so that retry
+	// storms on write endpoints don't translate into redundant deletions in
+	// the store. The first purge runs immediately and the ones requested
+	// within the window after it are collapsed into one that runs at the end
+	// of the window.
+	PurgeDedupWindow time.Duration
+
 	// TTL for a cache item. If this is not set, no TTL is applied to cached
-	// items.
+	// items. Handlers can override the TTL of individual responses with the
+	// X-Fastcache-TTL response header (eg: 30s, or 0s to not cache), which is
+	// stripped from the response.
 	TTL time.Duration
 
+	// TTLHook, if set, returns the TTL of a request's response, so that it
+	// can depend on the request, for instance, market hours or the tier of
+	// the namespace. It's invoked after the handler for cacheable responses.
+	// 0 falls back to TTL (and the other TTL options) and negative values
+	// skip caching. The handler's X-Fastcache-TTL takes precedence.
+	TTLHook func(r *fastglue.Request) time.Duration
+
 	// Process ETags and send 304s?
 	ETag bool
 
+	// ContentETag derives ETags from the SHA-1 hash of the response body
+	// instead of generating random ones. Unchanged content thus keeps its
+	// ETag across cache clears and restarts, and a request with a matching
+	// If-None-Match gets a 304 even when the response was not in the cache.
+	ContentETag bool
+
+	// LastModified sends the time at which a response was cached
+	// (Item.CreatedAt) as the Last-Modified header and honors
+	// If-Modified-Since, sending 304s for unmodified cached responses. When
+	// ETag is enabled, If-None-Match takes precedence over If-Modified-Since.
+	LastModified bool
+
 	// By default, handler response bodies are cached and served. If this is
 	// enabled, only ETags are cached and for response bodies, the original
 	// handler is invoked.
@@ -65,10 +289,369 @@ type Options struct {
 	// Logger is the optional logger to which errors will be written.
 	Logger *log.Logger
 
-	// Cache based on uri+querystring.
+	// Cache based on uri+querystring. The key is the full URI with the
+	// scheme and the host, or if any of the query options below or
+	// NormalizePath is set, the host and the path with the canonical query
+	// string.
 	IncludeQueryString bool
 
+	// QueryArgsTransformerHook takes the parsed query string args when
+	// IncludeQueryString is enabled and performs transformations on them
+	// before the cache key is computed. Eg: sort the args, remove keys etc.
+	QueryArgsTransformerHook func(*fasthttp.Args)
+
+	// QueryValueCanonicalizers are functions by query param names that
+	// canonicalize the param's values before the cache key is computed when
+	// IncludeQueryString is enabled. This prevents set-like params where
+	// ?ids=1,2,3 and ?ids=3,2,1 are equivalent from exploding the key space.
+	// Eg: map[string]func(string) string{"ids": fastcache.CanonicalCSV}.
+	// They are applied before QueryArgsTransformerHook.
+	QueryValueCanonicalizers map[string]func(string) string
+
+	// DuplicateParams is the treatment of repeated query params in cache
+	// keys when IncludeQueryString is enabled. Default is
+	// DuplicateParamsKeepAll. It's applied before QueryValueCanonicalizers.
+	DuplicateParams DuplicateParams
+
+	// NormalizeQuery normalizes query strings before cache keys are
+	// computed when IncludeQueryString is enabled. Param names are lowercased
+	// and empty params are dropped before DuplicateParams is applied, and
+	// params are sorted before QueryArgsTransformerHook.
+	NormalizeQuery QueryNormalization
+
+	// IncludeQueryParams, if set, is the list of the only query params that
+	// are part of the cache key when IncludeQueryString is enabled. The rest
+	// are ignored. ExcludeQueryParams is the list of query params that are
+	// ignored (eg: utm_source, _). With either, the params are sorted by
+	// name. They're applied before QueryArgsTransformerHook, which remains
+	// available for advanced transformations.
+	IncludeQueryParams []string
+	ExcludeQueryParams []string
+
+	// MaxQueryStringLength, if set, bypasses the cache for requests whose
+	// query string is longer than the given number of bytes when
+	// IncludeQueryString is enabled. This prevents unbounded creation of unique
+	// cache keys with arbitrarily long query strings.
+	MaxQueryStringLength int
+
+	// KeyHasher hashes cache keys. Default is MD5Hasher. FNVHasher and
+	// XXHasher are cheaper as keys don't need cryptographic hashes. Changing
+	// it changes all the keys, which is like purging the cache.
+	KeyHasher KeyHasher
+
+	// RawKeys, if enabled, caches responses under their literal path (and
+	// query string with IncludeQueryString) instead of their hash, so that
+	// the keys are readable in the store (eg: with HGETALL in redis-cli).
+	// Keys longer than MaxRawKeyLength and keys with IncludeHeaders,
+	// IncludeCookies and request bodies are still hashed.
+	RawKeys bool
+
+	// MaxRawKeyLength is the length beyond which keys are hashed with
+	// RawKeys. Default is 256.
+	MaxRawKeyLength int
+
+	// KeyGenerator, if set, replaces the built-in cache key logic (the hash
+	// of the path and IncludeQueryString, IncludeHeaders, IncludeCookies, the
+	// request body of CacheMethods requests and their transformations). It is
+	// invoked with the request and returns its key within the group, for
+	// instance, one built from path params, a header and the normalized
+	// path. It's invoked more than once per request and has to be
+	// deterministic. An empty key bypasses the cache.
+	KeyGenerator func(r *fastglue.Request) string
+
+	// GroupHook, if set, derives the group of a request, for instance, from
+	// path params (eg: orders:{account_id} with GroupFromParams()), so that
+	// groups can be invalidated per account instead of across all of them.
+	// The static group is used if it returns an empty group. With
+	// ClearGroup(), the derived group is cleared along with the given groups.
+	GroupHook func(r *fastglue.Request) string
+
+	// CacheMethods is the list of HTTP methods besides GET and HEAD whose
+	// requests are cached (eg: "POST" for GraphQL or search endpoints). The
+	// method and the hash of the request body are part of the cache keys of
+	// such requests, so they never collide with those of GET requests for
+	// the same URI. HEAD requests share the keys of GET requests unless
+	// IncludeMethod is set. Requests with other methods bypass the cache.
+	CacheMethods []string
+
+	// IncludeMethod keys HEAD requests apart from GET requests for the same
+	// URI, for routes whose HEAD handlers respond differently. HEAD requests
+	// are then cached under their own keys instead of being served from the
+	// cache of GET requests. The keys of GET requests don't change.
+	IncludeMethod bool
+
+	// MaxBodyBytes is the maximum size of the request bodies of CacheMethods
+	// requests that are hashed into cache keys. Requests with larger bodies
+	// bypass the cache. Default is 64 KB.
+	MaxBodyBytes int
+
+	// Pagination, if set, validates the If-Match header of requests for the
+	// pages of paginated listings against the ETag of the cached first page,
+	// failing requests with 412 if the listing has changed. See
+	// PaginationOptions.
+	Pagination *PaginationOptions
+
+	// MaxHeaderBytes, if set, bypasses the cache for responses whose
+	// cacheable headers (the ones that are replayed on hits) are larger than
+	// the given number of bytes in total.
+	MaxHeaderBytes int
+
+	// IncludeHeaders is the list of request headers (eg: X-Tenant-ID, Accept)
+	// whose values are included in the cache key in addition to the URI.
+	IncludeHeaders []string
+
+	// IncludeCookies is the list of request cookies (eg: an experiment
+	// cookie) whose values are included in the cache key.
+	IncludeCookies []string
+
+	// NormalizePath normalizes request paths before cache keys are computed
+	// so that, for instance, /orders/ and /orders share a cached response.
+	NormalizePath PathNormalization
+
+	// CookiesTransformerHook takes the name->value args of IncludeCookies
+	// and performs transformations on them before the cache key is computed.
+	// Eg: bucket values, remove cookies etc.
+	CookiesTransformerHook func(*fasthttp.Args)
+
 	Compression CompressionsOptions
+
+	// CacheRedirects enables caching of 301, 302, 307 and 308 responses
+	// along with their Location header. Cached redirects are replayed
+	// without invoking the handler.
+	CacheRedirects bool
+
+	// CacheableStatuses are the status codes of responses, in addition
+	// to 200, that are cached and replayed with their original status code,
+	// for instance, []int{404, 410}. Redirects listed here are only cached
+	// if they have a Location header.
+	CacheableStatuses []int
+
+	// NegativeTTL, if set, enables caching of "negative" responses, that is,
+	// 404, 410 and 5xx responses, with this TTL instead of TTL. This shields
+	// the handler from clients polling for resources that don't exist. It
+	// also applies to the 4xx and 5xx statuses in CacheableStatuses.
+	NegativeTTL time.Duration
+
+	// TTLFromCacheControl, if enabled, uses the s-maxage or the max-age
+	// directive (in that order) in the handler's Cache-Control response
+	// header, if there's one, as the TTL of the cached response instead of
+	// TTL and NegativeTTL. This lets individual handlers control their own
+	// cache lifetimes. Responses with a zero max-age are not cached.
+	TTLFromCacheControl bool
+
+	// AdaptiveTTL scales TTLs by the latency of the handler on misses,
+	// optimising the cache toward the entries that are expensive to
+	// regenerate. The X-Fastcache-TTL header isn't scaled.
+	AdaptiveTTL AdaptiveTTLOptions
+
+	// MinHandlerLatency, if set, only caches responses that the handler took
+	// at least this long to generate, so that the store isn't filled with
+	// the responses of cheap handlers. This also applies to background
+	// refreshes (StaleWhileRevalidate etc.).
+	MinHandlerLatency time.Duration
+
+	// SlidingTTL, if enabled, extends the TTL of a cached response by its
+	// TTL every time it's served so that hot responses stay cached while
+	// cold ones expire. The store has to implement Toucher. In the Redis
+	// stores, the TTL of the whole group is extended.
+	SlidingTTL bool
+
+	// StaleWhileRevalidate, if set, retains cached responses in the store for
+	// this long past their TTL. Such stale responses are served immediately
+	// while the handler is invoked in the background to refresh them,
+	// eliminating latency spikes at expiry. Handlers are invoked in the
+	// background with a copy of the request and must not depend on the
+	// original connection.
+	StaleWhileRevalidate time.Duration
+
+	// Grace, if set, retains cached responses in the store for this long
+	// past their TTL (and StaleWhileRevalidate). Like stale-while-revalidate,
+	// responses in their grace window are served while they're refreshed in
+	// the background, but grace serves are capped with GraceLimit, and are
+	// counted in reports (StartReporter()) and with Hooks.OnGrace.
+	Grace time.Duration
+
+	// GraceLimit is the maximum number of times (per process) a response is
+	// served in its grace window, after which requests for it wait for the
+	// handler. 0 is unlimited. The counts are kept in memory until the
+	// response's grace window ends.
+	GraceLimit int
+
+	// RefreshAhead, if set, is the fraction (eg: 0.1 for the last 10%) of
+	// the TTL of a cached response within which a hit invokes the handler in
+	// the background to refresh it, so that popular responses never expire
+	// for clients. The remaining TTL is read on every hit from stores that
+	// implement TTLGetter and is otherwise derived from the response's age.
+	RefreshAhead float64
+
+	// Coalesce, if enabled, coalesces concurrent requests for a URI that
+	// miss the cache so that only one of them executes the handler and the
+	// others are served its response, preventing stampedes on the handler.
+	// Cookies set by the handler aren't shared.
+	Coalesce bool
+
+	// EmitCacheControl, if enabled, sets `Cache-Control: public,
+	// max-age=<remaining TTL>` and Expires on cached and fresh responses that
+	// don't have a Cache-Control header already so that downstream CDNs and
+	// browsers can cache them too. The remaining TTL is fetched from stores
+	// that implement TTLGetter and is otherwise derived from the response's
+	// age. As the responses are marked public, this should only be enabled
+	// for responses that are not specific to a user.
+	EmitCacheControl bool
+
+	// RewriteMaxAge, if enabled, sets the max-age directive of the
+	// Cache-Control header of cached responses served from the cache to
+	// their remaining TTL, so that browser caches expire along with the
+	// cache. Responses without a Cache-Control header get `Cache-Control:
+	// private, max-age=<remaining TTL>`. The remaining TTL is derived like
+	// for EmitCacheControl.
+	RewriteMaxAge bool
+
+	// Ranges enables serving single byte range requests (Range: bytes=0-99)
+	// for cached, uncompressed 200 responses with 206 responses. Stores that
+	// implement RangeGetter serve the ranges without loading whole blobs.
+	// Multipart ranges are served with the whole response.
+	Ranges bool
+
+	// CacheStatusHeader, if enabled, sets the `X-Cache: HIT` header on
+	// responses served from the cache and `X-Cache: MISS` on responses from
+	// the handler that were cacheable. This is meant for debugging caching.
+	CacheStatusHeader bool
+
+	// CacheHitsHeader, if enabled along with CacheStatusHeader, sets the
+	// `X-Cache-Hits` header with the number of times a cached response has
+	// been served. The store has to implement HitCounter.
+	CacheHitsHeader bool
+
+	// DebugSecret, if set, enables the `X-Cache-Key: namespace/group/uri`
+	// response header with the cache key computed for requests that have the
+	// `X-Cache-Debug: <DebugSecret>` header. This is meant for diagnosing
+	// requests that don't hit the cache.
+	DebugSecret string
+
+	// Clock is the source of time for all time computations such as an
+	// Item's CreatedAt. Default is SystemClock.
+	Clock Clock
+
+	// Preflight, if set, answers OPTIONS (CORS preflight) requests to routes
+	// wrapped with Cached() from the given static policy without invoking
+	// the handler. The route has to be registered for OPTIONS with the
+	// router for this to take effect.
+	Preflight *PreflightOptions
+
+	// RevalidateAfter, if set, revalidates cached responses that are older
+	// than the given duration with the handler instead of serving them
+	// as-is. This is meant for proxy-style handlers that talk to an upstream
+	// with validators. The ETag and Last-Modified set by the handler are
+	// recorded when a response is cached and are sent to the handler as
+	// If-None-Match and If-Modified-Since on revalidation. If the handler
+	// responds with a 304, the cached response is refreshed and served
+	// without re-downloading the payload. Otherwise, the new response is
+	// cached. TTL should be longer than RevalidateAfter.
+	RevalidateAfter time.Duration
+
+	// Hooks are optional callbacks invoked on cache events.
+	Hooks Hooks
+
+	// StalenessField, if set, injects the cache metadata of cached JSON
+	// responses into a top-level field of that name in the response object
+	// when they are served from the cache, for instance,
+	// "_cache": {"cached_at": "2006-01-02T15:04:05Z", "age": 30} where age
+	// is in seconds. This lets clients display "data as of" without reading
+	// extra headers. Responses that are not JSON objects are served as-is.
+	StalenessField string
+
+	// CacheBodyIf, if set, is invoked with the content type and the body of
+	// cacheable responses and the response is cached only if it returns
+	// true. For instance, EnvelopeSuccess excludes fastglue error envelopes
+	// that are sent with a 200 status and NotEmptyJSON excludes empty JSON
+	// arrays and objects. Predicates can be combined with AllBodyIf(). The
+	// body should not be retained beyond the call.
+	CacheBodyIf func(contentType string, body []byte) bool
+
+	// ShouldCache, if set, is invoked with the request after the handler
+	// has run and the response is cached only if it returns true, for
+	// instance, to skip caching based on response headers, the body, or the
+	// user's role. It's evaluated after the built-in checks (status,
+	// no-store and CacheBodyIf).
+	ShouldCache func(r *fastglue.Request) bool
+
+	// RespectNoCache, if enabled, lets clients force a fresh response with
+	// the `Cache-Control: no-cache` (or `Pragma: no-cache`) request header.
+	// The cached response is skipped, the handler is invoked and its response
+	// is cached, refreshing the cache.
+	RespectNoCache bool
+
+	// ForceRefreshHeader, if set, is a request header (eg: X-Cache-Refresh)
+	// with which requests force a fresh response like RespectNoCache, for
+	// instance, for support teams to refresh a single stale response
+	// without clearing its group. If ForceRefreshSecret is set, the header's
+	// value has to match it.
+	ForceRefreshHeader string
+	ForceRefreshSecret string
+
+	// RecoverPanics, if enabled, recovers from panics in the handler and
+	// responds with a 500 instead of re-panicking to the server framework.
+	// Either way, the partially written response is never cached and
+	// Hooks.OnPanic is invoked. Panics in background refreshes
+	// (StaleWhileRevalidate etc.) are always recovered and logged.
+	RecoverPanics bool
+
+	// compiled is the precomputed config of a wrapped middleware.
+	compiled *compiled
+}
+
+// Hooks are optional callbacks that are invoked by the middleware on cache
+// events, for instance, to record metrics.
+type Hooks struct {
+	// OnBypass is invoked when a request skips the cache altogether. reason
+	// is one of the Bypass* values.
+	OnBypass func(r *fastglue.Request, reason string)
+
+	// OnGrace is invoked when a response is served in its grace window
+	// (Options.Grace).
+	OnGrace func(r *fastglue.Request, namespace, group string)
+
+	// OnPanic is invoked with the recovered value when the handler panics.
+	OnPanic func(r *fastglue.Request, namespace, group string, p interface{})
+
+	// OnHit is invoked when a response is served from the cache, including
+	// 304 responses. uri is the cache key of the response.
+	OnHit func(r *fastglue.Request, namespace, group, uri string)
+
+	// OnMiss is invoked after the handler has served a request that wasn't
+	// in the cache, with the time the handler took, whether or not its
+	// response is cached.
+	OnMiss func(r *fastglue.Request, namespace, group string, latency time.Duration)
+
+	// OnStore is invoked when a response has been written to the store
+	// under uri with the TTL ttl.
+	OnStore func(r *fastglue.Request, namespace, group, uri string, ttl time.Duration)
+
+	// OnError is invoked with errors that prevent responses from being
+	// cached, that is, errors in writing to the store and responses whose
+	// body doesn't match their Content-Length (ErrContentLength). The
+	// request is served regardless. Stores report misses as read errors, so
+	// those aren't passed.
+	OnError func(r *fastglue.Request, namespace, group string, err error)
+}
+
+// PreflightOptions is the static CORS policy used to answer OPTIONS
+// preflight requests.
+type PreflightOptions struct {
+	// AllowOrigin is sent as Access-Control-Allow-Origin. If it is empty,
+	// the request's Origin header is echoed back.
+	AllowOrigin string
+
+	// AllowMethods is sent as Access-Control-Allow-Methods. Default is "GET, HEAD, OPTIONS".
+	AllowMethods string
+
+	// AllowHeaders is sent as Access-Control-Allow-Headers, if set.
+	AllowHeaders string
+
+	// MaxAge is sent as Access-Control-Max-Age, if set, so that clients
+	// can cache the preflight response.
+	MaxAge time.Duration
 }
 
 // Item represents the cache entry for a single endpoint with the actual cache
@@ -77,11 +660,129 @@ type Item struct {
 	ContentType string
 	Compression string
 	ETag        string
+
+	// StatusCode is the HTTP status code of the cached response. 0 is
+	// treated as 200.
+	StatusCode int
+
+	// Location is the Location header of cached redirect responses.
+	Location string
+
+	// CreatedAt is the time at which the item was cached as per Options.Clock.
+	CreatedAt time.Time
+
+	// Vary is the normalized list of request headers (from the Vary header)
+	// the response varies by. Responses with Vary are cached per variant
+	// and an Item with Vary and no ContentType marks the URI as varying.
+	Vary string
+
+	// Headers are the response headers (other than the ones managed by
+	// fastcache such as Content-Type and ETag) that are replayed on hits,
+	// for instance, Content-Disposition or CORS headers. Set-Cookie is
+	// never cached.
+	Headers map[string][]string
+
+	// CacheControl and Expires are the Cache-Control and Expires headers
+	// set by the handler. They are replayed on hits so that the caching
+	// behaviour of clients and CDNs downstream is retained.
+	CacheControl string
+	Expires      string
+
+	// UpstreamETag and UpstreamLastModified are the ETag and Last-Modified
+	// headers set by the handler, for instance, from an upstream that the
+	// handler proxies. They are recorded if Options.RevalidateAfter is set.
+	UpstreamETag         string
+	UpstreamLastModified string
+
+	// Hits is the number of times the Item has been served from the cache.
+	// It is maintained by stores that implement HitCounter and is reset when
+	// the Item is written.
+	Hits int64
+
+	// Cost is the time the handler took to generate the response, that is,
+	// the cost of regenerating the Item if it's evicted. Stores that evict
+	// items (such as in-memory stores) can weigh it along with the size of
+	// the Item so that expensive items aren't evicted for cheap ones, like
+	// the goredis store with LRUCostWeight. The redigo store doesn't persist
+	// it.
+	Cost time.Duration
+
+	// StaleAt is the time after which the Item is stale. It is set if
+	// Options.StaleWhileRevalidate or Options.Grace is set, in which case the
+	// Item is retained in the store past it, and by DelGroup() with
+	// SetDelGroupGrace().
+	StaleAt time.Time
+
+	// CompressionReason records why the blob was or wasn't compressed
+	// (one of the CompressionReason* values). It is meant for debugging
+	// and can be looked up with FastCache.Inspect().
+	CompressionReason string
+
 	// If the Blob is used beyond the scope of the request, it should be copied.
 	// Such as when the cache is written asynchronously.
 	Blob []byte
 }
 
+// stale checks if the Item is stale at the given time, that is, past its
+// TTL (Options.StaleWhileRevalidate, Options.Grace) or marked stale by
+// DelGroup() (SetDelGroupGrace()).
+func (it Item) stale(now time.Time) bool {
+	return !it.StaleAt.IsZero() && !now.Before(it.StaleAt)
+}
+
+// MetaGetter is an optional interface that a Store can implement to fetch an
+// Item's metadata (everything but the Blob) and its Blob separately. When a
+// Store implements it, Cached() only fetches the blob when it's actually
+// needed, that is, not for 304 responses or in NoBlob mode.
+type MetaGetter interface {
+	GetMeta(namespace, group, uri string) (Item, error)
+	GetBlob(namespace, group, uri string) ([]byte, error)
+}
+
+// BlobHasher is an optional interface that a Store can implement to compute
+// the hex encoded SHA1 hash of a cached (and possibly compressed) Blob on the
+// store's side, so that validators for large items can be produced without
+// fetching the Blob.
+type BlobHasher interface {
+	HashBlob(namespace, group, uri string) (string, error)
+}
+
+// TTLGetter is an optional interface that a Store can implement to return
+// the remaining TTL of a cached URI. A zero TTL is returned for items without
+// a TTL, and ErrNotCached is returned for URIs that aren't in the cache.
+type TTLGetter interface {
+	TTL(namespace, group, uri string) (time.Duration, error)
+}
+
+// HitCounter is an optional interface that a Store can implement to count
+// the number of times a cached URI is served. IncrHits increments the count
+// and returns the new count.
+type HitCounter interface {
+	IncrHits(namespace, group, uri string) (int64, error)
+}
+
+// Toucher is an optional interface that a Store can implement to extend the
+// TTL of a cached URI, for Options.SlidingTTL.
+type Toucher interface {
+	Touch(namespace, group, uri string, ttl time.Duration) error
+}
+
+// Clock is a source of time. It can be swapped out in Options to control
+// time deterministically in tests or to correct for clock skew.
+type Clock interface {
+	Now() time.Time
+}
+
+// systemClock is a Clock that returns the system time.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// SystemClock is the default Clock that returns time.Now().
+var SystemClock Clock = systemClock{}
+
 // Store represents a backend data store where bytes are cached. Individual
 // keys are namespaced under
 type Store interface {
@@ -91,19 +792,129 @@ type Store interface {
 	DelGroup(namespace string, group ...string) error
 }
 
-const compGzip = "gzip"
+// MultiGetter is an optional interface that a Store can implement to fetch
+// multiple URIs under a namespace->group in a single round trip. Items that
+// are not found in the store are returned as empty Items, in the same order
+// as uris.
+type MultiGetter interface {
+	GetMulti(namespace, group string, uris ...string) ([]Item, error)
+}
+
+// NamespacePurger is an optional interface that a Store can implement to
+// invalidate everything cached under a namespace in one go, for instance,
+// when a user logs out everywhere.
+type NamespacePurger interface {
+	PurgeNamespace(namespace string) error
+}
+
+// GroupStaler is an optional interface that a Store can implement to mark
+// all the items in groups stale instead of deleting them, for
+// SetDelGroupGrace(). Stale items are expired within ttl unless they're
+// written to again. Groups can be glob patterns like in DelGroup().
+type GroupStaler interface {
+	StaleGroup(namespace string, ttl time.Duration, group ...string) error
+}
+
+const (
+	compGzip = "gzip"
+	compZstd = "zstd"
+
+	headerXCache      = "X-Cache"
+	headerXCacheHits  = "X-Cache-Hits"
+	headerXCacheKey   = "X-Cache-Key"
+	headerXCacheDebug = "X-Cache-Debug"
+
+	// headerTTL is the response header with which handlers can override
+	// the TTL of a response.
+	headerTTL = "X-Fastcache-TTL"
+
+	// sep separates the parts of internal keys.
+	sep = "\x00"
+)
+
+// UserValues with which handlers can direct the caching of their own
+// responses with RequestCtx.SetUserValue().
+const (
+	// UserValueTTL (time.Duration) overrides the TTL of the response like
+	// the X-Fastcache-TTL header. 0 doesn't cache the response.
+	UserValueTTL = "fastcache_ttl"
+
+	// UserValueSkip (bool) skips caching the response when true.
+	UserValueSkip = "fastcache_skip"
+)
+
+// Reasons for compressing or not compressing an Item recorded in
+// Item.CompressionReason.
+const (
+	CompressionReasonCompressed     = "compressed"
+	CompressionReasonDisabled       = "disabled"
+	CompressionReasonBelowMinLength = "below_min_length"
+	CompressionReasonError          = "error"
+	CompressionReasonLowRatio       = "low_ratio"
+)
+
+// Reasons for bypassing the cache passed to Hooks.OnBypass.
+const (
+	// BypassUpgrade is for connection upgrade (eg: WebSocket) requests.
+	BypassUpgrade = "upgrade"
 
-var cacheNoStore = []byte("no-store")
+	// BypassStream is for server-sent event requests and streamed responses.
+	BypassStream = "stream"
+
+	// BypassQueryLength is for query strings longer than MaxQueryStringLength.
+	BypassQueryLength = "query_length"
+
+	// BypassMethod is for requests with methods other than GET, HEAD and
+	// CacheMethods.
+	BypassMethod = "method"
+
+	// BypassBodySize is for requests with bodies larger than MaxBodyBytes.
+	BypassBodySize = "body_size"
+
+	// BypassKey is for requests for which KeyGenerator returns an empty key.
+	BypassKey = "key"
+
+	// BypassHeaderSize is for responses with headers larger than
+	// MaxHeaderBytes.
+	BypassHeaderSize = "header_size"
+)
+
+// ErrNotSupported is returned when an operation requires an optional
+// interface that the Store doesn't implement.
+var ErrNotSupported = errors.New("fastcache: operation not supported by the store")
+
+// ErrNotCached is returned by TTLGetter.TTL() for URIs that aren't in the
+// cache.
+var ErrNotCached = errors.New("fastcache: URI not in the cache")
+
+// ErrContentLength is passed to Hooks.OnError for responses that aren't
+// cached because their body doesn't match their Content-Length header, for
+// instance, truncated bodies of aborted upstream connections.
+var ErrContentLength = errors.New("fastcache: response body doesn't match its Content-Length")
+
+// ErrStreamingRoute is returned by CachedPath() when the route is marked as
+// streaming with MarkStreaming().
+var ErrStreamingRoute = errors.New("fastcache: streaming routes cannot be cached")
 
 // New creates and returns a new FastCache instance.
-func New(s Store) *FastCache {
-	return &FastCache{
+//
+// defaults, if given, are the default Options of the routes wrapped with nil
+// Options or with Options returned by Override(). Only the first one is used.
+func New(s Store, defaults ...*Options) *FastCache {
+	f := &FastCache{
 		s: s,
 	}
+	if len(defaults) > 0 && defaults[0] != nil {
+		d := *defaults[0]
+		f.defaults = &d
+	}
+	return f
 }
 
 // Cached middleware "dumb" caches 200 HTTP responses as bytes with an optional TTL.
-// This is used to wrap GET calls that need response cache.
+// This is used to wrap GET calls that need response cache. HEAD handlers can
+// be wrapped with the same group to serve the headers of the GET responses
+// cached for the URIs. Responses to HEAD requests themselves aren't cached.
 //
 // In addition to retrieving / caching HTTP responses, it also accepts
 // ETags from clients and sends a 304 response with no actual body
@@ -113,66 +924,206 @@ func New(s Store) *FastCache {
 // requests for orders can have the group "orders" so that they can be cleared
 // in one shot when something changes using the Del*() methods or Clear*() middleware.
 func (f *FastCache) Cached(h fastglue.FastRequestHandler, o *Options, group string) fastglue.FastRequestHandler {
-	if o.Logger == nil {
-		o.Logger = log.New(io.Discard, "", 0)
-	}
+	o = f.options(o).compile()
 
 	return func(r *fastglue.Request) error {
-		namespace, _ := r.RequestCtx.UserValue(o.NamespaceKey).(string)
-		if namespace == "" {
-			o.Logger.Printf("no namespace found in UserValue() for key '%s'", o.NamespaceKey)
+		// The TTL override is internal and never sent to the client, whether
+		// or not the response is cached.
+		defer r.RequestCtx.Response.Header.Del(headerTTL)
+
+		// Answer CORS preflights from the static policy.
+		if o.Preflight != nil && r.RequestCtx.IsOptions() {
+			writePreflight(r, o.Preflight)
+			return nil
+		}
+
+		namespace, err := o.namespace(r)
+		if err != nil {
+			o.Logger.Printf("%v", err)
+			return h(r)
+		}
+		group := o.group(r, group)
+
+		// Bypass the cache for WebSocket upgrades and server-sent events
+		// which can't be cached.
+		if reason := streamingRequest(r); reason != "" {
+			o.bypass(r, reason)
+			return h(r)
+		}
+
+		// Only GET and HEAD requests and those with CacheMethods are cached.
+		if !r.RequestCtx.IsGet() && !r.RequestCtx.IsHead() {
+			if !o.cacheableMethod(r.RequestCtx.Method()) {
+				o.bypass(r, BypassMethod)
+				return h(r)
+			}
+			if len(r.RequestCtx.PostBody()) > o.MaxBodyBytes {
+				o.bypass(r, BypassBodySize)
+				return h(r)
+			}
+		}
+
+		// Bypass the cache for overly long query strings.
+		if o.IncludeQueryString && o.MaxQueryStringLength > 0 && len(r.RequestCtx.URI().QueryString()) > o.MaxQueryStringLength {
+			o.bypass(r, BypassQueryLength)
+			return h(r)
+		}
+
+		// Reject repeated query params if they're disallowed.
+		if o.IncludeQueryString && o.DuplicateParams == DuplicateParamsError && hasDuplicateParams(r.RequestCtx.URI().QueryString()) {
+			r.RequestCtx.Error("duplicate query params", fasthttp.StatusBadRequest)
+			return nil
+		}
+
+		// Fail fast if the snapshot of a paginated listing has changed.
+		if o.Pagination != nil && !f.validSnapshot(r, namespace, group, o) {
+			r.RequestCtx.SetStatusCode(fasthttp.StatusPreconditionFailed)
+			return nil
+		}
+
+		uri := cacheURI(r, o)
+		if uri == "" {
+			o.bypass(r, BypassKey)
 			return h(r)
 		}
 
-		if o.Compression.Enabled && o.Compression.MinLength < 1 {
-			o.Compression.MinLength = 500
+		// Expose the final key (of the variant, if any) for debugging.
+		if o.DebugSecret != "" && validDebugSecret(r.RequestCtx.Request.Header.Peek(headerXCacheDebug), o.DebugSecret) {
+			defer func() {
+				r.RequestCtx.Response.Header.Set(headerXCacheKey, namespace+"/"+group+"/"+uri)
+			}()
 		}
 
-		var hash [16]byte
-		// If IncludeQueryString option is set then cache based on uri + md5(query_string)
-		if o.IncludeQueryString {
-			hash = md5.Sum(r.RequestCtx.URI().FullURI())
+		// Fetch etag + cached bytes from the store. If the store supports it,
+		// only the metadata is fetched here and the blob is fetched later,
+		// only if it's needed.
+		var (
+			mg, lazy = f.s.(MetaGetter)
+			blob     Item
+		)
+		if lazy {
+			blob, err = f.getMeta(mg, namespace, group, uri)
 		} else {
-			hash = md5.Sum(r.RequestCtx.URI().Path())
+			blob, err = f.get(namespace, group, uri)
 		}
-		uri := hex.EncodeToString(hash[:])
 
-		// Fetch etag + cached bytes from the store.
-		blob, err := f.s.Get(namespace, group, uri)
+		// The response varies by request headers. Fetch the request's variant.
+		var marker Item
+		if err == nil && isVaryMarker(blob) {
+			marker = blob
+			uri = variantURI(r, uri, marker, o)
+			if lazy {
+				blob, err = f.getMeta(mg, namespace, group, uri)
+			} else {
+				blob, err = f.get(namespace, group, uri)
+			}
+		}
 		if err != nil {
 			o.Logger.Printf("error reading cache: %v", err)
 		}
 
+		// The client wants a fresh response. Treat it as a miss.
+		if (o.RespectNoCache && requestNoCache(r)) || o.forceRefresh(r) {
+			blob = Item{}
+		}
+
+		// Serve stale responses while they're refreshed in the background.
+		// Stale responses outside the windows (eg: of groups marked stale by
+		// DelGroup()) are misses. While load is shed, stale responses are
+		// served as they are and nothing is refreshed.
+		shed := f.Shedding()
+		if err == nil && !blob.StaleAt.IsZero() && !o.Clock.Now().Before(blob.StaleAt) {
+			// The grace window follows the stale-while-revalidate window.
+			switch {
+			case shed:
+				// Serve the last stale response.
+			case o.Clock.Now().Before(blob.StaleAt.Add(o.StaleWhileRevalidate)):
+				f.refresh(r, h, namespace, group, uri, marker, o)
+			case o.Grace > 0 && f.grace(r, namespace, group, uri, blob, o):
+				f.refresh(r, h, namespace, group, uri, marker, o)
+			default:
+				blob = Item{}
+			}
+		} else if err == nil && !shed && o.RefreshAhead > 0 && !blob.CreatedAt.IsZero() && f.expiring(namespace, group, uri, blob, o) {
+			// Refresh responses that are about to expire in the background.
+			f.refresh(r, h, namespace, group, uri, marker, o)
+		}
+
 		// If ETag matching is enabled, attempt to match the header etag
 		// with the stored one (if there's any).
-		if o.ETag {
-			var (
-				match = string(r.RequestCtx.Request.Header.Peek("If-None-Match"))
-			)
-			if len(match) > 4 && len(blob.ETag) > 0 && strings.Contains(match, blob.ETag) {
-				r.RequestCtx.SetStatusCode(fasthttp.StatusNotModified)
-				return nil
+		if o.ETag && matchETag(r.RequestCtx.Request.Header.Peek("If-None-Match"), blob.ETag) {
+			f.writeHitHeaders(r, namespace, group, uri, blob, o)
+			r.RequestCtx.SetStatusCode(fasthttp.StatusNotModified)
+			return nil
+		}
+
+		// Time based validation for clients that don't use ETags.
+		if o.LastModified && !blob.CreatedAt.IsZero() && notModifiedSince(r, blob.CreatedAt, o) {
+			f.writeHitHeaders(r, namespace, group, uri, blob, o)
+			r.RequestCtx.Response.Header.SetLastModified(blob.CreatedAt)
+			r.RequestCtx.SetStatusCode(fasthttp.StatusNotModified)
+			return nil
+		}
+
+		// Serve byte ranges of cached responses, without fetching whole blobs
+		// from stores that implement RangeGetter.
+		if o.Ranges && err == nil && f.serveRange(r, namespace, group, uri, blob, lazy, o) {
+			return nil
+		}
+
+		// Lazily fetch the blob if there's a cached item.
+		if lazy && !o.NoBlob && err == nil && blob.ContentType != "" {
+			if blob.Blob, err = f.getBlob(mg, namespace, group, uri); err != nil {
+				o.Logger.Printf("error reading cache blob: %v", err)
 			}
 		}
 
-		// There's cache. Write it and end the request.
-		if len(blob.Blob) > 0 {
-			if o.ETag {
-				r.RequestCtx.Response.Header.Add("ETag", `"`+string(blob.ETag)+`"`)
+		// Revalidate stale cached responses by delegating to the handler
+		// (upstream) with the upstream's validators.
+		if !shed && len(blob.Blob) > 0 && o.RevalidateAfter > 0 && o.Clock.Now().Sub(blob.CreatedAt) >= o.RevalidateAfter &&
+			(blob.UpstreamETag != "" || blob.UpstreamLastModified != "") {
+			start := time.Now()
+			ok, err := f.revalidate(r, h, namespace, group, uri, &blob, o)
+			if err != nil {
+				o.Logger.Printf("error running middleware: %v", err)
+				return nil
+			}
+			if !ok {
+				// The handler sent a fresh response.
+				f.cacheResponse(r, namespace, group, marker, time.Since(start), o)
+				return nil
 			}
-			r.RequestCtx.SetStatusCode(fasthttp.StatusOK)
-			r.RequestCtx.SetContentType(blob.ContentType)
+		}
 
-			out := blob.Blob
+		// There's cache. Write it and end the request. Cached non-200
+		// responses are replayed without a blob only if they're bodiless,
+		// which can't be told in NoBlob mode, except for redirects.
+		if len(blob.Blob) > 0 || (blob.StatusCode != fasthttp.StatusOK && (!o.NoBlob || isRedirect(blob.StatusCode)) &&
+			o.cacheableStatus(blob.StatusCode, blob.Location)) {
+			f.writeHeaders(r, namespace, group, uri, blob, o)
+
+			var (
+				out    = blob.Blob
+				inject = o.StalenessField != "" && !blob.CreatedAt.IsZero() && isJSON(blob.ContentType)
+			)
 
 			// Compression is enabled.
-			if o.Compression.Enabled && blob.Compression == compGzip {
-				// Header is requesting for gzipped content.
-				if o.Compression.RespectHeaders && r.RequestCtx.Request.Header.HasAcceptEncoding(compGzip) {
-					r.RequestCtx.Request.Header.Set("Content-Encoding", compGzip)
+			if o.Compression.Enabled && blob.Compression != "" {
+				var (
+					ae      = r.RequestCtx.Request.Header.Peek("Accept-Encoding")
+					respect = !inject && o.Compression.RespectHeaders
+				)
+
+				// Header is requesting for content in the blob's encoding. The
+				// body can't be served compressed if it has to be rewritten.
+				if respect && acceptsEncoding(ae, blob.Compression) {
+					r.RequestCtx.Response.Header.Set("Content-Encoding", blob.Compression)
+				} else if respect && blob.Compression == compZstd && acceptsEncoding(ae, compGzip) {
+					streamZstdToGzip(r, out, o)
+					return nil
 				} else {
 					// Decompress the compressed blob and send uncompressed response.
-					b, err := decompressGzip(out)
+					b, err := decompress(blob.Compression, out)
 					if err != nil {
 						o.Logger.Printf("error decompressing blob: %v", err)
 					}
@@ -180,6 +1131,10 @@ func (f *FastCache) Cached(h fastglue.FastRequestHandler, o *Options, group stri
 				}
 			}
 
+			if inject {
+				out = injectStaleness(out, o.StalenessField, blob.CreatedAt, o.Clock.Now())
+			}
+
 			if _, err := r.RequestCtx.Write(out); err != nil {
 				o.Logger.Printf("error writing request: %v", err)
 			}
@@ -187,49 +1142,477 @@ func (f *FastCache) Cached(h fastglue.FastRequestHandler, o *Options, group stri
 			return nil
 		}
 
-		// Execute the actual handler.
-		if err := h(r); err != nil {
-			o.Logger.Printf("error running middleware: %v", err)
+		// Shield the origin from misses while load is shed.
+		if shed {
+			r.RequestCtx.Error(fasthttp.StatusMessage(fasthttp.StatusServiceUnavailable), fasthttp.StatusServiceUnavailable)
+			return nil
 		}
 
-		// Read the response body written by the handler and cache it.
-		if r.RequestCtx.Response.StatusCode() == 200 {
-			// If "no-store" is set in the cache control header, don't cache.
-			if !bytes.Contains(r.RequestCtx.Response.Header.Peek("Cache-Control"), cacheNoStore) {
-				if err := f.cache(r, namespace, group, o); err != nil {
-					o.Logger.Println(err.Error())
-				}
-			}
+		// Share the response of a concurrent request for the URI. Responses
+		// to HEAD requests have no body to share.
+		if o.Coalesce && !r.RequestCtx.IsHead() && f.coalesce(r, h, namespace, group, uri, marker, o) {
+			return nil
+		}
+
+		// Execute the actual handler. A response (such as a partially written
+		// envelope) is never cached if the handler returned an error.
+		start := time.Now()
+		if err := o.run(r, h, namespace, group, false); err != nil {
+			o.Logger.Printf("error running middleware: %v", err)
+			return nil
 		}
+
+		f.cacheResponse(r, namespace, group, marker, time.Since(start), o)
 		return nil
 	}
 }
 
-// ClearGroup middleware clears cache set by the Cached() middleware
-// for the all the specified groups.
-//
-// This should ideally wrap write handlers (POST / PUT / DELETE)
-// and the cache is cleared when the handler responds with a 200.
-func (f *FastCache) ClearGroup(h fastglue.FastRequestHandler, o *Options, groups ...string) fastglue.FastRequestHandler {
-	if o.Logger == nil {
-		o.Logger = log.New(ioutil.Discard, "", 0)
+// writeHeaders writes the status and the headers of a cached response.
+func (f *FastCache) writeHeaders(r *fastglue.Request, namespace, group, uri string, blob Item, o *Options) {
+	if o.ETag {
+		r.RequestCtx.Response.Header.Add("ETag", `"`+string(blob.ETag)+`"`)
 	}
-
-	return func(r *fastglue.Request) error {
-		namespace, _ := r.RequestCtx.UserValue(o.NamespaceKey).(string)
-		if namespace == "" {
-			o.Logger.Printf("no namespace found in UserValue() for key '%s'", o.NamespaceKey)
-			return h(r)
+	if o.LastModified && !blob.CreatedAt.IsZero() {
+		r.RequestCtx.Response.Header.SetLastModified(blob.CreatedAt)
+	}
+	if blob.Vary != "" {
+		r.RequestCtx.Response.Header.Set("Vary", blob.Vary)
+	}
+	f.writeHitHeaders(r, namespace, group, uri, blob, o)
+	for k, vals := range blob.Headers {
+		for _, v := range vals {
+			r.RequestCtx.Response.Header.Add(k, v)
 		}
+	}
+	if o.Ranges && o.rangeable(blob) {
+		r.RequestCtx.Response.Header.Set("Accept-Ranges", "bytes")
+	}
 
-		// Execute the actual handler.
-		if err := h(r); err != nil {
-			o.Logger.Printf("error running middleware: %v", err)
+	status := blob.StatusCode
+	if status == 0 {
+		status = fasthttp.StatusOK
+	}
+	r.RequestCtx.SetStatusCode(status)
+	r.RequestCtx.SetContentType(blob.ContentType)
+	if blob.Location != "" {
+		r.RequestCtx.Response.Header.Set("Location", blob.Location)
+	}
+}
+
+// writeHitHeaders writes the caching and the cache status headers of
+// a response served from the cache, including 304 responses.
+func (f *FastCache) writeHitHeaders(r *fastglue.Request, namespace, group, uri string, blob Item, o *Options) {
+	if o.SlidingTTL {
+		f.touch(namespace, group, uri, blob, o)
+	}
+	if rep := f.reports(); rep != nil {
+		rep.hit(group)
+	}
+	if o.Hooks.OnHit != nil {
+		o.Hooks.OnHit(r, namespace, group, uri)
+	}
+	if cdn := f.cdnOptions(); cdn != nil {
+		cdn.tag(r, namespace, group)
+	}
+
+	writeCacheHeaders(r, blob, o)
+	if o.EmitCacheControl || o.RewriteMaxAge {
+		ttl := f.remainingTTL(namespace, group, uri, blob, o)
+		if o.EmitCacheControl {
+			emitCacheControl(r, ttl, o)
+		}
+		if o.RewriteMaxAge {
+			if ttl < 0 {
+				ttl = 0
+			}
+			r.RequestCtx.Response.Header.Set("Cache-Control", withMaxAge(r.RequestCtx.Response.Header.Peek("Cache-Control"), int(ttl/time.Second)))
+		}
+	}
+
+	if !o.CacheStatusHeader {
+		return
+	}
+	r.RequestCtx.Response.Header.Set(headerXCache, "HIT")
+	if o.CacheHitsHeader && !f.ReadOnly() {
+		if hc, ok := f.s.(HitCounter); ok {
+			n, err := f.incrHits(hc, namespace, group, uri)
+			if err != nil {
+				o.Logger.Printf("error counting cache hits: %v", err)
+				return
+			}
+			r.RequestCtx.Response.Header.Set(headerXCacheHits, strconv.FormatInt(n, 10))
+		}
+	}
+}
+
+// touch extends the TTL of a cached response on stores that implement
+// Toucher.
+func (f *FastCache) touch(namespace, group, uri string, blob Item, o *Options) {
+	t, ok := f.s.(Toucher)
+	if !ok || f.ReadOnly() {
+		return
+	}
+
+	ttl, ok := o.ttl(blob.StatusCode, blob.CacheControl)
+	if !ok || ttl <= 0 {
+		return
+	}
+	if err := f.touchTTL(t, namespace, group, uri, o.storeTTL(ttl)); err != nil {
+		o.Logger.Printf("error extending cache TTL: %v", err)
+	}
+}
+
+// cacheResponse caches the response written by the handler if it's cacheable.
+// latency is the time the handler took to generate the response.
+func (f *FastCache) cacheResponse(r *fastglue.Request, namespace, group string, marker Item, latency time.Duration, o *Options) {
+	if rep := f.reports(); rep != nil {
+		rep.miss(group, latency)
+	}
+	if o.Hooks.OnMiss != nil {
+		o.Hooks.OnMiss(r, namespace, group, latency)
+	}
+
+	// Responses to HEAD requests have no body and aren't cached. HEAD
+	// requests are served from the cache of GET requests for the URI
+	// unless they have keys of their own.
+	if r.RequestCtx.IsHead() && !o.IncludeMethod {
+		return
+	}
+
+	// The response is cheap to regenerate.
+	if latency < o.MinHandlerLatency {
+		return
+	}
+
+	// Streamed responses can't be cached.
+	if r.RequestCtx.Response.IsBodyStream() || isEventStream(r.RequestCtx.Response.Header.ContentType()) {
+		o.bypass(r, BypassStream)
+		return
+	}
+
+	// Never persist truncated bodies.
+	if cl := r.RequestCtx.Response.Header.Peek("Content-Length"); len(cl) > 0 {
+		if n := len(r.RequestCtx.Response.Body()); r.RequestCtx.Response.Header.ContentLength() != n {
+			err := fmt.Errorf("%w: %s != %d", ErrContentLength, cl, n)
+			o.Logger.Println(err.Error())
+			o.cacheError(r, namespace, group, err)
+			return
+		}
+	}
+
+	// Read the response body written by the handler and cache it, unless the
+	// body predicate rejects it.
+	if o.shouldCache(r) &&
+		(o.CacheBodyIf == nil || o.CacheBodyIf(string(r.RequestCtx.Response.Header.ContentType()), r.RequestCtx.Response.Body())) {
+		if err := f.cache(r, namespace, group, marker, latency, o); err != nil {
+			o.Logger.Println(err.Error())
+		}
+		if o.CacheStatusHeader {
+			r.RequestCtx.Response.Header.Set(headerXCache, "MISS")
+		}
+	}
+}
+
+// shouldCache checks if the response written by the handler can be cached as
+// per its status code and Cache-Control header ("no-store"), UserValueSkip and
+// ShouldCache.
+func (o *Options) shouldCache(r *fastglue.Request) bool {
+	if skip, _ := r.RequestCtx.UserValue(UserValueSkip).(bool); skip {
+		return false
+	}
+	if !o.cacheableStatus(r.RequestCtx.Response.StatusCode(), string(r.RequestCtx.Response.Header.Peek("Location"))) {
+		return false
+	}
+	if hasDirective(r.RequestCtx.Response.Header.Peek("Cache-Control"), "no-store") {
+		return false
+	}
+	return o.ShouldCache == nil || o.ShouldCache(r)
+}
+
+// revalidate invokes the handler with the upstream validators of a cached
+// response as the request's If-None-Match and If-Modified-Since. If the handler
+// responds with a 304, the cached response is refreshed in the store and the
+// response is reset so that the cached one can be served, and true is returned.
+// Otherwise, the handler's response is left as-is.
+func (f *FastCache) revalidate(r *fastglue.Request, h fastglue.FastRequestHandler, namespace, group, uri string, it *Item, o *Options) (bool, error) {
+	var (
+		req = &r.RequestCtx.Request.Header
+		inm = string(req.Peek("If-None-Match"))
+		ims = string(req.Peek("If-Modified-Since"))
+	)
+	setHeader(req, "If-None-Match", it.UpstreamETag)
+	setHeader(req, "If-Modified-Since", it.UpstreamLastModified)
+	err := o.run(r, h, namespace, group, false)
+	setHeader(req, "If-None-Match", inm)
+	setHeader(req, "If-Modified-Since", ims)
+	if err != nil {
+		return false, err
+	}
+
+	if r.RequestCtx.Response.StatusCode() != fasthttp.StatusNotModified {
+		return false, nil
+	}
+
+	r.RequestCtx.Response.Reset()
+	it.CreatedAt = o.Clock.Now()
+	if ttl, ok := o.ttl(it.StatusCode, it.CacheControl); ok {
+		if (o.StaleWhileRevalidate > 0 || o.Grace > 0) && ttl > 0 {
+			it.StaleAt = it.CreatedAt.Add(ttl)
+		}
+		if err := f.put(namespace, group, uri, *it, o.storeTTL(ttl)); err != nil {
+			o.Logger.Printf("error writing cache to store: %v", err)
+			o.cacheError(r, namespace, group, err)
+		}
+	}
+	return true, nil
+}
+
+// coalesced is a response shared with coalesced requests.
+type coalesced struct {
+	resp fasthttp.Response
+	vary bool
+
+	// Reading a fasthttp.Response isn't safe for concurrent use.
+	mu sync.Mutex
+}
+
+// coalesce executes the handler for the first of concurrent requests for a
+// URI and shares its response with the others. It returns false if the
+// request has to execute the handler itself, for instance, if the shared
+// response isn't applicable to it.
+func (f *FastCache) coalesce(r *fastglue.Request, h fastglue.FastRequestHandler, namespace, group, uri string, marker Item, o *Options) bool {
+	v, err, shared := f.sf.do(r.RequestCtx, "coalesce"+sep+namespace+sep+group+sep+uri, func() (interface{}, error) {
+		start := time.Now()
+		if err := o.run(r, h, namespace, group, false); err != nil {
+			return nil, err
+		}
+		f.cacheResponse(r, namespace, group, marker, time.Since(start), o)
+
+		// Streamed responses and the responses to the request's validators
+		// can't be shared.
+		if r.RequestCtx.Response.IsBodyStream() || r.RequestCtx.Response.StatusCode() == fasthttp.StatusNotModified {
+			return nil, nil
+		}
+
+		c := &coalesced{vary: len(r.RequestCtx.Response.Header.Peek("Vary")) > 0}
+		r.RequestCtx.Response.CopyTo(&c.resp)
+		c.resp.Header.DelAllCookies()
+		return c, nil
+	})
+	if !shared {
+		if err != nil {
+			o.Logger.Printf("error running middleware: %v", err)
+		}
+		return true
+	}
+
+	// The headers that the response varies by may differ from those of the
+	// request that produced the response.
+	c, _ := v.(*coalesced)
+	if err != nil || c == nil || (c.vary && marker.Vary == "") {
+		return false
+	}
+
+	c.mu.Lock()
+	c.resp.CopyTo(&r.RequestCtx.Response)
+	c.mu.Unlock()
+	return true
+}
+
+// expiring checks if a cached response is within the last RefreshAhead
+// fraction of its TTL.
+func (f *FastCache) expiring(namespace, group, uri string, blob Item, o *Options) bool {
+	ttl, ok := o.ttl(blob.StatusCode, blob.CacheControl)
+	if !ok || ttl <= 0 {
+		return false
+	}
+
+	rem := f.remainingTTL(namespace, group, uri, blob, o)
+	return rem > 0 && float64(rem) <= float64(ttl)*o.RefreshAhead
+}
+
+// graceSweepFreq is the interval at which the grace serve counts of ended
+// grace windows are swept.
+const graceSweepFreq = time.Minute
+
+// graceCount is the number of grace serves of a response whose grace window
+// ends at end.
+type graceCount struct {
+	n   int64
+	end time.Time
+}
+
+// grace checks if a response in its grace window can be served within
+// GraceLimit and counts the serve.
+func (f *FastCache) grace(r *fastglue.Request, namespace, group, uri string, blob Item, o *Options) bool {
+	if o.GraceLimit > 0 {
+		f.sweepGrace(o.Clock.Now())
+
+		// The count of an earlier response of the URI, for instance, one
+		// that was refreshed by another instance, is reset.
+		var (
+			key = namespace + sep + group + sep + uri
+			end = blob.StaleAt.Add(o.StaleWhileRevalidate + o.Grace)
+		)
+		v, _ := f.graceServes.LoadOrStore(key, &graceCount{end: end})
+		c := v.(*graceCount)
+		if !c.end.Equal(end) {
+			c = &graceCount{end: end}
+			f.graceServes.Store(key, c)
+		}
+		if atomic.AddInt64(&c.n, 1) > int64(o.GraceLimit) {
+			return false
+		}
+	}
+
+	if rep := f.reports(); rep != nil {
+		rep.grace(group)
+	}
+	if o.Hooks.OnGrace != nil {
+		o.Hooks.OnGrace(r, namespace, group)
+	}
+	return true
+}
+
+// sweepGrace deletes the grace serve counts of the responses whose grace
+// windows have ended, at most once every graceSweepFreq, so that the counts
+// of URIs that are never refreshed don't accumulate.
+func (f *FastCache) sweepGrace(now time.Time) {
+	next := atomic.LoadInt64(&f.graceSweep)
+	if now.UnixNano() < next || !atomic.CompareAndSwapInt64(&f.graceSweep, next, now.Add(graceSweepFreq).UnixNano()) {
+		return
+	}
+
+	f.graceServes.Range(func(k, v interface{}) bool {
+		if !now.Before(v.(*graceCount).end) {
+			f.graceServes.Delete(k)
+		}
+		return true
+	})
+}
+
+// refresh invokes the handler in the background with a copy of the request
+// to refresh a stale or expiring cached response. Concurrent refreshes of a
+// URI are deduplicated.
+func (f *FastCache) refresh(r *fastglue.Request, h fastglue.FastRequestHandler, namespace, group, uri string, marker Item, o *Options) {
+	// Responses to HEAD requests can't refresh the cache of GET requests.
+	if r.RequestCtx.IsHead() && !o.IncludeMethod {
+		return
+	}
+
+	key := namespace + sep + group + sep + uri
+	if _, ok := f.refreshing.LoadOrStore(key, struct{}{}); ok {
+		return
+	}
+
+	// The request is only valid until the handler returns.
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Init(&r.RequestCtx.Request, r.RequestCtx.RemoteAddr(), nil)
+	r.RequestCtx.VisitUserValues(func(k []byte, v interface{}) {
+		ctx.SetUserValueBytes(k, v)
+	})
+
+	// The client's validators shouldn't get a 304 from the handler.
+	ctx.Request.Header.Del("If-None-Match")
+	ctx.Request.Header.Del("If-Modified-Since")
+
+	req := &fastglue.Request{RequestCtx: ctx, Context: r.Context}
+	go func() {
+		defer f.refreshing.Delete(key)
+
+		start := time.Now()
+		if err := o.run(req, h, namespace, group, true); err != nil {
+			o.Logger.Printf("error refreshing cache: %v", err)
+			return
+		}
+		f.cacheResponse(req, namespace, group, marker, time.Since(start), o)
+	}()
+}
+
+// SetReadOnly enables or disables the read-only mode in which writes to the
+// store (caching responses, extending TTLs and counting hits) are no-ops and
+// only the existing cache is served, for instance, during incidents when the
+// store is memory constrained, or during blue/green deploys where only one
+// color should write. Deletions still go through so that invalidated
+// responses aren't served. It can be toggled at runtime.
+func (f *FastCache) SetReadOnly(on bool) {
+	var v int32
+	if on {
+		v = 1
+	}
+	atomic.StoreInt32(&f.readOnly, v)
+}
+
+// ReadOnly checks if the read-only mode is enabled.
+func (f *FastCache) ReadOnly() bool {
+	return atomic.LoadInt32(&f.readOnly) == 1
+}
+
+// MarkStreaming marks route paths (as registered with the router) as
+// streaming routes, such as WebSocket or server-sent event endpoints.
+// Wrapping them with CachedPath() returns ErrStreamingRoute.
+func (f *FastCache) MarkStreaming(paths ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.streaming == nil {
+		f.streaming = make(map[string]struct{}, len(paths))
+	}
+	for _, p := range paths {
+		f.streaming[p] = struct{}{}
+	}
+}
+
+// CachedPath is Cached() for a handler registered on the given route path.
+// It returns ErrStreamingRoute if the path has been marked with
+// MarkStreaming(), catching such misconfigurations at registration time.
+func (f *FastCache) CachedPath(path string, h fastglue.FastRequestHandler, o *Options, group string) (fastglue.FastRequestHandler, error) {
+	f.mu.RLock()
+	_, ok := f.streaming[path]
+	f.mu.RUnlock()
+	if ok {
+		return nil, fmt.Errorf("%w: %s", ErrStreamingRoute, path)
+	}
+
+	return f.Cached(h, o, group), nil
+}
+
+// ClearGroup middleware clears cache set by the Cached() middleware
+// for the all the specified groups.
+//
+// This should ideally wrap write handlers (POST / PUT / DELETE)
+// and the cache is cleared when the handler responds with a 200.
+func (f *FastCache) ClearGroup(h fastglue.FastRequestHandler, o *Options, groups ...string) fastglue.FastRequestHandler {
+	o = f.options(o).compile()
+
+	return func(r *fastglue.Request) error {
+		namespace, err := o.namespace(r)
+		if err != nil {
+			o.Logger.Printf("%v", err)
+			return h(r)
+		}
+
+		// Execute the actual handler.
+		if err := h(r); err != nil {
+			o.Logger.Printf("error running middleware: %v", err)
 		}
 
 		// Clear cache.
 		if r.RequestCtx.Response.StatusCode() == 200 {
-			if err := f.DelGroup(namespace, groups...); err != nil {
+			groups := groups
+			if o.GroupHook != nil {
+				if g := o.GroupHook(r); g != "" {
+					groups = append(groups[:len(groups):len(groups)], g)
+				}
+			}
+
+			var err error
+			if o.PurgeDedupWindow > 0 {
+				err = f.dedupDelGroup(namespace, groups, o)
+			} else {
+				err = f.DelGroup(namespace, groups...)
+			}
+			if err != nil {
 				o.Logger.Printf("error while deleting groups '%v': %v", groups, err)
 			}
 		}
@@ -242,67 +1625,815 @@ func (f *FastCache) Del(namespace, group, uri string) error {
 	return f.s.Del(namespace, group, uri)
 }
 
-// DelGroup deletes all cached URIs under a group.
+// DelGroup deletes all cached URIs under a group. Stores may support glob
+// patterns (eg: orders:*) as group names to delete all the matching groups.
+//
+// If a grace window is set with SetDelGroupGrace() and the store implements
+// GroupStaler, the URIs are marked stale instead.
 func (f *FastCache) DelGroup(namespace string, group ...string) error {
-	return f.s.DelGroup(namespace, group...)
+	var (
+		err   error
+		grace = time.Duration(atomic.LoadInt64(&f.delGroupGrace))
+	)
+	if gs, ok := f.s.(GroupStaler); ok && grace > 0 {
+		err = gs.StaleGroup(namespace, grace, group...)
+	} else {
+		err = f.s.DelGroup(namespace, group...)
+	}
+	if err != nil {
+		return err
+	}
+
+	if fn, _ := f.onInvalidate.Load().(func(string, []string)); fn != nil {
+		fn(namespace, group)
+	}
+	if cdn := f.cdnOptions(); cdn != nil {
+		return cdn.purge(namespace, group)
+	}
+	return nil
+}
+
+// OnInvalidate sets a callback that is invoked with the namespace and the
+// groups after they're deleted with DelGroup() (and ClearGroup(),
+// InvalidationHandler()), for instance, to invalidate caches derived from
+// them such as local materialized views or CDN caches along with them. It's
+// invoked synchronously and should be quick.
+func (f *FastCache) OnInvalidate(fn func(namespace string, groups []string)) {
+	f.onInvalidate.Store(fn)
+}
+
+// SetDelGroupGrace makes DelGroup() (and ClearGroup(), InvalidationHandler())
+// retain the URIs of deleted groups for the grace window marked as stale
+// instead of deleting them, if the store implements GroupStaler. On routes
+// with Options.StaleWhileRevalidate, stale URIs are served while they're
+// refreshed in the background, absorbing the burst of requests that follows
+// the invalidation of a hot group. They're served for the shorter of the
+// grace window and StaleWhileRevalidate, and are misses on other routes.
+// 0 disables it. It can be changed at runtime.
+func (f *FastCache) SetDelGroupGrace(grace time.Duration) {
+	atomic.StoreInt64(&f.delGroupGrace, int64(grace))
+}
+
+// PurgeNamespace invalidates everything cached under a namespace. The Store
+// has to implement NamespacePurger, or ErrNotSupported is returned.
+func (f *FastCache) PurgeNamespace(namespace string) error {
+	p, ok := f.s.(NamespacePurger)
+	if !ok {
+		return ErrNotSupported
+	}
+	return p.PurgeNamespace(namespace)
+}
+
+// HashBlob returns the hex encoded SHA1 hash of the Blob cached for a URI
+// in a namespace->group, for instance, for producing validators while warming
+// or verifying caches of large items. The hash is computed by the store
+// without fetching the Blob. The store has to implement BlobHasher, or
+// ErrNotSupported is returned.
+func (f *FastCache) HashBlob(namespace, group, uri string) (string, error) {
+	h, ok := f.s.(BlobHasher)
+	if !ok {
+		return "", ErrNotSupported
+	}
+	return h.HashBlob(namespace, group, uri)
+}
+
+// GetOrFill is a read-through loader that returns the Item cached for a URI
+// in a namespace->group. If there's no cached Item, fill is invoked to
+// produce it and the Item is written to the store with the given ttl. Items
+// are told apart from misses by their ContentType, so Items with empty Blobs
+// are cached, and Items without a ContentType aren't written to the store.
+// Concurrent calls for the same URI are deduplicated so that fill is
+// only executed once. ctx bounds the time spent waiting for a concurrent
+// call's fill to finish.
+//
+// This allows non-HTTP code such as background jobs to share the cache
+// entries served by the Cached() middleware. The Item is returned as it is in
+// the store, that is, its Blob may be compressed (Item.Compression). Stale
+// Items (Item.StaleAt) are misses, and the staleness and the CreatedAt of
+// filled Items are as per the Clock of the default Options passed to New().
+func (f *FastCache) GetOrFill(ctx context.Context, namespace, group, uri string, ttl time.Duration, fill func() (Item, error)) (Item, error) {
+	// Some stores return errors for missing items, which are treated as misses.
+	if it, err := f.get(namespace, group, uri); err == nil && it.ContentType != "" && !it.stale(f.clock().Now()) {
+		return it, nil
+	}
+
+	v, err, _ := f.sf.do(ctx, namespace+sep+group+sep+uri, func() (interface{}, error) {
+		it, err := fill()
+		if err != nil {
+			return it, err
+		}
+		if it.ContentType == "" {
+			return it, nil
+		}
+		if it.CreatedAt.IsZero() {
+			it.CreatedAt = f.clock().Now()
+		}
+
+		if err := f.put(namespace, group, uri, it, ttl); err != nil {
+			return it, fmt.Errorf("error writing cache to store: %v", err)
+		}
+		return it, nil
+	})
+	if err != nil {
+		return Item{}, err
+	}
+
+	it, ok := v.(Item)
+	if !ok {
+		return Item{}, fmt.Errorf("unexpected fill result %T", v)
+	}
+	return it, nil
+}
+
+// Inspect returns the Item for a single URI in a namespace->group as it is
+// in the store, that is, with the blob compressed and with the stored
+// metadata such as CompressionReason. This is meant for admin introspection
+// and debugging.
+func (f *FastCache) Inspect(namespace, group, uri string) (Item, error) {
+	return f.s.Get(namespace, group, uri)
 }
 
-// cache caches a response body.
-func (f *FastCache) cache(r *fastglue.Request, namespace, group string, o *Options) error {
+// cache caches a response body. marker is the existing Vary marker of the
+// URI, if any, and latency is the time the handler took to generate it.
+func (f *FastCache) cache(r *fastglue.Request, namespace, group string, marker Item, latency time.Duration, o *Options) error {
+	ttl, ok, err := o.responseTTL(r, latency)
+	if err != nil || !ok {
+		return err
+	}
+
+	headers, ok := responseHeaders(&r.RequestCtx.Response.Header, o.MaxHeaderBytes)
+	if !ok {
+		o.bypass(r, BypassHeaderSize)
+		return nil
+	}
+
 	// ETag?.
 	var etag string
 	if o.ETag {
-		e, err := generateRandomString(16)
-		if err != nil {
-			return fmt.Errorf("error generating etag: %v", err)
+		if o.ContentETag {
+			h := sha1.Sum(r.RequestCtx.Response.Body())
+			etag = hex.EncodeToString(h[:])
+		} else {
+			e, err := generateRandomString(16)
+			if err != nil {
+				return fmt.Errorf("error generating etag: %v", err)
+			}
+			etag = e
 		}
-		etag = e
 	}
 
 	// Write cache to the store (etag, content type, response body).
-	var hash [16]byte
-	// If IncludeQueryString option is set then cache based on uri + md5(query_string)
-	if o.IncludeQueryString {
-		hash = md5.Sum(r.RequestCtx.URI().FullURI())
-	} else {
-		hash = md5.Sum(r.RequestCtx.URI().Path())
+	uri := cacheURI(r, o)
+
+	// If the response varies by request headers, mark the URI as varying and
+	// cache the response under the request's variant. Every new marker gets
+	// a random generation so that variants cached under a deleted or expired
+	// marker are never served again.
+	vary := parseVary(r.RequestCtx.Response.Header.Peek("Vary"))
+	if vary == "*" {
+		return nil
+	}
+	if vary != "" {
+		if marker.Vary != vary {
+			gen, err := generateRandomString(8)
+			if err != nil {
+				return fmt.Errorf("error generating vary generation: %v", err)
+			}
+
+			// The marker expires with the variant, whose TTL may have been
+			// overridden by the handler.
+			marker = Item{Vary: vary, ETag: gen, CreatedAt: o.Clock.Now()}
+			if err := f.put(namespace, group, uri, marker, o.storeTTL(ttl)); err != nil {
+				o.cacheError(r, namespace, group, err)
+				return fmt.Errorf("error writing cache to store: %v", err)
+			}
+		}
+		uri = variantURI(r, uri, marker, o)
 	}
-	uri := hex.EncodeToString(hash[:])
 
 	var blob []byte
 	if !o.NoBlob {
 		blob = r.RequestCtx.Response.Body()
 	}
 
+	// Record the handler's (upstream's) validators before they are replaced.
+	var upETag, upLastMod string
+	if o.RevalidateAfter > 0 {
+		upETag = string(r.RequestCtx.Response.Header.Peek("ETag"))
+		upLastMod = string(r.RequestCtx.Response.Header.Peek("Last-Modified"))
+	}
+
 	item := Item{
 		ETag:        etag,
 		ContentType: string(r.RequestCtx.Response.Header.ContentType()),
 		Blob:        blob,
+		StatusCode:  r.RequestCtx.Response.StatusCode(),
+		CreatedAt:   o.Clock.Now(),
+		Vary:        vary,
+		Headers:     headers,
+
+		CacheControl: string(r.RequestCtx.Response.Header.Peek("Cache-Control")),
+		Expires:      string(r.RequestCtx.Response.Header.Peek("Expires")),
+
+		UpstreamETag:         upETag,
+		UpstreamLastModified: upLastMod,
+
+		Cost: latency,
+	}
+	if isRedirect(item.StatusCode) {
+		item.Location = string(r.RequestCtx.Response.Header.Peek("Location"))
 	}
 
-	// Optionally compress the response.
-	if o.Compression.Enabled && len(blob) >= o.Compression.MinLength {
-		b, err := compressGzip(blob)
-		if err != nil {
-			o.Logger.Printf("error compressing blob: %v", err)
-		} else {
-			item.Blob = b
-			item.Compression = compGzip
-		}
+	if (o.StaleWhileRevalidate > 0 || o.Grace > 0) && ttl > 0 {
+		item.StaleAt = item.CreatedAt.Add(ttl)
 	}
 
-	err := f.s.Put(namespace, group, uri, item, o.TTL)
+	// Optionally compress the response.
+	f.compress(group, &item, o)
+
+	err = f.put(namespace, group, uri, item, o.storeTTL(ttl))
 	if err != nil {
+		o.cacheError(r, namespace, group, err)
 		return fmt.Errorf("error writing cache to store: %v", err)
 	}
+	if o.Hooks.OnStore != nil {
+		o.Hooks.OnStore(r, namespace, group, uri, ttl)
+	}
+	if cdn := f.cdnOptions(); cdn != nil {
+		cdn.tag(r, namespace, group)
+	}
+	if o.GraceLimit > 0 {
+		f.graceServes.Delete(namespace + sep + group + sep + uri)
+	}
+
+	if o.LastModified {
+		r.RequestCtx.Response.Header.SetLastModified(item.CreatedAt)
+	}
+	if o.EmitCacheControl {
+		emitCacheControl(r, ttl, o)
+	}
 
 	// Send the eTag with the response.
 	if o.ETag {
-		r.RequestCtx.Response.Header.Add("ETag", `"`+string(etag)+`"`)
+		r.RequestCtx.Response.Header.Set("ETag", `"`+string(etag)+`"`)
+
+		// The client already has the content.
+		if o.ContentETag && item.StatusCode == fasthttp.StatusOK && matchETag(r.RequestCtx.Request.Header.Peek("If-None-Match"), etag) {
+			r.RequestCtx.Response.ResetBody()
+			r.RequestCtx.SetStatusCode(fasthttp.StatusNotModified)
+		}
 	}
 	return nil
 }
 
+// cacheURI returns the hashed URI under which the request's response is
+// cached. By default, it is md5(path). If IncludeQueryString is set, it is
+// md5(scheme://host/path?query_string), or with query options (see
+// canonicalKeys()), md5(host/path?canonical_query_string). The values of
+// IncludeHeaders and IncludeCookies, the method and the body of CacheMethods
+// requests and the method of HEAD requests with IncludeMethod, if any, are
+// hashed along with it. KeyGenerator, if set, replaces all of it.
+func cacheURI(r *fastglue.Request, o *Options) string {
+	if o.KeyGenerator != nil {
+		return o.KeyGenerator(r)
+	}
+
+	var key []byte
+	if o.IncludeQueryString {
+		key = uriKey(r.RequestCtx.URI(), o)
+	} else {
+		key = o.NormalizePath.normalize(r.RequestCtx.URI().Path())
+	}
+
+	// The bodies of requests with CacheMethods are part of the key, and
+	// with IncludeMethod, so is the method of HEAD requests.
+	var (
+		hasBody = !r.RequestCtx.IsGet() && !r.RequestCtx.IsHead()
+		isHead  = o.IncludeMethod && r.RequestCtx.IsHead()
+	)
+
+	if len(o.IncludeHeaders) == 0 && len(o.IncludeCookies) == 0 && !hasBody && !isHead {
+		return o.hashKey(key)
+	}
+
+	h := o.newHash()
+	h.Write(key)
+	if hasBody || isHead {
+		h.Write([]byte(sep))
+		h.Write(r.RequestCtx.Method())
+	}
+	if hasBody {
+		h.Write([]byte(sep))
+		h.Write(r.RequestCtx.PostBody())
+	}
+	for _, name := range o.IncludeHeaders {
+		h.Write([]byte(sep + name + "="))
+		h.Write(r.RequestCtx.Request.Header.Peek(name))
+	}
+
+	if len(o.IncludeCookies) > 0 {
+		args := fasthttp.AcquireArgs()
+		defer fasthttp.ReleaseArgs(args)
+
+		for _, name := range o.IncludeCookies {
+			args.SetBytesV(name, r.RequestCtx.Request.Header.Cookie(name))
+		}
+		if o.CookiesTransformerHook != nil {
+			o.CookiesTransformerHook(args)
+		}
+
+		h.Write([]byte(sep))
+		h.Write(args.QueryString())
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// run invokes the handler, recovering from panics in it if RecoverPanics is
+// enabled or if it's run in the background. The response of a recovered
+// panic is a 500 and an error is returned so that it's never cached.
+func (o *Options) run(r *fastglue.Request, h fastglue.FastRequestHandler, namespace, group string, background bool) (err error) {
+	defer func() {
+		p := recover()
+		if p == nil {
+			return
+		}
+
+		if o.Hooks.OnPanic != nil {
+			o.Hooks.OnPanic(r, namespace, group, p)
+		}
+		if !o.RecoverPanics && !background {
+			panic(p)
+		}
+
+		r.RequestCtx.Response.Reset()
+		r.RequestCtx.Error(fasthttp.StatusMessage(fasthttp.StatusInternalServerError), fasthttp.StatusInternalServerError)
+		err = fmt.Errorf("handler panic: %v", p)
+	}()
+
+	return h(r)
+}
+
+// namespace returns the namespace of a request, computed with NamespaceHook
+// if it's set, or from UserValue(NamespaceKey), falling back to
+// SharedNamespace.
+func (o *Options) namespace(r *fastglue.Request) (string, error) {
+	if o.NamespaceHook != nil {
+		ns, err := o.NamespaceHook(r)
+		if err != nil {
+			return "", fmt.Errorf("error computing namespace: %v", err)
+		}
+		if ns == "" {
+			if o.SharedNamespace != "" {
+				return o.sharedNamespace(r)
+			}
+			return "", errors.New("empty namespace from NamespaceHook")
+		}
+		return ns, nil
+	}
+
+	ns, _ := r.RequestCtx.UserValue(o.NamespaceKey).(string)
+	if ns == "" {
+		if o.SharedNamespace != "" {
+			return o.sharedNamespace(r)
+		}
+		return "", fmt.Errorf("no namespace found in UserValue() for key '%s'", o.NamespaceKey)
+	}
+	return ns, nil
+}
+
+// sharedNamespace returns SharedNamespace for requests without a namespace,
+// unless they're authorized and ShareAuthorized isn't enabled.
+func (o *Options) sharedNamespace(r *fastglue.Request) (string, error) {
+	if !o.ShareAuthorized && len(r.RequestCtx.Request.Header.Peek("Authorization")) > 0 {
+		return "", errors.New("no namespace for authorized request; not caching it under the shared namespace")
+	}
+	return o.SharedNamespace, nil
+}
+
+// group returns the group of a request, derived with GroupHook if it's set.
+func (o *Options) group(r *fastglue.Request, group string) string {
+	if o.GroupHook != nil {
+		if g := o.GroupHook(r); g != "" {
+			return g
+		}
+	}
+	return group
+}
+
+// cacheableMethod checks if requests with a method other than GET and HEAD
+// are cached (CacheMethods). The Options have to be compiled.
+func (o *Options) cacheableMethod(method []byte) bool {
+	_, ok := o.compiled.cacheMethods[string(method)]
+	return ok
+}
+
+// bypass invokes the OnBypass hook, if it's set.
+func (o *Options) bypass(r *fastglue.Request, reason string) {
+	if o.Hooks.OnBypass != nil {
+		o.Hooks.OnBypass(r, reason)
+	}
+}
+
+// cacheError invokes the OnError hook, if it's set.
+func (o *Options) cacheError(r *fastglue.Request, namespace, group string, err error) {
+	if o.Hooks.OnError != nil {
+		o.Hooks.OnError(r, namespace, group, err)
+	}
+}
+
+// streamingRequest returns the bypass reason if the request is a connection
+// upgrade or a server-sent event request, and an empty string otherwise.
+func streamingRequest(r *fastglue.Request) string {
+	h := &r.RequestCtx.Request.Header
+	if len(h.Peek("Upgrade")) > 0 || hasDirective(h.Peek("Connection"), "upgrade") {
+		return BypassUpgrade
+	}
+	if isEventStream(h.Peek("Accept")) {
+		return BypassStream
+	}
+	return ""
+}
+
+// isEventStream checks if a content type (or Accept header) is text/event-stream.
+func isEventStream(b []byte) bool {
+	return bytes.Contains(bytes.ToLower(b), []byte("text/event-stream"))
+}
+
+// forceRefresh checks if a request has the ForceRefreshHeader with the
+// ForceRefreshSecret, if any.
+func (o *Options) forceRefresh(r *fastglue.Request) bool {
+	if o.ForceRefreshHeader == "" {
+		return false
+	}
+
+	v := r.RequestCtx.Request.Header.Peek(o.ForceRefreshHeader)
+	if o.ForceRefreshSecret == "" {
+		return len(v) > 0
+	}
+	return validDebugSecret(v, o.ForceRefreshSecret)
+}
+
+// requestNoCache checks if a request has the `Cache-Control: no-cache` or
+// `Pragma: no-cache` header.
+func requestNoCache(r *fastglue.Request) bool {
+	return hasDirective(r.RequestCtx.Request.Header.Peek("Cache-Control"), "no-cache") ||
+		hasDirective(r.RequestCtx.Request.Header.Peek("Pragma"), "no-cache")
+}
+
+// notModifiedSince checks if the request has an If-Modified-Since header
+// that is not older than the given modification time. If-Modified-Since is
+// ignored if ETags are enabled and the request has If-None-Match.
+func notModifiedSince(r *fastglue.Request, modified time.Time, o *Options) bool {
+	h := &r.RequestCtx.Request.Header
+	if len(h.Peek("If-Modified-Since")) == 0 || (o.ETag && len(h.Peek("If-None-Match")) > 0) {
+		return false
+	}
+
+	return !r.RequestCtx.IfModifiedSince(modified)
+}
+
+// skipHeaders are the (canonical) response headers that are not cached in
+// Item.Headers as they are either managed by fastcache, are connection
+// specific (hop-by-hop) or shouldn't be shared.
+var skipHeaders = map[string]struct{}{
+	"Content-Type":        {},
+	"Content-Length":      {},
+	"Content-Encoding":    {},
+	"Transfer-Encoding":   {},
+	"Connection":          {},
+	"Keep-Alive":          {},
+	"Proxy-Authenticate":  {},
+	"Proxy-Authorization": {},
+	"Te":                  {},
+	"Trailer":             {},
+	"Upgrade":             {},
+	"Date":                {},
+	"Server":              {},
+	"Etag":                {},
+	"Last-Modified":       {},
+	"Location":            {},
+	"Vary":                {},
+	"Cache-Control":       {},
+	"Expires":             {},
+	"Set-Cookie":          {},
+	headerXCache:          {},
+	headerXCacheHits:      {},
+	"X-Fastcache-Ttl":     {}, // headerTTL, canonical.
+}
+
+// writeCacheHeaders writes the Cache-Control and Expires headers of a cached
+// response along with its Age so that downstream caches can account for the
+// time spent in the cache.
+func writeCacheHeaders(r *fastglue.Request, it Item, o *Options) {
+	if it.CacheControl == "" && it.Expires == "" {
+		return
+	}
+
+	if it.CacheControl != "" {
+		r.RequestCtx.Response.Header.Set("Cache-Control", it.CacheControl)
+	}
+	if it.Expires != "" {
+		r.RequestCtx.Response.Header.Set("Expires", it.Expires)
+	}
+	if !it.CreatedAt.IsZero() {
+		if age := o.Clock.Now().Sub(it.CreatedAt); age >= 0 {
+			r.RequestCtx.Response.Header.Set("Age", strconv.Itoa(int(age/time.Second)))
+		}
+	}
+}
+
+// remainingTTL returns the remaining TTL of a cached item. It is fetched
+// from the store if it implements TTLGetter, and is otherwise derived from
+// the item's age.
+func (f *FastCache) remainingTTL(namespace, group, uri string, it Item, o *Options) time.Duration {
+	// The store's TTL includes the stale period.
+	if !it.StaleAt.IsZero() {
+		return it.StaleAt.Sub(o.Clock.Now())
+	}
+
+	if g, ok := f.s.(TTLGetter); ok {
+		ttl, err := f.getTTL(g, namespace, group, uri)
+		if err == nil {
+			return ttl
+		}
+		// The item expired after it was read.
+		if errors.Is(err, ErrNotCached) {
+			return 0
+		}
+		o.Logger.Printf("error reading cache TTL: %v", err)
+	}
+
+	ttl, _ := o.ttl(it.StatusCode, it.CacheControl)
+	if ttl <= 0 || it.CreatedAt.IsZero() {
+		return 0
+	}
+	return ttl - o.Clock.Now().Sub(it.CreatedAt)
+}
+
+// emitCacheControl sets the public Cache-Control and Expires headers for
+// the given remaining TTL unless the response has a Cache-Control header.
+func emitCacheControl(r *fastglue.Request, ttl time.Duration, o *Options) {
+	if ttl < time.Second || len(r.RequestCtx.Response.Header.Peek("Cache-Control")) > 0 {
+		return
+	}
+
+	r.RequestCtx.Response.Header.Set("Cache-Control", "public, max-age="+strconv.Itoa(int(ttl/time.Second)))
+	r.RequestCtx.Response.Header.SetBytesV("Expires", fasthttp.AppendHTTPDate(nil, o.Clock.Now().Add(ttl)))
+}
+
+// responseHeaders returns the response headers to be cached with canonical
+// names. If max is set and the headers are larger than max bytes, false is
+// returned.
+func responseHeaders(h *fasthttp.ResponseHeader, max int) (map[string][]string, bool) {
+	// Headers listed in Connection are hop-by-hop too.
+	var hop map[string]struct{}
+	for _, n := range bytes.Split(h.Peek("Connection"), []byte(",")) {
+		if n = bytes.TrimSpace(n); len(n) > 0 {
+			if hop == nil {
+				hop = make(map[string]struct{})
+			}
+			hop[textproto.CanonicalMIMEHeaderKey(string(n))] = struct{}{}
+		}
+	}
+
+	var (
+		out  map[string][]string
+		size int
+	)
+	h.VisitAll(func(k, v []byte) {
+		key := textproto.CanonicalMIMEHeaderKey(string(k))
+		if _, ok := skipHeaders[key]; ok {
+			return
+		}
+		if _, ok := hop[key]; ok {
+			return
+		}
+		if out == nil {
+			out = make(map[string][]string)
+		}
+		out[key] = append(out[key], string(v))
+		size += len(key) + len(v)
+	})
+
+	if max > 0 && size > max {
+		return nil, false
+	}
+	return out, true
+}
+
+// parseVary normalizes a Vary header value into a sorted, comma separated
+// list of lowercased header names. "*" is returned as-is.
+func parseVary(h []byte) string {
+	var names []string
+	for _, n := range bytes.Split(h, []byte(",")) {
+		n = bytes.TrimSpace(n)
+		if len(n) == 0 {
+			continue
+		}
+		if len(n) == 1 && n[0] == '*' {
+			return "*"
+		}
+		names = append(names, strings.ToLower(string(n)))
+	}
+	sort.Strings(names)
+
+	return strings.Join(names, ",")
+}
+
+// isVaryMarker checks if an Item is the marker of a URI whose responses
+// vary by request headers. The marker's ETag is its generation.
+func isVaryMarker(it Item) bool {
+	return it.Vary != "" && it.ContentType == ""
+}
+
+// variantURI returns the URI of the request's variant of a varying response
+// from the values of the request headers in the marker's Vary.
+func variantURI(r *fastglue.Request, uri string, marker Item, o *Options) string {
+	h := o.newHash()
+	h.Write([]byte(uri + sep + marker.ETag))
+	for _, name := range strings.Split(marker.Vary, ",") {
+		h.Write([]byte(sep + name + "="))
+		h.Write(r.RequestCtx.Request.Header.Peek(name))
+	}
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// setHeader sets a request header, or deletes it if the value is empty.
+func setHeader(h *fasthttp.RequestHeader, key, val string) {
+	if val == "" {
+		h.Del(key)
+		return
+	}
+	h.Set(key, val)
+}
+
+// isJSON checks if a content type is JSON (eg: application/json,
+// application/problem+json).
+func isJSON(ctype string) bool {
+	return strings.Contains(strings.ToLower(ctype), "json")
+}
+
+// injectStaleness injects a JSON field with the cached_at time and age (in
+// seconds) of a cached item at the beginning of a JSON object body. Bodies
+// that are not JSON objects are returned as-is.
+func injectStaleness(b []byte, field string, createdAt, now time.Time) []byte {
+	body := bytes.TrimLeft(b, " \t\r\n")
+	if len(body) == 0 || body[0] != '{' {
+		return b
+	}
+
+	age := now.Sub(createdAt) / time.Second
+	if age < 0 {
+		age = 0
+	}
+
+	k, _ := json.Marshal(field)
+	out := make([]byte, 0, len(body)+len(k)+64)
+	out = append(out, '{')
+	out = append(out, k...)
+	out = append(out, `:{"cached_at":"`...)
+	out = createdAt.UTC().AppendFormat(out, time.RFC3339)
+	out = append(out, `","age":`...)
+	out = strconv.AppendInt(out, int64(age), 10)
+	out = append(out, '}')
+
+	// Is the object empty?
+	if rest := bytes.TrimLeft(body[1:], " \t\r\n"); len(rest) == 0 || rest[0] != '}' {
+		out = append(out, ',')
+	}
+	return append(out, body[1:]...)
+}
+
+// cacheableStatus checks if a response with the given status code and
+// Location header can be cached.
+func (o *Options) cacheableStatus(status int, location string) bool {
+	if status == fasthttp.StatusOK {
+		return true
+	}
+	if isRedirect(status) {
+		if location == "" {
+			return false
+		}
+		if o.CacheRedirects {
+			return true
+		}
+	}
+
+	if o.NegativeTTL > 0 && isNegative(status) {
+		return true
+	}
+
+	for _, s := range o.CacheableStatuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// ttl returns the TTL for a response with the given status code and
+// Cache-Control header. false is returned if the response shouldn't be cached.
+func (o *Options) ttl(status int, cacheControl string) (time.Duration, bool) {
+	if o.TTLFromCacheControl {
+		if ttl, ok := maxAge([]byte(cacheControl)); ok {
+			return ttl, ttl > 0
+		}
+	}
+
+	if o.NegativeTTL > 0 && status >= fasthttp.StatusBadRequest {
+		return o.NegativeTTL, true
+	}
+	return o.TTL, true
+}
+
+// responseTTL returns the TTL of a response that the handler took latency to
+// generate, and whether it's cached at all, from the route's TTL, the
+// Cache-Control header, AdaptiveTTL, TTLHook and the TTL overrides of the
+// handler (the X-Fastcache-TTL header and UserValueTTL), in that order.
+func (o *Options) responseTTL(r *fastglue.Request, latency time.Duration) (time.Duration, bool, error) {
+	ttl, ok := o.ttl(r.RequestCtx.Response.StatusCode(), string(r.RequestCtx.Response.Header.Peek("Cache-Control")))
+	ttl = o.AdaptiveTTL.scale(ttl, latency)
+
+	// The TTL depends on the request.
+	if ok && o.TTLHook != nil {
+		if d := o.TTLHook(r); d != 0 {
+			ttl, ok = d, d > 0
+		}
+	}
+
+	// The handler has overridden the TTL of the response.
+	if v := r.RequestCtx.Response.Header.Peek(headerTTL); len(v) > 0 {
+		d, err := time.ParseDuration(string(v))
+		if err != nil || d < 0 {
+			return 0, false, fmt.Errorf("invalid %s header: %s", headerTTL, v)
+		}
+		ttl, ok = d, d > 0
+	}
+	if d, set := r.RequestCtx.UserValue(UserValueTTL).(time.Duration); set {
+		ttl, ok = d, d > 0
+	}
+	return ttl, ok, nil
+}
+
+// storeTTL returns the TTL with which an item with the given TTL is written
+// to the store. With StaleWhileRevalidate and Grace, items are retained past
+// their TTL so that they can be served stale.
+func (o *Options) storeTTL(ttl time.Duration) time.Duration {
+	if ttl > 0 {
+		return ttl + o.StaleWhileRevalidate + o.Grace
+	}
+	return ttl
+}
+
+// isNegative checks if a status code is a "negative" response that
+// NegativeTTL applies to.
+func isNegative(status int) bool {
+	return status == fasthttp.StatusNotFound || status == fasthttp.StatusGone || status >= fasthttp.StatusInternalServerError
+}
+
+// isRedirect checks if a status code is a cacheable redirect.
+func isRedirect(status int) bool {
+	switch status {
+	case fasthttp.StatusMovedPermanently, fasthttp.StatusFound,
+		fasthttp.StatusTemporaryRedirect, fasthttp.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
+
+// writePreflight writes a 204 response to a CORS preflight request
+// from the given policy.
+func writePreflight(r *fastglue.Request, p *PreflightOptions) {
+	var (
+		hdr    = &r.RequestCtx.Response.Header
+		origin = p.AllowOrigin
+	)
+	if origin == "" {
+		origin = string(r.RequestCtx.Request.Header.Peek("Origin"))
+		hdr.Add("Vary", "Origin")
+	}
+	if origin != "" {
+		hdr.Set("Access-Control-Allow-Origin", origin)
+	}
+
+	methods := p.AllowMethods
+	if methods == "" {
+		methods = "GET, HEAD, OPTIONS"
+	}
+	hdr.Set("Access-Control-Allow-Methods", methods)
+
+	if p.AllowHeaders != "" {
+		hdr.Set("Access-Control-Allow-Headers", p.AllowHeaders)
+	}
+	if p.MaxAge > 0 {
+		hdr.Set("Access-Control-Max-Age", strconv.Itoa(int(p.MaxAge.Seconds())))
+	}
+
+	r.RequestCtx.SetStatusCode(fasthttp.StatusNoContent)
+}
+
 // generateRandomString generates a cryptographically random,
 // alphanumeric string of length n.
 func generateRandomString(totalLen int) (string, error) {
@@ -320,6 +2451,53 @@ func generateRandomString(totalLen int) (string, error) {
 	return string(bytes), nil
 }
 
+// compress compresses the item's blob if compression is enabled and the blob
+// is at least MinLength bytes, recording the decision in the item's
+// CompressionReason and in the group's report (StartReporter()).
+func (f *FastCache) compress(group string, item *Item, o *Options) {
+	if rep := f.reports(); rep != nil && o.Compression.Enabled {
+		n := len(item.Blob)
+		defer func() {
+			rep.compression(group, n, len(item.Blob), item.Compression != "")
+		}()
+	}
+
+	switch {
+	case !o.Compression.Enabled:
+		item.CompressionReason = CompressionReasonDisabled
+		return
+	case len(item.Blob) < o.Compression.MinLength:
+		item.CompressionReason = CompressionReasonBelowMinLength
+		return
+	case o.Compression.MinRatio > 0 && f.ratios.skip(item.ContentType, o.Compression.MinRatio):
+		item.CompressionReason = CompressionReasonLowRatio
+		return
+	}
+
+	var (
+		b    []byte
+		comp = compGzip
+		n    = len(item.Blob)
+	)
+	if o.Compression.Algorithm == compZstd {
+		b, comp = compressZstd(item.Blob), compZstd
+	} else {
+		var err error
+		if b, err = compressGzip(item.Blob); err != nil {
+			o.Logger.Printf("error compressing blob: %v", err)
+			item.CompressionReason = CompressionReasonError
+			return
+		}
+	}
+	if o.Compression.MinRatio > 0 {
+		f.ratios.record(item.ContentType, n, len(b))
+	}
+
+	item.Blob = b
+	item.Compression = comp
+	item.CompressionReason = CompressionReasonCompressed
+}
+
 func compressGzip(b []byte) ([]byte, error) {
 	var buf bytes.Buffer
 
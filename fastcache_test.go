@@ -0,0 +1,51 @@
+package fastcache
+
+import (
+	"testing"
+	"time"
+)
+
+// stepClock is a Clock whose time is set by the test.
+type stepClock struct {
+	now time.Time
+}
+
+func (c *stepClock) Now() time.Time {
+	return c.now
+}
+
+func TestGraceServes(t *testing.T) {
+	var (
+		c = &stepClock{now: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)}
+		f = New(&delGroupStore{})
+		o = &Options{Grace: time.Minute, GraceLimit: 1, Clock: c}
+
+		blob = Item{StaleAt: c.now}
+	)
+
+	if !f.grace(nil, "ns", "g", "/a", blob, o) {
+		t.Fatal("expected a grace serve")
+	}
+	if f.grace(nil, "ns", "g", "/a", blob, o) {
+		t.Fatal("expected grace serves to be capped")
+	}
+
+	// The count is reset for a new response of the URI.
+	blob.StaleAt = c.now.Add(time.Second)
+	if !f.grace(nil, "ns", "g", "/a", blob, o) {
+		t.Fatal("expected a grace serve of the new response")
+	}
+
+	// The counts of ended grace windows are swept.
+	c.now = c.now.Add(graceSweepFreq + o.Grace)
+	f.grace(nil, "ns", "g", "/b", Item{StaleAt: c.now}, o)
+
+	var keys []interface{}
+	f.graceServes.Range(func(k, v interface{}) bool {
+		keys = append(keys, k)
+		return true
+	})
+	if len(keys) != 1 || keys[0] != "ns"+sep+"g"+sep+"/b" {
+		t.Fatalf("expected only the count of /b but got %q", keys)
+	}
+}
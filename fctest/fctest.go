@@ -0,0 +1,235 @@
+// Package fctest provides a test server for testing the cache configuration
+// of fastglue routes, for instance, that a route's responses are cached and
+// revalidated the way they're expected to be.
+//
+//	s := fctest.NewServer(t, nil)
+//	r := s.Cached("/orders", handler, &fastcache.Options{TTL: time.Minute, ETag: true}, "orders")
+//
+//	resp := r.ExpectMiss(t, "/orders")
+//	r.ExpectHit(t, "/orders")
+//	r.ExpectNotModified(t, "/orders", resp.Header.Get("ETag"))
+package fctest
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/valyala/fasthttp"
+	"github.com/zerodha/fastcache/v4"
+	"github.com/zerodha/fastglue"
+)
+
+const (
+	// NamespaceKey is the UserValue in which the server sets the namespace
+	// of requests. It's the NamespaceKey of routes that have neither a
+	// NamespaceKey nor a NamespaceHook.
+	NamespaceKey = "fctest_namespace"
+
+	// HeaderNamespace is the request header with the namespace of a request.
+	// Requests without it are in DefaultNamespace.
+	HeaderNamespace  = "X-Fctest-Namespace"
+	DefaultNamespace = "test"
+)
+
+// Server is a fastglue server with cached routes that listens on a random
+// local port.
+type Server struct {
+	Glue  *fastglue.Fastglue
+	Cache *fastcache.FastCache
+
+	srv    *fasthttp.Server
+	client http.Client
+	url    string
+	err    error
+	once   sync.Once
+}
+
+// NewServer returns a Server that caches in s and is shut down when the test
+// ends. If s is nil, an in-memory Store (NewStore()) is used. defaults are
+// passed to fastcache.New().
+func NewServer(t testing.TB, s fastcache.Store, defaults ...*fastcache.Options) *Server {
+	srv := New(s, defaults...)
+	t.Cleanup(func() {
+		_ = srv.Close()
+	})
+	return srv
+}
+
+// New returns a Server like NewServer() for servers that outlive a single
+// test, for instance, one that is set up in TestMain() or init(). It has to
+// be shut down with Close().
+func New(s fastcache.Store, defaults ...*fastcache.Options) *Server {
+	if s == nil {
+		s = NewStore()
+	}
+
+	srv := &Server{
+		Glue:  fastglue.NewGlue(),
+		Cache: fastcache.New(s, defaults...),
+	}
+	srv.Glue.Before(func(r *fastglue.Request) *fastglue.Request {
+		ns := string(r.RequestCtx.Request.Header.Peek(HeaderNamespace))
+		if ns == "" {
+			ns = DefaultNamespace
+		}
+		r.RequestCtx.SetUserValue(NamespaceKey, ns)
+		return r
+	})
+	return srv
+}
+
+// Start starts the server if it isn't running and returns its base URL.
+// Routes can't be added after the server is started.
+func (s *Server) Start() (string, error) {
+	s.once.Do(func() {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			s.err = fmt.Errorf("error starting server: %v", err)
+			return
+		}
+
+		s.srv = &fasthttp.Server{Handler: s.Glue.Handler()}
+		s.url = "http://" + ln.Addr().String()
+		go func() {
+			_ = s.srv.Serve(ln)
+		}()
+	})
+	return s.url, s.err
+}
+
+// URL returns the base URL of the server like Start(), failing the test if
+// the server can't be started.
+func (s *Server) URL(t testing.TB) string {
+	t.Helper()
+
+	u, err := s.Start()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return u
+}
+
+// Close shuts the server down if it's running.
+func (s *Server) Close() error {
+	if s.srv == nil {
+		return nil
+	}
+	s.client.CloseIdleConnections()
+	return s.srv.Shutdown()
+}
+
+// Route is a cached GET route that counts its handler's invocations.
+type Route struct {
+	srv   *Server
+	calls int32
+}
+
+// Cached registers a GET handler wrapped with the Cached() middleware. nil
+// Options are the defaults of the server. If the Options have neither a
+// NamespaceKey nor a NamespaceHook, the namespace is that of the server
+// (HeaderNamespace).
+func (s *Server) Cached(path string, h fastglue.FastRequestHandler, o *fastcache.Options, group string) *Route {
+	if o == nil {
+		o = s.Cache.Override(fastcache.Override{})
+	}
+	if o.NamespaceKey == "" && o.NamespaceHook == nil {
+		c := *o
+		c.NamespaceKey = NamespaceKey
+		o = &c
+	}
+
+	rt := &Route{srv: s}
+	s.Glue.GET(path, s.Cache.Cached(func(r *fastglue.Request) error {
+		atomic.AddInt32(&rt.calls, 1)
+		return h(r)
+	}, o, group))
+	return rt
+}
+
+// Calls returns the number of times the route's handler has been invoked.
+func (rt *Route) Calls() int {
+	return int(atomic.LoadInt32(&rt.calls))
+}
+
+// Response is a response received from the server.
+type Response struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+}
+
+// Get sends a GET request for a URI (path with an optional query string)
+// with the given headers to the server.
+func (s *Server) Get(t testing.TB, uri string, headers map[string]string) *Response {
+	t.Helper()
+
+	req, err := http.NewRequest(http.MethodGet, s.URL(t)+uri, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		t.Fatalf("error requesting %s: %v", uri, err)
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("error reading %s: %v", uri, err)
+	}
+	return &Response{StatusCode: resp.StatusCode, Header: resp.Header, Body: b}
+}
+
+// ExpectMiss requests a URI of the route and fails the test unless the
+// handler is invoked.
+func (rt *Route) ExpectMiss(t testing.TB, uri string) *Response {
+	t.Helper()
+
+	n := rt.Calls()
+	resp := rt.srv.Get(t, uri, nil)
+	if rt.Calls() == n {
+		t.Fatalf("%s: expected a miss but the response was served from the cache", uri)
+	}
+	return resp
+}
+
+// ExpectHit requests a URI of the route and fails the test unless the
+// response is served from the cache.
+func (rt *Route) ExpectHit(t testing.TB, uri string) *Response {
+	t.Helper()
+
+	n := rt.Calls()
+	resp := rt.srv.Get(t, uri, nil)
+	if rt.Calls() != n {
+		t.Fatalf("%s: expected a hit but the handler was invoked", uri)
+	}
+	if resp.StatusCode == http.StatusNotModified {
+		t.Fatalf("%s: expected a hit but got 304", uri)
+	}
+	return resp
+}
+
+// ExpectNotModified requests a URI of the route with If-None-Match and fails
+// the test unless a 304 is served from the cache.
+func (rt *Route) ExpectNotModified(t testing.TB, uri, etag string) *Response {
+	t.Helper()
+
+	n := rt.Calls()
+	resp := rt.srv.Get(t, uri, map[string]string{"If-None-Match": etag})
+	if resp.StatusCode != http.StatusNotModified {
+		t.Fatalf("%s: expected 304 but got %d", uri, resp.StatusCode)
+	}
+	if rt.Calls() != n {
+		t.Fatalf("%s: expected 304 from the cache but the handler was invoked", uri)
+	}
+	return resp
+}
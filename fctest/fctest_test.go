@@ -0,0 +1,106 @@
+package fctest
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/zerodha/fastcache/v4"
+	"github.com/zerodha/fastglue"
+)
+
+func TestServer(t *testing.T) {
+	var (
+		s    = NewServer(t, nil)
+		body = []byte("orders")
+		o    = &fastcache.Options{TTL: time.Minute, ETag: true, IncludeQueryString: true}
+	)
+	r := s.Cached("/orders", func(r *fastglue.Request) error {
+		return r.SendBytes(200, "text/plain", body)
+	}, o, "orders")
+
+	resp := r.ExpectMiss(t, "/orders")
+	if !bytes.Equal(resp.Body, body) {
+		t.Fatalf("expected '%s' but got '%s'", body, resp.Body)
+	}
+	if resp = r.ExpectHit(t, "/orders"); !bytes.Equal(resp.Body, body) {
+		t.Fatalf("expected '%s' from the cache but got '%s'", body, resp.Body)
+	}
+	r.ExpectNotModified(t, "/orders", resp.Header.Get("ETag"))
+	r.ExpectMiss(t, "/orders?page=2")
+
+	// Namespaces are isolated.
+	s.Get(t, "/orders", map[string]string{HeaderNamespace: "other"})
+	if r.Calls() != 3 {
+		t.Fatalf("expected 3 handler calls but got %d", r.Calls())
+	}
+
+	// Invalidation.
+	if err := s.Cache.DelGroup(DefaultNamespace, "ord*"); err != nil {
+		t.Fatal(err)
+	}
+	r.ExpectMiss(t, "/orders")
+}
+
+func TestStoreTTL(t *testing.T) {
+	s := NewStore()
+	if err := s.Put("ns", "g", "a", fastcache.Item{ETag: "a"}, time.Millisecond*10); err != nil {
+		t.Fatal(err)
+	}
+	if it, _ := s.Get("ns", "g", "a"); it.ETag != "a" {
+		t.Fatalf("expected the item but got %+v", it)
+	}
+
+	time.Sleep(time.Millisecond * 20)
+	if it, _ := s.Get("ns", "g", "a"); it.ETag != "" {
+		t.Fatalf("expected the item to expire but got %+v", it)
+	}
+}
+
+func TestStoreDelGroup(t *testing.T) {
+	s := NewStore()
+	for _, ns := range []string{"ns", "n*"} {
+		for _, g := range []string{"orders:1", "orders:2/a", "orders", "trades:1", `a\b`} {
+			if err := s.Put(ns, g, "a", fastcache.Item{ETag: "a"}, 0); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// * matches / like in Redis, the namespace isn't a pattern, and
+	// malformed patterns don't fail.
+	if err := s.DelGroup("n*", "orders:*", "trades:[2", `a\b`); err != nil {
+		t.Fatal(err)
+	}
+	for g, n := range map[string]int{"orders:1": 0, "orders:2/a": 0, "orders": 1, "trades:1": 1, `a\b`: 0} {
+		if l := s.Len("n*", g); l != n {
+			t.Fatalf("expected %d items in n*/%s but got %d", n, g, l)
+		}
+		if l := s.Len("ns", g); l != 1 {
+			t.Fatalf("expected ns/%s to be untouched but got %d items", g, l)
+		}
+	}
+}
+
+func TestMatchGlob(t *testing.T) {
+	for _, c := range []struct {
+		p, s string
+		ok   bool
+	}{
+		{"orders:*", "orders:1/a", true},
+		{"orders:?", "orders:1", true},
+		{"orders:?", "orders:12", false},
+		{"orders:[0-9]", "orders:5", true},
+		{"orders:[^0-9]", "orders:5", false},
+		{"orders:[ab]", "orders:b", true},
+		{`orders:\*`, "orders:*", true},
+		{`orders:\*`, "orders:1", false},
+		{"orders:[1", "orders:1", true},
+		{"*", "", true},
+		{"a**b", "axyb", true},
+	} {
+		if ok := matchGlob(c.p, c.s); ok != c.ok {
+			t.Errorf("matchGlob(%q, %q): expected %v but got %v", c.p, c.s, c.ok, ok)
+		}
+	}
+}
@@ -0,0 +1,24 @@
+module github.com/zerodha/fastcache/fctest/redistest
+
+go 1.18
+
+require (
+	github.com/alicebob/miniredis/v2 v2.33.0
+	github.com/redis/go-redis/v9 v9.5.1
+	github.com/zerodha/fastcache/stores/goredis/v9 v9.0.0
+	github.com/zerodha/fastcache/v4 v4.0.0
+)
+
+require (
+	github.com/alicebob/gopher-json v0.0.0-20200520072559-a9ecdc9d1d3a // indirect
+	github.com/andybalholm/brotli v1.1.0 // indirect
+	github.com/cespare/xxhash/v2 v2.3.0 // indirect
+	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
+	github.com/fasthttp/router v1.4.5 // indirect
+	github.com/klauspost/compress v1.17.6 // indirect
+	github.com/savsgio/gotils v0.0.0-20211223103454-d0aaa54c5899 // indirect
+	github.com/valyala/bytebufferpool v1.0.0 // indirect
+	github.com/valyala/fasthttp v1.52.0 // indirect
+	github.com/yuin/gopher-lua v1.1.1 // indirect
+	github.com/zerodha/fastglue v1.8.0 // indirect
+)
@@ -0,0 +1,64 @@
+// Package redistest provides fctest servers that cache in the goredis store
+// on an in-process Redis (miniredis), for testing routes along with the
+// keys and TTLs they're cached with in Redis.
+//
+//	s, rd := redistest.NewServer(t, goredis.Config{Prefix: "CACHE:"})
+//	r := s.Cached("/orders", handler, &fastcache.Options{TTL: time.Minute}, "orders")
+//
+//	r.ExpectMiss(t, "/orders")
+//	if rd.TTL("CACHE:test:orders") != time.Minute {
+//		...
+//	}
+//
+// It's a module of its own so that fctest doesn't depend on a Redis client.
+package redistest
+
+import (
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/zerodha/fastcache/stores/goredis/v9"
+	"github.com/zerodha/fastcache/v4"
+	"github.com/zerodha/fastcache/v4/fctest"
+)
+
+// Redis is an in-process Redis server whose keys can be inspected and
+// manipulated by tests with the embedded miniredis.Miniredis.
+type Redis struct {
+	*miniredis.Miniredis
+}
+
+// NewRedis starts a Redis that is shut down when the test ends.
+func NewRedis(t testing.TB) *Redis {
+	t.Helper()
+
+	mr, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("error starting redis: %v", err)
+	}
+	t.Cleanup(mr.Close)
+	return &Redis{Miniredis: mr}
+}
+
+// NewStore returns a goredis Store with the given config on the Redis that
+// is closed when the test ends.
+func (r *Redis) NewStore(t testing.TB, cfg goredis.Config) *goredis.Store {
+	cn := redis.NewClient(&redis.Options{Addr: r.Addr()})
+	s := goredis.New(cfg, cn)
+	t.Cleanup(func() {
+		_ = s.Close()
+		_ = cn.Close()
+	})
+	return s
+}
+
+// NewServer returns an fctest.Server (fctest.NewServer()) that caches in a
+// goredis Store with the given config on a new Redis, along with the Redis.
+// defaults are passed to fastcache.New().
+func NewServer(t testing.TB, cfg goredis.Config, defaults ...*fastcache.Options) (*fctest.Server, *Redis) {
+	t.Helper()
+
+	rd := NewRedis(t)
+	return fctest.NewServer(t, rd.NewStore(t, cfg), defaults...), rd
+}
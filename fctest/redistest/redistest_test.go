@@ -0,0 +1,32 @@
+package redistest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/zerodha/fastcache/stores/goredis/v9"
+	"github.com/zerodha/fastcache/v4"
+	"github.com/zerodha/fastglue"
+)
+
+func TestServer(t *testing.T) {
+	s, rd := NewServer(t, goredis.Config{Prefix: "CACHE:"})
+	r := s.Cached("/orders", func(r *fastglue.Request) error {
+		return r.SendBytes(200, "text/plain", []byte("orders"))
+	}, &fastcache.Options{TTL: time.Minute}, "orders")
+
+	r.ExpectMiss(t, "/orders")
+	r.ExpectHit(t, "/orders")
+	if ttl := rd.TTL("CACHE:test:orders"); ttl != time.Minute {
+		t.Fatalf("expected TTL %v but got %v", time.Minute, ttl)
+	}
+
+	// Servers don't share Redis.
+	other, ord := NewServer(t, goredis.Config{Prefix: "CACHE:"})
+	other.Cached("/orders", func(r *fastglue.Request) error {
+		return r.SendBytes(200, "text/plain", []byte("orders"))
+	}, &fastcache.Options{TTL: time.Minute}, "orders").ExpectMiss(t, "/orders")
+	if ord.Addr() == rd.Addr() {
+		t.Fatal("expected the servers to have their own Redis")
+	}
+}
@@ -0,0 +1,177 @@
+package fctest
+
+import (
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zerodha/fastcache/v4"
+)
+
+// Store is an in-memory fastcache.Store for tests. Items expire with their
+// TTLs and groups can be deleted with glob patterns like in the Redis stores.
+type Store struct {
+	// groups are the items of namespace->group->uri.
+	groups map[string]map[string]storeItem
+	mu     sync.Mutex
+}
+
+type storeItem struct {
+	it  fastcache.Item
+	exp time.Time
+}
+
+// NewStore returns an empty in-memory Store.
+func NewStore() *Store {
+	return &Store{groups: make(map[string]map[string]storeItem)}
+}
+
+// Get gets the Item of a URI. Items that don't exist are returned empty.
+func (s *Store) Get(namespace, group, uri string) (fastcache.Item, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i, ok := s.groups[namespace+"\x00"+group][uri]
+	if !ok || (!i.exp.IsZero() && !time.Now().Before(i.exp)) {
+		return fastcache.Item{}, nil
+	}
+	return i.it, nil
+}
+
+// Put puts the Item of a URI. A ttl of 0 never expires.
+func (s *Store) Put(namespace, group, uri string, it fastcache.Item, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := namespace + "\x00" + group
+	g, ok := s.groups[key]
+	if !ok {
+		g = make(map[string]storeItem)
+		s.groups[key] = g
+	}
+
+	i := storeItem{it: it}
+	if ttl > 0 {
+		i.exp = time.Now().Add(ttl)
+	}
+	g[uri] = i
+	return nil
+}
+
+// Del deletes the Item of a URI.
+func (s *Store) Del(namespace, group, uri string) error {
+	s.mu.Lock()
+	delete(s.groups[namespace+"\x00"+group], uri)
+	s.mu.Unlock()
+	return nil
+}
+
+// DelGroup deletes groups, which can be glob patterns (eg: orders:*) with
+// the semantics of Redis' KEYS and SCAN, where * also matches /.
+func (s *Store) DelGroup(namespace string, group ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key := range s.groups {
+		ns, g, _ := strings.Cut(key, "\x00")
+		if ns != namespace {
+			continue
+		}
+		for _, p := range group {
+			// Like in the Redis stores, groups without glob characters
+			// are deleted as-is.
+			if p == g || (strings.ContainsAny(p, "*?[") && matchGlob(p, g)) {
+				delete(s.groups, key)
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// matchGlob reports whether s matches the glob pattern p. It is a port of
+// Redis' stringmatchlen(), so malformed patterns (eg: an unterminated [)
+// match leniently like they do in Redis instead of failing.
+func matchGlob(p, s string) bool {
+	for len(p) > 0 && len(s) > 0 {
+		switch p[0] {
+		case '*':
+			for len(p) > 1 && p[1] == '*' {
+				p = p[1:]
+			}
+			if len(p) == 1 {
+				return true
+			}
+			for ; len(s) > 0; s = s[1:] {
+				if matchGlob(p[1:], s) {
+					return true
+				}
+			}
+			return false
+
+		case '?':
+			s = s[1:]
+
+		case '[':
+			p = p[1:]
+			not := len(p) > 0 && p[0] == '^'
+			if not {
+				p = p[1:]
+			}
+
+			match := false
+			for ; len(p) > 0 && p[0] != ']'; p = p[1:] {
+				switch {
+				case p[0] == '\\' && len(p) >= 2:
+					p = p[1:]
+					match = match || p[0] == s[0]
+				case len(p) >= 3 && p[1] == '-':
+					lo, hi := p[0], p[2]
+					if lo > hi {
+						lo, hi = hi, lo
+					}
+					match = match || (s[0] >= lo && s[0] <= hi)
+					p = p[2:]
+				default:
+					match = match || p[0] == s[0]
+				}
+			}
+			if match == not {
+				return false
+			}
+			s = s[1:]
+
+			// Skip the closing ], if any.
+			if len(p) > 0 {
+				p = p[1:]
+			}
+			continue
+
+		case '\\':
+			if len(p) >= 2 {
+				p = p[1:]
+			}
+			fallthrough
+
+		default:
+			if p[0] != s[0] {
+				return false
+			}
+			s = s[1:]
+		}
+		p = p[1:]
+	}
+
+	if len(s) == 0 {
+		p = strings.TrimLeft(p, "*")
+	}
+	return len(p) == 0 && len(s) == 0
+}
+
+// Len returns the number of Items in a namespace->group, including the
+// expired ones that haven't been overwritten.
+func (s *Store) Len(namespace, group string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.groups[namespace+"\x00"+group])
+}
@@ -3,6 +3,8 @@ module github.com/zerodha/fastcache/v4
 go 1.18
 
 require (
+	github.com/cespare/xxhash/v2 v2.3.0
+	github.com/klauspost/compress v1.15.0
 	github.com/valyala/fasthttp v1.34.0
 	github.com/zerodha/fastglue v1.7.1
 )
@@ -11,7 +13,6 @@ require (
 	github.com/andybalholm/brotli v1.0.4 // indirect
 	github.com/davecgh/go-spew v1.1.1 // indirect
 	github.com/fasthttp/router v1.4.5 // indirect
-	github.com/klauspost/compress v1.15.0 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/savsgio/gotils v0.0.0-20211223103454-d0aaa54c5899 // indirect
 	github.com/stretchr/testify v1.6.1 // indirect
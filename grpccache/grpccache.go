@@ -0,0 +1,165 @@
+// Package grpccache provides a gRPC unary server interceptor that caches
+// serialized responses in fastcache stores, just like the HTTP middleware.
+package grpccache
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"log"
+	"time"
+
+	"github.com/zerodha/fastcache/v4"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+)
+
+const contentType = "application/grpc+proto"
+
+// Method represents the cache configuration for a single gRPC method.
+type Method struct {
+	// Group is the cache group the method's responses are stored under,
+	// unless the request has a group in its metadata (Config.GroupKey).
+	// The group can be purged with FastCache.DelGroup().
+	Group string
+
+	// TTL for the cached responses.
+	TTL time.Duration
+
+	// New returns a new, empty response message for the method into which
+	// cached responses are unmarshalled.
+	New func() proto.Message
+}
+
+// Config represents the interceptor configuration.
+type Config struct {
+	// NamespaceKey is the incoming metadata key, the value of which is used
+	// as the cache namespace, for instance, a user ID. If the key is not
+	// present in the request metadata, the response is not cached.
+	NamespaceKey string
+
+	// GroupKey, if set, is the incoming metadata key, the value of which is
+	// used as the cache group instead of the method's Group, for instance,
+	// a portfolio ID. If the key is not present, the method's Group is used.
+	GroupKey string
+
+	// Methods is the map of full method names (/package.Service/Method)
+	// to cache. Methods that are not in the map are not cached.
+	Methods map[string]Method
+
+	Logger *log.Logger
+}
+
+// UnaryServerInterceptor returns an interceptor that caches the responses of
+// the configured methods in the FastCache's store. Responses are keyed by the
+// method and the hash of the serialized request.
+func UnaryServerInterceptor(f *fastcache.FastCache, cfg Config) grpc.UnaryServerInterceptor {
+	if cfg.Logger == nil {
+		cfg.Logger = log.New(io.Discard, "", 0)
+	}
+
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, h grpc.UnaryHandler) (interface{}, error) {
+		m, ok := cfg.Methods[info.FullMethod]
+		if !ok {
+			return h(ctx, req)
+		}
+
+		namespace := getMetadata(ctx, cfg.NamespaceKey)
+		if namespace == "" {
+			cfg.Logger.Printf("no namespace found in metadata for key '%s'", cfg.NamespaceKey)
+			return h(ctx, req)
+		}
+
+		group := m.Group
+		if cfg.GroupKey != "" {
+			if g := getMetadata(ctx, cfg.GroupKey); g != "" {
+				group = g
+			}
+		}
+
+		msg, ok := req.(proto.Message)
+		if !ok {
+			return h(ctx, req)
+		}
+		uri, err := requestKey(info.FullMethod, msg)
+		if err != nil {
+			cfg.Logger.Printf("error marshalling request: %v", err)
+			return h(ctx, req)
+		}
+
+		// If the handler ran in this call (a miss), its response is returned
+		// as-is instead of being unmarshalled back from the serialized blob.
+		var res interface{}
+		it, err := f.GetOrFill(ctx, namespace, group, uri, m.TTL, func() (fastcache.Item, error) {
+			r, err := h(ctx, req)
+			if err != nil {
+				return fastcache.Item{}, err
+			}
+			res = r
+
+			// Responses that aren't proto messages aren't cached (an Item
+			// without a ContentType). Those that are cached always have a
+			// ContentType, even if they serialize to zero bytes.
+			pm, ok := r.(proto.Message)
+			if !ok {
+				return fastcache.Item{}, nil
+			}
+			b, err := proto.Marshal(pm)
+			if err != nil {
+				return fastcache.Item{}, err
+			}
+			return fastcache.Item{ContentType: contentType, Blob: b}, nil
+		})
+		if res != nil {
+			if err != nil {
+				cfg.Logger.Printf("error caching response: %v", err)
+			}
+			return res, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// The call was coalesced with one whose response wasn't cached.
+		if it.ContentType == "" {
+			return h(ctx, req)
+		}
+
+		out := m.New()
+		if err := proto.Unmarshal(it.Blob, out); err != nil {
+			cfg.Logger.Printf("error unmarshalling cached response: %v", err)
+			return h(ctx, req)
+		}
+		return out, nil
+	}
+}
+
+// getMetadata returns the first value of the given key in the incoming
+// request metadata.
+func getMetadata(ctx context.Context, key string) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+	if v := md.Get(key); len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+// requestKey returns the cache key for a request, which is the md5 hash
+// of the method name and the deterministically serialized request.
+func requestKey(method string, req proto.Message) (string, error) {
+	b, err := proto.MarshalOptions{Deterministic: true}.Marshal(req)
+	if err != nil {
+		return "", err
+	}
+
+	h := md5.New()
+	h.Write([]byte(method))
+	h.Write([]byte{0})
+	h.Write(b)
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
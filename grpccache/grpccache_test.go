@@ -0,0 +1,229 @@
+package grpccache
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/zerodha/fastcache/v4"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// mapStore is a minimal in-memory fastcache.Store.
+type mapStore struct {
+	mu    sync.Mutex
+	items map[string]fastcache.Item
+}
+
+func (s *mapStore) Get(ns, group, uri string) (fastcache.Item, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.items[ns+group+uri], nil
+}
+
+func (s *mapStore) Put(ns, group, uri string, it fastcache.Item, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.items[ns+group+uri] = it
+	return nil
+}
+
+func (s *mapStore) Del(ns, group, uri string) error           { return nil }
+func (s *mapStore) DelGroup(ns string, group ...string) error { return nil }
+
+func TestUnaryServerInterceptor(t *testing.T) {
+	var (
+		st    = &mapStore{items: map[string]fastcache.Item{}}
+		fc    = fastcache.New(st)
+		calls int
+	)
+
+	icpt := UnaryServerInterceptor(fc, Config{
+		NamespaceKey: "user-id",
+		Methods: map[string]Method{
+			"/test.Svc/Echo": {
+				Group: "echo",
+				TTL:   time.Minute,
+				New:   func() proto.Message { return &wrapperspb.StringValue{} },
+			},
+		},
+	})
+
+	h := func(ctx context.Context, req interface{}) (interface{}, error) {
+		calls++
+		switch req.(*wrapperspb.StringValue).Value {
+		case "fail":
+			return nil, errors.New("failed")
+		case "empty":
+			// Serializes to zero bytes.
+			return &wrapperspb.StringValue{}, nil
+		case "raw":
+			return "raw", nil
+		}
+		return wrapperspb.String("hello " + req.(*wrapperspb.StringValue).Value), nil
+	}
+
+	var (
+		info = &grpc.UnaryServerInfo{FullMethod: "/test.Svc/Echo"}
+		ctx  = metadata.NewIncomingContext(context.Background(), metadata.Pairs("user-id", "123"))
+	)
+	call := func(ctx context.Context, info *grpc.UnaryServerInfo, val string) (string, error) {
+		res, err := icpt(ctx, wrapperspb.String(val), info, h)
+		if err != nil {
+			return "", err
+		}
+		return res.(*wrapperspb.StringValue).Value, nil
+	}
+
+	// Miss and then hit.
+	for i := 0; i < 2; i++ {
+		v, err := call(ctx, info, "a")
+		if err != nil || v != "hello a" {
+			t.Fatalf("expected 'hello a' but got '%s': %v", v, err)
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("expected 1 handler call but got %d", calls)
+	}
+
+	// Different request.
+	if v, _ := call(ctx, info, "b"); v != "hello b" || calls != 2 {
+		t.Fatalf("expected uncached 'hello b' but got '%s' (%d calls)", v, calls)
+	}
+
+	// Errors are not cached.
+	for i := 0; i < 2; i++ {
+		if _, err := call(ctx, info, "fail"); err == nil {
+			t.Fatal("expected error")
+		}
+	}
+	if calls != 4 {
+		t.Fatalf("expected 4 handler calls but got %d", calls)
+	}
+
+	// Responses that serialize to zero bytes are cached.
+	for i := 0; i < 2; i++ {
+		if v, err := call(ctx, info, "empty"); err != nil || v != "" {
+			t.Fatalf("expected an empty value but got '%s': %v", v, err)
+		}
+	}
+	if calls != 5 {
+		t.Fatalf("expected 5 handler calls but got %d", calls)
+	}
+
+	// Responses that aren't proto messages are not cached.
+	n := len(st.items)
+	for i := 0; i < 2; i++ {
+		if res, err := icpt(ctx, wrapperspb.String("raw"), info, h); err != nil || res != "raw" {
+			t.Fatalf("expected 'raw' but got '%v': %v", res, err)
+		}
+	}
+	if calls != 7 || len(st.items) != n {
+		t.Fatalf("expected 7 handler calls and no stored items but got %d, %d", calls, len(st.items)-n)
+	}
+
+	// No namespace in the metadata and unconfigured methods are not cached.
+	calls = 0
+	call(context.Background(), info, "a")
+	call(ctx, &grpc.UnaryServerInfo{FullMethod: "/test.Svc/Other"}, "a")
+	if calls != 2 {
+		t.Fatalf("expected 2 handler calls but got %d", calls)
+	}
+}
+
+func TestGroupKey(t *testing.T) {
+	var (
+		st   = &mapStore{items: map[string]fastcache.Item{}}
+		icpt = UnaryServerInterceptor(fastcache.New(st), Config{
+			NamespaceKey: "user-id",
+			GroupKey:     "group",
+			Methods: map[string]Method{
+				"/test.Svc/Echo": {
+					Group: "echo",
+					TTL:   time.Minute,
+					New:   func() proto.Message { return &wrapperspb.StringValue{} },
+				},
+			},
+		})
+		info = &grpc.UnaryServerInfo{FullMethod: "/test.Svc/Echo"}
+		h    = func(ctx context.Context, req interface{}) (interface{}, error) {
+			return req, nil
+		}
+	)
+
+	// The group in the metadata overrides the method's group.
+	for _, md := range []metadata.MD{metadata.Pairs("user-id", "123", "group", "portfolio"), metadata.Pairs("user-id", "123")} {
+		if _, err := icpt(metadata.NewIncomingContext(context.Background(), md), wrapperspb.String("a"), info, h); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	uri, _ := requestKey(info.FullMethod, wrapperspb.String("a"))
+	for _, g := range []string{"portfolio", "echo"} {
+		if _, ok := st.items["123"+g+uri]; !ok {
+			t.Fatalf("expected the response to be cached under '%s'", g)
+		}
+	}
+}
+
+func TestCoalescedUncached(t *testing.T) {
+	var (
+		icpt = UnaryServerInterceptor(fastcache.New(&mapStore{items: map[string]fastcache.Item{}}), Config{
+			NamespaceKey: "user-id",
+			Methods: map[string]Method{
+				"/test.Svc/Echo": {
+					Group: "echo",
+					TTL:   time.Minute,
+					New:   func() proto.Message { return &wrapperspb.StringValue{} },
+				},
+			},
+		})
+		info    = &grpc.UnaryServerInfo{FullMethod: "/test.Svc/Echo"}
+		ctx     = metadata.NewIncomingContext(context.Background(), metadata.Pairs("user-id", "123"))
+		calls   int32
+		started = make(chan struct{})
+		release = make(chan struct{})
+	)
+
+	// The first call blocks until the second one is waiting on it.
+	h := func(ctx context.Context, req interface{}) (interface{}, error) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			close(started)
+			<-release
+		}
+		return "raw", nil
+	}
+
+	var (
+		wg  sync.WaitGroup
+		res = make([]interface{}, 2)
+	)
+	for i := 0; i < 2; i++ {
+		if i == 1 {
+			<-started
+		}
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			res[i], _ = icpt(ctx, wrapperspb.String("a"), info, h)
+		}(i)
+	}
+	time.Sleep(time.Millisecond * 50)
+	close(release)
+	wg.Wait()
+
+	// The response that wasn't cached isn't served as an empty message to
+	// the coalesced call.
+	for i, r := range res {
+		if r != "raw" {
+			t.Fatalf("%d: expected 'raw' but got '%v'", i, r)
+		}
+	}
+}
@@ -0,0 +1,52 @@
+package fastcache
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"hash"
+	"hash/fnv"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// KeyHasher returns a new hash.Hash with which cache keys are hashed
+// (Options.KeyHasher). Keys don't need cryptographic hashes.
+type KeyHasher func() hash.Hash
+
+// MD5Hasher hashes cache keys with MD5. It's the default, so that the keys
+// of routes that don't set any of the newer key options (eg: the query
+// options of IncludeQueryString, IncludeHeaders) remain those of previous
+// versions.
+func MD5Hasher() hash.Hash {
+	return md5.New()
+}
+
+// FNVHasher hashes cache keys with the 64-bit FNV-1a hash.
+func FNVHasher() hash.Hash {
+	return fnv.New64a()
+}
+
+// XXHasher hashes cache keys with the 64-bit xxHash, which is the fastest.
+func XXHasher() hash.Hash {
+	return xxhash.New()
+}
+
+// newHash returns a new hash.Hash for cache keys.
+func (o *Options) newHash() hash.Hash {
+	if o.KeyHasher == nil {
+		return md5.New()
+	}
+	return o.KeyHasher()
+}
+
+// hashKey returns the hex encoded hash of a cache key, or the key itself
+// with RawKeys if it fits in MaxRawKeyLength, which is set by compile().
+func (o *Options) hashKey(b []byte) string {
+	if o.RawKeys && len(b) <= o.MaxRawKeyLength {
+		return string(b)
+	}
+
+	h := o.newHash()
+	h.Write(b)
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,177 @@
+package fastcache
+
+import (
+	"crypto/md5"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+	"github.com/zerodha/fastglue"
+)
+
+// InvalidationRequest is the JSON body accepted by InvalidationHandler().
+type InvalidationRequest struct {
+	Purges []Purge `json:"purges"`
+}
+
+// Purge represents the cache to purge in a namespace.
+type Purge struct {
+	Namespace string `json:"namespace"`
+
+	// All purges everything in the namespace. The store has to implement
+	// NamespacePurger.
+	All bool `json:"all"`
+
+	// Groups to purge. Groups can be glob patterns on stores that support them.
+	Groups []string `json:"groups"`
+
+	// URIs to purge.
+	URIs []PurgeURI `json:"uris"`
+
+	// Tags are surrogate keys to purge from the CDN (SetCDN()), for
+	// instance, those of responses tagged by the application. They're
+	// rejected if there's no CDN.
+	Tags []string `json:"tags"`
+}
+
+// PurgeURI is a single cached URI to purge.
+type PurgeURI struct {
+	Group string `json:"group"`
+
+	// URI is the request path, for instance, /orders, or for routes that
+	// have IncludeQueryString enabled, the absolute URL with the host and
+	// the query string, for instance, http://api.example.com/orders?page=2.
+	// Keys that include request headers can't be purged by URI.
+	URI string `json:"uri"`
+}
+
+// InvalidationHandler returns a fastglue handler for POST requests that
+// purges the namespaces, groups, URIs and CDN tags listed in an
+// InvalidationRequest JSON body. This allows external systems (CMS,
+// back-office tools etc.) to invalidate caches without custom handlers in
+// every service. The keys of the URIs are computed with o, which should be
+// the Options of the routes they're cached by. nil Options are the defaults.
+//
+// Requests are authenticated with the `Authorization: Bearer <secret>` header.
+// If secret is empty, all requests are rejected.
+func (f *FastCache) InvalidationHandler(secret string, o *Options) fastglue.FastRequestHandler {
+	o = f.options(o).compile()
+
+	return func(r *fastglue.Request) error {
+		if !validSecret(r.RequestCtx.Request.Header.Peek("Authorization"), secret) {
+			return r.SendErrorEnvelope(fasthttp.StatusUnauthorized, "invalid secret", nil, "")
+		}
+
+		var req InvalidationRequest
+		if err := json.Unmarshal(r.RequestCtx.PostBody(), &req); err != nil {
+			return r.SendErrorEnvelope(fasthttp.StatusBadRequest, "invalid JSON: "+err.Error(), nil, "")
+		}
+		for _, p := range req.Purges {
+			if p.Namespace == "" {
+				return r.SendErrorEnvelope(fasthttp.StatusBadRequest, "empty `namespace`", nil, "")
+			}
+			if len(p.Tags) > 0 && f.cdnOptions() == nil {
+				return r.SendErrorEnvelope(fasthttp.StatusBadRequest, "`tags` require a CDN", nil, "")
+			}
+			for _, u := range p.URIs {
+				// The keys of URIs with query strings have the host.
+				if !strings.Contains(u.URI, "://") && strings.IndexByte(u.URI, '?') >= 0 {
+					return r.SendErrorEnvelope(fasthttp.StatusBadRequest, "`uri` with a query string has to be an absolute URL", nil, "")
+				}
+			}
+		}
+
+		for _, p := range req.Purges {
+			if err := f.purge(p, o); err != nil {
+				return r.SendErrorEnvelope(fasthttp.StatusInternalServerError, "error purging cache: "+err.Error(), nil, "")
+			}
+		}
+
+		return r.SendEnvelope(true)
+	}
+}
+
+// purge purges the cache for a single Purge. The keys of URIs are computed
+// with o.
+func (f *FastCache) purge(p Purge, o *Options) error {
+	if len(p.Tags) > 0 {
+		if err := f.cdnOptions().purgeKeys(p.Tags); err != nil {
+			return err
+		}
+	}
+
+	if p.All {
+		return f.PurgeNamespace(p.Namespace)
+	}
+
+	if len(p.Groups) > 0 {
+		if err := f.DelGroup(p.Namespace, p.Groups...); err != nil {
+			return err
+		}
+	}
+
+	for _, u := range p.URIs {
+		if err := f.Del(p.Namespace, u.Group, o.hashKey(rawURI(u.URI, o))); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// HashURI returns the cache key of a request URI the way Cached() computes
+// it, that is, md5(path) for a path, or for an absolute URL
+// (IncludeQueryString), md5(scheme://host/path?query_string), without
+// IncludeHeaders, IncludeCookies and query options, with the default
+// KeyHasher. Paths with query strings aren't the keys of any route, as those
+// of IncludeQueryString routes have the host, and are hashed as they are.
+func HashURI(uri string) string {
+	hash := md5.Sum(rawURI(uri, &Options{}))
+	return hex.EncodeToString(hash[:])
+}
+
+// RawURI returns the cache key of a request URI like HashURI() does, but
+// for routes with Options.RawKeys, that is, the path or the URL itself.
+func RawURI(uri string) string {
+	return string(rawURI(uri, &Options{}))
+}
+
+// rawURI returns the unhashed cache key of a request URI as described by
+// RawURI() with the path normalization and the query options of o.
+func rawURI(uri string, o *Options) []byte {
+	if !strings.Contains(uri, "://") {
+		if strings.IndexByte(uri, '?') >= 0 {
+			return []byte(uri)
+		}
+		return o.NormalizePath.normalize([]byte(uri))
+	}
+
+	// Absolute URLs are keyed like the requests of IncludeQueryString
+	// routes.
+	u := fasthttp.AcquireURI()
+	defer fasthttp.ReleaseURI(u)
+
+	if err := u.Parse(nil, []byte(uri)); err != nil {
+		return []byte(uri)
+	}
+	return uriKey(u, o)
+}
+
+// validDebugSecret checks an X-Cache-Debug header against the secret in
+// constant time.
+func validDebugSecret(header []byte, secret string) bool {
+	return len(header) > 0 && subtle.ConstantTimeCompare(header, []byte(secret)) == 1
+}
+
+// validSecret checks an Authorization header against the secret in
+// constant time.
+func validSecret(header []byte, secret string) bool {
+	const prefix = "Bearer "
+	if secret == "" || len(header) <= len(prefix) || !strings.EqualFold(string(header[:len(prefix)]), prefix) {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare(header[len(prefix):], []byte(secret)) == 1
+}
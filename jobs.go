@@ -0,0 +1,130 @@
+package fastcache
+
+import (
+	"errors"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"github.com/zerodha/fastglue"
+)
+
+// JobStats are the run stats of a store's background job such as an LRU
+// janitor or an async writer.
+type JobStats struct {
+	// Runs is the number of times the job has run.
+	Runs int64 `json:"runs"`
+
+	// LastRun is the time at which the job last ran.
+	LastRun time.Time `json:"last_run"`
+
+	// Items is the total number of items processed by the job, for instance,
+	// the number of items evicted or writes committed.
+	Items int64 `json:"items"`
+
+	// Errors is the number of failed runs and LastError is the last error.
+	Errors    int64  `json:"errors"`
+	LastError string `json:"last_error"`
+
+	// LastSuccess is the time at which the job last ran successfully. For
+	// jobs with queues, a growing time since LastSuccess while items are
+	// Queued means that the job is falling behind.
+	LastSuccess time.Time `json:"last_success"`
+
+	// LastItems is the number of items processed in the last successful run,
+	// for instance, the size of the last committed batch, and MaxItems is the
+	// largest.
+	LastItems int64 `json:"last_items"`
+	MaxItems  int64 `json:"max_items"`
+
+	// Queued is the number of items waiting for the job, for instance, the
+	// uncommitted writes of an async writer, and QueueSize is the capacity of
+	// the queue. They're only set for jobs with queues.
+	Queued    int64 `json:"queued"`
+	QueueSize int64 `json:"queue_size"`
+}
+
+// Record records a run of the job that processed n items.
+func (j *JobStats) Record(t time.Time, n int, err error) {
+	j.Runs++
+	j.LastRun = t
+	j.Items += int64(n)
+	if err != nil {
+		j.Errors++
+		j.LastError = err.Error()
+		return
+	}
+
+	j.LastSuccess = t
+	j.LastItems = int64(n)
+	if j.LastItems > j.MaxItems {
+		j.MaxItems = j.LastItems
+	}
+}
+
+// JobRunner is an optional interface that a Store with background jobs can
+// implement to expose the jobs' run stats and to allow running them manually,
+// for instance, during incidents.
+type JobRunner interface {
+	// JobStats returns the run stats of the store's jobs by their names.
+	JobStats() map[string]JobStats
+
+	// RunJob runs a job immediately. ErrUnknownJob is returned if there's
+	// no such job.
+	RunJob(name string) error
+}
+
+// ErrUnknownJob is returned by JobRunner.RunJob() for unknown jobs.
+var ErrUnknownJob = errors.New("fastcache: unknown job")
+
+// JobStats returns the run stats of the Store's background jobs. The store
+// has to implement JobRunner, or ErrNotSupported is returned.
+func (f *FastCache) JobStats() (map[string]JobStats, error) {
+	j, ok := f.s.(JobRunner)
+	if !ok {
+		return nil, ErrNotSupported
+	}
+	return j.JobStats(), nil
+}
+
+// RunJob runs one of the Store's background jobs immediately. The store has
+// to implement JobRunner, or ErrNotSupported is returned.
+func (f *FastCache) RunJob(name string) error {
+	j, ok := f.s.(JobRunner)
+	if !ok {
+		return ErrNotSupported
+	}
+	return j.RunJob(name)
+}
+
+// JobsHandler returns a fastglue handler for the Store's background jobs.
+// GET requests return the jobs' run stats and POST requests with the `job`
+// param run a job immediately. Requests are authenticated like
+// InvalidationHandler().
+func (f *FastCache) JobsHandler(secret string) fastglue.FastRequestHandler {
+	return func(r *fastglue.Request) error {
+		if !validSecret(r.RequestCtx.Request.Header.Peek("Authorization"), secret) {
+			return r.SendErrorEnvelope(fasthttp.StatusUnauthorized, "invalid secret", nil, "")
+		}
+
+		if !r.RequestCtx.IsPost() {
+			stats, err := f.JobStats()
+			if err != nil {
+				return r.SendErrorEnvelope(fasthttp.StatusNotImplemented, err.Error(), nil, "")
+			}
+			return r.SendEnvelope(stats)
+		}
+
+		name := string(r.RequestCtx.FormValue("job"))
+		if err := f.RunJob(name); err != nil {
+			switch err {
+			case ErrUnknownJob:
+				return r.SendErrorEnvelope(fasthttp.StatusBadRequest, "unknown `job`", nil, "")
+			case ErrNotSupported:
+				return r.SendErrorEnvelope(fasthttp.StatusNotImplemented, err.Error(), nil, "")
+			}
+			return r.SendErrorEnvelope(fasthttp.StatusInternalServerError, "error running job: "+err.Error(), nil, "")
+		}
+
+		return r.SendEnvelope(true)
+	}
+}
@@ -0,0 +1,170 @@
+package fastcache
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrStoreBusy is returned when a store operation couldn't start within the
+// queue timeout set with LimitStore().
+var ErrStoreBusy = errors.New("fastcache: store busy")
+
+// limiter is a semaphore that bounds the number of outstanding store
+// operations.
+type limiter struct {
+	sem     chan struct{}
+	timeout time.Duration
+}
+
+// LimitStore limits the number of concurrent operations on the store on the
+// request path (Get, Put and the optional interfaces such as
+// MetaGetter.GetBlob and HitCounter.IncrHits) to max, protecting the store
+// (for instance, Redis) from connection storms when traffic spikes.
+// Operations beyond the limit wait in a queue for up to timeout, after which
+// they fail with ErrStoreBusy. The middleware then serves the request from
+// the handler without caching it, which keeps pool exhaustion errors from
+// cascading. A timeout of 0 fails immediately. max < 1 removes the limit.
+// It can be changed at runtime. Operations in flight complete within the
+// previous limit.
+//
+// Deletions (Del(), DelGroup() and PurgeNamespace()) are deliberately not
+// limited, as failing an invalidation with ErrStoreBusy would leave stale
+// responses cached.
+func (f *FastCache) LimitStore(max int, timeout time.Duration) {
+	var l *limiter
+	if max >= 1 {
+		l = &limiter{sem: make(chan struct{}, max), timeout: timeout}
+	}
+	f.lim.Store(l)
+}
+
+// acquire acquires a slot for a store operation from the current limiter,
+// which is returned. Its release() has to be called after the operation if
+// it succeeds.
+func (f *FastCache) acquire() (*limiter, error) {
+	l, _ := f.lim.Load().(*limiter)
+	if l == nil {
+		return nil, nil
+	}
+
+	select {
+	case l.sem <- struct{}{}:
+		return l, nil
+	default:
+	}
+	if l.timeout <= 0 {
+		return nil, ErrStoreBusy
+	}
+
+	t := time.NewTimer(l.timeout)
+	defer t.Stop()
+	select {
+	case l.sem <- struct{}{}:
+		return l, nil
+	case <-t.C:
+		return nil, ErrStoreBusy
+	}
+}
+
+// release releases a slot acquired with acquire(). It's a no-op on a nil
+// limiter.
+func (l *limiter) release() {
+	if l != nil {
+		<-l.sem
+	}
+}
+
+// get gets an item from the store within the store limit.
+func (f *FastCache) get(namespace, group, uri string) (Item, error) {
+	l, err := f.acquire()
+	if err != nil {
+		return Item{}, err
+	}
+	defer l.release()
+
+	return f.s.Get(namespace, group, uri)
+}
+
+// getMeta gets an item's metadata from the store within the store limit.
+func (f *FastCache) getMeta(mg MetaGetter, namespace, group, uri string) (Item, error) {
+	l, err := f.acquire()
+	if err != nil {
+		return Item{}, err
+	}
+	defer l.release()
+
+	return mg.GetMeta(namespace, group, uri)
+}
+
+// getBlob gets an item's blob from the store within the store limit.
+func (f *FastCache) getBlob(mg MetaGetter, namespace, group, uri string) ([]byte, error) {
+	l, err := f.acquire()
+	if err != nil {
+		return nil, err
+	}
+	defer l.release()
+
+	return mg.GetBlob(namespace, group, uri)
+}
+
+// getRange gets a byte range of an item's blob from the store within the
+// store limit.
+func (f *FastCache) getRange(rg RangeGetter, namespace, group, uri string, offset, n int64) ([]byte, int64, error) {
+	l, err := f.acquire()
+	if err != nil {
+		return nil, 0, err
+	}
+	defer l.release()
+
+	return rg.GetRange(namespace, group, uri, offset, n)
+}
+
+// incrHits increments an item's hit count in the store within the store
+// limit.
+func (f *FastCache) incrHits(hc HitCounter, namespace, group, uri string) (int64, error) {
+	l, err := f.acquire()
+	if err != nil {
+		return 0, err
+	}
+	defer l.release()
+
+	return hc.IncrHits(namespace, group, uri)
+}
+
+// getTTL gets an item's remaining TTL from the store within the store limit.
+func (f *FastCache) getTTL(g TTLGetter, namespace, group, uri string) (time.Duration, error) {
+	l, err := f.acquire()
+	if err != nil {
+		return 0, err
+	}
+	defer l.release()
+
+	return g.TTL(namespace, group, uri)
+}
+
+// touchTTL extends an item's TTL in the store within the store limit.
+func (f *FastCache) touchTTL(t Toucher, namespace, group, uri string, ttl time.Duration) error {
+	l, err := f.acquire()
+	if err != nil {
+		return err
+	}
+	defer l.release()
+
+	return t.Touch(namespace, group, uri, ttl)
+}
+
+// put puts an item into the store within the store limit. It's a no-op in
+// the read-only mode.
+func (f *FastCache) put(namespace, group, uri string, it Item, ttl time.Duration) error {
+	if f.ReadOnly() {
+		return nil
+	}
+
+	l, err := f.acquire()
+	if err != nil {
+		return err
+	}
+	defer l.release()
+
+	return f.s.Put(namespace, group, uri, it, ttl)
+}
@@ -0,0 +1,69 @@
+package fastcache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLimitStore(t *testing.T) {
+	f := New(nil)
+	f.LimitStore(2, time.Millisecond*10)
+
+	var l *limiter
+	for i := 0; i < 2; i++ {
+		var err error
+		if l, err = f.acquire(); err != nil {
+			t.Fatalf("expected slot but got %v", err)
+		}
+	}
+
+	start := time.Now()
+	if _, err := f.acquire(); err != ErrStoreBusy {
+		t.Fatalf("expected ErrStoreBusy but got %v", err)
+	}
+	if time.Since(start) < time.Millisecond*10 {
+		t.Fatal("expected acquire to wait for the queue timeout")
+	}
+
+	// A released slot is available to queued operations.
+	go func() {
+		time.Sleep(time.Millisecond)
+		l.release()
+	}()
+	if _, err := f.acquire(); err != nil {
+		t.Fatalf("expected slot after release but got %v", err)
+	}
+
+	// Slots are released to the limiter they were acquired from after the
+	// limit is changed.
+	f.LimitStore(0, 0)
+	if _, err := f.acquire(); err != nil {
+		t.Fatalf("expected no limit but got %v", err)
+	}
+	l.release()
+}
+
+func TestLimitStoreOps(t *testing.T) {
+	f := New(nil)
+	f.LimitStore(1, 0)
+	if _, err := f.acquire(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The store isn't called (nil) while the limit is reached.
+	if _, err := f.getBlob(nil, "ns", "g", "/"); err != ErrStoreBusy {
+		t.Fatalf("getBlob: expected ErrStoreBusy but got %v", err)
+	}
+	if _, _, err := f.getRange(nil, "ns", "g", "/", 0, 1); err != ErrStoreBusy {
+		t.Fatalf("getRange: expected ErrStoreBusy but got %v", err)
+	}
+	if _, err := f.incrHits(nil, "ns", "g", "/"); err != ErrStoreBusy {
+		t.Fatalf("incrHits: expected ErrStoreBusy but got %v", err)
+	}
+	if _, err := f.getTTL(nil, "ns", "g", "/"); err != ErrStoreBusy {
+		t.Fatalf("getTTL: expected ErrStoreBusy but got %v", err)
+	}
+	if err := f.touchTTL(nil, "ns", "g", "/", time.Second); err != ErrStoreBusy {
+		t.Fatalf("touchTTL: expected ErrStoreBusy but got %v", err)
+	}
+}
@@ -0,0 +1,78 @@
+package fastcache
+
+import (
+	"bytes"
+
+	"github.com/zerodha/fastglue"
+)
+
+// PaginationOptions binds the pages of cached paginated listings to the ETag
+// of their first page, so that clients can guarantee that the pages they
+// fetch are of the same snapshot of a listing.
+//
+// Clients fetch the first page without the cursor param and send its ETag in
+// the If-Match header when fetching subsequent pages. If the first page has
+// changed or is no longer cached, the request fails with 412 (Precondition
+// Failed) and the client can restart from the first page. Requests without
+// If-Match are served as usual.
+type PaginationOptions struct {
+	// CursorParam is the query param of the page or cursor (eg: "page",
+	// "cursor"). The first page of a request is the request without it.
+	// Options.IncludeQueryString has to be enabled.
+	CursorParam string
+}
+
+// validSnapshot checks the If-Match header of a paginated request against
+// the ETag of the first page cached for it.
+func (f *FastCache) validSnapshot(r *fastglue.Request, namespace, group string, o *Options) bool {
+	im := r.RequestCtx.Request.Header.Peek("If-Match")
+	if len(im) == 0 {
+		return true
+	}
+
+	mg, lazy := f.s.(MetaGetter)
+	get := func(uri string) (Item, error) {
+		if lazy {
+			return f.getMeta(mg, namespace, group, uri)
+		}
+		return f.get(namespace, group, uri)
+	}
+
+	// The first page may vary by request headers.
+	uri := snapshotURI(r, o)
+	it, err := get(uri)
+	if err == nil && isVaryMarker(it) {
+		it, err = get(variantURI(r, uri, it, o))
+	}
+	if err != nil {
+		return false
+	}
+
+	return matchStrongETag(im, it.ETag)
+}
+
+// snapshotURI returns the cache key of the first page of a paginated request,
+// that is, of the request without the cursor param.
+func snapshotURI(r *fastglue.Request, o *Options) string {
+	// Generate the key with the cursor param removed from the request.
+	var (
+		u  = r.RequestCtx.URI()
+		qs = append([]byte(nil), u.QueryString()...)
+	)
+	u.QueryArgs().Del(o.Pagination.CursorParam)
+	u.SetQueryStringBytes(u.QueryArgs().QueryString())
+	defer u.SetQueryStringBytes(qs)
+
+	return cacheURI(r, o)
+}
+
+// matchStrongETag checks an If-Match header against an ETag. Weak ETags
+// never match.
+func matchStrongETag(header []byte, etag string) bool {
+	for _, t := range bytes.Split(header, []byte(",")) {
+		if t = bytes.TrimSpace(t); !bytes.HasPrefix(t, []byte("W/")) && matchETag(t, etag) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,408 @@
+package fastcache
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"github.com/zerodha/fastglue"
+)
+
+// matchETag checks if an If-None-Match header value matches the given
+// (unquoted) etag. The header is a comma separated list of strong or weak
+// (W/) entity tags, or "*", which matches any etag.
+func matchETag(header []byte, etag string) bool {
+	if len(etag) == 0 {
+		return false
+	}
+
+	for _, t := range bytes.Split(header, []byte(",")) {
+		t = bytes.TrimSpace(t)
+		if len(t) == 1 && t[0] == '*' {
+			return true
+		}
+
+		// Weak comparison. Drop the weak indicator and the quotes.
+		t = bytes.TrimPrefix(t, []byte("W/"))
+		if len(t) >= 2 && t[0] == '"' && t[len(t)-1] == '"' {
+			t = t[1 : len(t)-1]
+		}
+
+		if string(t) == etag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// hasDirective checks if a Cache-Control (or Pragma) header value has the
+// given directive. Directive names are case-insensitive.
+func hasDirective(header []byte, directive string) bool {
+	_, ok := directiveValue(header, directive)
+	return ok
+}
+
+// directiveValue returns the (unquoted) value of a directive in a Cache-Control
+// header value, and whether the directive exists.
+func directiveValue(header []byte, directive string) (string, bool) {
+	for _, d := range bytes.Split(header, []byte(",")) {
+		var val []byte
+		if i := bytes.IndexByte(d, '='); i >= 0 {
+			d, val = d[:i], d[i+1:]
+		}
+
+		if !bytes.EqualFold(bytes.TrimSpace(d), []byte(directive)) {
+			continue
+		}
+
+		val = bytes.TrimSpace(val)
+		if len(val) >= 2 && val[0] == '"' && val[len(val)-1] == '"' {
+			val = val[1 : len(val)-1]
+		}
+		return string(val), true
+	}
+
+	return "", false
+}
+
+// maxAge returns the s-maxage, or the max-age, directive in a Cache-Control
+// header value as a duration. false is returned if neither directive has
+// a valid value.
+func maxAge(header []byte) (time.Duration, bool) {
+	for _, d := range []string{"s-maxage", "max-age"} {
+		v, ok := directiveValue(header, d)
+		if !ok {
+			continue
+		}
+
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			continue
+		}
+		return time.Duration(n) * time.Second, true
+	}
+
+	return 0, false
+}
+
+// withMaxAge returns a Cache-Control header value with its max-age directive,
+// if any, replaced with max-age=secs. It's private if header is empty.
+func withMaxAge(header []byte, secs int) string {
+	out := make([]string, 0, 4)
+	for _, d := range bytes.Split(header, []byte(",")) {
+		name := d
+		if i := bytes.IndexByte(d, '='); i >= 0 {
+			name = d[:i]
+		}
+		if name = bytes.TrimSpace(name); len(name) == 0 || bytes.EqualFold(name, []byte("max-age")) {
+			continue
+		}
+		out = append(out, string(bytes.TrimSpace(d)))
+	}
+	if len(out) == 0 {
+		out = append(out, "private")
+	}
+
+	return strings.Join(append(out, "max-age="+strconv.Itoa(secs)), ", ")
+}
+
+// acceptsEncoding checks if an Accept-Encoding header value accepts the given
+// encoding, either explicitly or via "*", honoring q=0 which rejects it.
+func acceptsEncoding(header []byte, enc string) bool {
+	var (
+		ok       bool
+		wildcard bool
+	)
+	for _, e := range bytes.Split(header, []byte(",")) {
+		var params []byte
+		if i := bytes.IndexByte(e, ';'); i >= 0 {
+			e, params = e[:i], e[i+1:]
+		}
+		e = bytes.TrimSpace(e)
+
+		// Is the encoding disabled with q=0?
+		accept := true
+		for _, p := range bytes.Split(params, []byte(";")) {
+			p = bytes.TrimSpace(p)
+			if len(p) < 2 || (p[0] != 'q' && p[0] != 'Q') || p[1] != '=' {
+				continue
+			}
+			if q, err := strconv.ParseFloat(string(p[2:]), 64); err == nil && q <= 0 {
+				accept = false
+			}
+		}
+
+		switch {
+		case bytes.EqualFold(e, []byte(enc)):
+			// An explicit entry overrides the wildcard.
+			return accept
+		case len(e) == 1 && e[0] == '*':
+			ok, wildcard = accept, true
+		}
+	}
+
+	return wildcard && ok
+}
+
+// uriKey returns the unhashed cache key of a request URI of an
+// IncludeQueryString route. Without query options, it's the full URI with the
+// scheme, as keyed by previous versions. Otherwise, it's the host and the
+// queryKey() of the path, without the scheme, so that virtual hosts with the
+// same paths don't share cached responses either way.
+func uriKey(u *fasthttp.URI, o *Options) []byte {
+	if !o.canonicalKeys() {
+		// FullURI() re-encodes the query string once the handler has parsed
+		// the query args, so it's computed on a copy with the raw one.
+		c := fasthttp.AcquireURI()
+		defer fasthttp.ReleaseURI(c)
+
+		u.CopyTo(c)
+		c.SetQueryStringBytes(u.QueryString())
+		return append([]byte(nil), c.FullURI()...)
+	}
+
+	q := queryKey(o.NormalizePath.normalize(u.Path()), u.QueryString(), o)
+	return append(append(make([]byte, 0, len(u.Host())+len(q)), u.Host()...), q...)
+}
+
+// canonicalKeys reports whether any of the options that canonicalize the
+// paths and the query strings of IncludeQueryString keys is set.
+func (o *Options) canonicalKeys() bool {
+	return o.NormalizePath != (PathNormalization{}) ||
+		o.NormalizeQuery != (QueryNormalization{}) ||
+		o.DuplicateParams != DuplicateParamsKeepAll ||
+		len(o.QueryValueCanonicalizers) > 0 ||
+		len(o.IncludeQueryParams) > 0 ||
+		len(o.ExcludeQueryParams) > 0 ||
+		o.QueryArgsTransformerHook != nil
+}
+
+// queryKey returns the cache key for a request path and its raw query string.
+// The query string is parsed and re-encoded canonically, normalized with
+// NormalizeQuery, repeated params are folded as per DuplicateParams, the
+// values of the params in QueryValueCanonicalizers are canonicalized, params
+// are filtered with Include/ExcludeQueryParams, and the args are optionally
+// transformed with QueryArgsTransformerHook before being appended to the
+// path.
+func queryKey(path, query []byte, o *Options) []byte {
+	args := fasthttp.AcquireArgs()
+	defer fasthttp.ReleaseArgs(args)
+
+	args.ParseBytes(query)
+	n := o.NormalizeQuery
+	if n.LowercaseKeys || n.DropEmpty {
+		n.normalize(args)
+	}
+	if o.DuplicateParams != DuplicateParamsKeepAll {
+		foldDuplicates(args, o.DuplicateParams)
+	}
+	if len(o.QueryValueCanonicalizers) > 0 {
+		canonicalize(args, o.QueryValueCanonicalizers)
+	}
+	filter := len(o.IncludeQueryParams) > 0 || len(o.ExcludeQueryParams) > 0
+	if filter {
+		include, exclude := o.paramSets()
+		filterParams(args, include, exclude)
+	}
+	if n.Sort || filter {
+		args.Sort(bytes.Compare)
+	}
+	if o.QueryArgsTransformerHook != nil {
+		o.QueryArgsTransformerHook(args)
+	}
+
+	out := make([]byte, 0, len(path)+len(query)+1)
+	out = append(out, path...)
+	out = append(out, '?')
+	return args.AppendBytes(out)
+}
+
+// normalize lowercases the names of args and drops empty args in place.
+func (n QueryNormalization) normalize(args *fasthttp.Args) {
+	c := fasthttp.AcquireArgs()
+	defer fasthttp.ReleaseArgs(c)
+
+	args.VisitAll(func(k, v []byte) {
+		if n.DropEmpty && len(v) == 0 {
+			return
+		}
+		if n.LowercaseKeys {
+			k = bytes.ToLower(k)
+		}
+		c.AddBytesKV(k, v)
+	})
+	c.CopyTo(args)
+}
+
+// filterParams retains only the args in include (if set) and removes the args
+// in exclude in place.
+func filterParams(args *fasthttp.Args, include, exclude map[string]struct{}) {
+	c := fasthttp.AcquireArgs()
+	defer fasthttp.ReleaseArgs(c)
+
+	args.VisitAll(func(k, v []byte) {
+		if _, ok := include[string(k)]; len(include) > 0 && !ok {
+			return
+		}
+		if _, ok := exclude[string(k)]; ok {
+			return
+		}
+		c.AddBytesKV(k, v)
+	})
+	c.CopyTo(args)
+}
+
+// foldDuplicates folds the values of repeated args in place as per dup.
+// Folded args retain the position of their first occurrence.
+func foldDuplicates(args *fasthttp.Args, dup DuplicateParams) {
+	var (
+		keys []string
+		vals = make(map[string][]string, args.Len())
+		rep  = false
+	)
+	args.VisitAll(func(k, v []byte) {
+		vs, ok := vals[string(k)]
+		if !ok {
+			keys = append(keys, string(k))
+		} else {
+			rep = true
+		}
+		vals[string(k)] = append(vs, string(v))
+	})
+	if !rep {
+		return
+	}
+
+	args.Reset()
+	for _, k := range keys {
+		vs := vals[k]
+		switch dup {
+		case DuplicateParamsJoin:
+			args.Add(k, strings.Join(vs, ","))
+		case DuplicateParamsLast:
+			args.Add(k, vs[len(vs)-1])
+		default:
+			args.Add(k, vs[0])
+		}
+	}
+}
+
+// hasDuplicateParams checks if a raw query string has repeated params.
+func hasDuplicateParams(query []byte) bool {
+	args := fasthttp.AcquireArgs()
+	defer fasthttp.ReleaseArgs(args)
+
+	args.ParseBytes(query)
+	seen := make(map[string]struct{}, args.Len())
+	found := false
+	args.VisitAll(func(k, _ []byte) {
+		if _, ok := seen[string(k)]; ok {
+			found = true
+		}
+		seen[string(k)] = struct{}{}
+	})
+	return found
+}
+
+// canonicalize canonicalizes the values of the args in canon in place,
+// retaining the order of the args.
+func canonicalize(args *fasthttp.Args, canon map[string]func(string) string) {
+	c := fasthttp.AcquireArgs()
+	defer fasthttp.ReleaseArgs(c)
+
+	found := false
+	args.VisitAll(func(k, v []byte) {
+		if fn, ok := canon[string(k)]; ok {
+			found = true
+			c.AddBytesK(k, fn(string(v)))
+			return
+		}
+		c.AddBytesKV(k, v)
+	})
+	if found {
+		c.CopyTo(args)
+	}
+}
+
+// CanonicalCSV is a query value canonicalizer for set-like comma separated
+// values. It sorts the values and removes duplicates so that ?ids=3,1,2,1 and
+// ?ids=1,2,3 map to the same cache key.
+func CanonicalCSV(v string) string {
+	vals := strings.Split(v, ",")
+	sort.Strings(vals)
+
+	out := vals[:1]
+	for _, v := range vals[1:] {
+		if v != out[len(out)-1] {
+			out = append(out, v)
+		}
+	}
+	return strings.Join(out, ",")
+}
+
+// GroupFromParams returns an Options.GroupHook that derives groups from a
+// template with {param} placeholders that are replaced with the request's
+// path params (UserValue()), for instance, orders:{account_id}. If a param
+// is missing, the static group is used.
+func GroupFromParams(template string) func(r *fastglue.Request) string {
+	return func(r *fastglue.Request) string {
+		var (
+			b   strings.Builder
+			tpl = template
+		)
+		for {
+			i := strings.IndexByte(tpl, '{')
+			if i < 0 {
+				break
+			}
+			j := strings.IndexByte(tpl[i:], '}')
+			if j < 0 {
+				break
+			}
+
+			v := r.RequestCtx.UserValue(tpl[i+1 : i+j])
+			if v == nil {
+				return ""
+			}
+			b.WriteString(tpl[:i])
+			b.WriteString(fmt.Sprint(v))
+			tpl = tpl[i+j+1:]
+		}
+		b.WriteString(tpl)
+
+		return b.String()
+	}
+}
+
+// normalize normalizes a request path for its cache key. The path is only
+// copied if it changes.
+func (n PathNormalization) normalize(p []byte) []byte {
+	if n.MergeSlashes && bytes.Contains(p, []byte("//")) {
+		out := make([]byte, 0, len(p))
+		for i, c := range p {
+			if c == '/' && i > 0 && p[i-1] == '/' {
+				continue
+			}
+			out = append(out, c)
+		}
+		p = out
+	}
+
+	if n.TrimTrailingSlash && len(p) > 1 && p[len(p)-1] == '/' {
+		p = bytes.TrimRight(p, "/")
+		if len(p) == 0 {
+			p = []byte("/")
+		}
+	}
+
+	if n.Lowercase && bytes.ContainsAny(p, "ABCDEFGHIJKLMNOPQRSTUVWXYZ") {
+		p = bytes.ToLower(p)
+	}
+
+	return p
+}
@@ -0,0 +1,359 @@
+package fastcache
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+func TestMatchETag(t *testing.T) {
+	for _, c := range []struct {
+		header string
+		etag   string
+		match  bool
+	}{
+		{`"abc"`, "abc", true},
+		{`W/"abc"`, "abc", true},
+		{`"xyz", "abc"`, "abc", true},
+		{`*`, "abc", true},
+		{`"abcd"`, "abc", false},
+		{`"xabcx"`, "abc", false},
+		{`wrong`, "abc", false},
+		{`""`, "", false},
+		{``, "abc", false},
+	} {
+		if got := matchETag([]byte(c.header), c.etag); got != c.match {
+			t.Errorf("matchETag(%q, %q): expected %v but got %v", c.header, c.etag, c.match, got)
+		}
+	}
+}
+
+func TestAcceptsEncoding(t *testing.T) {
+	for _, c := range []struct {
+		header string
+		accept bool
+	}{
+		{"gzip", true},
+		{"deflate, gzip;q=0.5", true},
+		{"GZIP", true},
+		{"gzip;q=0", false},
+		{"*", true},
+		{"*, gzip;q=0", false},
+		{"*;q=0", false},
+		{"deflate", false},
+		{"", false},
+	} {
+		if got := acceptsEncoding([]byte(c.header), "gzip"); got != c.accept {
+			t.Errorf("acceptsEncoding(%q): expected %v but got %v", c.header, c.accept, got)
+		}
+	}
+}
+
+func TestDirectiveValue(t *testing.T) {
+	for _, c := range []struct {
+		header string
+		dir    string
+		val    string
+		ok     bool
+	}{
+		{"no-store", "no-store", "", true},
+		{"private, No-Store", "no-store", "", true},
+		{"max-age=60, s-maxage=120", "s-maxage", "120", true},
+		{`max-age="60"`, "max-age", "60", true},
+		{"no-storage", "no-store", "", false},
+		{"x=no-store", "no-store", "", false},
+	} {
+		val, ok := directiveValue([]byte(c.header), c.dir)
+		if val != c.val || ok != c.ok {
+			t.Errorf("directiveValue(%q, %q): expected (%q, %v) but got (%q, %v)", c.header, c.dir, c.val, c.ok, val, ok)
+		}
+	}
+}
+
+func TestWithMaxAge(t *testing.T) {
+	for _, c := range []struct {
+		header string
+		exp    string
+	}{
+		{"", "private, max-age=10"},
+		{"public", "public, max-age=10"},
+		{"public, Max-Age=3600, must-revalidate", "public, must-revalidate, max-age=10"},
+		{"private,max-age=60,s-maxage=120", "private, s-maxage=120, max-age=10"},
+	} {
+		if out := withMaxAge([]byte(c.header), 10); out != c.exp {
+			t.Errorf("withMaxAge(%q): expected %q but got %q", c.header, c.exp, out)
+		}
+	}
+}
+
+func TestQueryKeyCanonicalizers(t *testing.T) {
+	canon := map[string]func(string) string{"ids": CanonicalCSV, "q": strings.ToLower}
+	for _, c := range []struct {
+		query string
+		key   string
+	}{
+		{"ids=3,1,2&page=1", "/q?ids=1%2C2%2C3&page=1"},
+		{"ids=1,2,3&page=1", "/q?ids=1%2C2%2C3&page=1"},
+		{"ids=2,2,1,2", "/q?ids=1%2C2"},
+		{"page=1&q=ABC&ids=b,a", "/q?page=1&q=abc&ids=a%2Cb"},
+		{"ids=", "/q?ids="},
+		{"page=2", "/q?page=2"},
+	} {
+		if got := string(queryKey([]byte("/q"), []byte(c.query), &Options{QueryValueCanonicalizers: canon})); got != c.key {
+			t.Errorf("queryKey(%q): expected %q but got %q", c.query, c.key, got)
+		}
+	}
+}
+
+func TestQueryKeyDuplicateParams(t *testing.T) {
+	canon := map[string]func(string) string{"id": CanonicalCSV}
+	for _, c := range []struct {
+		query string
+		dup   DuplicateParams
+		key   string
+	}{
+		{"id=2&page=1&id=1", DuplicateParamsKeepAll, "/q?id=2&page=1&id=1"},
+		{"id=2&page=1&id=1", DuplicateParamsJoin, "/q?id=1%2C2&page=1"},
+		{"id=2&page=1&id=1", DuplicateParamsFirst, "/q?id=2&page=1"},
+		{"id=2&page=1&id=1", DuplicateParamsLast, "/q?id=1&page=1"},
+		{"page=1&id=1", DuplicateParamsLast, "/q?page=1&id=1"},
+	} {
+		if got := string(queryKey([]byte("/q"), []byte(c.query), &Options{DuplicateParams: c.dup, QueryValueCanonicalizers: canon})); got != c.key {
+			t.Errorf("queryKey(%q, %d): expected %q but got %q", c.query, c.dup, c.key, got)
+		}
+	}
+
+	if !hasDuplicateParams([]byte("id=1&page=1&id=2")) || hasDuplicateParams([]byte("id=1&page=1")) {
+		t.Error("expected repeated params to be detected")
+	}
+}
+
+func TestQueryKeyNormalization(t *testing.T) {
+	for _, c := range []struct {
+		query string
+		norm  QueryNormalization
+		key   string
+	}{
+		{"q=a%20b", QueryNormalization{}, "/q?q=a+b"},
+		{"q=a+b", QueryNormalization{}, "/q?q=a+b"},
+		{"Q=a&page=", QueryNormalization{}, "/q?Q=a&page="},
+		{"Q=a&page=", QueryNormalization{LowercaseKeys: true}, "/q?q=a&page="},
+		{"Q=a&page=", QueryNormalization{DropEmpty: true}, "/q?Q=a"},
+		{"b=2&a=1&b=1", QueryNormalization{Sort: true}, "/q?a=1&b=1&b=2"},
+		{"Q=b&x=&q=a", QueryNormalization{LowercaseKeys: true, DropEmpty: true, Sort: true}, "/q?q=a&q=b"},
+	} {
+		if got := string(queryKey([]byte("/q"), []byte(c.query), &Options{NormalizeQuery: c.norm})); got != c.key {
+			t.Errorf("queryKey(%q, %+v): expected %q but got %q", c.query, c.norm, c.key, got)
+		}
+	}
+
+	// Lowercased names are folded as repeated params.
+	o := &Options{NormalizeQuery: QueryNormalization{LowercaseKeys: true}, DuplicateParams: DuplicateParamsLast}
+	if got := string(queryKey([]byte("/q"), []byte("Page=1&page=2"), o)); got != "/q?page=2" {
+		t.Errorf("expected lowercased names to be folded but got %q", got)
+	}
+}
+
+func TestQueryKeyParams(t *testing.T) {
+	for _, c := range []struct {
+		query            string
+		include, exclude []string
+		key              string
+	}{
+		{"page=1&utm_source=x&id=2", nil, nil, "/q?page=1&utm_source=x&id=2"},
+		{"page=1&utm_source=x&id=2", []string{"page", "id"}, nil, "/q?id=2&page=1"},
+		{"page=1&utm_source=x&id=2", nil, []string{"utm_source"}, "/q?id=2&page=1"},
+		{"page=1&utm_source=x&id=2", []string{"page", "id"}, []string{"id"}, "/q?page=1"},
+		{"utm_source=x", []string{"page"}, nil, "/q?"},
+	} {
+		o := &Options{IncludeQueryParams: c.include, ExcludeQueryParams: c.exclude}
+		if got := string(queryKey([]byte("/q"), []byte(c.query), o)); got != c.key {
+			t.Errorf("queryKey(%q, %v, %v): expected %q but got %q", c.query, c.include, c.exclude, c.key, got)
+		}
+	}
+}
+
+func TestURIKey(t *testing.T) {
+	for _, c := range []struct {
+		uri string
+		o   *Options
+		key string
+	}{
+		// Without query options, keys are the full URIs as in previous versions.
+		{"http://Example.com/q?b=2&a=%20", &Options{}, "http://example.com/q?b=2&a=%20"},
+		{"https://example.com/q", &Options{}, "https://example.com/q"},
+		{"http://example.com/q?b=2&a=1", &Options{NormalizeQuery: QueryNormalization{Sort: true}}, "example.com/q?a=1&b=2"},
+		{"http://example.com/q/?a=%20", &Options{NormalizePath: PathNormalization{TrimTrailingSlash: true}}, "example.com/q?a=+"},
+	} {
+		if got := string(rawURI(c.uri, c.o)); got != c.key {
+			t.Errorf("rawURI(%q): expected %q but got %q", c.uri, c.key, got)
+		}
+	}
+
+	// Parsed query args don't change the keys.
+	u := fasthttp.AcquireURI()
+	defer fasthttp.ReleaseURI(u)
+	u.Parse(nil, []byte("http://example.com/q?cc=a,b"))
+	u.QueryArgs().Peek("cc")
+	if got := string(uriKey(u, &Options{})); got != "http://example.com/q?cc=a,b" {
+		t.Errorf("expected the raw query string but got %q", got)
+	}
+}
+
+func TestMaxAge(t *testing.T) {
+	for _, c := range []struct {
+		header string
+		ttl    time.Duration
+		ok     bool
+	}{
+		{"max-age=60", time.Minute, true},
+		{"public, max-age=60, s-maxage=120", time.Minute * 2, true},
+		{"s-maxage=invalid, max-age=60", time.Minute, true},
+		{`max-age="0"`, 0, true},
+		{"max-age=-1", 0, false},
+		{"no-cache", 0, false},
+		{"", 0, false},
+	} {
+		ttl, ok := maxAge([]byte(c.header))
+		if ttl != c.ttl || ok != c.ok {
+			t.Errorf("maxAge(%q): expected %v, %v but got %v, %v", c.header, c.ttl, c.ok, ttl, ok)
+		}
+	}
+}
+
+func TestParseRange(t *testing.T) {
+	for _, c := range []struct {
+		header string
+		offset int64
+		n      int64
+		ok     bool
+	}{
+		{"bytes=0-99", 0, 100, true},
+		{"bytes=100-", 100, -1, true},
+		{"bytes=-50", -50, -1, true},
+		{"Bytes= 5 - 5", 5, 1, true},
+		{"bytes=10-5", 0, 0, false},
+		{"bytes=0-1,5-6", 0, 0, false},
+		{"bytes=-0", 0, 0, false},
+		{"bytes=-", 0, 0, false},
+		{"items=0-1", 0, 0, false},
+		{"", 0, 0, false},
+	} {
+		offset, n, ok := parseRange([]byte(c.header))
+		if offset != c.offset || n != c.n || ok != c.ok {
+			t.Errorf("parseRange(%q): expected %d, %d, %v but got %d, %d, %v", c.header, c.offset, c.n, c.ok, offset, n, ok)
+		}
+	}
+}
+
+func TestBlobRange(t *testing.T) {
+	b := []byte("0123456789")
+	for _, c := range []struct {
+		offset int64
+		n      int64
+		out    string
+	}{
+		{0, 3, "012"},
+		{8, 5, "89"},
+		{5, -1, "56789"},
+		{-3, -1, "789"},
+		{-20, -1, "0123456789"},
+		{10, -1, ""},
+	} {
+		if out := string(BlobRange(b, c.offset, c.n)); out != c.out {
+			t.Errorf("BlobRange(%d, %d): expected %q but got %q", c.offset, c.n, c.out, out)
+		}
+	}
+}
+
+func FuzzParseRange(f *testing.F) {
+	f.Add("bytes=0-99")
+	f.Add("bytes=-5")
+	f.Add("bytes=9223372036854775807-")
+	f.Fuzz(func(t *testing.T, header string) {
+		offset, n, ok := parseRange([]byte(header))
+		if ok && BlobRange(make([]byte, 16), offset, n) == nil && rangeStart(offset, 16) < 16 {
+			t.Fatalf("nil range for %q", header)
+		}
+	})
+}
+
+func FuzzMatchETag(f *testing.F) {
+	f.Add(`"abc"`, "abc")
+	f.Add(`W/"abc", "xyz"`, "xyz")
+	f.Add(`*`, "abc")
+	f.Add(`"`, `"`)
+	f.Fuzz(func(t *testing.T, header, etag string) {
+		if matchETag([]byte(header), etag) && etag == "" {
+			t.Fatalf("empty etag matched %q", header)
+		}
+		// A quoted etag should always match itself.
+		if etag != "" && !bytes.ContainsAny([]byte(etag), `,"`) && !matchETag([]byte(`"`+etag+`"`), etag) {
+			t.Fatalf("etag %q didn't match itself", etag)
+		}
+	})
+}
+
+func FuzzAcceptsEncoding(f *testing.F) {
+	f.Add("gzip, deflate;q=0.5")
+	f.Add("*;q=0")
+	f.Add(";;q=,")
+	f.Fuzz(func(t *testing.T, header string) {
+		acceptsEncoding([]byte(header), "gzip")
+	})
+}
+
+func FuzzDirectiveValue(f *testing.F) {
+	f.Add("no-store", "no-store")
+	f.Add(`max-age="60", private`, "max-age")
+	f.Add(`="`, "")
+	f.Fuzz(func(t *testing.T, header, directive string) {
+		directiveValue([]byte(header), directive)
+	})
+}
+
+func FuzzQueryKey(f *testing.F) {
+	f.Add([]byte("/orders"), []byte("a=1&b=2"))
+	f.Add([]byte("/"), []byte("q=a%20b&q=a+b&&=&x"))
+	f.Add([]byte(""), []byte("%zz=%"))
+	f.Fuzz(func(t *testing.T, path, query []byte) {
+		k := queryKey(path, query, &Options{})
+		if !bytes.HasPrefix(k, append(append([]byte{}, path...), '?')) {
+			t.Fatalf("key %q doesn't start with path %q", k, path)
+		}
+
+		// Canonicalization should be idempotent.
+		q := k[len(path)+1:]
+		if k2 := queryKey(path, q, &Options{}); !bytes.Equal(k, k2) {
+			t.Fatalf("non-idempotent key for %q: %q != %q", query, k, k2)
+		}
+	})
+}
+
+func TestNormalizePath(t *testing.T) {
+	all := PathNormalization{TrimTrailingSlash: true, MergeSlashes: true, Lowercase: true}
+	for _, c := range []struct {
+		n    PathNormalization
+		path string
+		out  string
+	}{
+		{all, "/orders", "/orders"},
+		{all, "/orders/", "/orders"},
+		{all, "/orders//", "/orders"},
+		{all, "/", "/"},
+		{all, "//", "/"},
+		{all, "/a//b///c", "/a/b/c"},
+		{all, "/Orders/ABC/", "/orders/abc"},
+		{PathNormalization{TrimTrailingSlash: true}, "/a//b/", "/a//b"},
+		{PathNormalization{MergeSlashes: true}, "/a//B/", "/a/B/"},
+		{PathNormalization{Lowercase: true}, "/A/", "/a/"},
+		{PathNormalization{}, "/A//", "/A//"},
+	} {
+		if got := string(c.n.normalize([]byte(c.path))); got != c.out {
+			t.Errorf("normalize(%+v, %q): expected %q but got %q", c.n, c.path, c.out, got)
+		}
+	}
+}
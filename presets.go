@@ -0,0 +1,71 @@
+package fastcache
+
+import "time"
+
+// Presets are Options with sensible defaults for common kinds of routes.
+// The returned Options can be modified further before they are passed to
+// Cached(). The presets of public responses cache requests without a
+// namespace under the shared namespace "public" (SharedNamespace).
+
+// PresetAPI returns Options for JSON API responses that are the same for all
+// users (eg: market data). Responses are cached per URI + query string with
+// ETags, and are compressed in the store and served compressed to clients
+// that accept it. They're public, and are sent with `Cache-Control: public,
+// max-age=<remaining TTL>` (EmitCacheControl) so that CDNs can cache them
+// too.
+func PresetAPI(ttl time.Duration) *Options {
+	return &Options{
+		TTL:                  ttl,
+		ETag:                 true,
+		IncludeQueryString:   true,
+		MaxQueryStringLength: 2048,
+		SharedNamespace:      "public",
+		EmitCacheControl:     true,
+		Compression: CompressionsOptions{
+			Enabled:        true,
+			RespectHeaders: true,
+		},
+	}
+}
+
+// PresetStaticAsset returns Options for static assets that are cached per
+// path (query strings such as cache busters are ignored) with compression.
+// Their ETags are hashes of their content (ContentETag), so that they don't
+// change when assets are recached, and they're sent with Last-Modified and
+// `Cache-Control: public, max-age=<remaining TTL>` so that browsers and CDNs
+// can cache and revalidate them.
+func PresetStaticAsset(ttl time.Duration) *Options {
+	return &Options{
+		TTL:              ttl,
+		ETag:             true,
+		ContentETag:      true,
+		LastModified:     true,
+		SharedNamespace:  "public",
+		EmitCacheControl: true,
+		Compression: CompressionsOptions{
+			Enabled:        true,
+			RespectHeaders: true,
+		},
+	}
+}
+
+// PresetPrivatePerUser returns Options for private, per-user responses that
+// are cached per URI + query string under the user's namespace, the value of
+// which is obtained from RequestCtx.UserValue(namespaceKey). Requests without
+// a namespace are never cached. Cached responses are sent with `Cache-Control:
+// private, max-age=<remaining TTL>` (RewriteMaxAge) so that browsers, but not
+// shared caches, can cache them until they expire.
+func PresetPrivatePerUser(namespaceKey string, ttl time.Duration) *Options {
+	return &Options{
+		NamespaceKey:         namespaceKey,
+		TTL:                  ttl,
+		ETag:                 true,
+		IncludeQueryString:   true,
+		MaxQueryStringLength: 2048,
+		RewriteMaxAge:        true,
+		Compression: CompressionsOptions{
+			Enabled:        true,
+			RespectHeaders: true,
+		},
+	}
+}
@@ -0,0 +1,50 @@
+package fastcache
+
+import (
+	"strings"
+	"time"
+)
+
+// dedupDelGroup deletes groups like DelGroup(), deduplicating identical
+// purges (same namespace and groups) within Options.PurgeDedupWindow. The
+// first purge runs immediately. Purges requested within the window after it
+// are collapsed into one that runs at the end of the window, so that changes
+// made within the window are still purged.
+func (f *FastCache) dedupDelGroup(namespace string, groups []string, o *Options) error {
+	key := namespace + sep + strings.Join(groups, sep)
+
+	f.purgeMu.Lock()
+	if _, ok := f.purges[key]; ok {
+		f.purges[key] = true
+		f.purgeMu.Unlock()
+		return nil
+	}
+	if f.purges == nil {
+		f.purges = make(map[string]bool)
+	}
+	f.purges[key] = false
+	f.purgeMu.Unlock()
+
+	f.endPurgeWindow(key, namespace, groups, o)
+	return f.DelGroup(namespace, groups...)
+}
+
+// endPurgeWindow runs the trailing purge of a deduplicated purge, if any, at
+// the end of its window.
+func (f *FastCache) endPurgeWindow(key, namespace string, groups []string, o *Options) {
+	time.AfterFunc(o.PurgeDedupWindow, func() {
+		f.purgeMu.Lock()
+		if !f.purges[key] {
+			delete(f.purges, key)
+			f.purgeMu.Unlock()
+			return
+		}
+		f.purges[key] = false
+		f.purgeMu.Unlock()
+
+		f.endPurgeWindow(key, namespace, groups, o)
+		if err := f.DelGroup(namespace, groups...); err != nil {
+			o.Logger.Printf("error while deleting groups '%v': %v", groups, err)
+		}
+	})
+}
@@ -0,0 +1,128 @@
+package fastcache
+
+import (
+	"io"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// delGroupStore is a Store that counts DelGroup calls.
+type delGroupStore struct {
+	Store
+	n int32
+}
+
+func (s *delGroupStore) DelGroup(namespace string, group ...string) error {
+	atomic.AddInt32(&s.n, 1)
+	return nil
+}
+
+func TestDedupDelGroup(t *testing.T) {
+	var (
+		s = &delGroupStore{}
+		f = New(s)
+		o = &Options{PurgeDedupWindow: time.Millisecond * 50}
+	)
+
+	// The first purge runs immediately and the rest are collapsed.
+	for i := 0; i < 5; i++ {
+		if err := f.dedupDelGroup("ns", []string{"a", "b"}, o); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := atomic.LoadInt32(&s.n); n != 1 {
+		t.Fatalf("expected 1 purge but got %d", n)
+	}
+
+	// Purges of other groups aren't deduplicated with them.
+	if err := f.dedupDelGroup("ns", []string{"a"}, o); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&s.n); n != 2 {
+		t.Fatalf("expected 2 purges but got %d", n)
+	}
+
+	// The collapsed purges run once at the end of the window.
+	time.Sleep(time.Millisecond * 200)
+	if n := atomic.LoadInt32(&s.n); n != 3 {
+		t.Fatalf("expected 3 purges but got %d", n)
+	}
+
+	f.purgeMu.Lock()
+	defer f.purgeMu.Unlock()
+	if len(f.purges) != 0 {
+		t.Fatalf("expected purge windows to end but got %v", f.purges)
+	}
+}
+
+func TestOnInvalidate(t *testing.T) {
+	var (
+		f   = New(&delGroupStore{})
+		got []string
+	)
+	f.OnInvalidate(func(namespace string, groups []string) {
+		got = append(got, namespace+":"+strings.Join(groups, ","))
+	})
+
+	if err := f.DelGroup("ns", "a", "b"); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.dedupDelGroup("ns", []string{"c"}, &Options{PurgeDedupWindow: time.Millisecond * 10}); err != nil {
+		t.Fatal(err)
+	}
+	if exp := []string{"ns:a,b", "ns:c"}; strings.Join(got, " ") != strings.Join(exp, " ") {
+		t.Fatalf("expected %v but got %v", exp, got)
+	}
+}
+
+func TestRuntimeSetters(t *testing.T) {
+	var (
+		s    = &delGroupStore{}
+		f    = New(s)
+		done = make(chan struct{})
+		n    int32
+	)
+
+	// The setters can be called while requests are being served.
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			f.OnInvalidate(func(string, []string) { atomic.AddInt32(&n, 1) })
+			f.SetDelGroupGrace(time.Duration(i))
+			f.SetShedSignal(func() bool { return false })
+			f.LimitStore(i%3, 0)
+			_ = f.SetCDN(CDNOptions{Purger: nopPurger{}})
+			f.StartReporter(io.Discard, time.Hour, nil)()
+		}
+	}()
+	for {
+		select {
+		case <-done:
+			if atomic.LoadInt32(&n) == 0 {
+				t.Fatal("expected the invalidation callback to be invoked")
+			}
+			return
+		default:
+		}
+
+		if err := f.DelGroup("ns", "g"); err != nil {
+			t.Fatal(err)
+		}
+		f.Shedding()
+		if l, err := f.acquire(); err == nil {
+			l.release()
+		}
+		if rep := f.reports(); rep != nil {
+			rep.hit("g")
+		}
+	}
+}
+
+// nopPurger is a CDNPurger that purges nothing.
+type nopPurger struct{}
+
+func (nopPurger) PurgeKeys([]string) error {
+	return nil
+}
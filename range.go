@@ -0,0 +1,161 @@
+package fastcache
+
+import (
+	"bytes"
+	"strconv"
+
+	"github.com/valyala/fasthttp"
+	"github.com/zerodha/fastglue"
+)
+
+// RangeGetter is an optional interface that a Store capable of partial reads
+// can implement to read a byte range of a cached Blob without loading the
+// whole Blob, for serving Range requests. offset is the start of the range,
+// or if it's negative, the number of bytes from the end of the Blob. n is the
+// maximum number of bytes to read, or -1 to read till the end. The bytes in
+// the range (nil if the range starts after the end of the Blob) are returned
+// along with the size of the whole Blob.
+type RangeGetter interface {
+	GetRange(namespace, group, uri string, offset, n int64) ([]byte, int64, error)
+}
+
+// BlobRange returns the range of b as described by RangeGetter. It is meant
+// for RangeGetter implementations.
+func BlobRange(b []byte, offset, n int64) []byte {
+	size := int64(len(b))
+	start := rangeStart(offset, size)
+	if start >= size {
+		return nil
+	}
+
+	end := size
+	if n >= 0 && start+n < size {
+		end = start + n
+	}
+	return b[start:end]
+}
+
+// rangeStart returns the absolute start of a range in a blob of the given
+// size.
+func rangeStart(offset, size int64) int64 {
+	if offset >= 0 {
+		return offset
+	}
+	if offset += size; offset < 0 {
+		return 0
+	}
+	return offset
+}
+
+// parseRange parses a single byte range in a Range header value into an
+// offset and a length as described by RangeGetter. Multiple ranges and
+// other units are not supported.
+func parseRange(header []byte) (int64, int64, bool) {
+	const prefix = "bytes="
+	if len(header) <= len(prefix) || !bytes.EqualFold(header[:len(prefix)], []byte(prefix)) {
+		return 0, 0, false
+	}
+
+	spec := bytes.TrimSpace(header[len(prefix):])
+	i := bytes.IndexByte(spec, '-')
+	if i < 0 || bytes.IndexByte(spec, ',') >= 0 {
+		return 0, 0, false
+	}
+
+	var (
+		first = bytes.TrimSpace(spec[:i])
+		last  = bytes.TrimSpace(spec[i+1:])
+	)
+
+	// Suffix range (bytes=-500).
+	if len(first) == 0 {
+		n, err := strconv.ParseInt(string(last), 10, 64)
+		if err != nil || n <= 0 {
+			return 0, 0, false
+		}
+		return -n, -1, true
+	}
+
+	start, err := strconv.ParseInt(string(first), 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, false
+	}
+
+	// Open range (bytes=500-).
+	if len(last) == 0 {
+		return start, -1, true
+	}
+
+	end, err := strconv.ParseInt(string(last), 10, 64)
+	if err != nil || end < start {
+		return 0, 0, false
+	}
+	return start, end - start + 1, true
+}
+
+// rangeable checks if byte ranges of a cached response can be served.
+func (o *Options) rangeable(blob Item) bool {
+	return blob.ContentType != "" && blob.Compression == "" &&
+		(blob.StatusCode == 0 || blob.StatusCode == fasthttp.StatusOK) &&
+		!(o.StalenessField != "" && isJSON(blob.ContentType))
+}
+
+// serveRange serves a byte range of a cached response if the request has
+// a single range that can be served. It returns false if the response has
+// to be served otherwise.
+func (f *FastCache) serveRange(r *fastglue.Request, namespace, group, uri string, blob Item, lazy bool, o *Options) bool {
+	offset, n, ok := parseRange(r.RequestCtx.Request.Header.Peek("Range"))
+	if !ok || !o.rangeable(blob) {
+		return false
+	}
+
+	// Serve the whole response if the client's copy is outdated.
+	if ir := r.RequestCtx.Request.Header.Peek("If-Range"); len(ir) > 0 && !(o.ETag && matchETag(ir, blob.ETag)) {
+		return false
+	}
+
+	// Stale responses have to be revalidated first.
+	if o.RevalidateAfter > 0 && o.Clock.Now().Sub(blob.CreatedAt) >= o.RevalidateAfter {
+		return false
+	}
+
+	var (
+		b    []byte
+		size int64
+	)
+	if rg, ok := f.s.(RangeGetter); ok && lazy {
+		var err error
+		if b, size, err = f.getRange(rg, namespace, group, uri, offset, n); err != nil {
+			o.Logger.Printf("error reading cache blob range: %v", err)
+			return false
+		}
+	} else {
+		if lazy {
+			var err error
+			if blob.Blob, err = f.getBlob(f.s.(MetaGetter), namespace, group, uri); err != nil {
+				o.Logger.Printf("error reading cache blob: %v", err)
+				return false
+			}
+		}
+		b, size = BlobRange(blob.Blob, offset, n), int64(len(blob.Blob))
+	}
+	if size == 0 {
+		return false
+	}
+
+	start := rangeStart(offset, size)
+	if start >= size {
+		r.RequestCtx.Response.Header.Set("Content-Range", "bytes */"+strconv.FormatInt(size, 10))
+		r.RequestCtx.SetStatusCode(fasthttp.StatusRequestedRangeNotSatisfiable)
+		return true
+	}
+
+	f.writeHeaders(r, namespace, group, uri, blob, o)
+	r.RequestCtx.SetStatusCode(fasthttp.StatusPartialContent)
+	r.RequestCtx.Response.Header.Set("Content-Range", "bytes "+strconv.FormatInt(start, 10)+"-"+
+		strconv.FormatInt(start+int64(len(b))-1, 10)+"/"+strconv.FormatInt(size, 10))
+	if _, err := r.RequestCtx.Write(b); err != nil {
+		o.Logger.Printf("error writing request: %v", err)
+	}
+	return true
+}
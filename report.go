@@ -0,0 +1,217 @@
+package fastcache
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+)
+
+// Report is the hit/miss/latency aggregate of the requests served by the
+// middleware between From and To, by group.
+type Report struct {
+	From   time.Time              `json:"from"`
+	To     time.Time              `json:"to"`
+	Groups map[string]GroupReport `json:"groups"`
+}
+
+// GroupReport is the hit/miss/latency aggregate of a group. The latencies
+// are those of the handler on misses, in milliseconds. GraceHits is the
+// number of the hits that were served in their grace window (Options.Grace).
+//
+// The compression counts are of the responses stored on routes with
+// compression enabled, for tuning Compression.MinLength. Compressed is the
+// number of responses that were compressed and CompressedBytesIn and
+// CompressedBytesOut are their sizes before and after compression.
+// Uncompressed is the number of the responses that weren't compressed (eg:
+// below MinLength) and UncompressedBytes is their size.
+type GroupReport struct {
+	Hits             int64   `json:"hits"`
+	GraceHits        int64   `json:"grace_hits"`
+	Misses           int64   `json:"misses"`
+	HitRatio         float64 `json:"hit_ratio"`
+	AvgMissLatencyMS float64 `json:"avg_miss_latency_ms"`
+	MaxMissLatencyMS float64 `json:"max_miss_latency_ms"`
+
+	Compressed         int64   `json:"compressed"`
+	CompressedBytesIn  int64   `json:"compressed_bytes_in"`
+	CompressedBytesOut int64   `json:"compressed_bytes_out"`
+	CompressionSaved   float64 `json:"compression_saved"`
+	Uncompressed       int64   `json:"uncompressed"`
+	UncompressedBytes  int64   `json:"uncompressed_bytes"`
+}
+
+// groupCounts are the running counts of a group.
+type groupCounts struct {
+	hits, misses   int64
+	graceHits      int64
+	latSum, latMax time.Duration
+
+	compressed, uncompressed int64
+	compIn, compOut          int64
+	uncompBytes              int64
+}
+
+// reporter aggregates the counts of groups for a report. The reports are
+// timed with clock.
+type reporter struct {
+	from   time.Time
+	clock  Clock
+	groups map[string]*groupCounts
+	mu     sync.Mutex
+}
+
+func newReporter(clock Clock) *reporter {
+	return &reporter{from: clock.Now(), clock: clock, groups: make(map[string]*groupCounts)}
+}
+
+func (rp *reporter) counts(group string) *groupCounts {
+	c, ok := rp.groups[group]
+	if !ok {
+		c = &groupCounts{}
+		rp.groups[group] = c
+	}
+	return c
+}
+
+// hit records a cache hit in a group.
+func (rp *reporter) hit(group string) {
+	rp.mu.Lock()
+	rp.counts(group).hits++
+	rp.mu.Unlock()
+}
+
+// grace records a cache hit served in its grace window in a group.
+func (rp *reporter) grace(group string) {
+	rp.mu.Lock()
+	rp.counts(group).graceHits++
+	rp.mu.Unlock()
+}
+
+// miss records a cache miss in a group along with the handler's latency.
+func (rp *reporter) miss(group string, latency time.Duration) {
+	rp.mu.Lock()
+	c := rp.counts(group)
+	c.misses++
+	c.latSum += latency
+	if latency > c.latMax {
+		c.latMax = latency
+	}
+	rp.mu.Unlock()
+}
+
+// compression records the compression of a response of n bytes stored in a
+// group, which is out bytes if it was compressed.
+func (rp *reporter) compression(group string, n, out int, compressed bool) {
+	rp.mu.Lock()
+	c := rp.counts(group)
+	if compressed {
+		c.compressed++
+		c.compIn += int64(n)
+		c.compOut += int64(out)
+	} else {
+		c.uncompressed++
+		c.uncompBytes += int64(n)
+	}
+	rp.mu.Unlock()
+}
+
+// flush returns the report of the counts so far and resets them.
+func (rp *reporter) flush() Report {
+	rp.mu.Lock()
+	var (
+		now    = rp.clock.Now()
+		groups = rp.groups
+		out    = Report{From: rp.from, To: now, Groups: make(map[string]GroupReport, len(groups))}
+	)
+	rp.from = now
+	rp.groups = make(map[string]*groupCounts, len(groups))
+	rp.mu.Unlock()
+
+	for g, c := range groups {
+		r := GroupReport{
+			Hits:             c.hits,
+			GraceHits:        c.graceHits,
+			Misses:           c.misses,
+			MaxMissLatencyMS: float64(c.latMax) / float64(time.Millisecond),
+
+			Compressed:         c.compressed,
+			CompressedBytesIn:  c.compIn,
+			CompressedBytesOut: c.compOut,
+			Uncompressed:       c.uncompressed,
+			UncompressedBytes:  c.uncompBytes,
+		}
+		if total := c.hits + c.misses; total > 0 {
+			r.HitRatio = float64(c.hits) / float64(total)
+		}
+		if c.misses > 0 {
+			r.AvgMissLatencyMS = float64(c.latSum) / float64(c.misses) / float64(time.Millisecond)
+		}
+		if c.compIn > 0 {
+			r.CompressionSaved = 1 - float64(c.compOut)/float64(c.compIn)
+		}
+		out.Groups[g] = r
+	}
+
+	return out
+}
+
+// StartReporter starts aggregating per-group hit/miss/latency counts of the
+// requests served by the middleware and writes them as a JSON Report (one per
+// line) to w every interval, for instance, to a file for periodic reviews of
+// the cache's effectiveness. w can be any writer, such as one that pushes
+// reports to an HTTP endpoint or a Redis key. Every Report covers the
+// requests since the previous one and is timed with the Clock of the default
+// Options. onErr, if set, is called with errors in writing reports. A
+// reporter started later replaces the previous one, which keeps writing
+// empty Reports until it's stopped. The returned function stops the
+// reporter after writing a final Report.
+func (f *FastCache) StartReporter(w io.Writer, interval time.Duration, onErr func(error)) (stop func()) {
+	var (
+		rp   = newReporter(f.clock())
+		done = make(chan struct{})
+		wg   sync.WaitGroup
+	)
+	f.rep.Store(rp)
+
+	write := func() {
+		b, err := json.Marshal(rp.flush())
+		if err == nil {
+			_, err = w.Write(append(b, '\n'))
+		}
+		if err != nil && onErr != nil {
+			onErr(err)
+		}
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				write()
+			case <-done:
+				write()
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(done)
+			wg.Wait()
+		})
+	}
+}
+
+// reports returns the reporter started with StartReporter(), if any.
+func (f *FastCache) reports() *reporter {
+	rp, _ := f.rep.Load().(*reporter)
+	return rp
+}
@@ -0,0 +1,63 @@
+package fastcache
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestReporter(t *testing.T) {
+	var (
+		c    = &stepClock{now: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)}
+		f    = New(nil, &Options{Clock: c})
+		buf  bytes.Buffer
+		stop = f.StartReporter(&buf, time.Hour, func(err error) { t.Fatal(err) })
+	)
+	f.reports().hit("orders")
+	f.reports().hit("orders")
+	f.reports().hit("orders")
+	f.reports().miss("orders", time.Millisecond*10)
+	f.reports().miss("holdings", time.Millisecond*20)
+	f.reports().miss("holdings", time.Millisecond*40)
+	c.now = c.now.Add(time.Minute)
+	stop()
+	stop()
+
+	var rep Report
+	if err := json.Unmarshal(buf.Bytes(), &rep); err != nil {
+		t.Fatalf("error decoding report: %v: %s", err, buf.Bytes())
+	}
+	if !rep.From.Equal(c.now.Add(-time.Minute)) || !rep.To.Equal(c.now) {
+		t.Fatalf("expected the report to be timed with the clock but got %v - %v", rep.From, rep.To)
+	}
+
+	exp := map[string]GroupReport{
+		"orders":   {Hits: 3, Misses: 1, HitRatio: 0.75, AvgMissLatencyMS: 10, MaxMissLatencyMS: 10},
+		"holdings": {Misses: 2, AvgMissLatencyMS: 30, MaxMissLatencyMS: 40},
+	}
+	for g, e := range exp {
+		if rep.Groups[g] != e {
+			t.Fatalf("expected %s report %+v but got %+v", g, e, rep.Groups[g])
+		}
+	}
+
+	// Compression savings.
+	var (
+		o     = (&Options{Compression: CompressionsOptions{Enabled: true, MinLength: 100}}).compile()
+		big   = Item{Blob: bytes.Repeat([]byte("a"), 1000)}
+		small = Item{Blob: []byte("a")}
+	)
+	f.compress("orders", &big, o)
+	f.compress("orders", &small, o)
+	cr := f.reports().flush().Groups["orders"]
+	if cr.Compressed != 1 || cr.CompressedBytesIn != 1000 || cr.CompressedBytesOut != int64(len(big.Blob)) ||
+		cr.Uncompressed != 1 || cr.UncompressedBytes != 1 || cr.CompressionSaved <= 0.9 {
+		t.Fatalf("unexpected compression report %+v", cr)
+	}
+
+	// Counts are reset after every report.
+	if r := f.reports().flush(); len(r.Groups) != 0 {
+		t.Fatalf("expected empty report but got %+v", r.Groups)
+	}
+}
@@ -0,0 +1,38 @@
+package fastcache
+
+import (
+	"sync/atomic"
+)
+
+// SetShedding enables or disables the load shedding mode in which only the
+// cache is served, for instance, during origin overload events. Cache misses
+// are responded to with 503 (Service Unavailable) instead of invoking the
+// handlers, stale responses retained in the store (Options.
+// StaleWhileRevalidate) are served regardless of their windows without being
+// refreshed, and responses aren't revalidated. Requests that bypass the cache
+// are served as usual. It can be toggled at runtime.
+func (f *FastCache) SetShedding(on bool) {
+	var v int32
+	if on {
+		v = 1
+	}
+	atomic.StoreInt32(&f.shed, v)
+}
+
+// SetShedSignal sets a load signal callback, for instance, one that checks
+// the origin's error rate or the number of in-flight requests. Load is shed
+// as with SetShedding(true) while it returns true. It's called on every
+// cached request and should be cheap. nil removes it.
+func (f *FastCache) SetShedSignal(fn func() bool) {
+	f.shedSignal.Store(fn)
+}
+
+// Shedding checks if load is being shed, that is, if the load shedding mode
+// is enabled or the load signal is set.
+func (f *FastCache) Shedding() bool {
+	if atomic.LoadInt32(&f.shed) == 1 {
+		return true
+	}
+	fn, _ := f.shedSignal.Load().(func() bool)
+	return fn != nil && fn()
+}
@@ -0,0 +1,71 @@
+package fastcache
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// call is an in-flight or completed singleflight call.
+type call struct {
+	done chan struct{}
+	val  interface{}
+	err  error
+}
+
+// singleflight deduplicates concurrent calls with the same key so that only
+// one of them executes while the others wait for and share its result.
+// The zero value is ready to use.
+type singleflight struct {
+	mu    sync.Mutex
+	calls map[string]*call
+}
+
+// do executes fn for the key if there's no call in-flight for it, or waits
+// for the in-flight call to finish, or for ctx to be done. shared is true
+// if the result came from another caller's execution. If fn panics, the
+// waiting callers get an error and the panic is propagated to the caller
+// that executed fn.
+func (g *singleflight) do(ctx context.Context, key string, fn func() (interface{}, error)) (v interface{}, err error, shared bool) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*call)
+	}
+
+	if c, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+
+		select {
+		case <-c.done:
+			return c.val, c.err, true
+		case <-ctx.Done():
+			return nil, ctx.Err(), true
+		}
+	}
+
+	c := &call{done: make(chan struct{})}
+	g.calls[key] = c
+	g.mu.Unlock()
+
+	var p interface{}
+	defer func() {
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		close(c.done)
+
+		if p != nil {
+			panic(p)
+		}
+	}()
+
+	func() {
+		defer func() {
+			if p = recover(); p != nil {
+				c.val, c.err = nil, fmt.Errorf("panic in call: %v", p)
+			}
+		}()
+		c.val, c.err = fn()
+	}()
+	return c.val, c.err, false
+}
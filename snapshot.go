@@ -0,0 +1,175 @@
+package fastcache
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"time"
+	"unicode/utf8"
+
+	"github.com/valyala/fasthttp"
+	"github.com/zerodha/fastglue"
+)
+
+// Snapshot is a cached Item exported as a self-contained JSON bundle with
+// its body decompressed, so that what was served for a URI can be examined
+// and reproduced elsewhere, for instance, by importing it into a local cache.
+type Snapshot struct {
+	Namespace string `json:"namespace"`
+	Group     string `json:"group"`
+
+	// URI is the cache key of the Item as exposed by X-Cache-Key (see
+	// Options.DebugSecret).
+	URI string `json:"uri"`
+
+	ContentType          string              `json:"content_type"`
+	ETag                 string              `json:"etag"`
+	StatusCode           int                 `json:"status_code"`
+	Location             string              `json:"location,omitempty"`
+	Vary                 string              `json:"vary,omitempty"`
+	Headers              map[string][]string `json:"headers,omitempty"`
+	CacheControl         string              `json:"cache_control,omitempty"`
+	Expires              string              `json:"expires,omitempty"`
+	UpstreamETag         string              `json:"upstream_etag,omitempty"`
+	UpstreamLastModified string              `json:"upstream_last_modified,omitempty"`
+	CreatedAt            time.Time           `json:"created_at"`
+	StaleAt              time.Time           `json:"stale_at"`
+	Hits                 int64               `json:"hits"`
+
+	// Compression and CompressionReason are of the Item as it was stored.
+	// Body is always decompressed.
+	Compression       string `json:"compression,omitempty"`
+	CompressionReason string `json:"compression_reason,omitempty"`
+
+	// Body is the response body. Bodies that aren't valid UTF-8 are base64
+	// encoded with BodyEncoding set to "base64".
+	Body         string `json:"body"`
+	BodyEncoding string `json:"body_encoding,omitempty"`
+}
+
+// ExportSnapshot exports the Item for a single URI in a namespace->group as a
+// Snapshot.
+func (f *FastCache) ExportSnapshot(namespace, group, uri string) (Snapshot, error) {
+	it, err := f.Inspect(namespace, group, uri)
+	if err != nil {
+		return Snapshot{}, err
+	}
+
+	b := it.Blob
+	if it.Compression != "" {
+		if b, err = decompress(it.Compression, b); err != nil {
+			return Snapshot{}, err
+		}
+	}
+
+	s := Snapshot{
+		Namespace:            namespace,
+		Group:                group,
+		URI:                  uri,
+		ContentType:          it.ContentType,
+		ETag:                 it.ETag,
+		StatusCode:           it.StatusCode,
+		Location:             it.Location,
+		Vary:                 it.Vary,
+		Headers:              it.Headers,
+		CacheControl:         it.CacheControl,
+		Expires:              it.Expires,
+		UpstreamETag:         it.UpstreamETag,
+		UpstreamLastModified: it.UpstreamLastModified,
+		CreatedAt:            it.CreatedAt,
+		StaleAt:              it.StaleAt,
+		Hits:                 it.Hits,
+		Compression:          it.Compression,
+		CompressionReason:    it.CompressionReason,
+		Body:                 string(b),
+	}
+	if !utf8.Valid(b) {
+		s.Body = base64.StdEncoding.EncodeToString(b)
+		s.BodyEncoding = "base64"
+	}
+
+	return s, nil
+}
+
+// ImportSnapshot caches the Item of a Snapshot under its namespace, group and
+// URI for ttl. The body is stored uncompressed. The StaleAt of the Snapshot
+// is retained, so snapshots of stale Items are imported as stale.
+func (f *FastCache) ImportSnapshot(s Snapshot, ttl time.Duration) error {
+	if s.Namespace == "" || s.Group == "" || s.URI == "" {
+		return errors.New("empty namespace, group or uri in snapshot")
+	}
+
+	b := []byte(s.Body)
+	switch s.BodyEncoding {
+	case "":
+	case "base64":
+		d, err := base64.StdEncoding.DecodeString(s.Body)
+		if err != nil {
+			return err
+		}
+		b = d
+	default:
+		return errors.New("unknown body_encoding in snapshot: " + s.BodyEncoding)
+	}
+
+	return f.put(s.Namespace, s.Group, s.URI, Item{
+		ContentType:          s.ContentType,
+		ETag:                 s.ETag,
+		StatusCode:           s.StatusCode,
+		Location:             s.Location,
+		Vary:                 s.Vary,
+		Headers:              s.Headers,
+		CacheControl:         s.CacheControl,
+		Expires:              s.Expires,
+		UpstreamETag:         s.UpstreamETag,
+		UpstreamLastModified: s.UpstreamLastModified,
+		CreatedAt:            s.CreatedAt,
+		StaleAt:              s.StaleAt,
+		Blob:                 b,
+	}, ttl)
+}
+
+// SnapshotHandler returns a fastglue handler for exporting and importing
+// Snapshots. GET requests with the `namespace`, `group` and `uri` params
+// return the Snapshot of a cached URI and POST requests with a Snapshot JSON
+// body and the `ttl` param (eg: 10m) import it. Requests are authenticated
+// like InvalidationHandler().
+func (f *FastCache) SnapshotHandler(secret string) fastglue.FastRequestHandler {
+	return func(r *fastglue.Request) error {
+		if !validSecret(r.RequestCtx.Request.Header.Peek("Authorization"), secret) {
+			return r.SendErrorEnvelope(fasthttp.StatusUnauthorized, "invalid secret", nil, "")
+		}
+
+		if !r.RequestCtx.IsPost() {
+			var (
+				ns    = string(r.RequestCtx.QueryArgs().Peek("namespace"))
+				group = string(r.RequestCtx.QueryArgs().Peek("group"))
+				uri   = string(r.RequestCtx.QueryArgs().Peek("uri"))
+			)
+			if ns == "" || group == "" || uri == "" {
+				return r.SendErrorEnvelope(fasthttp.StatusBadRequest, "empty `namespace`, `group` or `uri`", nil, "")
+			}
+
+			s, err := f.ExportSnapshot(ns, group, uri)
+			if err != nil {
+				return r.SendErrorEnvelope(fasthttp.StatusNotFound, "error exporting snapshot: "+err.Error(), nil, "")
+			}
+			return r.SendEnvelope(s)
+		}
+
+		ttl, err := time.ParseDuration(string(r.RequestCtx.QueryArgs().Peek("ttl")))
+		if err != nil || ttl <= 0 {
+			return r.SendErrorEnvelope(fasthttp.StatusBadRequest, "invalid `ttl`", nil, "")
+		}
+
+		var s Snapshot
+		if err := json.Unmarshal(r.RequestCtx.PostBody(), &s); err != nil {
+			return r.SendErrorEnvelope(fasthttp.StatusBadRequest, "invalid JSON: "+err.Error(), nil, "")
+		}
+		if err := f.ImportSnapshot(s, ttl); err != nil {
+			return r.SendErrorEnvelope(fasthttp.StatusBadRequest, "error importing snapshot: "+err.Error(), nil, "")
+		}
+
+		return r.SendEnvelope(true)
+	}
+}
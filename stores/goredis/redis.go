@@ -14,6 +14,21 @@
 //
 // ```
 //
+// If Config.LRUMaxItems or Config.LRUMaxBytes is set, the last access time of
+// every URI in a group is tracked in a ZSET (CACHE:XX1234:marketwatch:_lru)
+// and a janitor evicts the least recently used URIs from groups that exceed
+// the limits. With Config.LRUCostWeight, the access times are weighted by the
+// URIs' costs.
+//
+// If Config.NamespaceEpochs is set, a per-namespace epoch counter
+// (CACHE:_epoch:XX1234) is mixed into the namespace's keys
+// (CACHE:XX1234@2:marketwatch) once the namespace has been purged.
+//
+// The epoch counters and the deduplicated blobs (Config.DedupBlobs,
+// CACHE:_blob:<sha1>) share the key space of namespaces, so the namespaces
+// _epoch and _blob (as they appear in keys) are reserved and operations on
+// them return errors.
+//
 // This library also supports async mode which is dependent on the go-redis
 // library. ref:
 // https://github.com/redis/go-redis/discussions/2597#discussioncomment-5909650
@@ -23,9 +38,19 @@ package goredis
 
 import (
 	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
+	"hash/fnv"
 	"io"
 	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 	"unsafe"
 
@@ -34,22 +59,170 @@ import (
 )
 
 const (
+	sep = ":"
+
 	// Store keys.
 	keyEtag        = "_etag"
 	keyCtype       = "_ctype"
 	keyCompression = "_comp"
 	keyBlob        = "_blob"
+	keyCompReason  = "_compreason"
+	keyStatus      = "_status"
+	keyLocation    = "_location"
+	keyCreated     = "_created"
+	keyVary        = "_vary"
+	keyHeaders     = "_headers"
+	keyUETag       = "_uetag"
+	keyULastMod    = "_ulastmod"
+	keyCacheCtrl   = "_cc"
+	keyExpires     = "_expires"
+	keyHits        = "_hits"
+	keyStaleAt     = "_staleat"
+	keyBlobRef     = "_blobref"
+	keyCost        = "_cost"
+	keySize        = "_size"
 
-	sep = ":"
+	// keyLRU is the suffix of the per-group LRU index ZSET.
+	keyLRU = sep + "_lru"
+
+	// keyEpoch is the prefix of the per-namespace epoch counter keys.
+	keyEpoch = "_epoch" + sep
+
+	// keyDedupBlob is the prefix of the content-addressed blob keys
+	// (Config.DedupBlobs).
+	keyDedupBlob = "_blob" + sep
+
+	// numFields is the number of hash fields stored per URI.
+	numFields = 19
+
+	// fieldCost is the index of the cost field in fields().
+	fieldCost = 15
 )
 
+// Names of the background jobs reported by JobStats().
+const (
+	JobLRUJanitor  = "lru_janitor"
+	JobAsyncWriter = "async_writer"
+)
+
+// hashBlob is a Lua script that returns the hex SHA1 of a URI's blob. The
+// reference of deduplicated blobs (ARGV[2]) is their SHA1.
+var hashBlob = redis.NewScript(`
+local b = redis.call("HGET", KEYS[1], ARGV[1])
+if not b then
+	return false
+end
+if b == "" then
+	local ref = redis.call("HGET", KEYS[1], ARGV[2])
+	if ref and ref ~= "" then
+		return ref
+	end
+end
+return redis.sha1hex(b)
+`)
+
+// putBlob is a Lua script that writes a deduplicated blob unless it exists
+// with a longer TTL than ARGV[2] (ms), so that a blob outlives all the URIs
+// that reference it. A TTL of 0 doesn't expire it.
+var putBlob = redis.NewScript(`
+local ttl = tonumber(ARGV[2])
+local pttl = redis.call("PTTL", KEYS[1])
+if pttl == -1 or (ttl > 0 and pttl >= ttl) then
+	return 0
+end
+if ttl > 0 then
+	redis.call("SET", KEYS[1], ARGV[1], "PX", ttl)
+else
+	redis.call("SET", KEYS[1], ARGV[1])
+end
+return 1
+`)
+
+// incrHits is a Lua script that increments the hit count of a URI if it's
+// cached, so that counts don't create keys for evicted URIs without a TTL.
+var incrHits = redis.NewScript(`
+if redis.call("HEXISTS", KEYS[1], ARGV[1]) == 0 then
+	return 0
+end
+return redis.call("HINCRBY", KEYS[1], ARGV[2], 1)
+`)
+
+// staleGroup is a Lua script that marks all the URIs in a group stale as of
+// ARGV[1] (unix ms), unless they're already stale, and caps the group's TTL
+// at ARGV[2] (ms). ARGV[3] and ARGV[4] are the prefixes of the content type
+// and stale-at fields.
+var staleGroup = redis.NewScript(`
+local now, ttl = tonumber(ARGV[1]), tonumber(ARGV[2])
+local n = string.len(ARGV[3])
+for _, f in ipairs(redis.call("HKEYS", KEYS[1])) do
+	if string.sub(f, 1, n) == ARGV[3] then
+		local field = ARGV[4] .. string.sub(f, n + 1)
+		local at = tonumber(redis.call("HGET", KEYS[1], field))
+		if not at or at == 0 or at > now then
+			redis.call("HSET", KEYS[1], field, ARGV[1])
+		end
+	end
+end
+
+local pttl = redis.call("PTTL", KEYS[1])
+if pttl == -1 or pttl > ttl then
+	redis.call("PEXPIRE", KEYS[1], ttl)
+end
+return 0
+`)
+
+// getRange is a Lua script that returns a byte range of a URI's blob as
+// described by fastcache.RangeGetter along with the blob's size. The
+// reference of deduplicated blobs (ARGV[4]) is returned instead as {ref}.
+var getRange = redis.NewScript(`
+local b = redis.call("HGET", KEYS[1], ARGV[1])
+if not b then
+	return false
+end
+if b == "" then
+	local ref = redis.call("HGET", KEYS[1], ARGV[4])
+	if ref and ref ~= "" then
+		return {ref}
+	end
+end
+
+local size = string.len(b)
+local off, n = tonumber(ARGV[2]), tonumber(ARGV[3])
+if off < 0 then
+	off = math.max(size + off, 0)
+end
+if off >= size then
+	return {"", size}
+end
+
+local last = size
+if n >= 0 then
+	last = math.min(off + n, size)
+end
+return {string.sub(b, off + 1, last), size}
+`)
+
 // Store is a Redis cache store implementation for fastcache.
 type Store struct {
 	config Config
 	putBuf chan putReq
 	cn     redis.UniversalClient
 	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
 	logger *log.Logger
+
+	// dirty is the set of group keys written to since the last LRU trim.
+	dirty map[string]struct{}
+	mu    sync.Mutex
+
+	// jobs are the run stats of the background jobs.
+	jobs   map[string]*fastcache.JobStats
+	jobsMu sync.Mutex
+
+	// pending is the number of async writes read from the buffer by the
+	// worker that are yet to be committed.
+	pending int64
 }
 
 type Config struct {
@@ -57,8 +230,15 @@ type Config struct {
 	// Note: in async mode you can use braces to specify the {sharding_key}.
 	Prefix string
 
+	// PrefixFunc, if set, provides the prefix instead of Prefix. It is
+	// called once in New(), for instance, to compose the prefix from the
+	// environment with fastcache.EnvPrefix() so that deployments sharing
+	// a Redis never collide.
+	PrefixFunc func() string
+
 	// Async enables async writes to Redis. If enabled, writes are buffered
-	// and committed in batches.
+	// and committed in batches. Deletes wait for the writes buffered before
+	// them to be committed so that they can't resurrect deleted items.
 	Async bool
 	// AsyncMaxCommitSize is the maximum number of writes to commit in a single
 	// batch.
@@ -70,6 +250,78 @@ type Config struct {
 	// AsyncCommitFreq is the time to wait before committing the write
 	// buffer.
 	AsyncCommitFreq time.Duration
+	// LRUMaxItems, if set, bounds the number of URIs cached in a group. The
+	// last access time of every URI is tracked in a ZSET index alongside the
+	// group and a janitor periodically evicts the least recently used URIs
+	// from groups that exceed the limit.
+	LRUMaxItems int
+	// LRUMaxBytes, if set, bounds the total size of the blobs cached in a
+	// group like LRUMaxItems bounds their number. The size of every blob is
+	// recorded along with it. Both the limits can be set.
+	LRUMaxBytes int64
+	// LRUJanitorFreq is the interval at which the janitor trims groups.
+	// Default is 10 seconds.
+	LRUJanitorFreq time.Duration
+	// LRUCostWeight, if set, weights the LRU index by the cost of
+	// regenerating URIs (fastcache.Item.Cost) so that expensive responses
+	// outlive cheap ones. Every access scores a URI as if it happened
+	// Cost*LRUCostWeight later, for instance, with a weight of 1000, a
+	// response that took 10ms to generate is evicted after the cheap ones
+	// accessed up to 10s after it. It costs an additional round trip for
+	// every Get.
+	LRUCostWeight float64
+
+	// NamespaceEpochs enables a per-namespace epoch counter that is mixed
+	// into the keys of the namespace (CACHE:XX1234@<epoch>:marketwatch).
+	// PurgeNamespace() bumps the epoch with an INCR which instantly
+	// invalidates everything in the namespace without deleting any keys.
+	// The old keys age out with their TTLs. This costs an additional GET
+	// of the epoch for every operation. The @ in namespaces is escaped as
+	// @@ in keys, so enabling it orphans the keys of such namespaces.
+	NamespaceEpochs bool
+
+	// KeyObfuscator, if set, replaces the namespaces and URIs in keys with
+	// their obfuscated versions, for instance, with HMACObfuscator(secret),
+	// so that they can't be enumerated or correlated by others with read
+	// access to a shared Redis. It has to be deterministic. Groups aren't
+	// obfuscated so that they can be deleted with glob patterns.
+	KeyObfuscator func(string) string
+
+	// NamespaceHashTags wraps namespaces in keys in Redis Cluster hash tags
+	// (CACHE:{XX1234}:marketwatch) so that all the keys of a namespace,
+	// including its epoch counter, are in the same hash slot, which makes
+	// multi-key operations on a namespace cluster-safe. As a namespace lives
+	// on a single shard, a hot namespace (eg: a heavy user) skews the load
+	// towards its shard.
+	NamespaceHashTags bool
+
+	// NamespaceBuckets, if set, instead prefixes namespaces with the hash
+	// tag of one of as many buckets (CACHE:{3}XX1234:marketwatch), picked by
+	// the hash of the namespace. Namespaces are still confined to a slot, but
+	// the number of slots in use is bounded, so buckets can be set to a
+	// multiple of the number of shards and their slots spread evenly across
+	// the shards. Namespaces in a bucket share a shard. Changing it changes
+	// all the keys.
+	NamespaceBuckets int
+
+	// DedupBlobs enables content-addressed storage of blobs. Blobs of at
+	// least DedupMinSize bytes are stored once by their SHA1 hash
+	// (CACHE:_blob:<sha1>) and URIs reference them, so that identical
+	// responses cached under many namespaces are stored once. Blobs expire
+	// with the longest TTL of the URIs that reference them, and orphaned
+	// blobs age out with their TTLs. URIs whose blobs have expired (eg:
+	// after their TTLs are extended with Touch()) are misses. Items without
+	// TTLs aren't deduplicated.
+	DedupBlobs bool
+
+	// DedupMinSize is the size in bytes below which blobs aren't
+	// deduplicated. Default is 1024.
+	DedupMinSize int
+
+	// Clock is the source of time of the LRU index, StaleGroup() and the
+	// job stats. Default is fastcache.SystemClock.
+	Clock fastcache.Clock
+
 	// Logger is an optional logger to which errors will be written. If it is
 	// nil, errors are sent to io.Discard.
 	Logger *log.Logger
@@ -78,11 +330,25 @@ type Config struct {
 // New creates a new Redis instance. prefix is the prefix to apply to all
 // cache keys.
 func New(cfg Config, client redis.UniversalClient) *Store {
+	if cfg.PrefixFunc != nil {
+		cfg.Prefix = cfg.PrefixFunc()
+	}
+	if cfg.DedupBlobs && cfg.DedupMinSize < 1 {
+		cfg.DedupMinSize = 1024
+	}
+	if cfg.Clock == nil {
+		cfg.Clock = fastcache.SystemClock
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
 	s := &Store{
 		config: cfg,
 		cn:     client,
 		logger: cfg.Logger,
-		ctx:    context.TODO(),
+		ctx:    ctx,
+		cancel: cancel,
+		dirty:  make(map[string]struct{}),
+		jobs:   make(map[string]*fastcache.JobStats),
 	}
 
 	if s.logger == nil {
@@ -105,28 +371,378 @@ func New(cfg Config, client redis.UniversalClient) *Store {
 		}
 
 		s.putBuf = make(chan putReq, s.config.AsyncBufSize)
+		s.jobs[JobAsyncWriter] = &fastcache.JobStats{}
+		s.wg.Add(1)
 		go s.putWorker()
 	}
 
+	// Start the LRU janitor if enabled.
+	if s.lru() {
+		if s.config.LRUJanitorFreq == 0 {
+			s.config.LRUJanitorFreq = 10 * time.Second
+		}
+		s.jobs[JobLRUJanitor] = &fastcache.JobStats{}
+		s.wg.Add(1)
+		go s.janitor()
+	}
+
 	return s
 }
 
 // Get gets the fastcache.Item for a single cached URI.
 func (s *Store) Get(namespace, group, uri string) (fastcache.Item, error) {
+	uri = s.obfuscate(uri)
+	resp, err := s.hmget(namespace, group, uri, s.fields(uri))
+	if err != nil {
+		return fastcache.Item{}, err
+	}
+
+	out, err := s.parseItem(resp)
+	if err != nil {
+		return out, err
+	}
+	if ref, _ := resp[numFields-2].(string); ref != "" && len(out.Blob) == 0 {
+		if out.Blob, err = s.getBlobRef(ref); err != nil {
+			return fastcache.Item{}, err
+		}
+	}
+
+	return out, nil
+}
+
+// GetMeta gets the fastcache.Item for a single cached URI without the blob.
+func (s *Store) GetMeta(namespace, group, uri string) (fastcache.Item, error) {
+	uri = s.obfuscate(uri)
+	resp, err := s.hmget(namespace, group, uri, s.fields(uri)[:numFields-2])
+	if err != nil {
+		return fastcache.Item{}, err
+	}
+
+	return s.parseItem(resp)
+}
+
+// GetBlob gets the blob of a single cached URI.
+func (s *Store) GetBlob(namespace, group, uri string) ([]byte, error) {
+	uri = s.obfuscate(uri)
+	namespace, err := s.epoch(namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := s.cn.HMGet(s.ctx, s.key(namespace, group), s.field(keyBlob, uri), s.field(keyBlobRef, uri)).Result()
+	if err != nil {
+		return nil, err
+	}
+	b, ok := resp[0].(string)
+	if !ok {
+		return nil, errors.New("goredis-store: nil received")
+	}
+	if ref, _ := resp[1].(string); ref != "" && b == "" {
+		return s.getBlobRef(ref)
+	}
+
+	return stringToBytes(b), nil
+}
+
+// HashBlob returns the hex SHA1 hash of the blob of a single cached URI. The
+// hash is computed in Redis with a Lua script without fetching the blob.
+func (s *Store) HashBlob(namespace, group, uri string) (string, error) {
+	uri = s.obfuscate(uri)
+	namespace, err := s.epoch(namespace)
+	if err != nil {
+		return "", err
+	}
+
+	h, err := hashBlob.Run(s.ctx, s.cn, []string{s.key(namespace, group)}, s.field(keyBlob, uri), s.field(keyBlobRef, uri)).Text()
+	if err != nil {
+		if err == redis.Nil {
+			return "", errors.New("goredis-store: nil received")
+		}
+		return "", err
+	}
+
+	return h, nil
+}
+
+// GetRange gets a byte range of the blob of a single cached URI along with
+// the blob's size. The range is sliced in Redis with a Lua script so that
+// only the range is transferred.
+func (s *Store) GetRange(namespace, group, uri string, offset, n int64) ([]byte, int64, error) {
+	uri = s.obfuscate(uri)
+	namespace, err := s.epoch(namespace)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	res, err := getRange.Run(s.ctx, s.cn, []string{s.key(namespace, group)}, s.field(keyBlob, uri), offset, n, s.field(keyBlobRef, uri)).Slice()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, 0, errors.New("goredis-store: nil received")
+		}
+		return nil, 0, err
+	}
+	if len(res) == 1 {
+		ref, _ := res[0].(string)
+		return s.getBlobRefRange(ref, offset, n)
+	}
+	if len(res) != 2 {
+		return nil, 0, errors.New("goredis-store: invalid range received")
+	}
+
+	b, _ := res[0].(string)
+	size, _ := res[1].(int64)
+	if b == "" {
+		return nil, size, nil
+	}
+	return stringToBytes(b), size, nil
+}
+
+// IncrHits increments the hit count of a cached URI and returns the new
+// count. 0 is returned if the URI isn't cached.
+func (s *Store) IncrHits(namespace, group, uri string) (int64, error) {
+	uri = s.obfuscate(uri)
+	namespace, err := s.epoch(namespace)
+	if err != nil {
+		return 0, err
+	}
+
+	return incrHits.Run(s.ctx, s.cn, []string{s.key(namespace, group)}, s.field(keyCtype, uri), s.field(keyHits, uri)).Int64()
+}
+
+// TTL returns the remaining TTL of a cached URI. As TTLs are applied to
+// whole groups, this is the TTL of the URI's group. A zero TTL is returned
+// for keys without a TTL and fastcache.ErrNotCached for missing keys.
+func (s *Store) TTL(namespace, group, uri string) (time.Duration, error) {
+	namespace, err := s.epoch(namespace)
+	if err != nil {
+		return 0, err
+	}
+
+	ttl, err := s.cn.PTTL(s.ctx, s.key(namespace, group)).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	// -2 is returned for missing keys and -1 for keys without a TTL.
+	switch {
+	case ttl == -2:
+		return 0, fastcache.ErrNotCached
+	case ttl < 0:
+		return 0, nil
+	}
+	return ttl, nil
+}
+
+// Touch extends the TTL of a cached URI. As TTLs are applied to whole
+// groups, the TTL of the URI's group is extended.
+func (s *Store) Touch(namespace, group, uri string, ttl time.Duration) error {
+	namespace, err := s.epoch(namespace)
+	if err != nil {
+		return err
+	}
+
+	key := s.key(namespace, group)
+	p := s.cn.Pipeline()
+	p.PExpire(s.ctx, key, ttl)
+	if s.lru() {
+		p.PExpire(s.ctx, s.lruKey(key), ttl)
+	}
+
+	_, err = p.Exec(s.ctx)
+	return err
+}
+
+// hmget gets the given hash fields of a cached URI.
+func (s *Store) hmget(namespace, group, uri string, fields []string) ([]interface{}, error) {
+	namespace, err := s.epoch(namespace)
+	if err != nil {
+		return nil, err
+	}
+
 	var (
-		out fastcache.Item
+		key = s.key(namespace, group)
+		cmd *redis.SliceCmd
 	)
-	// Get content_type, etag, blob in that order.
-	cmd := s.cn.HMGet(s.ctx, s.key(namespace, group), s.field(keyCtype, uri), s.field(keyEtag, uri), s.field(keyCompression, uri), s.field(keyBlob, uri))
-	if err := cmd.Err(); err != nil {
-		return out, err
+	switch {
+	case s.lru() && s.config.LRUCostWeight > 0:
+		// The URI's access time is weighted by its cost, which has to be
+		// fetched first.
+		resp, err := s.cn.HMGet(s.ctx, key, fields...).Result()
+		if err != nil || resp[0] == nil {
+			return resp, err
+		}
+
+		var cost time.Duration
+		if c, ok := resp[fieldCost].(string); ok {
+			n, _ := strconv.ParseInt(c, 10, 64)
+			cost = time.Duration(n)
+		}
+		if err := s.cn.ZAddArgs(s.ctx, s.lruKey(key), redis.ZAddArgs{XX: true, Members: []redis.Z{{Score: s.lruScore(cost), Member: uri}}}).Err(); err != nil {
+			return nil, err
+		}
+		return resp, nil
+
+	case s.lru():
+		// Update the URI's access time in the LRU index (if it exists) in the
+		// same round trip.
+		p := s.cn.Pipeline()
+		cmd = p.HMGet(s.ctx, key, fields...)
+		p.ZAddArgs(s.ctx, s.lruKey(key), redis.ZAddArgs{XX: true, Members: []redis.Z{{Score: s.lruScore(0), Member: uri}}})
+		if _, err := p.Exec(s.ctx); err != nil {
+			return nil, err
+		}
+
+	default:
+		cmd = s.cn.HMGet(s.ctx, key, fields...)
 	}
 
-	resp, err := cmd.Result()
+	return cmd.Result()
+}
+
+// lruScore returns the LRU index score of a URI accessed now, weighted by
+// its cost with LRUCostWeight.
+func (s *Store) lruScore(cost time.Duration) float64 {
+	return float64(s.config.Clock.Now().UnixNano()) + float64(cost)*s.config.LRUCostWeight
+}
+
+// GetMulti gets the fastcache.Items for multiple URIs in a group in a single
+// HMGET. URIs that are not in the cache are returned as empty Items. The
+// access times of the cached URIs are updated in the LRU index like Get()
+// does.
+func (s *Store) GetMulti(namespace, group string, uris ...string) ([]fastcache.Item, error) {
+	namespace, err := s.epoch(namespace)
 	if err != nil {
-		return out, err
+		return nil, err
+	}
+
+	var (
+		key    = s.key(namespace, group)
+		fields = make([]string, 0, len(uris)*numFields)
+	)
+	for _, uri := range uris {
+		fields = append(fields, s.fields(s.obfuscate(uri))...)
+	}
+
+	resp, err := s.cn.HMGet(s.ctx, key, fields...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		out     = make([]fastcache.Item, len(uris))
+		refs    = make(map[int]string)
+		members []redis.Z
+	)
+	for n, uri := range uris {
+		// Missing items are left empty.
+		r := resp[n*numFields : (n+1)*numFields]
+		item, err := s.parseItem(r)
+		if err != nil {
+			continue
+		}
+		out[n] = item
+		if ref, _ := r[numFields-2].(string); ref != "" && len(item.Blob) == 0 {
+			refs[n] = ref
+		}
+
+		if s.lru() {
+			var cost time.Duration
+			if c, ok := r[fieldCost].(string); ok && s.config.LRUCostWeight > 0 {
+				v, _ := strconv.ParseInt(c, 10, 64)
+				cost = time.Duration(v)
+			}
+			members = append(members, redis.Z{Score: s.lruScore(cost), Member: s.obfuscate(uri)})
+		}
+	}
+
+	// Update the access times of the cached URIs in the LRU index (if it
+	// exists).
+	if len(members) > 0 {
+		if err := s.cn.ZAddArgs(s.ctx, s.lruKey(key), redis.ZAddArgs{XX: true, Members: members}).Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(refs) == 0 {
+		return out, nil
+	}
+
+	// Fetch the deduplicated blobs. Items whose blobs have expired are left
+	// empty.
+	var (
+		p    = s.cn.Pipeline()
+		cmds = make(map[int]*redis.StringCmd, len(refs))
+	)
+	for n, ref := range refs {
+		cmds[n] = p.Get(s.ctx, s.blobRefKey(ref))
+	}
+	if _, err := p.Exec(s.ctx); err != nil && err != redis.Nil {
+		return nil, err
+	}
+	for n, cmd := range cmds {
+		b, err := cmd.Result()
+		if err != nil {
+			out[n] = fastcache.Item{}
+			continue
+		}
+		out[n].Blob = stringToBytes(b)
+	}
+
+	return out, nil
+}
+
+// getBlobRef gets a deduplicated blob by its reference.
+func (s *Store) getBlobRef(ref string) ([]byte, error) {
+	b, err := s.cn.Get(s.ctx, s.blobRefKey(ref)).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, errors.New("goredis-store: nil received")
+		}
+		return nil, err
+	}
+	return stringToBytes(b), nil
+}
+
+// getBlobRefRange gets a byte range of a deduplicated blob by its reference
+// along with the blob's size, like GetRange().
+func (s *Store) getBlobRefRange(ref string, offset, n int64) ([]byte, int64, error) {
+	key := s.blobRefKey(ref)
+	size, err := s.cn.StrLen(s.ctx, key).Result()
+	if err != nil {
+		return nil, 0, err
+	}
+	if size == 0 {
+		return nil, 0, errors.New("goredis-store: nil received")
+	}
+
+	if offset < 0 {
+		offset = size + offset
+		if offset < 0 {
+			offset = 0
+		}
+	}
+	if offset >= size {
+		return nil, size, nil
+	}
+	last := size
+	if n >= 0 && offset+n < size {
+		last = offset + n
 	}
+	if last == offset {
+		return nil, size, nil
+	}
+
+	b, err := s.cn.GetRange(s.ctx, key, offset, last-1).Result()
+	if err != nil {
+		return nil, 0, err
+	}
+	return stringToBytes(b), size, nil
+}
 
+// parseItem parses the result of an HMGET of fields() into an Item. If the
+// blob (the last field) isn't in the result, the Item is returned without it.
+func (s *Store) parseItem(resp []interface{}) (fastcache.Item, error) {
+	var out fastcache.Item
 	if resp[0] == nil || resp[1] == nil || resp[2] == nil {
 		return out, errors.New("goredis-store: nil received")
 	}
@@ -149,13 +765,46 @@ func (s *Store) Get(namespace, group, uri string) (fastcache.Item, error) {
 		return out, errors.New("goredis-store: invalid type received for etag")
 	}
 
-	if blob, ok := resp[3].(string); ok {
+	// Metadata fields may be missing in items written by older versions.
+	out.CompressionReason, _ = resp[3].(string)
+	if status, ok := resp[4].(string); ok {
+		out.StatusCode, _ = strconv.Atoi(status)
+	}
+	out.Location, _ = resp[5].(string)
+	if created, ok := resp[6].(string); ok {
+		ms, _ := strconv.ParseInt(created, 10, 64)
+		out.CreatedAt = fromMillis(ms)
+	}
+	out.Vary, _ = resp[7].(string)
+	if h, ok := resp[8].(string); ok {
+		out.Headers = decodeHeaders(h)
+	}
+	out.UpstreamETag, _ = resp[9].(string)
+	out.UpstreamLastModified, _ = resp[10].(string)
+	out.CacheControl, _ = resp[11].(string)
+	out.Expires, _ = resp[12].(string)
+	if hits, ok := resp[13].(string); ok {
+		out.Hits, _ = strconv.ParseInt(hits, 10, 64)
+	}
+	if stale, ok := resp[14].(string); ok {
+		ms, _ := strconv.ParseInt(stale, 10, 64)
+		out.StaleAt = fromMillis(ms)
+	}
+	if cost, ok := resp[fieldCost].(string); ok {
+		n, _ := strconv.ParseInt(cost, 10, 64)
+		out.Cost = time.Duration(n)
+	}
+
+	if len(resp) < numFields {
+		return out, nil
+	}
+	if blob, ok := resp[numFields-1].(string); ok {
 		out.Blob = stringToBytes(blob)
 	} else {
 		return out, errors.New("goredis-store: invalid type received for blob")
 	}
 
-	return out, err
+	return out, nil
 }
 
 type putReq struct {
@@ -164,10 +813,26 @@ type putReq struct {
 	uri       string
 	b         fastcache.Item
 	ttl       time.Duration
+
+	// del, if set, is a delete that is executed by the async worker after
+	// committing the puts queued before it, so that puts of purged items
+	// that are still in the buffer can't resurrect them. Its result is
+	// sent on done.
+	del  func() error
+	done chan error
 }
 
 // Put sets a value to given session but stored only on commit
 func (s *Store) Put(namespace, group, uri string, b fastcache.Item, ttl time.Duration) error {
+	uri = s.obfuscate(uri)
+
+	// The epoch is resolved at the time of the put and not when an async
+	// write is committed.
+	namespace, err := s.epoch(namespace)
+	if err != nil {
+		return err
+	}
+
 	if s.config.Async {
 		// In async mode, we need to copy b.Blob to prevent fasthttp from reusing
 		// the buffer, as we will use the buffer in a separate goroutine beyond
@@ -177,7 +842,7 @@ func (s *Store) Put(namespace, group, uri string, b fastcache.Item, ttl time.Dur
 		b.Blob = blobCopy
 
 		// Send the put request to the async buffer channel.
-		s.putBuf <- putReq{namespace, group, uri, b, ttl}
+		s.putBuf <- putReq{namespace: namespace, group: group, uri: uri, b: b, ttl: ttl}
 		return nil
 	}
 
@@ -185,17 +850,30 @@ func (s *Store) Put(namespace, group, uri string, b fastcache.Item, ttl time.Dur
 }
 
 func (s *Store) putSync(namespace, group, uri string, b fastcache.Item, ttl time.Duration) error {
-	var (
-		key = s.key(namespace, group)
-		p   = s.cn.Pipeline()
-	)
+	p := s.cn.Pipeline()
+	if err := s.pipePut(p, namespace, group, uri, b, ttl); err != nil {
+		return err
+	}
 
-	if err := p.HMSet(s.ctx, key, map[string]interface{}{
-		s.field(keyCtype, uri):       b.ContentType,
-		s.field(keyEtag, uri):        b.ETag,
-		s.field(keyCompression, uri): b.Compression,
-		s.field(keyBlob, uri):        b.Blob,
-	}).Err(); err != nil {
+	_, err := p.Exec(s.ctx)
+	return err
+}
+
+// pipePut queues the commands for writing an Item into a pipeline.
+func (s *Store) pipePut(p redis.Pipeliner, namespace, group, uri string, b fastcache.Item, ttl time.Duration) error {
+	key := s.key(namespace, group)
+
+	// Store the blob content-addressed and reference it.
+	var ref string
+	if s.config.DedupBlobs && ttl > 0 && len(b.Blob) >= s.config.DedupMinSize {
+		h := sha1.Sum(b.Blob)
+		ref = hex.EncodeToString(h[:])
+		if err := putBlob.Eval(s.ctx, p, []string{s.blobRefKey(ref)}, b.Blob, ttl.Milliseconds()).Err(); err != nil {
+			return err
+		}
+	}
+
+	if err := p.HMSet(s.ctx, key, s.values(uri, b, ref)).Err(); err != nil {
 		return err
 	}
 
@@ -208,11 +886,29 @@ func (s *Store) putSync(namespace, group, uri string, b fastcache.Item, ttl time
 		}
 	}
 
-	_, err := p.Exec(s.ctx)
-	return err
+	// Record the access in the group's LRU index.
+	if s.lru() {
+		lru := s.lruKey(key)
+		if err := p.ZAdd(s.ctx, lru, redis.Z{Score: s.lruScore(b.Cost), Member: uri}).Err(); err != nil {
+			return err
+		}
+		if ttl.Seconds() > 0 {
+			if err := p.PExpire(s.ctx, lru, ttl).Err(); err != nil {
+				return err
+			}
+		}
+
+		s.mu.Lock()
+		s.dirty[key] = struct{}{}
+		s.mu.Unlock()
+	}
+
+	return nil
 }
 
 func (s *Store) putWorker() {
+	defer s.wg.Done()
+
 	var (
 		p      = s.cn.Pipeline()
 		count  = 0
@@ -221,82 +917,676 @@ func (s *Store) putWorker() {
 	defer ticker.Stop()
 
 	for {
+		atomic.StoreInt64(&s.pending, int64(count))
+
 		select {
 		case req := <-s.putBuf:
-			key := s.key(req.namespace, req.group)
-			if err := p.HMSet(s.ctx, key, map[string]interface{}{
-				s.field(keyCtype, req.uri):       req.b.ContentType,
-				s.field(keyEtag, req.uri):        req.b.ETag,
-				s.field(keyCompression, req.uri): req.b.Compression,
-				s.field(keyBlob, req.uri):        req.b.Blob,
-			}).Err(); err != nil {
-				// Log error
+			if req.del != nil {
+				if count > 0 {
+					s.commit(s.ctx, p, count)
+					count = 0
+					p = s.cn.Pipeline()
+				}
+				req.done <- req.del()
 				continue
 			}
 
-			// Set a TTL for the group. If one uri in cache group sets a TTL
-			// then entire group will be evicted. This is a shortcoming of using
-			// hashmap as a group. Needs some work here.
-			if req.ttl.Seconds() > 0 {
-				if err := p.PExpire(s.ctx, key, req.ttl).Err(); err != nil {
-					// Log error
-					continue
-				}
+			if err := s.pipePut(p, req.namespace, req.group, req.uri, req.b, req.ttl); err != nil {
+				// Log error
+				continue
 			}
 
 			if count++; count > s.config.AsyncMaxCommitSize {
-				if _, err := p.Exec(s.ctx); err != nil {
-					s.logger.Printf("goredis-store: error committing async writes: %v", err)
-				}
+				s.commit(s.ctx, p, count)
 				count = 0
 				p = s.cn.Pipeline()
 			}
 
 		case <-ticker.C:
 			if count > 0 {
-				if _, err := p.Exec(s.ctx); err != nil {
-					s.logger.Printf("goredis-store: error committing ticker async writes: %v", err)
-				}
+				s.commit(s.ctx, p, count)
 				count = 0
 				p = s.cn.Pipeline()
 			}
 
 		case <-s.ctx.Done():
+			s.flush(p, count)
 			return
 		}
 	}
 }
 
-// Del deletes a single cached URI.
+// flush commits the writes remaining in the async buffer along with the
+// uncommitted writes in the pipeline on Close().
+func (s *Store) flush(p redis.Pipeliner, count int) {
+	for {
+		select {
+		case req := <-s.putBuf:
+			if req.del != nil {
+				req.done <- errors.New("goredis-store: store closed")
+				continue
+			}
+			if err := s.pipePut(p, req.namespace, req.group, req.uri, req.b, req.ttl); err == nil {
+				count++
+			}
+		default:
+			if count > 0 {
+				s.commit(context.Background(), p, count)
+			}
+			return
+		}
+	}
+}
+
+// commit commits the async writes in the pipeline and records the run.
+func (s *Store) commit(ctx context.Context, p redis.Pipeliner, count int) {
+	_, err := p.Exec(ctx)
+	if err != nil {
+		s.logger.Printf("goredis-store: error committing async writes: %v", err)
+		count = 0
+	}
+	s.recordJob(JobAsyncWriter, count, err)
+}
+
+// Close stops the async writer, committing the buffered writes, and the LRU
+// janitor. The Store shouldn't be used after it's closed. The Redis client
+// is not closed.
+func (s *Store) Close() error {
+	s.cancel()
+	s.wg.Wait()
+	return nil
+}
+
+// janitor periodically trims groups that exceed LRUMaxItems or LRUMaxBytes.
+func (s *Store) janitor() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(s.config.LRUJanitorFreq)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.runJanitor(); err != nil {
+				s.logger.Printf("goredis-store: error trimming groups: %v", err)
+			}
+
+		case <-s.ctx.Done():
+			return
+		}
+	}
+}
+
+// runJanitor trims the groups and records the run.
+func (s *Store) runJanitor() error {
+	n, err := s.trim()
+	s.recordJob(JobLRUJanitor, n, err)
+	return err
+}
+
+// JobStats returns the run stats of the enabled background jobs, the LRU
+// janitor (JobLRUJanitor) and the async writer (JobAsyncWriter). The async
+// writer's stats include the number of writes waiting to be committed and
+// the size of the write buffer.
+func (s *Store) JobStats() map[string]fastcache.JobStats {
+	s.jobsMu.Lock()
+	defer s.jobsMu.Unlock()
+
+	out := make(map[string]fastcache.JobStats, len(s.jobs))
+	for name, j := range s.jobs {
+		out[name] = *j
+	}
+
+	// The writes waiting in the buffer and the uncommitted ones.
+	if j, ok := out[JobAsyncWriter]; ok {
+		j.Queued = int64(len(s.putBuf)) + atomic.LoadInt64(&s.pending)
+		j.QueueSize = int64(cap(s.putBuf))
+		out[JobAsyncWriter] = j
+	}
+	return out
+}
+
+// RunJob runs a background job immediately. Running the LRU janitor trims
+// the groups and running the async writer commits the buffered writes.
+func (s *Store) RunJob(name string) error {
+	if _, ok := s.jobs[name]; !ok {
+		return fastcache.ErrUnknownJob
+	}
+
+	switch name {
+	case JobLRUJanitor:
+		return s.runJanitor()
+	case JobAsyncWriter:
+		// The worker commits the pending writes before sequenced operations.
+		return s.sequence(func() error { return nil })
+	}
+	return fastcache.ErrUnknownJob
+}
+
+// recordJob records a run of a background job.
+func (s *Store) recordJob(name string, n int, err error) {
+	s.jobsMu.Lock()
+	s.jobs[name].Record(s.config.Clock.Now(), n, err)
+	s.jobsMu.Unlock()
+}
+
+// trim evicts the least recently used URIs from the groups written to since
+// the last run that have more than LRUMaxItems URIs or whose blobs add up to
+// more than LRUMaxBytes. It returns the number of URIs evicted. On errors,
+// the groups that weren't trimmed are retried in the next run.
+func (s *Store) trim() (int, error) {
+	s.mu.Lock()
+	keys := s.dirty
+	s.dirty = make(map[string]struct{})
+	s.mu.Unlock()
+
+	evicted := 0
+	for key := range keys {
+		n, err := s.trimGroup(key)
+		if err != nil {
+			s.mu.Lock()
+			for k := range keys {
+				s.dirty[k] = struct{}{}
+			}
+			s.mu.Unlock()
+			return evicted, err
+		}
+		evicted += n
+		delete(keys, key)
+	}
+
+	return evicted, nil
+}
+
+// trimGroup evicts the least recently used URIs of a group as described by
+// trim() and returns the number of URIs evicted.
+func (s *Store) trimGroup(key string) (int, error) {
+	uris, err := s.evictions(key)
+	if err != nil || len(uris) == 0 {
+		return 0, err
+	}
+
+	// Delete the URIs' fields and remove them from the index.
+	var (
+		fields  = make([]string, 0, len(uris)*numFields)
+		members = make([]interface{}, len(uris))
+	)
+	for i, uri := range uris {
+		fields = append(fields, s.fields(uri)...)
+		members[i] = uri
+	}
+	p := s.cn.Pipeline()
+	p.HDel(s.ctx, key, fields...)
+	p.ZRem(s.ctx, s.lruKey(key), members...)
+	if _, err := p.Exec(s.ctx); err != nil {
+		return 0, err
+	}
+	return len(uris), nil
+}
+
+// evictions returns the least recently used URIs of a group that have to be
+// evicted to bring it within LRUMaxItems and LRUMaxBytes.
+func (s *Store) evictions(key string) ([]string, error) {
+	var (
+		lru = s.lruKey(key)
+		max = int64(s.config.LRUMaxItems)
+	)
+	if s.config.LRUMaxBytes == 0 {
+		n, err := s.cn.ZCard(s.ctx, lru).Result()
+		if err != nil || n <= max {
+			return nil, err
+		}
+		return s.cn.ZRange(s.ctx, lru, 0, n-max-1).Result()
+	}
+
+	// The sizes of all the URIs, oldest first, are needed to find the ones
+	// to evict.
+	uris, err := s.cn.ZRange(s.ctx, lru, 0, -1).Result()
+	if err != nil || len(uris) == 0 {
+		return nil, err
+	}
+	fields := make([]string, len(uris))
+	for i, uri := range uris {
+		fields[i] = s.field(keySize, uri)
+	}
+	res, err := s.cn.HMGet(s.ctx, key, fields...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		sizes = make([]int64, len(uris))
+		total int64
+	)
+	for i, v := range res {
+		if v, ok := v.(string); ok {
+			sizes[i], _ = strconv.ParseInt(v, 10, 64)
+		}
+		total += sizes[i]
+	}
+
+	// Evict the URIs beyond LRUMaxItems and then as many as it takes to
+	// fit in LRUMaxBytes.
+	n := 0
+	if max > 0 && int64(len(uris)) > max {
+		n = len(uris) - int(max)
+	}
+	for i := 0; i < n; i++ {
+		total -= sizes[i]
+	}
+	for ; n < len(uris) && total > s.config.LRUMaxBytes; n++ {
+		total -= sizes[n]
+	}
+
+	return uris[:n], nil
+}
+
+// Del deletes a single cached URI. In async mode, the delete is sequenced
+// after the buffered writes.
 func (s *Store) Del(namespace, group, uri string) error {
-	return s.cn.HDel(s.ctx, s.key(namespace, group),
-		s.field(keyCtype, uri),
-		s.field(keyEtag, uri),
-		s.field(keyCompression, uri),
-		s.field(keyBlob, uri)).Err()
+	uri = s.obfuscate(uri)
+	if s.config.Async {
+		return s.sequence(func() error {
+			return s.del(namespace, group, uri)
+		})
+	}
+	return s.del(namespace, group, uri)
+}
+
+func (s *Store) del(namespace, group, uri string) error {
+	namespace, err := s.epoch(namespace)
+	if err != nil {
+		return err
+	}
+
+	key := s.key(namespace, group)
+	if !s.lru() {
+		return s.cn.HDel(s.ctx, key, s.fields(uri)...).Err()
+	}
+
+	p := s.cn.Pipeline()
+	p.HDel(s.ctx, key, s.fields(uri)...)
+	p.ZRem(s.ctx, s.lruKey(key), uri)
+	_, err = p.Exec(s.ctx)
+	return err
 }
 
-// DelGroup deletes a whole group.
+// DelGroup deletes a whole group. Groups can be glob patterns (eg: orders:*)
+// in which case all the matching groups in the namespace are found with SCAN
+// and deleted. In async mode, the delete is sequenced after the buffered writes.
 func (s *Store) DelGroup(namespace string, groups ...string) error {
+	if s.config.Async {
+		return s.sequence(func() error {
+			return s.delGroup(namespace, groups...)
+		})
+	}
+	return s.delGroup(namespace, groups...)
+}
+
+func (s *Store) delGroup(namespace string, groups ...string) error {
+	namespace, err := s.epoch(namespace)
+	if err != nil {
+		return err
+	}
+
 	p := s.cn.Pipeline()
 	for _, group := range groups {
-		if err := p.Del(s.ctx, s.key(namespace, group)).Err(); err != nil {
+		if isPattern(group) {
+			keys, err := s.scan(escapePattern(s.key(namespace, "")) + group)
+			if err != nil {
+				return err
+			}
+
+			// LRU indexes of the groups also match the pattern.
+			for _, k := range keys {
+				if err := p.Del(s.ctx, k).Err(); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		key := s.key(namespace, group)
+		if err := p.Del(s.ctx, key).Err(); err != nil {
+			return err
+		}
+		if s.lru() {
+			if err := p.Del(s.ctx, s.lruKey(key)).Err(); err != nil {
+				return err
+			}
+		}
+	}
+
+	_, err = p.Exec(s.ctx)
+	return err
+}
+
+// StaleGroup marks all the URIs in groups stale instead of deleting them and
+// caps the TTL of the groups at ttl, as described by fastcache.GroupStaler.
+// In async mode, it's sequenced after the buffered writes.
+func (s *Store) StaleGroup(namespace string, ttl time.Duration, groups ...string) error {
+	if s.config.Async {
+		return s.sequence(func() error {
+			return s.staleGroup(namespace, ttl, groups...)
+		})
+	}
+	return s.staleGroup(namespace, ttl, groups...)
+}
+
+func (s *Store) staleGroup(namespace string, ttl time.Duration, groups ...string) error {
+	namespace, err := s.epoch(namespace)
+	if err != nil {
+		return err
+	}
+
+	var keys []string
+	for _, group := range groups {
+		if !isPattern(group) {
+			keys = append(keys, s.key(namespace, group))
+			continue
+		}
+
+		matches, err := s.scan(escapePattern(s.key(namespace, "")) + group)
+		if err != nil {
 			return err
 		}
+		for _, k := range matches {
+			// LRU indexes of the groups also match the pattern.
+			if !strings.HasSuffix(k, keyLRU) {
+				keys = append(keys, k)
+			}
+		}
 	}
 
-	_, err := p.Exec(s.ctx)
+	// The script is run per key as the groups may be on different
+	// cluster slots.
+	var (
+		p   = s.cn.Pipeline()
+		now = s.config.Clock.Now().UnixNano() / int64(time.Millisecond)
+	)
+	for _, key := range keys {
+		staleGroup.Eval(s.ctx, p, []string{key}, now, ttl.Milliseconds(), keyCtype+"_", keyStaleAt+"_")
+		if s.lru() {
+			p.PExpire(s.ctx, s.lruKey(key), ttl)
+		}
+	}
+
+	_, err = p.Exec(s.ctx)
 	return err
 }
 
+// sequence queues a delete in the async write buffer and waits for the
+// worker to execute it after committing the writes queued before it.
+func (s *Store) sequence(del func() error) error {
+	done := make(chan error, 1)
+	s.putBuf <- putReq{del: del, done: done}
+	return <-done
+}
+
+// PurgeNamespace invalidates everything cached under a namespace. If
+// Config.NamespaceEpochs is enabled, the namespace's epoch is bumped, which
+// is O(1), and otherwise, all the groups in the namespace are deleted.
+func (s *Store) PurgeNamespace(namespace string) error {
+	if !s.config.NamespaceEpochs {
+		return s.DelGroup(namespace, "*")
+	}
+
+	if err := reserved(s.keyNamespace(namespace)); err != nil {
+		return err
+	}
+	return s.cn.Incr(s.ctx, s.epochKey(namespace)).Err()
+}
+
+// epoch returns the namespace as it appears in keys (keyNamespace()),
+// suffixed with its current epoch if Config.NamespaceEpochs is enabled. The
+// epoch isn't suffixed if it's disabled or if the namespace has never been
+// purged.
+func (s *Store) epoch(namespace string) (string, error) {
+	ns := s.keyNamespace(namespace)
+	if err := reserved(ns); err != nil {
+		return "", err
+	}
+	if !s.config.NamespaceEpochs {
+		return ns, nil
+	}
+
+	n, err := s.cn.Get(s.ctx, s.epochKey(namespace)).Int64()
+	if err != nil {
+		if err == redis.Nil {
+			return ns, nil
+		}
+		return "", err
+	}
+
+	return ns + "@" + strconv.FormatInt(n, 10), nil
+}
+
+// keyNamespace returns a namespace as it appears in keys, that is, obfuscated
+// (Config.KeyObfuscator) and hash tagged (Config.NamespaceHashTags). With
+// Config.NamespaceEpochs, the @ of the epoch suffix is escaped as @@ in the
+// namespace, so that a namespace like a@2 doesn't share the keys of the
+// namespace a at the epoch 2 (a@@2 and a@2).
+func (s *Store) keyNamespace(namespace string) string {
+	ns := s.obfuscate(namespace)
+	if s.config.NamespaceEpochs {
+		ns = strings.ReplaceAll(ns, "@", "@@")
+	}
+	return s.tag(ns)
+}
+
+// reserved checks if a namespace, as it appears in keys, is reserved for the
+// epoch counter and deduplicated blob keys, with whose keys (and patterns)
+// those of its groups would collide.
+func reserved(ns string) error {
+	if ns+sep == keyEpoch || ns+sep == keyDedupBlob {
+		return errors.New("goredis-store: namespace '" + ns + "' is reserved")
+	}
+	return nil
+}
+
+// scan returns all the keys matching a pattern. On Redis cluster, all the
+// master nodes are scanned.
+func (s *Store) scan(pattern string) ([]string, error) {
+	var (
+		out []string
+		mu  sync.Mutex
+	)
+	scan := func(ctx context.Context, c redis.UniversalClient) error {
+		iter := c.Scan(ctx, 0, pattern, 1000).Iterator()
+		for iter.Next(ctx) {
+			mu.Lock()
+			out = append(out, iter.Val())
+			mu.Unlock()
+		}
+		return iter.Err()
+	}
+
+	if cc, ok := s.cn.(*redis.ClusterClient); ok {
+		err := cc.ForEachMaster(s.ctx, func(ctx context.Context, c *redis.Client) error {
+			return scan(ctx, c)
+		})
+		return out, err
+	}
+
+	return out, scan(s.ctx, s.cn)
+}
+
+// isPattern checks if a group name is a glob pattern.
+func isPattern(s string) bool {
+	return strings.ContainsAny(s, "*?[")
+}
+
+// escapePattern escapes the glob characters in a string.
+func escapePattern(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		if strings.ContainsRune(`*?[]\`, c) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// key returns the key of a group. namespace is as returned by epoch().
 func (s *Store) key(namespace, group string) string {
 	return s.config.Prefix + namespace + sep + group
 }
 
+// blobRefKey returns the key of a deduplicated blob.
+func (s *Store) blobRefKey(ref string) string {
+	return s.config.Prefix + keyDedupBlob + ref
+}
+
+// epochKey returns the key of the epoch counter of a namespace. It's in the
+// same hash slot as the namespace's keys.
+func (s *Store) epochKey(namespace string) string {
+	return s.config.Prefix + keyEpoch + s.keyNamespace(namespace)
+}
+
+// tag wraps a namespace in a Redis Cluster hash tag ({namespace}) with
+// Config.NamespaceHashTags, or prefixes it with the hash tag of its bucket
+// ({3}namespace) with Config.NamespaceBuckets.
+func (s *Store) tag(namespace string) string {
+	if n := s.config.NamespaceBuckets; n > 0 {
+		h := fnv.New32a()
+		h.Write([]byte(namespace))
+		return "{" + strconv.FormatUint(uint64(h.Sum32()%uint32(n)), 10) + "}" + namespace
+	}
+	if s.config.NamespaceHashTags {
+		return "{" + namespace + "}"
+	}
+	return namespace
+}
+
+// obfuscate obfuscates a namespace or a URI with Config.KeyObfuscator.
+func (s *Store) obfuscate(v string) string {
+	if s.config.KeyObfuscator == nil {
+		return v
+	}
+	return s.config.KeyObfuscator(v)
+}
+
+// HMACObfuscator returns a Config.KeyObfuscator that replaces namespaces and
+// URIs with the hex encoded HMAC-SHA256 (truncated to 128 bits) of them,
+// keyed with secret.
+func HMACObfuscator(secret []byte) func(string) string {
+	return func(v string) string {
+		h := hmac.New(sha256.New, secret)
+		h.Write([]byte(v))
+		return hex.EncodeToString(h.Sum(nil)[:16])
+	}
+}
+
+// lru checks if the LRU index and janitor are enabled.
+func (s *Store) lru() bool {
+	return s.config.LRUMaxItems > 0 || s.config.LRUMaxBytes > 0
+}
+
+// lruKey returns the key of the LRU index ZSET of a group key.
+func (s *Store) lruKey(key string) string {
+	return key + keyLRU
+}
+
 func (s *Store) field(key string, uri string) string {
 	return key + "_" + uri
 }
 
+// fields returns the hash fields of a URI in the order in which
+// parseItem() reads them. The blob is always the last field.
+func (s *Store) fields(uri string) []string {
+	return []string{
+		s.field(keyCtype, uri),
+		s.field(keyEtag, uri),
+		s.field(keyCompression, uri),
+		s.field(keyCompReason, uri),
+		s.field(keyStatus, uri),
+		s.field(keyLocation, uri),
+		s.field(keyCreated, uri),
+		s.field(keyVary, uri),
+		s.field(keyHeaders, uri),
+		s.field(keyUETag, uri),
+		s.field(keyULastMod, uri),
+		s.field(keyCacheCtrl, uri),
+		s.field(keyExpires, uri),
+		s.field(keyHits, uri),
+		s.field(keyStaleAt, uri),
+		s.field(keyCost, uri),
+		s.field(keySize, uri),
+		s.field(keyBlobRef, uri),
+		s.field(keyBlob, uri),
+	}
+}
+
+// values returns the hash field->value map of an Item for HMSET.
+func (s *Store) values(uri string, b fastcache.Item, ref string) map[string]interface{} {
+	blob := b.Blob
+	if ref != "" {
+		blob = nil
+	}
+
+	out := map[string]interface{}{
+		s.field(keyCtype, uri):       b.ContentType,
+		s.field(keyEtag, uri):        b.ETag,
+		s.field(keyCompression, uri): b.Compression,
+		s.field(keyBlob, uri):        blob,
+		s.field(keyBlobRef, uri):     ref,
+		s.field(keyCompReason, uri):  b.CompressionReason,
+		s.field(keyStatus, uri):      b.StatusCode,
+		s.field(keyLocation, uri):    b.Location,
+		s.field(keyCreated, uri):     toMillis(b.CreatedAt),
+		s.field(keyVary, uri):        b.Vary,
+		s.field(keyHeaders, uri):     encodeHeaders(b.Headers),
+		s.field(keyUETag, uri):       b.UpstreamETag,
+		s.field(keyULastMod, uri):    b.UpstreamLastModified,
+		s.field(keyCacheCtrl, uri):   b.CacheControl,
+		s.field(keyExpires, uri):     b.Expires,
+		s.field(keyHits, uri):        0,
+		s.field(keyStaleAt, uri):     toMillis(b.StaleAt),
+		s.field(keyCost, uri):        int64(b.Cost),
+	}
+	if s.config.LRUMaxBytes > 0 {
+		out[s.field(keySize, uri)] = len(b.Blob)
+	}
+	return out
+}
+
+// encodeHeaders encodes an Item's headers as JSON. No headers are encoded
+// as an empty string.
+func encodeHeaders(h map[string][]string) string {
+	if len(h) == 0 {
+		return ""
+	}
+	b, _ := json.Marshal(h)
+	return string(b)
+}
+
+// decodeHeaders decodes JSON encoded headers.
+func decodeHeaders(s string) map[string][]string {
+	if s == "" {
+		return nil
+	}
+	var h map[string][]string
+	_ = json.Unmarshal([]byte(s), &h)
+	return h
+}
+
+// toMillis converts a time to unix milliseconds. The zero time is 0.
+func toMillis(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// fromMillis converts unix milliseconds to a time. 0 is the zero time.
+func fromMillis(ms int64) time.Time {
+	if ms <= 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ms*int64(time.Millisecond))
+}
+
 // stringToBytes converts string to byte slice using unsafe.
 // Copied from: https://github.com/go-redis/redis/blob/803592d454c49277405303fa6261dc090db542d2/internal/util/unsafe.go
 // Context: https://github.com/redis/go-redis/issues/1618
@@ -0,0 +1,263 @@
+//go:build chaos
+// +build chaos
+
+package goredis
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/require"
+	"github.com/zerodha/fastcache/v4"
+)
+
+// The chaos tests drive the async store while injecting Redis latency,
+// connection resets and OOM errors, and assert that there are no goroutine
+// leaks, that memory stays bounded and that only writes in failed commits
+// are lost. Run them with:
+//
+//	go test -tags chaos -v -run Chaos ./...
+
+// errOOM is the error Redis returns for writes when maxmemory is reached.
+var errOOM = errors.New("OOM command not allowed when used memory > 'maxmemory'")
+
+// chaosHook is a go-redis hook that injects latency and OOM errors into
+// pipelines and counts the writes in failed pipelines.
+type chaosHook struct {
+	latency time.Duration
+	oomRate float64
+
+	mu     sync.Mutex
+	rnd    *rand.Rand
+	failed int64
+}
+
+func (h *chaosHook) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (h *chaosHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return next
+}
+
+func (h *chaosHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		h.mu.Lock()
+		var (
+			delay = time.Duration(h.rnd.Int63n(int64(h.latency) + 1))
+			oom   = h.rnd.Float64() < h.oomRate
+		)
+		h.mu.Unlock()
+
+		time.Sleep(delay)
+
+		err := errOOM
+		if !oom {
+			err = next(ctx, cmds)
+		}
+		if err != nil {
+			atomic.AddInt64(&h.failed, int64(countWrites(cmds)))
+		}
+		return err
+	}
+}
+
+// countWrites returns the number of HMSETs (cache writes) in a pipeline.
+func countWrites(cmds []redis.Cmder) int {
+	n := 0
+	for _, c := range cmds {
+		if c.Name() == "hmset" {
+			n++
+		}
+	}
+	return n
+}
+
+// chaosProxy is a TCP proxy to Redis that periodically resets all the
+// open connections.
+type chaosProxy struct {
+	ln     net.Listener
+	target string
+
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+	wg    sync.WaitGroup
+}
+
+func newChaosProxy(t *testing.T, target string) *chaosProxy {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	p := &chaosProxy{ln: ln, target: target, conns: make(map[net.Conn]struct{})}
+	p.wg.Add(1)
+	go p.serve()
+	return p
+}
+
+func (p *chaosProxy) serve() {
+	defer p.wg.Done()
+	for {
+		c, err := p.ln.Accept()
+		if err != nil {
+			return
+		}
+
+		u, err := net.Dial("tcp", p.target)
+		if err != nil {
+			c.Close()
+			continue
+		}
+
+		p.mu.Lock()
+		p.conns[c] = struct{}{}
+		p.conns[u] = struct{}{}
+		p.mu.Unlock()
+
+		p.wg.Add(2)
+		go p.pipe(c, u)
+		go p.pipe(u, c)
+	}
+}
+
+func (p *chaosProxy) pipe(dst, src net.Conn) {
+	defer p.wg.Done()
+	io.Copy(dst, src)
+	dst.Close()
+	src.Close()
+
+	p.mu.Lock()
+	delete(p.conns, dst)
+	delete(p.conns, src)
+	p.mu.Unlock()
+}
+
+// reset closes all the open connections.
+func (p *chaosProxy) reset() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for c := range p.conns {
+		c.Close()
+	}
+}
+
+func (p *chaosProxy) close() {
+	p.ln.Close()
+	p.reset()
+	p.wg.Wait()
+}
+
+func TestChaosAsyncStore(t *testing.T) {
+	const (
+		numWrites = 5000
+		resetFreq = time.Millisecond * 50
+	)
+
+	mr, err := miniredis.Run()
+	require.NoError(t, err)
+	defer mr.Close()
+
+	var (
+		goroutines = runtime.NumGoroutine()
+		heap       = int64(heapAlloc())
+	)
+
+	proxy := newChaosProxy(t, mr.Addr())
+	hook := &chaosHook{
+		latency: time.Millisecond * 5,
+		oomRate: 0.1,
+		rnd:     rand.New(rand.NewSource(1)),
+	}
+	client := redis.NewClient(&redis.Options{
+		Addr:         proxy.ln.Addr().String(),
+		MaxRetries:   -1,
+		DialTimeout:  time.Second,
+		ReadTimeout:  time.Second,
+		WriteTimeout: time.Second,
+	})
+	client.AddHook(hook)
+
+	store := New(Config{
+		Prefix:             "CHAOS:",
+		Async:              true,
+		AsyncMaxCommitSize: 50,
+		AsyncBufSize:       100,
+		AsyncCommitFreq:    time.Millisecond * 10,
+	}, client)
+
+	// Reset connections periodically while writing.
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ticker := time.NewTicker(resetFreq)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				proxy.reset()
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	item := fastcache.Item{ContentType: "text/plain", ETag: "etag", Blob: make([]byte, 1024)}
+	for i := 0; i < numWrites; i++ {
+		require.NoError(t, store.Put("namespace", "group", fmt.Sprintf("/%d", i), item, time.Minute))
+	}
+	close(stop)
+	wg.Wait()
+
+	// Wait for the buffer to be drained and committed.
+	time.Sleep(time.Millisecond * 500)
+
+	// Only the writes in failed commits may be lost.
+	var lost int64
+	for i := 0; i < numWrites; i++ {
+		if mr.HGet("CHAOS:namespace:group", fmt.Sprintf("%s_/%d", keyEtag, i)) == "" {
+			lost++
+		}
+	}
+	failed := atomic.LoadInt64(&hook.failed)
+	t.Logf("writes: %d, lost: %d, in failed commits: %d", numWrites, lost, failed)
+	require.LessOrEqual(t, lost, failed, "writes lost beyond the failed commits")
+	require.Less(t, lost, int64(numWrites), "all writes lost")
+
+	// Stop the worker and tear everything down.
+	require.NoError(t, store.Close())
+	client.Close()
+	proxy.close()
+
+	// No goroutine leaks.
+	var n int
+	for i := 0; i < 50; i++ {
+		if n = runtime.NumGoroutine(); n <= goroutines {
+			break
+		}
+		time.Sleep(time.Millisecond * 100)
+	}
+	require.LessOrEqual(t, n, goroutines, "goroutines leaked")
+
+	// Memory isn't retained beyond the written data.
+	require.Less(t, int64(heapAlloc())-heap, int64(64<<20), "unbounded memory growth")
+}
+
+// heapAlloc returns the live heap size after a GC.
+func heapAlloc() uint64 {
+	runtime.GC()
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	return m.HeapAlloc
+}
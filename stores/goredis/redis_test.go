@@ -2,6 +2,8 @@ package goredis
 
 import (
 	"context"
+	"crypto/sha1"
+	"encoding/hex"
 	"fmt"
 	"testing"
 	"time"
@@ -12,6 +14,13 @@ import (
 	"github.com/zerodha/fastcache/v4"
 )
 
+// fixedClock is a fastcache.Clock that's stuck at a time.
+type fixedClock time.Time
+
+func (c fixedClock) Now() time.Time {
+	return time.Time(c)
+}
+
 func newTestRedis(t *testing.T) *redis.Client {
 	mr, err := miniredis.Run()
 	if err != nil {
@@ -84,3 +93,714 @@ func TestNew(t *testing.T) {
 		})
 	}
 }
+
+func TestGetMulti(t *testing.T) {
+	redisClient := newTestRedis(t)
+
+	pool := New(Config{Prefix: "TEST:"}, redisClient)
+	testItem := fastcache.Item{
+		ETag:        "etag",
+		ContentType: "content_type",
+		Blob:        []byte("{}"),
+	}
+
+	assert.Nil(t, pool.Put("namespace", "group", "/a", testItem, time.Second*3))
+	assert.Nil(t, pool.Put("namespace", "group", "/c", testItem, time.Second*3))
+
+	items, err := pool.GetMulti("namespace", "group", "/a", "/b", "/c")
+	assert.Nil(t, err)
+	assert.Equal(t, []fastcache.Item{testItem, {}, testItem}, items)
+}
+
+func TestPrefixFunc(t *testing.T) {
+	redisClient := newTestRedis(t)
+
+	pool := New(Config{Prefix: "TEST:", PrefixFunc: func() string { return "TEST:staging:" }}, redisClient)
+	assert.Nil(t, pool.Put("namespace", "group", "/a", fastcache.Item{ContentType: "content_type"}, 0))
+
+	n, err := redisClient.Exists(context.Background(), "TEST:staging:namespace:group").Result()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), n)
+}
+
+func TestLRUTrim(t *testing.T) {
+	redisClient := newTestRedis(t)
+
+	pool := New(Config{
+		Prefix:         "TEST:",
+		LRUMaxItems:    2,
+		LRUJanitorFreq: time.Hour,
+	}, redisClient)
+	testItem := fastcache.Item{
+		ETag:        "etag",
+		ContentType: "content_type",
+		Blob:        []byte("{}"),
+	}
+
+	for _, uri := range []string{"/a", "/b", "/c"} {
+		assert.Nil(t, pool.Put("namespace", "group", uri, testItem, time.Second*3))
+	}
+
+	// Access /a so that /b becomes the least recently used.
+	_, err := pool.Get("namespace", "group", "/a")
+	assert.Nil(t, err)
+
+	evicted, err := pool.trim()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, evicted)
+
+	_, err = pool.Get("namespace", "group", "/b")
+	assert.NotNil(t, err)
+	for _, uri := range []string{"/a", "/c"} {
+		item, err := pool.Get("namespace", "group", uri)
+		assert.Nil(t, err)
+		assert.Equal(t, testItem, item)
+	}
+
+	// Reads through GetMulti() update the index too, so /c becomes the least
+	// recently used rather than /a.
+	assert.Nil(t, pool.Put("namespace", "group", "/d", testItem, time.Second*3))
+	_, err = pool.GetMulti("namespace", "group", "/d", "/missing", "/a")
+	assert.Nil(t, err)
+
+	evicted, err = pool.trim()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, evicted)
+
+	_, err = pool.Get("namespace", "group", "/c")
+	assert.NotNil(t, err)
+}
+
+func TestLRUTrimRetry(t *testing.T) {
+	mr, err := miniredis.Run()
+	assert.Nil(t, err)
+	defer mr.Close()
+
+	pool := New(Config{
+		Prefix:         "TEST:",
+		LRUMaxItems:    1,
+		LRUJanitorFreq: time.Hour,
+	}, redis.NewClient(&redis.Options{Addr: mr.Addr()}))
+	testItem := fastcache.Item{ETag: "etag", ContentType: "content_type", Blob: []byte("{}")}
+	for _, group := range []string{"a", "b"} {
+		for _, uri := range []string{"/a", "/b"} {
+			assert.Nil(t, pool.Put("namespace", group, uri, testItem, time.Second*3))
+		}
+	}
+
+	// The groups that couldn't be trimmed are trimmed in the next run.
+	mr.Close()
+	_, err = pool.trim()
+	assert.NotNil(t, err)
+
+	assert.Nil(t, mr.Restart())
+	evicted, err := pool.trim()
+	assert.Nil(t, err)
+	assert.Equal(t, 2, evicted)
+}
+
+func TestLRUMaxBytes(t *testing.T) {
+	redisClient := newTestRedis(t)
+
+	pool := New(Config{
+		Prefix:         "TEST:",
+		LRUMaxBytes:    10,
+		LRUJanitorFreq: time.Hour,
+	}, redisClient)
+	testItem := fastcache.Item{
+		ETag:        "etag",
+		ContentType: "content_type",
+		Blob:        []byte("1234"),
+	}
+
+	for _, uri := range []string{"/a", "/b", "/c"} {
+		assert.Nil(t, pool.Put("namespace", "group", uri, testItem, time.Second*3))
+	}
+
+	// Access /a so that /b becomes the least recently used. Evicting it
+	// brings the group from 12 to 8 bytes.
+	_, err := pool.Get("namespace", "group", "/a")
+	assert.Nil(t, err)
+
+	evicted, err := pool.trim()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, evicted)
+
+	_, err = pool.Get("namespace", "group", "/b")
+	assert.NotNil(t, err)
+	for _, uri := range []string{"/a", "/c"} {
+		item, err := pool.Get("namespace", "group", uri)
+		assert.Nil(t, err)
+		assert.Equal(t, testItem, item)
+	}
+
+	n, err := redisClient.ZCard(context.Background(), "TEST:namespace:group:_lru").Result()
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), n)
+}
+
+func TestLRUCostWeight(t *testing.T) {
+	redisClient := newTestRedis(t)
+
+	pool := New(Config{
+		Prefix:         "TEST:",
+		LRUMaxItems:    2,
+		LRUJanitorFreq: time.Hour,
+		LRUCostWeight:  1000,
+		Clock:          fixedClock(time.Now()),
+	}, redisClient)
+	cheap := fastcache.Item{ETag: "etag", ContentType: "content_type", Blob: []byte("{}")}
+	costly := cheap
+	costly.Cost = 10 * time.Millisecond
+
+	// The URIs are accessed at the same time, but /a outlives the cheap URIs
+	// (of which /b sorts first).
+	assert.Nil(t, pool.Put("namespace", "group", "/a", costly, time.Second*3))
+	for _, uri := range []string{"/b", "/c"} {
+		assert.Nil(t, pool.Put("namespace", "group", uri, cheap, time.Second*3))
+	}
+
+	evicted, err := pool.trim()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, evicted)
+
+	_, err = pool.Get("namespace", "group", "/b")
+	assert.NotNil(t, err)
+	item, err := pool.Get("namespace", "group", "/a")
+	assert.Nil(t, err)
+	assert.Equal(t, costly, item)
+}
+
+func TestJobs(t *testing.T) {
+	redisClient := newTestRedis(t)
+
+	pool := New(Config{
+		Prefix:          "TEST:",
+		Async:           true,
+		AsyncCommitFreq: time.Hour,
+		LRUMaxItems:     2,
+		LRUJanitorFreq:  time.Hour,
+	}, redisClient)
+	defer pool.Close()
+
+	testItem := fastcache.Item{
+		ETag:        "etag",
+		ContentType: "content_type",
+		Blob:        []byte("{}"),
+	}
+	for _, uri := range []string{"/a", "/b", "/c"} {
+		assert.Nil(t, pool.Put("namespace", "group", uri, testItem, time.Second*3))
+	}
+
+	// The uncommitted writes are queued.
+	assert.Eventually(t, func() bool {
+		return pool.JobStats()[JobAsyncWriter].Queued == 3
+	}, time.Second, time.Millisecond*10)
+	assert.Equal(t, int64(1000), pool.JobStats()[JobAsyncWriter].QueueSize)
+
+	// Commit the buffered writes and then trim the group.
+	assert.Nil(t, pool.RunJob(JobAsyncWriter))
+	assert.Nil(t, pool.RunJob(JobLRUJanitor))
+	assert.Equal(t, fastcache.ErrUnknownJob, pool.RunJob("unknown"))
+
+	stats := pool.JobStats()
+	assert.Len(t, stats, 2)
+	assert.Equal(t, int64(1), stats[JobAsyncWriter].Runs)
+	assert.Equal(t, int64(3), stats[JobAsyncWriter].Items)
+	assert.Equal(t, int64(3), stats[JobAsyncWriter].LastItems)
+	assert.Equal(t, int64(3), stats[JobAsyncWriter].MaxItems)
+	assert.Zero(t, stats[JobAsyncWriter].Queued)
+	assert.False(t, stats[JobAsyncWriter].LastSuccess.IsZero())
+	assert.Equal(t, int64(1), stats[JobLRUJanitor].Runs)
+	assert.Equal(t, int64(1), stats[JobLRUJanitor].Items)
+	assert.Zero(t, stats[JobLRUJanitor].Errors)
+	assert.False(t, stats[JobLRUJanitor].LastRun.IsZero())
+}
+
+func TestGetMetaBlob(t *testing.T) {
+	redisClient := newTestRedis(t)
+
+	pool := New(Config{Prefix: "TEST:"}, redisClient)
+	testItem := fastcache.Item{
+		ETag:        "etag",
+		ContentType: "content_type",
+		Blob:        []byte("{}"),
+	}
+	assert.Nil(t, pool.Put("namespace", "group", "/a", testItem, time.Second*3))
+
+	meta, err := pool.GetMeta("namespace", "group", "/a")
+	assert.Nil(t, err)
+	assert.Equal(t, "etag", meta.ETag)
+	assert.Nil(t, meta.Blob)
+
+	blob, err := pool.GetBlob("namespace", "group", "/a")
+	assert.Nil(t, err)
+	assert.Equal(t, testItem.Blob, blob)
+
+	_, err = pool.GetBlob("namespace", "group", "/b")
+	assert.NotNil(t, err)
+}
+
+func TestHashBlob(t *testing.T) {
+	redisClient := newTestRedis(t)
+
+	pool := New(Config{Prefix: "TEST:"}, redisClient)
+	testItem := fastcache.Item{
+		ETag:        "etag",
+		ContentType: "content_type",
+		Blob:        []byte("{}"),
+	}
+	assert.Nil(t, pool.Put("namespace", "group", "/a", testItem, time.Second*3))
+
+	h, err := pool.HashBlob("namespace", "group", "/a")
+	assert.Nil(t, err)
+	sum := sha1.Sum(testItem.Blob)
+	assert.Equal(t, hex.EncodeToString(sum[:]), h)
+
+	_, err = pool.HashBlob("namespace", "group", "/b")
+	assert.NotNil(t, err)
+}
+
+func TestGetRange(t *testing.T) {
+	redisClient := newTestRedis(t)
+
+	pool := New(Config{Prefix: "TEST:"}, redisClient)
+	testItem := fastcache.Item{
+		ETag:        "etag",
+		ContentType: "content_type",
+		Blob:        []byte("0123456789"),
+	}
+	assert.Nil(t, pool.Put("namespace", "group", "/a", testItem, time.Second*3))
+
+	for _, c := range []struct {
+		offset int64
+		n      int64
+		out    []byte
+	}{
+		{0, 3, []byte("012")},
+		{8, 5, []byte("89")},
+		{-3, -1, []byte("789")},
+		{10, -1, nil},
+	} {
+		b, size, err := pool.GetRange("namespace", "group", "/a", c.offset, c.n)
+		assert.Nil(t, err)
+		assert.Equal(t, c.out, b)
+		assert.Equal(t, int64(10), size)
+	}
+
+	_, _, err := pool.GetRange("namespace", "group", "/b", 0, -1)
+	assert.NotNil(t, err)
+}
+
+func TestIncrHits(t *testing.T) {
+	redisClient := newTestRedis(t)
+
+	pool := New(Config{Prefix: "TEST:"}, redisClient)
+	testItem := fastcache.Item{
+		ETag:        "etag",
+		ContentType: "content_type",
+		Blob:        []byte("{}"),
+	}
+	assert.Nil(t, pool.Put("namespace", "group", "/a", testItem, time.Second*3))
+
+	for i := int64(1); i <= 2; i++ {
+		n, err := pool.IncrHits("namespace", "group", "/a")
+		assert.Nil(t, err)
+		assert.Equal(t, i, n)
+	}
+
+	item, err := pool.Get("namespace", "group", "/a")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), item.Hits)
+
+	// Writes reset the count.
+	assert.Nil(t, pool.Put("namespace", "group", "/a", testItem, time.Second*3))
+	item, err = pool.Get("namespace", "group", "/a")
+	assert.Nil(t, err)
+	assert.Zero(t, item.Hits)
+
+	// Uncached URIs aren't counted.
+	n, err := pool.IncrHits("namespace", "missing", "/a")
+	assert.Nil(t, err)
+	assert.Zero(t, n)
+	assert.Zero(t, redisClient.Exists(context.Background(), "TEST:namespace:missing").Val())
+}
+
+func TestTTL(t *testing.T) {
+	redisClient := newTestRedis(t)
+
+	pool := New(Config{Prefix: "TEST:"}, redisClient)
+	testItem := fastcache.Item{
+		ETag:        "etag",
+		ContentType: "content_type",
+		Blob:        []byte("{}"),
+	}
+	assert.Nil(t, pool.Put("namespace", "group", "/a", testItem, time.Second*3))
+	assert.Nil(t, pool.Put("namespace", "nottl", "/a", testItem, 0))
+
+	ttl, err := pool.TTL("namespace", "group", "/a")
+	assert.Nil(t, err)
+	assert.Equal(t, time.Second*3, ttl)
+
+	ttl, err = pool.TTL("namespace", "nottl", "/a")
+	assert.Nil(t, err)
+	assert.Zero(t, ttl)
+
+	_, err = pool.TTL("namespace", "missing", "/a")
+	assert.ErrorIs(t, err, fastcache.ErrNotCached)
+}
+
+func TestTouch(t *testing.T) {
+	redisClient := newTestRedis(t)
+
+	pool := New(Config{Prefix: "TEST:"}, redisClient)
+	testItem := fastcache.Item{
+		ETag:        "etag",
+		ContentType: "content_type",
+		Blob:        []byte("{}"),
+	}
+	assert.Nil(t, pool.Put("namespace", "group", "/a", testItem, time.Second*3))
+	assert.Nil(t, pool.Touch("namespace", "group", "/a", time.Second*10))
+
+	ttl, err := pool.TTL("namespace", "group", "/a")
+	assert.Nil(t, err)
+	assert.Equal(t, time.Second*10, ttl)
+
+	// Missing keys aren't created.
+	assert.Nil(t, pool.Touch("namespace", "missing", "/a", time.Second*10))
+	_, err = pool.TTL("namespace", "missing", "/a")
+	assert.ErrorIs(t, err, fastcache.ErrNotCached)
+}
+
+func TestStaleGroup(t *testing.T) {
+	redisClient := newTestRedis(t)
+
+	now := time.Date(2024, 1, 1, 9, 15, 0, 0, time.UTC)
+	pool := New(Config{Prefix: "TEST:", Clock: fixedClock(now)}, redisClient)
+	testItem := fastcache.Item{
+		ETag:        "etag",
+		ContentType: "content_type",
+		Blob:        []byte("{}"),
+	}
+	for _, group := range []string{"orders:1", "orders:2"} {
+		assert.Nil(t, pool.Put("namespace", group, "/a", testItem, time.Second*30))
+	}
+
+	assert.Nil(t, pool.StaleGroup("namespace", time.Second*2, "orders:*"))
+
+	// The items are retained, marked stale, and expire in the grace window.
+	for _, group := range []string{"orders:1", "orders:2"} {
+		it, err := pool.Get("namespace", group, "/a")
+		assert.Nil(t, err)
+		assert.Equal(t, testItem.Blob, it.Blob)
+		assert.True(t, it.StaleAt.Equal(now))
+
+		ttl, err := pool.TTL("namespace", group, "/a")
+		assert.Nil(t, err)
+		assert.Equal(t, time.Second*2, ttl)
+	}
+
+	// TTLs shorter than the grace window aren't extended.
+	assert.Nil(t, pool.StaleGroup("namespace", time.Second*10, "orders:1"))
+	ttl, err := pool.TTL("namespace", "orders:1", "/a")
+	assert.Nil(t, err)
+	assert.Equal(t, time.Second*2, ttl)
+}
+
+func TestKeyObfuscator(t *testing.T) {
+	redisClient := newTestRedis(t)
+
+	pool := New(Config{Prefix: "TEST:", KeyObfuscator: HMACObfuscator([]byte("secret"))}, redisClient)
+	testItem := fastcache.Item{
+		ETag:        "etag",
+		ContentType: "content_type",
+		Blob:        []byte("{}"),
+	}
+	assert.Nil(t, pool.Put("namespace", "orders", "/user/a", testItem, time.Second*3))
+
+	item, err := pool.Get("namespace", "orders", "/user/a")
+	assert.Nil(t, err)
+	assert.Equal(t, testItem.Blob, item.Blob)
+
+	// Neither the namespace nor the URI appear in keys or fields.
+	keys, err := redisClient.Keys(context.TODO(), "*").Result()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(keys))
+	assert.NotContains(t, keys[0], "namespace")
+	assert.Contains(t, keys[0], "orders")
+
+	fields, err := redisClient.HKeys(context.TODO(), keys[0]).Result()
+	assert.Nil(t, err)
+	for _, f := range fields {
+		assert.NotContains(t, f, "/user/a")
+	}
+
+	// Other secrets derive other keys.
+	other := New(Config{Prefix: "TEST:", KeyObfuscator: HMACObfuscator([]byte("other"))}, redisClient)
+	_, err = other.Get("namespace", "orders", "/user/a")
+	assert.NotNil(t, err)
+
+	assert.Nil(t, pool.Del("namespace", "orders", "/user/a"))
+	_, err = pool.Get("namespace", "orders", "/user/a")
+	assert.NotNil(t, err)
+
+	assert.Nil(t, pool.Put("namespace", "orders", "/user/a", testItem, time.Second*3))
+	assert.Nil(t, pool.DelGroup("namespace", "ord*"))
+	_, err = pool.Get("namespace", "orders", "/user/a")
+	assert.NotNil(t, err)
+}
+
+func TestNamespaceHashTags(t *testing.T) {
+	redisClient := newTestRedis(t)
+
+	pool := New(Config{Prefix: "TEST:", NamespaceHashTags: true, NamespaceEpochs: true}, redisClient)
+	testItem := fastcache.Item{
+		ETag:        "etag",
+		ContentType: "content_type",
+		Blob:        []byte("{}"),
+	}
+	assert.Nil(t, pool.Put("namespace", "orders", "/a", testItem, time.Second*3))
+	assert.Equal(t, int64(1), redisClient.Exists(context.TODO(), "TEST:{namespace}:orders").Val())
+
+	// The epoch counter is in the namespace's slot.
+	assert.Nil(t, pool.PurgeNamespace("namespace"))
+	assert.Equal(t, int64(1), redisClient.Exists(context.TODO(), "TEST:_epoch:{namespace}").Val())
+	_, err := pool.Get("namespace", "orders", "/a")
+	assert.NotNil(t, err)
+
+	assert.Nil(t, pool.Put("namespace", "orders", "/a", testItem, time.Second*3))
+	assert.Equal(t, int64(1), redisClient.Exists(context.TODO(), "TEST:{namespace}@1:orders").Val())
+	assert.Nil(t, pool.DelGroup("namespace", "ord*"))
+	_, err = pool.Get("namespace", "orders", "/a")
+	assert.NotNil(t, err)
+
+	// Namespaces are bucketed.
+	pool = New(Config{Prefix: "TEST:", NamespaceBuckets: 16}, redisClient)
+	assert.Nil(t, pool.Put("namespace", "orders", "/a", testItem, time.Second*3))
+	keys, err := redisClient.Keys(context.TODO(), "TEST:{*}namespace:orders").Result()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(keys))
+	item, err := pool.Get("namespace", "orders", "/a")
+	assert.Nil(t, err)
+	assert.Equal(t, testItem.Blob, item.Blob)
+}
+
+func TestDedupBlobs(t *testing.T) {
+	redisClient := newTestRedis(t)
+
+	pool := New(Config{Prefix: "TEST:", DedupBlobs: true, DedupMinSize: 4}, redisClient)
+	var (
+		blob     = []byte("market data")
+		h        = sha1.Sum(blob)
+		blobKey  = "TEST:_blob:" + hex.EncodeToString(h[:])
+		testItem = fastcache.Item{
+			ETag:        "etag",
+			ContentType: "content_type",
+			Blob:        blob,
+		}
+	)
+	for _, ns := range []string{"ns1", "ns2"} {
+		assert.Nil(t, pool.Put(ns, "quotes", "/a", testItem, time.Second*3))
+	}
+	assert.Nil(t, pool.Put("ns3", "quotes", "/a", testItem, time.Second*10))
+
+	// The blob is stored once with the longest TTL and referenced.
+	assert.Equal(t, string(blob), redisClient.Get(context.TODO(), blobKey).Val())
+	assert.Equal(t, time.Second*10, redisClient.PTTL(context.TODO(), blobKey).Val())
+	assert.Equal(t, "", redisClient.HGet(context.TODO(), "TEST:ns1:quotes", "_blob_/a").Val())
+
+	for _, ns := range []string{"ns1", "ns2", "ns3"} {
+		item, err := pool.Get(ns, "quotes", "/a")
+		assert.Nil(t, err)
+		assert.Equal(t, blob, item.Blob)
+
+		b, err := pool.GetBlob(ns, "quotes", "/a")
+		assert.Nil(t, err)
+		assert.Equal(t, blob, b)
+	}
+
+	items, err := pool.GetMulti("ns1", "quotes", "/a", "/b")
+	assert.Nil(t, err)
+	assert.Equal(t, blob, items[0].Blob)
+	assert.Nil(t, items[1].Blob)
+
+	hash, err := pool.HashBlob("ns1", "quotes", "/a")
+	assert.Nil(t, err)
+	assert.Equal(t, hex.EncodeToString(h[:]), hash)
+
+	b, size, err := pool.GetRange("ns1", "quotes", "/a", -4, -1)
+	assert.Nil(t, err)
+	assert.Equal(t, "data", string(b))
+	assert.Equal(t, int64(len(blob)), size)
+	b, _, err = pool.GetRange("ns1", "quotes", "/a", 0, 6)
+	assert.Nil(t, err)
+	assert.Equal(t, "market", string(b))
+
+	// Small blobs aren't deduplicated.
+	testItem.Blob = []byte("abc")
+	assert.Nil(t, pool.Put("ns1", "quotes", "/a", testItem, time.Second*3))
+	assert.Equal(t, "abc", redisClient.HGet(context.TODO(), "TEST:ns1:quotes", "_blob_/a").Val())
+	item, err := pool.Get("ns1", "quotes", "/a")
+	assert.Nil(t, err)
+	assert.Equal(t, testItem.Blob, item.Blob)
+
+	// URIs whose blobs have expired are misses.
+	redisClient.Del(context.TODO(), blobKey)
+	_, err = pool.Get("ns2", "quotes", "/a")
+	assert.NotNil(t, err)
+}
+
+func TestDelGroupPattern(t *testing.T) {
+	redisClient := newTestRedis(t)
+
+	pool := New(Config{Prefix: "TEST:"}, redisClient)
+	testItem := fastcache.Item{
+		ETag:        "etag",
+		ContentType: "content_type",
+		Blob:        []byte("{}"),
+	}
+	for _, group := range []string{"orders:1", "orders:2", "trades"} {
+		assert.Nil(t, pool.Put("namespace", group, "/a", testItem, time.Second*3))
+	}
+	assert.Nil(t, pool.Put("namespace2", "orders:1", "/a", testItem, time.Second*3))
+
+	assert.Nil(t, pool.DelGroup("namespace", "orders:*"))
+
+	for _, group := range []string{"orders:1", "orders:2"} {
+		_, err := pool.Get("namespace", group, "/a")
+		assert.NotNil(t, err)
+	}
+
+	// Other groups and namespaces are untouched.
+	_, err := pool.Get("namespace", "trades", "/a")
+	assert.Nil(t, err)
+	_, err = pool.Get("namespace2", "orders:1", "/a")
+	assert.Nil(t, err)
+}
+
+func TestPurgeNamespace(t *testing.T) {
+	redisClient := newTestRedis(t)
+
+	pool := New(Config{Prefix: "TEST:", NamespaceEpochs: true}, redisClient)
+	testItem := fastcache.Item{
+		ETag:        "etag",
+		ContentType: "content_type",
+		Blob:        []byte("{}"),
+	}
+	assert.Nil(t, pool.Put("namespace", "orders", "/a", testItem, time.Second*3))
+	assert.Nil(t, pool.Put("namespace2", "orders", "/a", testItem, time.Second*3))
+
+	assert.Nil(t, pool.PurgeNamespace("namespace"))
+
+	_, err := pool.Get("namespace", "orders", "/a")
+	assert.NotNil(t, err)
+	_, err = pool.Get("namespace2", "orders", "/a")
+	assert.Nil(t, err)
+
+	// New items are cached under the new epoch.
+	assert.Nil(t, pool.Put("namespace", "orders", "/a", testItem, time.Second*3))
+	item, err := pool.Get("namespace", "orders", "/a")
+	assert.Nil(t, err)
+	assert.Equal(t, testItem.Blob, item.Blob)
+}
+
+func TestNamespaceEpochsEscaping(t *testing.T) {
+	redisClient := newTestRedis(t)
+
+	pool := New(Config{Prefix: "TEST:", NamespaceEpochs: true}, redisClient)
+	itemA := fastcache.Item{ContentType: "content_type", Blob: []byte("a")}
+	itemB := fastcache.Item{ContentType: "content_type", Blob: []byte("b")}
+
+	// a at the epoch 2 and a@2, which has never been purged, don't share
+	// keys.
+	assert.Nil(t, pool.PurgeNamespace("a"))
+	assert.Nil(t, pool.PurgeNamespace("a"))
+	assert.Nil(t, pool.Put("a", "orders", "/a", itemA, time.Second*3))
+	assert.Nil(t, pool.Put("a@2", "orders", "/a", itemB, time.Second*3))
+
+	item, err := pool.Get("a", "orders", "/a")
+	assert.Nil(t, err)
+	assert.Equal(t, itemA.Blob, item.Blob)
+	item, err = pool.Get("a@2", "orders", "/a")
+	assert.Nil(t, err)
+	assert.Equal(t, itemB.Blob, item.Blob)
+
+	assert.Nil(t, pool.DelGroup("a@2", "orders"))
+	item, err = pool.Get("a", "orders", "/a")
+	assert.Nil(t, err)
+	assert.Equal(t, itemA.Blob, item.Blob)
+}
+
+func TestReservedNamespaces(t *testing.T) {
+	redisClient := newTestRedis(t)
+
+	pool := New(Config{Prefix: "TEST:", NamespaceEpochs: true, DedupBlobs: true}, redisClient)
+	testItem := fastcache.Item{
+		ETag:        "etag",
+		ContentType: "content_type",
+		Blob:        []byte("{}"),
+	}
+	assert.Nil(t, pool.Put("namespace", "orders", "/a", testItem, time.Second*3))
+	assert.Nil(t, pool.PurgeNamespace("namespace"))
+	assert.Nil(t, pool.Put("namespace", "orders", "/a", testItem, time.Second*3))
+
+	// The epoch counters and blobs can't be overwritten or deleted through
+	// namespaces named after their keys.
+	for _, ns := range []string{"_epoch", "_blob"} {
+		assert.NotNil(t, pool.Put(ns, "namespace", "/a", testItem, time.Second*3))
+		assert.NotNil(t, pool.DelGroup(ns, "*"))
+		assert.NotNil(t, pool.PurgeNamespace(ns))
+	}
+
+	item, err := pool.Get("namespace", "orders", "/a")
+	assert.Nil(t, err)
+	assert.Equal(t, testItem.Blob, item.Blob)
+
+	// The namespaces aren't reserved when they're hash tagged.
+	pool = New(Config{Prefix: "TEST:", NamespaceHashTags: true}, redisClient)
+	assert.Nil(t, pool.Put("_epoch", "orders", "/a", testItem, time.Second*3))
+}
+
+func TestAsyncDelGroupOrdering(t *testing.T) {
+	redisClient := newTestRedis(t)
+
+	pool := New(Config{Prefix: "TEST:", Async: true, AsyncCommitFreq: time.Millisecond * 50}, redisClient)
+	testItem := fastcache.Item{
+		ETag:        "etag",
+		ContentType: "content_type",
+		Blob:        []byte("{}"),
+	}
+
+	// The buffered put should be committed before the group is deleted and
+	// shouldn't resurrect the item afterwards.
+	assert.Nil(t, pool.Put("namespace", "group", "/a", testItem, time.Second*3))
+	assert.Nil(t, pool.DelGroup("namespace", "group"))
+
+	time.Sleep(time.Millisecond * 150)
+	_, err := pool.Get("namespace", "group", "/a")
+	assert.NotNil(t, err)
+
+	assert.Nil(t, pool.Put("namespace", "group", "/a", testItem, time.Second*3))
+	assert.Nil(t, pool.Del("namespace", "group", "/a"))
+
+	time.Sleep(time.Millisecond * 150)
+	_, err = pool.Get("namespace", "group", "/a")
+	assert.NotNil(t, err)
+}
+
+func TestHeaders(t *testing.T) {
+	redisClient := newTestRedis(t)
+
+	pool := New(Config{Prefix: "TEST:"}, redisClient)
+	testItem := fastcache.Item{
+		ETag:        "etag",
+		ContentType: "content_type",
+		Headers:     map[string][]string{"X-Custom": {"a", "b"}},
+		Blob:        []byte("{}"),
+	}
+	assert.Nil(t, pool.Put("namespace", "group", "/a", testItem, time.Second*3))
+
+	item, err := pool.Get("namespace", "group", "/a")
+	assert.Nil(t, err)
+	assert.Equal(t, testItem.Headers, item.Headers)
+}
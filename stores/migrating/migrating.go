@@ -0,0 +1,125 @@
+// Package migrating implements a fastcache store that migrates live traffic
+// from an old store to a new one, for instance, from the redigo store's
+// layout to a redesigned goredis layout, without a cold cache.
+//
+// All writes and deletions go to both the stores. Reads are gradually cut
+// over to the new store with Config.ReadPercent: reads that are cut over are
+// served from the new store, falling back to the old store on misses, and the
+// rest are served from the old store only. Once the new store is warm (at
+// least one TTL after dual writes begin) and ReadPercent is 100, the old
+// store can be dropped.
+//
+// Only the methods of fastcache.Store are wrapped. Optional interfaces of the
+// underlying stores such as fastcache.MetaGetter aren't available during the
+// migration.
+package migrating
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sync/atomic"
+	"time"
+
+	"github.com/zerodha/fastcache/v4"
+)
+
+// Config has the migration options.
+type Config struct {
+	// ReadPercent is the percentage (0-100) of URIs whose reads are served
+	// new-then-old. URIs are picked deterministically so that a URI is always
+	// read from the same store(s) at a given percentage. It can be changed
+	// at runtime with SetReadPercent().
+	ReadPercent int
+}
+
+// Store is a fastcache.Store that dual-writes to an old and a new store.
+type Store struct {
+	old, new fastcache.Store
+	readPct  int32
+}
+
+// New returns a Store that migrates from the old store to the new store.
+func New(oldStore, newStore fastcache.Store, cfg Config) *Store {
+	s := &Store{old: oldStore, new: newStore}
+	s.SetReadPercent(cfg.ReadPercent)
+	return s
+}
+
+// SetReadPercent sets the percentage (0-100) of URIs whose reads are served
+// new-then-old, for cutting over gradually.
+func (s *Store) SetReadPercent(pct int) {
+	if pct < 0 {
+		pct = 0
+	} else if pct > 100 {
+		pct = 100
+	}
+	atomic.StoreInt32(&s.readPct, int32(pct))
+}
+
+// ReadPercent returns the current percentage of URIs whose reads are served
+// new-then-old.
+func (s *Store) ReadPercent() int {
+	return int(atomic.LoadInt32(&s.readPct))
+}
+
+// Get gets the fastcache.Item for a single cached URI, from the new store
+// first if the URI is cut over.
+func (s *Store) Get(namespace, group, uri string) (fastcache.Item, error) {
+	if !s.cutOver(namespace, group, uri) {
+		return s.old.Get(namespace, group, uri)
+	}
+
+	// Some stores return errors for misses. Fall back to the old store
+	// on any error.
+	if it, err := s.new.Get(namespace, group, uri); err == nil && (len(it.Blob) > 0 || it.ContentType != "" || it.Vary != "") {
+		return it, nil
+	}
+	return s.old.Get(namespace, group, uri)
+}
+
+// Put writes the fastcache.Item for a URI to both the stores.
+func (s *Store) Put(namespace, group, uri string, b fastcache.Item, ttl time.Duration) error {
+	return both(s.old.Put(namespace, group, uri, b, ttl), s.new.Put(namespace, group, uri, b, ttl))
+}
+
+// Del deletes a URI from both the stores.
+func (s *Store) Del(namespace, group, uri string) error {
+	return both(s.old.Del(namespace, group, uri), s.new.Del(namespace, group, uri))
+}
+
+// DelGroup deletes whole groups from both the stores.
+func (s *Store) DelGroup(namespace string, groups ...string) error {
+	return both(s.old.DelGroup(namespace, groups...), s.new.DelGroup(namespace, groups...))
+}
+
+// cutOver checks if reads of a URI are cut over to the new store.
+func (s *Store) cutOver(namespace, group, uri string) bool {
+	pct := atomic.LoadInt32(&s.readPct)
+	switch pct {
+	case 0:
+		return false
+	case 100:
+		return true
+	}
+
+	h := fnv.New32a()
+	h.Write([]byte(namespace))
+	h.Write([]byte{0})
+	h.Write([]byte(group))
+	h.Write([]byte{0})
+	h.Write([]byte(uri))
+	return int32(h.Sum32()%100) < pct
+}
+
+// both combines the errors of an operation on the old and the new store.
+func both(oldErr, newErr error) error {
+	switch {
+	case oldErr != nil && newErr != nil:
+		return fmt.Errorf("migrating-store: old: %v; new: %v", oldErr, newErr)
+	case oldErr != nil:
+		return fmt.Errorf("migrating-store: old: %v", oldErr)
+	case newErr != nil:
+		return fmt.Errorf("migrating-store: new: %v", newErr)
+	}
+	return nil
+}
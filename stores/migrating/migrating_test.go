@@ -0,0 +1,106 @@
+package migrating
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zerodha/fastcache/v4"
+)
+
+// mapStore is a minimal in-memory fastcache.Store.
+type mapStore struct {
+	mu    sync.Mutex
+	items map[string]fastcache.Item
+}
+
+func newMapStore() *mapStore {
+	return &mapStore{items: map[string]fastcache.Item{}}
+}
+
+func (s *mapStore) Get(ns, group, uri string) (fastcache.Item, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.items[ns+group+uri], nil
+}
+
+func (s *mapStore) Put(ns, group, uri string, it fastcache.Item, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.items[ns+group+uri] = it
+	return nil
+}
+
+func (s *mapStore) Del(ns, group, uri string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.items, ns+group+uri)
+	return nil
+}
+
+func (s *mapStore) DelGroup(ns string, group ...string) error { return nil }
+
+func TestStore(t *testing.T) {
+	var (
+		oldStore, newStore = newMapStore(), newMapStore()
+		s                  = New(oldStore, newStore, Config{})
+		item               = fastcache.Item{ContentType: "text/plain", Blob: []byte("old")}
+	)
+
+	// Items that are only in the old store are served from it at any
+	// percentage.
+	if err := oldStore.Put("ns", "group", "/a", item, 0); err != nil {
+		t.Fatal(err)
+	}
+	for _, pct := range []int{0, 50, 100} {
+		s.SetReadPercent(pct)
+		if it, _ := s.Get("ns", "group", "/a"); string(it.Blob) != "old" {
+			t.Fatalf("%d%%: expected old item but got '%s'", pct, it.Blob)
+		}
+	}
+
+	// Writes go to both the stores.
+	item.Blob = []byte("new")
+	if err := s.Put("ns", "group", "/a", item, 0); err != nil {
+		t.Fatal(err)
+	}
+	for _, st := range []*mapStore{oldStore, newStore} {
+		if it, _ := st.Get("ns", "group", "/a"); string(it.Blob) != "new" {
+			t.Fatalf("expected written item but got '%s'", it.Blob)
+		}
+	}
+
+	// Deletions go to both the stores.
+	if err := s.Del("ns", "group", "/a"); err != nil {
+		t.Fatal(err)
+	}
+	if len(oldStore.items) != 0 || len(newStore.items) != 0 {
+		t.Fatalf("expected empty stores but got %v, %v", oldStore.items, newStore.items)
+	}
+}
+
+func TestReadPercent(t *testing.T) {
+	s := New(newMapStore(), newMapStore(), Config{ReadPercent: 30})
+
+	n := 0
+	for i := 0; i < 1000; i++ {
+		uri := "/" + strconv.Itoa(i)
+		if s.cutOver("ns", "group", uri) {
+			n++
+		}
+
+		// URIs are picked deterministically.
+		if s.cutOver("ns", "group", uri) != s.cutOver("ns", "group", uri) {
+			t.Fatalf("expected %s to be picked deterministically", uri)
+		}
+	}
+	if n < 200 || n > 400 {
+		t.Fatalf("expected ~300 cut over URIs but got %d", n)
+	}
+
+	s.SetReadPercent(150)
+	if s.ReadPercent() != 100 {
+		t.Fatalf("expected percent to be clamped to 100 but got %d", s.ReadPercent())
+	}
+}
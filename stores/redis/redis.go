@@ -16,6 +16,9 @@
 package redis
 
 import (
+	"encoding/json"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gomodule/redigo/redis"
@@ -28,21 +31,123 @@ const (
 	keyCtype       = "_ctype"
 	keyCompression = "_comp"
 	keyBlob        = "_blob"
+	keyCompReason  = "_compreason"
+	keyStatus      = "_status"
+	keyLocation    = "_location"
+	keyCreated     = "_created"
+	keyVary        = "_vary"
+	keyHeaders     = "_headers"
+	keyUETag       = "_uetag"
+	keyULastMod    = "_ulastmod"
+	keyCacheCtrl   = "_cc"
+	keyExpires     = "_expires"
+	keyHits        = "_hits"
+	keyStaleAt     = "_staleat"
 
 	sep = ":"
+
+	// numFields is the number of hash fields stored per URI.
+	numFields = 16
 )
 
+// hashBlob is a Lua script that returns the hex SHA1 of a URI's blob.
+var hashBlob = redis.NewScript(1, `
+local b = redis.call("HGET", KEYS[1], ARGV[1])
+if not b then
+	return false
+end
+return redis.sha1hex(b)
+`)
+
+// incrHits is a Lua script that increments the hit count of a URI if it's
+// cached, so that counts don't create keys for evicted URIs without a TTL.
+var incrHits = redis.NewScript(1, `
+if redis.call("HEXISTS", KEYS[1], ARGV[1]) == 0 then
+	return 0
+end
+return redis.call("HINCRBY", KEYS[1], ARGV[2], 1)
+`)
+
+// staleGroup is a Lua script that marks all the URIs in a group stale as of
+// ARGV[1] (unix ms), unless they're already stale, and caps the group's TTL
+// at ARGV[2] (ms). ARGV[3] and ARGV[4] are the prefixes of the content type
+// and stale-at fields.
+var staleGroup = redis.NewScript(1, `
+local now, ttl = tonumber(ARGV[1]), tonumber(ARGV[2])
+local n = string.len(ARGV[3])
+for _, f in ipairs(redis.call("HKEYS", KEYS[1])) do
+	if string.sub(f, 1, n) == ARGV[3] then
+		local field = ARGV[4] .. string.sub(f, n + 1)
+		local at = tonumber(redis.call("HGET", KEYS[1], field))
+		if not at or at == 0 or at > now then
+			redis.call("HSET", KEYS[1], field, ARGV[1])
+		end
+	end
+end
+
+local pttl = redis.call("PTTL", KEYS[1])
+if pttl == -1 or pttl > ttl then
+	redis.call("PEXPIRE", KEYS[1], ttl)
+end
+return 0
+`)
+
+// getRange is a Lua script that returns a byte range of a URI's blob as
+// described by fastcache.RangeGetter along with the blob's size.
+var getRange = redis.NewScript(1, `
+local b = redis.call("HGET", KEYS[1], ARGV[1])
+if not b then
+	return false
+end
+
+local size = string.len(b)
+local off, n = tonumber(ARGV[2]), tonumber(ARGV[3])
+if off < 0 then
+	off = math.max(size + off, 0)
+end
+if off >= size then
+	return {"", size}
+end
+
+local last = size
+if n >= 0 then
+	last = math.min(off + n, size)
+end
+return {string.sub(b, off + 1, last), size}
+`)
+
 // Store is a Redis cache store implementation for fastcache.
 type Store struct {
-	prefix string
+	config Config
 	pool   *redis.Pool
 }
 
+// Config is the config of a Store created with NewWithConfig().
+type Config struct {
+	// Prefix is the prefix to apply to all cache keys. It can be composed
+	// from the environment with fastcache.EnvPrefix() so that deployments
+	// sharing a Redis never collide.
+	Prefix string
+
+	// Clock is the source of time of StaleGroup(). Default is
+	// fastcache.SystemClock.
+	Clock fastcache.Clock
+}
+
 // New creates a new Redis instance. prefix is the prefix to apply to all
-// cache keys.
+// cache keys (Config.Prefix).
 func New(prefix string, pool *redis.Pool) *Store {
+	return NewWithConfig(Config{Prefix: prefix}, pool)
+}
+
+// NewWithConfig creates a new Redis instance with a Config.
+func NewWithConfig(cfg Config, pool *redis.Pool) *Store {
+	if cfg.Clock == nil {
+		cfg.Clock = fastcache.SystemClock
+	}
+
 	return &Store{
-		prefix: prefix,
+		config: cfg,
 		pool:   pool,
 	}
 }
@@ -54,18 +159,144 @@ func (s *Store) Get(namespace, group, uri string) (fastcache.Item, error) {
 
 	var out fastcache.Item
 	// Get content_type, etag, blob in that order.
-	resp, err := redis.ByteSlices(cn.Do("HMGET", s.key(namespace, group), s.field(keyCtype, uri), s.field(keyEtag, uri), s.field(keyCompression, uri), s.field(keyBlob, uri)))
+	resp, err := redis.ByteSlices(cn.Do("HMGET", redis.Args{}.Add(s.key(namespace, group)).AddFlat(s.fields(uri))...))
 	if err != nil {
 		return out, err
 	}
 
-	out = fastcache.Item{
-		ContentType: string(resp[0]),
-		ETag:        string(resp[1]),
-		Compression: string(resp[2]),
-		Blob:        resp[3],
+	return parseItem(resp), err
+}
+
+// GetMeta gets the fastcache.Item for a single cached URI without the blob.
+func (s *Store) GetMeta(namespace, group, uri string) (fastcache.Item, error) {
+	cn := s.pool.Get()
+	defer cn.Close()
+
+	resp, err := redis.ByteSlices(cn.Do("HMGET", redis.Args{}.Add(s.key(namespace, group)).AddFlat(s.fields(uri)[:numFields-1])...))
+	if err != nil {
+		return fastcache.Item{}, err
+	}
+
+	return parseItem(resp), nil
+}
+
+// GetBlob gets the blob of a single cached URI.
+func (s *Store) GetBlob(namespace, group, uri string) ([]byte, error) {
+	cn := s.pool.Get()
+	defer cn.Close()
+
+	b, err := redis.Bytes(cn.Do("HGET", s.key(namespace, group), s.field(keyBlob, uri)))
+	if err == redis.ErrNil {
+		return nil, nil
+	}
+	return b, err
+}
+
+// HashBlob returns the hex SHA1 hash of the blob of a single cached URI. The
+// hash is computed in Redis with a Lua script without fetching the blob. An
+// empty hash is returned if the URI isn't cached.
+func (s *Store) HashBlob(namespace, group, uri string) (string, error) {
+	cn := s.pool.Get()
+	defer cn.Close()
+
+	h, err := redis.String(hashBlob.Do(cn, s.key(namespace, group), s.field(keyBlob, uri)))
+	if err == redis.ErrNil {
+		return "", nil
+	}
+	return h, err
+}
+
+// GetRange gets a byte range of the blob of a single cached URI along with
+// the blob's size. The range is sliced in Redis with a Lua script so that
+// only the range is transferred. A zero size is returned if the URI isn't
+// cached.
+func (s *Store) GetRange(namespace, group, uri string, offset, n int64) ([]byte, int64, error) {
+	cn := s.pool.Get()
+	defer cn.Close()
+
+	res, err := redis.Values(getRange.Do(cn, s.key(namespace, group), s.field(keyBlob, uri), offset, n))
+	if err == redis.ErrNil {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var (
+		b    []byte
+		size int64
+	)
+	if _, err := redis.Scan(res, &b, &size); err != nil {
+		return nil, 0, err
+	}
+	if len(b) == 0 {
+		b = nil
+	}
+	return b, size, nil
+}
+
+// IncrHits increments the hit count of a cached URI and returns the new
+// count. 0 is returned if the URI isn't cached.
+func (s *Store) IncrHits(namespace, group, uri string) (int64, error) {
+	cn := s.pool.Get()
+	defer cn.Close()
+
+	return redis.Int64(incrHits.Do(cn, s.key(namespace, group), s.field(keyCtype, uri), s.field(keyHits, uri)))
+}
+
+// TTL returns the remaining TTL of a cached URI. As TTLs are applied to
+// whole groups, this is the TTL of the URI's group. A zero TTL is returned
+// for keys without a TTL and fastcache.ErrNotCached for missing keys.
+func (s *Store) TTL(namespace, group, uri string) (time.Duration, error) {
+	cn := s.pool.Get()
+	defer cn.Close()
+
+	ms, err := redis.Int64(cn.Do("PTTL", s.key(namespace, group)))
+	if err != nil {
+		return 0, err
+	}
+
+	// -2 is returned for missing keys and -1 for keys without a TTL.
+	switch {
+	case ms == -2:
+		return 0, fastcache.ErrNotCached
+	case ms < 0:
+		return 0, nil
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+// Touch extends the TTL of a cached URI. As TTLs are applied to whole
+// groups, the TTL of the URI's group is extended.
+func (s *Store) Touch(namespace, group, uri string, ttl time.Duration) error {
+	cn := s.pool.Get()
+	defer cn.Close()
+
+	_, err := cn.Do("PEXPIRE", s.key(namespace, group), ttl.Milliseconds())
+	return err
+}
+
+// GetMulti gets the fastcache.Items for multiple URIs in a group in a single
+// HMGET. URIs that are not in the cache are returned as empty Items.
+func (s *Store) GetMulti(namespace, group string, uris ...string) ([]fastcache.Item, error) {
+	cn := s.pool.Get()
+	defer cn.Close()
+
+	args := redis.Args{}.Add(s.key(namespace, group))
+	for _, uri := range uris {
+		args = args.AddFlat(s.fields(uri))
+	}
+
+	resp, err := redis.ByteSlices(cn.Do("HMGET", args...))
+	if err != nil {
+		return nil, err
 	}
-	return out, err
+
+	out := make([]fastcache.Item, len(uris))
+	for n := range uris {
+		out[n] = parseItem(resp[n*numFields : (n+1)*numFields])
+	}
+	return out, nil
 }
 
 // Put sets a value to given session but stored only on commit
@@ -74,11 +305,7 @@ func (s *Store) Put(namespace, group, uri string, b fastcache.Item, ttl time.Dur
 	defer cn.Close()
 
 	key := s.key(namespace, group)
-	if err := cn.Send("HMSET", key,
-		s.field(keyCtype, uri), b.ContentType,
-		s.field(keyEtag, uri), b.ETag,
-		s.field(keyCompression, uri), b.Compression,
-		s.field(keyBlob, uri), b.Blob); err != nil {
+	if err := cn.Send("HMSET", redis.Args{}.Add(key).Add(s.values(uri, b)...)...); err != nil {
 		return err
 	}
 
@@ -99,30 +326,221 @@ func (s *Store) Del(namespace, group, uri string) error {
 	cn := s.pool.Get()
 	defer cn.Close()
 
-	if err := cn.Send("HDEL", s.key(namespace, group), s.field(keyCtype, uri), s.field(keyEtag, uri), s.field(keyCompression, uri), s.field(keyBlob, uri)); err != nil {
+	if err := cn.Send("HDEL", redis.Args{}.Add(s.key(namespace, group)).AddFlat(s.fields(uri))...); err != nil {
 		return err
 	}
 
 	return cn.Flush()
 }
 
-// DelGroup deletes a whole group.
+// DelGroup deletes a whole group. Groups can be glob patterns (eg: orders:*)
+// in which case all the matching groups in the namespace are found with SCAN
+// and deleted.
 func (s *Store) DelGroup(namespace string, groups ...string) error {
 	cn := s.pool.Get()
 	defer cn.Close()
 
-	for _, group := range groups {
-		if err := cn.Send("DEL", s.key(namespace, group)); err != nil {
+	keys, err := s.groupKeys(cn, namespace, groups)
+	if err != nil {
+		return err
+	}
+	for _, k := range keys {
+		if err := cn.Send("DEL", k); err != nil {
 			return err
 		}
 	}
 	return cn.Flush()
 }
 
+// StaleGroup marks all the URIs in groups stale instead of deleting them and
+// caps the TTL of the groups at ttl, as described by fastcache.GroupStaler.
+func (s *Store) StaleGroup(namespace string, ttl time.Duration, groups ...string) error {
+	cn := s.pool.Get()
+	defer cn.Close()
+
+	keys, err := s.groupKeys(cn, namespace, groups)
+	if err != nil {
+		return err
+	}
+
+	now := s.config.Clock.Now().UnixNano() / int64(time.Millisecond)
+	for _, k := range keys {
+		if err := staleGroup.Send(cn, k, now, ttl.Milliseconds(), keyCtype+"_", keyStaleAt+"_"); err != nil {
+			return err
+		}
+	}
+	return cn.Flush()
+}
+
+// groupKeys returns the keys of groups in a namespace. Groups that are glob
+// patterns are expanded to all the matching groups with SCAN.
+func (s *Store) groupKeys(cn redis.Conn, namespace string, groups []string) ([]string, error) {
+	var out []string
+	for _, group := range groups {
+		if !isPattern(group) {
+			out = append(out, s.key(namespace, group))
+			continue
+		}
+
+		var (
+			pattern = escapePattern(s.key(namespace, "")) + group
+			cursor  = 0
+		)
+		for {
+			res, err := redis.Values(cn.Do("SCAN", cursor, "MATCH", pattern, "COUNT", 1000))
+			if err != nil {
+				return nil, err
+			}
+
+			var keys []string
+			if _, err := redis.Scan(res, &cursor, &keys); err != nil {
+				return nil, err
+			}
+			out = append(out, keys...)
+
+			if cursor == 0 {
+				break
+			}
+		}
+	}
+	return out, nil
+}
+
+// isPattern checks if a group name is a glob pattern.
+func isPattern(s string) bool {
+	return strings.ContainsAny(s, "*?[")
+}
+
+// escapePattern escapes the glob characters in a string.
+func escapePattern(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		if strings.ContainsRune(`*?[]\`, c) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
 func (s *Store) key(namespace, group string) string {
-	return s.prefix + namespace + sep + group
+	return s.config.Prefix + namespace + sep + group
 }
 
 func (s *Store) field(key string, uri string) string {
 	return key + "_" + uri
 }
+
+// fields returns the hash fields of a URI in the order in which
+// parseItem() reads them. The blob is always the last field.
+func (s *Store) fields(uri string) []string {
+	return []string{
+		s.field(keyCtype, uri),
+		s.field(keyEtag, uri),
+		s.field(keyCompression, uri),
+		s.field(keyCompReason, uri),
+		s.field(keyStatus, uri),
+		s.field(keyLocation, uri),
+		s.field(keyCreated, uri),
+		s.field(keyVary, uri),
+		s.field(keyHeaders, uri),
+		s.field(keyUETag, uri),
+		s.field(keyULastMod, uri),
+		s.field(keyCacheCtrl, uri),
+		s.field(keyExpires, uri),
+		s.field(keyHits, uri),
+		s.field(keyStaleAt, uri),
+		s.field(keyBlob, uri),
+	}
+}
+
+// values returns the hash field, value pairs of an Item for HMSET.
+func (s *Store) values(uri string, b fastcache.Item) []interface{} {
+	return []interface{}{
+		s.field(keyCtype, uri), b.ContentType,
+		s.field(keyEtag, uri), b.ETag,
+		s.field(keyCompression, uri), b.Compression,
+		s.field(keyBlob, uri), b.Blob,
+		s.field(keyCompReason, uri), b.CompressionReason,
+		s.field(keyStatus, uri), b.StatusCode,
+		s.field(keyLocation, uri), b.Location,
+		s.field(keyCreated, uri), toMillis(b.CreatedAt),
+		s.field(keyVary, uri), b.Vary,
+		s.field(keyHeaders, uri), encodeHeaders(b.Headers),
+		s.field(keyUETag, uri), b.UpstreamETag,
+		s.field(keyULastMod, uri), b.UpstreamLastModified,
+		s.field(keyCacheCtrl, uri), b.CacheControl,
+		s.field(keyExpires, uri), b.Expires,
+		s.field(keyHits, uri), 0,
+		s.field(keyStaleAt, uri), toMillis(b.StaleAt),
+	}
+}
+
+// parseItem parses the result of an HMGET of fields() into an Item. If the
+// blob (the last field) isn't in the result, the Item is returned without it.
+func parseItem(resp [][]byte) fastcache.Item {
+	status, _ := strconv.Atoi(string(resp[4]))
+	created, _ := strconv.ParseInt(string(resp[6]), 10, 64)
+	hits, _ := strconv.ParseInt(string(resp[13]), 10, 64)
+	stale, _ := strconv.ParseInt(string(resp[14]), 10, 64)
+	out := fastcache.Item{
+		ContentType:       string(resp[0]),
+		ETag:              string(resp[1]),
+		Compression:       string(resp[2]),
+		CompressionReason: string(resp[3]),
+		StatusCode:        status,
+		Location:          string(resp[5]),
+		CreatedAt:         fromMillis(created),
+		Vary:              string(resp[7]),
+		Headers:           decodeHeaders(string(resp[8])),
+
+		UpstreamETag:         string(resp[9]),
+		UpstreamLastModified: string(resp[10]),
+
+		CacheControl: string(resp[11]),
+		Expires:      string(resp[12]),
+
+		Hits:    hits,
+		StaleAt: fromMillis(stale),
+	}
+	if len(resp) == numFields {
+		out.Blob = resp[numFields-1]
+	}
+	return out
+}
+
+// encodeHeaders encodes an Item's headers as JSON. No headers are encoded
+// as an empty string.
+func encodeHeaders(h map[string][]string) string {
+	if len(h) == 0 {
+		return ""
+	}
+	b, _ := json.Marshal(h)
+	return string(b)
+}
+
+// decodeHeaders decodes JSON encoded headers.
+func decodeHeaders(s string) map[string][]string {
+	if s == "" {
+		return nil
+	}
+	var h map[string][]string
+	_ = json.Unmarshal([]byte(s), &h)
+	return h
+}
+
+// toMillis converts a time to unix milliseconds. The zero time is 0.
+func toMillis(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// fromMillis converts unix milliseconds to a time. 0 is the zero time.
+func fromMillis(ms int64) time.Time {
+	if ms <= 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ms*int64(time.Millisecond))
+}
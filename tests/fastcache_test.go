@@ -3,20 +3,33 @@ package tests
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/fnv"
 	"io"
 	"log"
 	"net"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/alicebob/miniredis"
 	redis "github.com/redis/go-redis/v9"
 	"github.com/valyala/fasthttp"
+	"github.com/zerodha/fastcache/fctest/redistest"
 	cachestore "github.com/zerodha/fastcache/stores/goredis/v9"
 	"github.com/zerodha/fastcache/v4"
+	"github.com/zerodha/fastcache/v4/fctest"
 	"github.com/zerodha/fastglue"
 )
 
@@ -268,6 +281,2713 @@ func TestNoBlob(t *testing.T) {
 	}
 }
 
+// perUser are the Options of most routes on the test servers, those of
+// PresetPrivatePerUser keyed by path, with a compression threshold below the
+// size of content. Routes that need others copy and modify them.
+var perUser = func() *fastcache.Options {
+	o := fastcache.PresetPrivatePerUser(fctest.NamespaceKey, time.Second*5)
+	o.Logger = log.New(os.Stdout, "", log.Ldate|log.Ltime|log.Lshortfile)
+	o.Compression.MinLength = 10
+	o.IncludeQueryString = false
+	return o
+}()
+
+// newServer returns a test server that caches in Redis with the prefix
+// "CACHE:", along with the Redis. Requests are in the namespace
+// fctest.DefaultNamespace ("test").
+func newServer(t *testing.T) (*fctest.Server, *redistest.Redis) {
+	t.Helper()
+
+	return redistest.NewServer(t, cachestore.Config{Prefix: "CACHE:"})
+}
+
+// sendContent is a handler that responds with content.
+func sendContent(r *fastglue.Request) error {
+	return r.SendBytes(200, "text/plain", content)
+}
+
+// cdnPurger is a fastcache.CDNPurger that records the purged keys.
+type cdnPurger []string
+
+func (p *cdnPurger) PurgeKeys(keys []string) error {
+	*p = append(*p, keys...)
+	return nil
+}
+
+// setCDN sets a CDN that caches the group "cdn" on a server and returns the
+// purger that records the keys purged from it.
+func setCDN(t *testing.T, s *fctest.Server) *cdnPurger {
+	t.Helper()
+
+	keys := &cdnPurger{}
+	if err := s.Cache.SetCDN(fastcache.CDNOptions{
+		Purger: keys,
+		Header: "Surrogate-Key",
+		Groups: []string{"cdn"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
+
+// fixedClock is a fastcache.Clock that always returns fixedTime.
+type fixedClock struct{}
+
+var fixedTime = time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+func (fixedClock) Now() time.Time {
+	return fixedTime
+}
+
+// getServerReq makes a GET request to a test server for a URI with an optional If-None-Match and
+// Accept-Encoding: gzip.
+func getServerReq(s *fctest.Server, uri, etag string, gzipped bool, t *testing.T) (*fctest.Response, []byte) {
+	t.Helper()
+
+	hdr := map[string]string{}
+	if etag != "" {
+		hdr["If-None-Match"] = etag
+	}
+	if gzipped {
+		hdr["Accept-Encoding"] = "gzip"
+	}
+
+	r := s.Get(t, uri, hdr)
+	return r, r.Body
+}
+
+// getServerReqHeaders makes a GET request to a test server for a URI with the given headers.
+func getServerReqHeaders(s *fctest.Server, uri string, headers map[string]string, t *testing.T) (*fctest.Response, []byte) {
+	t.Helper()
+
+	r := s.Get(t, uri, headers)
+	return r, r.Body
+}
+
+func TestZstd(t *testing.T) {
+	s, _ := newServer(t)
+	zstd := *perUser
+	zstd.Compression.Algorithm = "zstd"
+	s.Cached("/zstd", sendContent, &zstd, group)
+
+	// First response from the handler.
+	getServerReq(s, "/zstd", "", false, t)
+
+	// zstd is served as is.
+	r, b := getServerReqHeaders(s, "/zstd", map[string]string{"Accept-Encoding": "zstd, gzip"}, t)
+	if r.Header.Get("Content-Encoding") != "zstd" {
+		t.Fatalf("expected zstd encoding but got '%s'", r.Header.Get("Content-Encoding"))
+	}
+	if len(b) == 0 || bytes.Equal(b, content) {
+		t.Fatalf("expected zstd body but got %v", b)
+	}
+
+	// gzip clients get the blob transcoded.
+	r, b = getServerReq(s, "/zstd", "", true, t)
+	if r.Header.Get("Content-Encoding") != "gzip" {
+		t.Fatalf("expected gzip encoding but got '%s'", r.Header.Get("Content-Encoding"))
+	}
+	decomp, err := decompressGzip(b)
+	if err != nil {
+		t.Fatalf("error decompressing gzip: %v", err)
+	}
+	if !bytes.Equal(decomp, content) {
+		t.Fatalf("expected test content in body but got %s", decomp)
+	}
+
+	// Others get it decompressed.
+	r, b = getServerReqHeaders(s, "/zstd", map[string]string{"Accept-Encoding": "identity"}, t)
+	if r.Header.Get("Content-Encoding") != "" || !bytes.Equal(b, content) {
+		t.Fatalf("expected test content in body but got %s", b)
+	}
+}
+
+func TestInspect(t *testing.T) {
+	s, _ := newServer(t)
+	s.Cached("/compressed", sendContent, perUser, group)
+
+	getServerReq(s, "/compressed", "", false, t)
+
+	hash := md5.Sum([]byte("/compressed"))
+	item, err := s.Cache.Inspect("test", group, hex.EncodeToString(hash[:]))
+	if err != nil {
+		t.Fatalf("error inspecting item: %v", err)
+	}
+	if item.CompressionReason != fastcache.CompressionReasonCompressed {
+		t.Fatalf("expected compression reason '%s' but got '%s'", fastcache.CompressionReasonCompressed, item.CompressionReason)
+	}
+}
+
+func TestPreflight(t *testing.T) {
+	s, _ := newServer(t)
+	preflight := *perUser
+	preflight.Preflight = &fastcache.PreflightOptions{
+		AllowOrigin: "*",
+		MaxAge:      time.Hour,
+	}
+	s.Glue.OPTIONS("/preflight", s.Cache.Cached(func(r *fastglue.Request) error {
+		return r.SendBytes(500, "text/plain", []byte("handler should not be invoked"))
+	}, &preflight, group))
+
+	req, err := http.NewRequest("OPTIONS", s.URL(t)+"/preflight", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Origin", "http://example.com")
+
+	r, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Body.Close()
+
+	if r.StatusCode != 204 {
+		t.Fatalf("expected 204 but got %v", r.StatusCode)
+	}
+	if r.Header.Get("Access-Control-Allow-Origin") != "*" {
+		t.Fatalf("unexpected Access-Control-Allow-Origin: %v", r.Header.Get("Access-Control-Allow-Origin"))
+	}
+	if r.Header.Get("Access-Control-Max-Age") != "3600" {
+		t.Fatalf("unexpected Access-Control-Max-Age: %v", r.Header.Get("Access-Control-Max-Age"))
+	}
+}
+
+func TestCacheRedirect(t *testing.T) {
+	s, _ := newServer(t)
+	redirects := *perUser
+	redirects.CacheRedirects = true
+	rt := s.Cached("/redirect", func(r *fastglue.Request) error {
+		r.RequestCtx.Response.Header.Set("Location", "/target")
+		r.RequestCtx.SetStatusCode(fasthttp.StatusFound)
+		return nil
+	}, &redirects, group)
+
+	client := http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	for n := 0; n < 3; n++ {
+		r, err := client.Get(s.URL(t) + "/redirect")
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Body.Close()
+
+		if r.StatusCode != 302 {
+			t.Fatalf("expected 302 but got %v", r.StatusCode)
+		}
+		if r.Header.Get("Location") != "/target" {
+			t.Fatalf("expected Location '/target' but got '%v'", r.Header.Get("Location"))
+		}
+	}
+
+	if n := rt.Calls(); n != 1 {
+		t.Fatalf("expected handler to be invoked once but got %d", n)
+	}
+}
+
+// sendStatus is a handler that responds with the status in the path param
+// "code" and its message.
+func sendStatus(r *fastglue.Request) error {
+	code, _ := strconv.Atoi(r.RequestCtx.UserValue("code").(string))
+	return r.SendBytes(code, "text/plain", []byte(fasthttp.StatusMessage(code)))
+}
+
+func TestCacheableStatuses(t *testing.T) {
+	s, _ := newServer(t)
+	statuses := *perUser
+	statuses.CacheableStatuses = []int{fasthttp.StatusNonAuthoritativeInfo, fasthttp.StatusPartialContent, fasthttp.StatusNotFound, fasthttp.StatusGone}
+	rt := s.Cached("/status/{code}", sendStatus, &statuses, group)
+
+	for n, c := range []struct {
+		code  int
+		calls int
+	}{
+		{404, 1},
+		{404, 1},
+		{410, 2},
+		{410, 2},
+		// Non-200 successes are replayed with their status.
+		{203, 3},
+		{203, 3},
+		{206, 4},
+		{206, 4},
+		// Not in CacheableStatuses.
+		{500, 5},
+		{500, 6},
+	} {
+		r, b := getServerReq(s, "/status/"+strconv.Itoa(c.code), "", false, t)
+		if r.StatusCode != c.code || string(b) != fasthttp.StatusMessage(c.code) {
+			t.Fatalf("%d: expected %d '%s' but got %d '%s'", n, c.code, fasthttp.StatusMessage(c.code), r.StatusCode, b)
+		}
+		if calls := rt.Calls(); calls != c.calls {
+			t.Fatalf("%d: expected %d handler calls but got %d", n, c.calls, calls)
+		}
+	}
+}
+
+func TestNegativeTTL(t *testing.T) {
+	s, rd := newServer(t)
+	negative := *perUser
+	negative.NegativeTTL = time.Second
+	rt := s.Cached("/negative/{code}", sendStatus, &negative, "negative")
+
+	for n, c := range []struct {
+		code  int
+		calls int
+		ttl   time.Duration
+	}{
+		{404, 1, time.Second},
+		{404, 1, time.Second},
+		{503, 2, time.Second},
+		{503, 2, time.Second},
+		// Not a negative response.
+		{400, 3, time.Second},
+		{400, 4, time.Second},
+		{200, 5, time.Second * 5},
+	} {
+		r, b := getServerReq(s, "/negative/"+strconv.Itoa(c.code), "", false, t)
+		if r.StatusCode != c.code || string(b) != fasthttp.StatusMessage(c.code) {
+			t.Fatalf("%d: expected %d '%s' but got %d '%s'", n, c.code, fasthttp.StatusMessage(c.code), r.StatusCode, b)
+		}
+		if calls := rt.Calls(); calls != c.calls {
+			t.Fatalf("%d: expected %d handler calls but got %d", n, c.calls, calls)
+		}
+		if ttl := rd.TTL("CACHE:test:negative"); ttl != c.ttl {
+			t.Fatalf("%d: expected TTL %v but got %v", n, c.ttl, ttl)
+		}
+	}
+}
+
+func TestTTLFromCacheControl(t *testing.T) {
+	s, rd := newServer(t)
+	ccTTL := *perUser
+	ccTTL.TTLFromCacheControl = true
+	rt := s.Cached("/cc-ttl/{maxage}", func(r *fastglue.Request) error {
+		if v := r.RequestCtx.UserValue("maxage").(string); v != "none" {
+			r.RequestCtx.Response.Header.Set("Cache-Control", "max-age="+v)
+		}
+		return r.SendBytes(200, "text/plain", content)
+	}, &ccTTL, "cc-ttl")
+
+	for n, c := range []struct {
+		maxAge string
+		calls  int
+		ttl    time.Duration
+	}{
+		{"30", 1, time.Second * 30},
+		{"30", 1, time.Second * 30},
+		// Not cached.
+		{"0", 2, time.Second * 30},
+		{"0", 3, time.Second * 30},
+		// Default TTL.
+		{"none", 4, time.Second * 5},
+	} {
+		r, _ := getServerReq(s, "/cc-ttl/"+c.maxAge, "", false, t)
+		if r.StatusCode != 200 {
+			t.Fatalf("%d: expected 200 but got %d", n, r.StatusCode)
+		}
+		if calls := rt.Calls(); calls != c.calls {
+			t.Fatalf("%d: expected %d handler calls but got %d", n, c.calls, calls)
+		}
+		if ttl := rd.TTL("CACHE:test:cc-ttl"); ttl != c.ttl {
+			t.Fatalf("%d: expected TTL %v but got %v", n, c.ttl, ttl)
+		}
+	}
+}
+
+func TestTTLHeader(t *testing.T) {
+	s, rd := newServer(t)
+	rt := s.Cached("/ttl-header/{ttl}", func(r *fastglue.Request) error {
+		if v := r.RequestCtx.UserValue("ttl").(string); v != "none" {
+			r.RequestCtx.Response.Header.Set("X-Fastcache-TTL", v)
+		}
+		return r.SendBytes(200, "text/plain", content)
+	}, perUser, "ttl-header")
+
+	for n, c := range []struct {
+		ttl   string
+		calls int
+		exp   time.Duration
+	}{
+		{"30s", 1, time.Second * 30},
+		{"30s", 1, time.Second * 30},
+		// Not cached.
+		{"0s", 2, time.Second * 30},
+		{"invalid", 3, time.Second * 30},
+		// Default TTL.
+		{"none", 4, time.Second * 5},
+	} {
+		r, _ := getServerReq(s, "/ttl-header/"+c.ttl, "", false, t)
+		if r.StatusCode != 200 {
+			t.Fatalf("%d: expected 200 but got %d", n, r.StatusCode)
+		}
+		if r.Header.Get("X-Fastcache-TTL") != "" {
+			t.Fatalf("%d: expected TTL header to be stripped", n)
+		}
+		if calls := rt.Calls(); calls != c.calls {
+			t.Fatalf("%d: expected %d handler calls but got %d", n, c.calls, calls)
+		}
+		if ttl := rd.TTL("CACHE:test:ttl-header"); ttl != c.exp {
+			t.Fatalf("%d: expected TTL %v but got %v", n, c.exp, ttl)
+		}
+	}
+}
+
+func TestTTLHeaderUncached(t *testing.T) {
+	s, _ := newServer(t)
+	s.Cached("/ttl-header", func(r *fastglue.Request) error {
+		r.RequestCtx.Response.Header.Set("X-Fastcache-TTL", "30s")
+		if r.RequestCtx.QueryArgs().Has("err") {
+			r.RequestCtx.SetStatusCode(500)
+			return errors.New("failed")
+		}
+		return r.SendBytes(200, "text/plain", content)
+	}, perUser, "ttl-header")
+
+	// The TTL header isn't sent on responses that bypass the cache or of
+	// handlers that fail either.
+	for n, h := range []map[string]string{
+		{"Connection": "Upgrade", "Upgrade": "websocket"},
+		{"Accept": "text/event-stream"},
+	} {
+		if r, _ := getServerReqHeaders(s, "/ttl-header", h, t); r.Header.Get("X-Fastcache-TTL") != "" {
+			t.Fatalf("%d: expected TTL header to be stripped from the bypassed response", n)
+		}
+	}
+	if r, _ := getServerReq(s, "/ttl-header?err", "", false, t); r.StatusCode != 500 || r.Header.Get("X-Fastcache-TTL") != "" {
+		t.Fatalf("expected 500 without the TTL header but got %d '%s'", r.StatusCode, r.Header.Get("X-Fastcache-TTL"))
+	}
+}
+
+func TestTTLHook(t *testing.T) {
+	s, rd := newServer(t)
+	ttlHook := *perUser
+	ttlHook.GroupHook = fastcache.GroupFromParams("ttl-hook:{tier}")
+	ttlHook.TTLHook = func(r *fastglue.Request) time.Duration {
+		switch r.RequestCtx.UserValue("tier").(string) {
+		case "paid":
+			return time.Second * 30
+		case "off":
+			return -1
+		}
+		return 0
+	}
+	rt := s.Cached("/ttl-hook/{tier}", sendContent, &ttlHook, "ttl-hook")
+
+	for n, c := range []struct {
+		tier  string
+		calls int
+		exp   time.Duration
+	}{
+		{"paid", 1, time.Second * 30},
+		{"paid", 1, time.Second * 30},
+		// Default TTL.
+		{"free", 2, time.Second * 5},
+		{"free", 2, time.Second * 5},
+		// Not cached.
+		{"off", 3, 0},
+		{"off", 4, 0},
+	} {
+		getServerReq(s, "/ttl-hook/"+c.tier, "", false, t)
+		if calls := rt.Calls(); calls != c.calls {
+			t.Fatalf("%d: expected %d handler calls but got %d", n, c.calls, calls)
+		}
+		if ttl := rd.TTL("CACHE:test:ttl-hook:" + c.tier); ttl != c.exp {
+			t.Fatalf("%d: expected TTL %v but got %v", n, c.exp, ttl)
+		}
+	}
+}
+
+func TestUserValueDirectives(t *testing.T) {
+	s, rd := newServer(t)
+	rt := s.Cached("/directives/{d}", func(r *fastglue.Request) error {
+		switch r.RequestCtx.UserValue("d").(string) {
+		case "ttl":
+			r.RequestCtx.SetUserValue(fastcache.UserValueTTL, time.Second*45)
+		case "skip":
+			r.RequestCtx.SetUserValue(fastcache.UserValueSkip, true)
+		}
+		return r.SendBytes(200, "text/plain", content)
+	}, perUser, "directives")
+
+	rt.ExpectMiss(t, "/directives/ttl")
+	rt.ExpectHit(t, "/directives/ttl")
+	if ttl := rd.TTL("CACHE:test:directives"); ttl != time.Second*45 {
+		t.Fatalf("expected TTL %v but got %v", time.Second*45, ttl)
+	}
+
+	// Skipped responses aren't cached.
+	rt.ExpectMiss(t, "/directives/skip")
+	rt.ExpectMiss(t, "/directives/skip")
+	hash := md5.Sum([]byte("/directives/skip"))
+	if rd.HGet("CACHE:test:directives", "_ctype_"+hex.EncodeToString(hash[:])) != "" {
+		t.Fatal("expected the skipped response not to be cached")
+	}
+}
+
+func TestShouldCache(t *testing.T) {
+	s, rd := newServer(t)
+
+	// Responses for admins aren't cached.
+	shouldCache := *perUser
+	shouldCache.ShouldCache = func(r *fastglue.Request) bool {
+		return string(r.RequestCtx.Response.Header.Peek("X-Role")) != "admin"
+	}
+	rt := s.Cached("/should-cache", func(r *fastglue.Request) error {
+		r.RequestCtx.Response.Header.Set("X-Role", string(r.RequestCtx.Request.Header.Peek("X-Role")))
+		return r.SendBytes(200, "text/plain", content)
+	}, &shouldCache, "should-cache")
+
+	calls := func(exp int) {
+		t.Helper()
+		if n := rt.Calls(); n != exp {
+			t.Fatalf("expected %d handler calls but got %d", exp, n)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		getServerReqHeaders(s, "/should-cache", map[string]string{"X-Role": "admin"}, t)
+	}
+	calls(2)
+	if rd.Exists("CACHE:test:should-cache") {
+		t.Fatal("expected the rejected response not to be cached")
+	}
+
+	for i := 0; i < 2; i++ {
+		getServerReq(s, "/should-cache", "", false, t)
+	}
+	calls(3)
+}
+
+func TestHooks(t *testing.T) {
+	var (
+		s, _ = newServer(t)
+
+		events []string
+		mu     sync.Mutex
+	)
+	event := func(e string) {
+		mu.Lock()
+		events = append(events, e)
+		mu.Unlock()
+	}
+
+	hooks := *perUser
+	hooks.Hooks.OnHit = func(r *fastglue.Request, namespace, group, uri string) {
+		event("hit " + namespace + "/" + group + "/" + uri)
+	}
+	hooks.Hooks.OnMiss = func(r *fastglue.Request, namespace, group string, latency time.Duration) {
+		event("miss " + namespace + "/" + group)
+	}
+	hooks.Hooks.OnStore = func(r *fastglue.Request, namespace, group, uri string, ttl time.Duration) {
+		event("store " + namespace + "/" + group + "/" + uri + " " + ttl.String())
+	}
+	hooks.Hooks.OnError = func(r *fastglue.Request, namespace, group string, err error) {
+		event("error " + err.Error())
+	}
+	s.Cached("/events", sendContent, &hooks, "events")
+
+	getServerReq(s, "/events", "", false, t)
+	r, _ := getServerReq(s, "/events", "", false, t)
+	getServerReqHeaders(s, "/events", map[string]string{"If-None-Match": r.Header.Get("ETag")}, t)
+
+	var (
+		hash = md5.Sum([]byte("/events"))
+		uri  = hex.EncodeToString(hash[:])
+	)
+	mu.Lock()
+	defer mu.Unlock()
+	exp := []string{
+		"miss test/events",
+		"store test/events/" + uri + " 5s",
+		"hit test/events/" + uri,
+		"hit test/events/" + uri,
+	}
+	if strings.Join(events, "\n") != strings.Join(exp, "\n") {
+		t.Fatalf("expected events %q but got %q", exp, events)
+	}
+}
+
+func TestCDN(t *testing.T) {
+	var (
+		s, _ = newServer(t)
+		keys = setCDN(t, s)
+	)
+	s.Cached("/cdn", sendContent, perUser, "cdn")
+	s.Cached("/cdn/error", func(r *fastglue.Request) error {
+		return r.SendBytes(500, "text/plain", content)
+	}, perUser, "cdn")
+	s.Glue.GET("/cdn/clear", s.Cache.ClearGroup(func(r *fastglue.Request) error {
+		return r.SendEnvelope(true)
+	}, perUser, "cdn"))
+	s.Cached("/cached", sendContent, perUser, group)
+
+	// Misses and hits are tagged with the surrogate key.
+	for i := 0; i < 2; i++ {
+		r, _ := getServerReq(s, "/cdn", "", false, t)
+		if k := r.Header.Get("Surrogate-Key"); k != "test/cdn" {
+			t.Fatalf("%d: expected surrogate key 'test/cdn' but got '%s'", i, k)
+		}
+	}
+	if r, _ := getServerReq(s, "/cached", "", false, t); r.Header.Get("Surrogate-Key") != "" {
+		t.Fatal("expected no surrogate key for groups not cached by the CDN")
+	}
+	if r, _ := getServerReq(s, "/cdn/error", "", false, t); r.Header.Get("Surrogate-Key") != "" {
+		t.Fatal("expected no surrogate key for uncacheable responses")
+	}
+
+	getServerReq(s, "/cdn/clear", "", false, t)
+	if len(*keys) != 1 || (*keys)[0] != "test/cdn" {
+		t.Fatalf("expected the purge of 'test/cdn' but got %v", *keys)
+	}
+}
+
+func TestWarm(t *testing.T) {
+	s, _ := newServer(t)
+	warm := *perUser
+	warm.IncludeQueryString = true
+	rt := s.Cached("/warm/{id}", func(r *fastglue.Request) error {
+		if r.RequestCtx.UserValue("id").(string) == "missing" {
+			return r.SendErrorEnvelope(fasthttp.StatusNotFound, "not found", nil, "")
+		}
+		return r.SendBytes(200, "text/plain", content)
+	}, &warm, "warm")
+
+	// The host is part of the keys of the route (IncludeQueryString).
+	host := strings.TrimPrefix(s.URL(t), "http://")
+	n, err := s.Cache.Warm(s.Glue, fctest.NamespaceKey, []fastcache.WarmRequest{
+		{Namespace: "test", Route: "/warm/{id}?page=1", Params: map[string]string{"id": "1"}, Host: host},
+		{Namespace: "test", Route: "/warm/{id}", Params: map[string]string{"id": "2"}, Host: host},
+		{Namespace: "test", Route: "/warm/{id}", Params: map[string]string{"id": "missing"}, Host: host},
+		{Namespace: "test", Route: "/warm/{id}", Params: map[string]string{"ref": "1"}, Host: host},
+	})
+	if n != 2 || err == nil || !strings.HasPrefix(err.Error(), "2 of 4 warm requests failed") {
+		t.Fatalf("expected 2 warmed requests and 2 failures but got %d, %v", n, err)
+	}
+	if n := rt.Calls(); n != 3 {
+		t.Fatalf("expected 3 handler calls but got %d", n)
+	}
+
+	// The warmed responses are served from the cache.
+	for _, uri := range []string{"/warm/1?page=1", "/warm/2"} {
+		r := rt.ExpectHit(t, uri)
+		if r.StatusCode != 200 || !bytes.Equal(r.Body, content) {
+			t.Fatalf("%s: unexpected response %d '%s'", uri, r.StatusCode, r.Body)
+		}
+	}
+}
+
+// sendContentSlow is a handler that responds with content, slowly for
+// requests with the query param "slow".
+func sendContentSlow(r *fastglue.Request) error {
+	if r.RequestCtx.QueryArgs().Has("slow") {
+		time.Sleep(time.Millisecond * 50)
+	}
+	return r.SendBytes(200, "text/plain", content)
+}
+
+func TestMinHandlerLatency(t *testing.T) {
+	s, _ := newServer(t)
+	minLatency := *perUser
+	minLatency.IncludeQueryString = true
+	minLatency.MinHandlerLatency = time.Millisecond * 20
+	rt := s.Cached("/min-latency", sendContentSlow, &minLatency, "min-latency")
+
+	// Cheap responses aren't cached.
+	rt.ExpectMiss(t, "/min-latency")
+	rt.ExpectMiss(t, "/min-latency")
+
+	rt.ExpectMiss(t, "/min-latency?slow")
+	rt.ExpectHit(t, "/min-latency?slow")
+}
+
+func TestAdaptiveTTL(t *testing.T) {
+	s, rd := newServer(t)
+	adaptive := *perUser
+	adaptive.IncludeQueryString = true
+	adaptive.AdaptiveTTL = fastcache.AdaptiveTTLOptions{
+		Enabled:  true,
+		Baseline: time.Millisecond * 10,
+		MinTTL:   time.Second,
+		MaxTTL:   time.Second * 20,
+	}
+	s.Cached("/adaptive", sendContentSlow, &adaptive, "adaptive")
+
+	// Cheap responses get the minimum TTL and expensive ones the maximum.
+	for _, c := range []struct {
+		uri string
+		ttl time.Duration
+	}{
+		{"/adaptive", time.Second},
+		{"/adaptive?slow", time.Second * 20},
+	} {
+		getServerReq(s, c.uri, "", false, t)
+		if ttl := rd.TTL("CACHE:test:adaptive"); ttl != c.ttl {
+			t.Fatalf("%s: expected TTL %v but got %v", c.uri, c.ttl, ttl)
+		}
+	}
+}
+
+func TestSlidingTTL(t *testing.T) {
+	s, rd := newServer(t)
+	sliding := *perUser
+	sliding.SlidingTTL = true
+	s.Cached("/sliding", sendContent, &sliding, "sliding")
+
+	getServerReq(s, "/sliding", "", false, t)
+	rd.SetTTL("CACHE:test:sliding", time.Second*2)
+
+	// Hits extend the TTL.
+	r, _ := getServerReq(s, "/sliding", "", false, t)
+	if r.StatusCode != 200 {
+		t.Fatalf("expected 200 but got %d", r.StatusCode)
+	}
+	if ttl := rd.TTL("CACHE:test:sliding"); ttl != time.Second*5 {
+		t.Fatalf("expected TTL %v but got %v", time.Second*5, ttl)
+	}
+}
+
+func TestStaleWhileRevalidate(t *testing.T) {
+	var (
+		s, rd = newServer(t)
+		calls int32
+
+		hash  = md5.Sum([]byte("/swr"))
+		field = "_staleat_" + hex.EncodeToString(hash[:])
+	)
+	swr := *perUser
+	swr.StaleWhileRevalidate = time.Second * 10
+	s.Cached("/swr", func(r *fastglue.Request) error {
+		n := atomic.AddInt32(&calls, 1)
+		return r.SendBytes(200, "text/plain", []byte("version "+strconv.Itoa(int(n))))
+	}, &swr, "swr")
+
+	_, b := getServerReq(s, "/swr", "", false, t)
+	if string(b) != "version 1" {
+		t.Fatalf("expected version 1 but got '%s'", b)
+	}
+
+	// Stale responses are retained for StaleWhileRevalidate past the TTL.
+	if ttl := rd.TTL("CACHE:test:swr"); ttl != time.Second*15 {
+		t.Fatalf("expected TTL %v but got %v", time.Second*15, ttl)
+	}
+
+	// The stale response is served while it's refreshed in the background.
+	stale := strconv.FormatInt(time.Now().Add(-time.Second).UnixMilli(), 10)
+	rd.HSet("CACHE:test:swr", field, stale)
+	_, b = getServerReq(s, "/swr", "", false, t)
+	if string(b) != "version 1" {
+		t.Fatalf("expected stale version 1 but got '%s'", b)
+	}
+
+	for i := 0; i < 100; i++ {
+		if rd.HGet("CACHE:test:swr", field) != stale {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	_, b = getServerReq(s, "/swr", "", false, t)
+	if string(b) != "version 2" {
+		t.Fatalf("expected refreshed version 2 but got '%s'", b)
+	}
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Fatalf("expected 2 handler calls but got %d", n)
+	}
+}
+
+func TestPagination(t *testing.T) {
+	var (
+		s, _    = newServer(t)
+		version int32
+	)
+	pages := *perUser
+	pages.IncludeQueryString = true
+	pages.Pagination = &fastcache.PaginationOptions{CursorParam: "page"}
+	s.Cached("/pages", func(r *fastglue.Request) error {
+		v := atomic.LoadInt32(&version)
+		return r.SendBytes(200, "text/plain", []byte("version "+strconv.Itoa(int(v))+" page "+string(r.RequestCtx.QueryArgs().Peek("page"))))
+	}, &pages, "pages")
+
+	r, _ := getServerReq(s, "/pages", "", false, t)
+	etag := r.Header.Get("Etag")
+
+	page := func(ifMatch string) int {
+		r, _ := getServerReqHeaders(s, "/pages?page=2", map[string]string{"If-Match": ifMatch}, t)
+		return r.StatusCode
+	}
+	if code := page(etag); code != 200 {
+		t.Fatalf("expected 200 for the snapshot's page but got %d", code)
+	}
+
+	// The first page is no longer cached.
+	if err := s.Cache.DelGroup("test", "pages"); err != nil {
+		t.Fatal(err)
+	}
+	if code := page(etag); code != http.StatusPreconditionFailed {
+		t.Fatalf("expected 412 for an uncached snapshot but got %d", code)
+	}
+
+	// The first page has changed.
+	atomic.AddInt32(&version, 1)
+	r, _ = getServerReq(s, "/pages", "", false, t)
+	if r.Header.Get("Etag") == etag {
+		t.Fatal("expected a new etag for the changed first page")
+	}
+	if code := page(etag); code != http.StatusPreconditionFailed {
+		t.Fatalf("expected 412 for a changed snapshot but got %d", code)
+	}
+	if code := page(r.Header.Get("Etag")); code != 200 {
+		t.Fatalf("expected 200 for the new snapshot's page but got %d", code)
+	}
+
+	// Weak ETags never match.
+	if code := page("W/" + r.Header.Get("Etag")); code != http.StatusPreconditionFailed {
+		t.Fatalf("expected 412 for a weak etag but got %d", code)
+	}
+}
+
+func TestKeyHasher(t *testing.T) {
+	s, rd := newServer(t)
+	fnvKeys := *perUser
+	fnvKeys.KeyHasher = fastcache.FNVHasher
+	fnvKeys.CacheStatusHeader = true
+	s.Cached("/fnv", sendContent, &fnvKeys, "fnv")
+
+	getServerReq(s, "/fnv", "", false, t)
+
+	h := fnv.New64a()
+	h.Write([]byte("/fnv"))
+	if rd.HGet("CACHE:test:fnv", "_ctype_"+hex.EncodeToString(h.Sum(nil))) == "" {
+		t.Fatal("expected the response to be cached under the FNV hash of the URI")
+	}
+
+	r, _ := getServerReq(s, "/fnv", "", false, t)
+	if r.Header.Get("X-Cache") != "HIT" {
+		t.Fatalf("expected X-Cache HIT but got '%s'", r.Header.Get("X-Cache"))
+	}
+}
+
+func TestRawKeys(t *testing.T) {
+	s, rd := newServer(t)
+	rawKeys := *perUser
+	rawKeys.IncludeQueryString = true
+	rawKeys.RawKeys = true
+	rawKeys.MaxRawKeyLength = 40
+	s.Cached("/raw", sendContent, &rawKeys, "raw")
+
+	root := s.URL(t)
+	raw := fastcache.RawURI(root + "/raw?b=2&a=1")
+	getServerReq(s, "/raw?b=2&a=1", "", false, t)
+	if rd.HGet("CACHE:test:raw", "_ctype_"+raw) == "" {
+		t.Fatalf("expected the response to be cached under the raw URI '%s'", raw)
+	}
+
+	// The host is part of the key, so virtual hosts don't share responses.
+	req, err := http.NewRequest("GET", root+"/raw?b=2&a=1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = "other.example"
+	r, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Body.Close()
+	if r.Header.Get("X-Cache") == "HIT" {
+		t.Fatal("expected a miss for another host")
+	}
+	if rd.HGet("CACHE:test:raw", "_ctype_"+fastcache.RawURI("http://other.example/raw?b=2&a=1")) == "" {
+		t.Fatal("expected the response to be cached under the other host's raw URI")
+	}
+
+	// Long keys are hashed.
+	long := "/raw?q=" + strings.Repeat("a", 40)
+	getServerReq(s, long, "", false, t)
+	if rd.HGet("CACHE:test:raw", "_ctype_"+fastcache.HashURI(root+long)) == "" {
+		t.Fatal("expected the response to be cached under the hashed URI")
+	}
+
+	if err := s.Cache.Del("test", "raw", raw); err != nil {
+		t.Fatal(err)
+	}
+	if rd.HGet("CACHE:test:raw", "_ctype_"+raw) != "" {
+		t.Fatal("expected the raw URI to be deleted")
+	}
+}
+
+func TestShedding(t *testing.T) {
+	var (
+		s, rd = newServer(t)
+
+		hash  = md5.Sum([]byte("/shed"))
+		field = "_staleat_" + hex.EncodeToString(hash[:])
+	)
+	swr := *perUser
+	swr.StaleWhileRevalidate = time.Second * 10
+	rt := s.Cached("/shed", sendContent, &swr, group)
+
+	calls := func(exp int) {
+		t.Helper()
+		if n := rt.Calls(); n != exp {
+			t.Fatalf("expected %d handler calls but got %d", exp, n)
+		}
+	}
+
+	// Misses are rejected without invoking the handler.
+	s.Cache.SetShedding(true)
+	if r, _ := getServerReq(s, "/shed", "", false, t); r.StatusCode != 503 {
+		t.Fatalf("expected 503 but got %v", r.StatusCode)
+	}
+	calls(0)
+
+	s.Cache.SetShedding(false)
+	getServerReq(s, "/shed", "", false, t)
+	calls(1)
+
+	// Stale responses past their windows are served without refreshes.
+	rd.HSet("CACHE:test:test", field, strconv.FormatInt(time.Now().Add(-time.Hour).UnixMilli(), 10))
+	s.Cache.SetShedding(true)
+	if r, b := getServerReq(s, "/shed", "", false, t); r.StatusCode != 200 || string(b) != string(content) {
+		t.Fatalf("expected stale response but got %v: '%s'", r.StatusCode, b)
+	}
+	calls(1)
+
+	s.Cache.SetShedding(false)
+	getServerReq(s, "/shed", "", false, t)
+	calls(2)
+}
+
+func TestNamespaceHook(t *testing.T) {
+	s, rd := newServer(t)
+	nsHook := *perUser
+	nsHook.NamespaceHook = func(r *fastglue.Request) (string, error) {
+		acc := r.RequestCtx.Request.Header.Peek("X-Account")
+		if len(acc) == 0 {
+			return "", errors.New("no account")
+		}
+		return "acc:" + string(acc), nil
+	}
+	rt := s.Cached("/ns-hook", sendContent, &nsHook, "nshook")
+
+	calls := func(exp int) {
+		t.Helper()
+		if n := rt.Calls(); n != exp {
+			t.Fatalf("expected %d handler calls but got %d", exp, n)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		getServerReqHeaders(s, "/ns-hook", map[string]string{"X-Account": "1"}, t)
+	}
+	calls(1)
+	if !rd.Exists("CACHE:acc:1:nshook") {
+		t.Fatal("expected the response to be cached in the computed namespace")
+	}
+
+	// Requests without a namespace aren't cached.
+	for i := 0; i < 2; i++ {
+		getServerReq(s, "/ns-hook", "", false, t)
+	}
+	calls(3)
+}
+
+func TestSharedNamespace(t *testing.T) {
+	s, rd := newServer(t)
+
+	// Requests to /public have no namespace.
+	public := *perUser
+	public.NamespaceKey = "anon"
+	public.SharedNamespace = "public"
+	rt := s.Cached("/public", sendContent, &public, "public")
+
+	for i := 0; i < 2; i++ {
+		getServerReq(s, "/public", "", false, t)
+	}
+	if n := rt.Calls(); n != 1 {
+		t.Fatalf("expected 1 handler call but got %d", n)
+	}
+	if !rd.Exists("CACHE:public:public") {
+		t.Fatal("expected the response to be cached in the shared namespace")
+	}
+
+	// Authorized requests are private and aren't served from or cached in
+	// the shared namespace.
+	for i := 0; i < 2; i++ {
+		getServerReqHeaders(s, "/public", map[string]string{"Authorization": "Bearer token"}, t)
+	}
+	if n := rt.Calls(); n != 3 {
+		t.Fatalf("expected 3 handler calls but got %d", n)
+	}
+}
+
+func TestGroupHook(t *testing.T) {
+	s, rd := newServer(t)
+	accountOrders := *perUser
+	accountOrders.GroupHook = fastcache.GroupFromParams("orders:{account_id}")
+	rt := s.Cached("/accounts/{account_id}/orders", sendContent, &accountOrders, "orders")
+	s.Glue.GET("/accounts/{account_id}/orders/clear", s.Cache.ClearGroup(sendContent, &accountOrders))
+
+	calls := func(exp int) {
+		t.Helper()
+		if n := rt.Calls(); n != exp {
+			t.Fatalf("expected %d handler calls but got %d", exp, n)
+		}
+	}
+
+	for _, id := range []string{"1", "2"} {
+		getServerReq(s, "/accounts/"+id+"/orders", "", false, t)
+		if !rd.Exists("CACHE:test:orders:" + id) {
+			t.Fatalf("expected the response to be cached in the group orders:%s", id)
+		}
+	}
+	calls(2)
+
+	// Clearing an account's group doesn't clear the other accounts'.
+	getServerReq(s, "/accounts/1/orders/clear", "", false, t)
+	if rd.Exists("CACHE:test:orders:1") || !rd.Exists("CACHE:test:orders:2") {
+		t.Fatal("expected only the group orders:1 to be cleared")
+	}
+	for _, id := range []string{"1", "2"} {
+		getServerReq(s, "/accounts/"+id+"/orders", "", false, t)
+	}
+	calls(3)
+}
+
+func TestKeyGenerator(t *testing.T) {
+	s, rd := newServer(t)
+	keyGen := *perUser
+	keyGen.KeyGenerator = func(r *fastglue.Request) string {
+		id := r.RequestCtx.UserValue("id").(string)
+		if id == "none" {
+			return ""
+		}
+		return "item:" + id + ":" + string(r.RequestCtx.Request.Header.Peek("X-Region"))
+	}
+	rt := s.Cached("/keygen/{id}", sendContent, &keyGen, "keygen")
+
+	calls := func(exp int) {
+		t.Helper()
+		if n := rt.Calls(); n != exp {
+			t.Fatalf("expected %d handler calls but got %d", exp, n)
+		}
+	}
+
+	// The query string isn't part of the generated key.
+	for _, u := range []string{"/keygen/1", "/keygen/1?a=b"} {
+		getServerReqHeaders(s, u, map[string]string{"X-Region": "in"}, t)
+	}
+	calls(1)
+	if !rd.Exists("CACHE:test:keygen") || rd.HGet("CACHE:test:keygen", "_ctype_item:1:in") == "" {
+		t.Fatal("expected the response to be cached under the generated key")
+	}
+
+	getServerReqHeaders(s, "/keygen/1", map[string]string{"X-Region": "us"}, t)
+	calls(2)
+
+	// Empty keys bypass the cache.
+	for i := 0; i < 2; i++ {
+		getServerReq(s, "/keygen/none", "", false, t)
+	}
+	calls(4)
+}
+
+func TestRecoverPanics(t *testing.T) {
+	var (
+		s, rd  = newServer(t)
+		panics int32
+	)
+	recoverPanics := *perUser
+	recoverPanics.RecoverPanics = true
+	recoverPanics.Hooks.OnPanic = func(r *fastglue.Request, namespace, group string, p interface{}) {
+		atomic.AddInt32(&panics, 1)
+	}
+	s.Cached("/panic", func(r *fastglue.Request) error {
+		r.RequestCtx.SetStatusCode(200)
+		r.RequestCtx.SetBodyString("partial")
+		panic("handler panic")
+	}, &recoverPanics, "panic")
+
+	for i := 0; i < 2; i++ {
+		r, b := getServerReq(s, "/panic", "", false, t)
+		if r.StatusCode != http.StatusInternalServerError || string(b) == "partial" {
+			t.Fatalf("expected 500 but got %d: '%s'", r.StatusCode, b)
+		}
+	}
+
+	// The partial response isn't cached.
+	if rd.Exists("CACHE:test:panic") {
+		t.Fatal("expected partial response to not be cached")
+	}
+	if n := atomic.LoadInt32(&panics); n != 2 {
+		t.Fatalf("expected 2 recovered panics but got %d", n)
+	}
+}
+
+func TestCacheMethods(t *testing.T) {
+	var (
+		s, _     = newServer(t)
+		searches int32
+	)
+	o := *perUser
+	o.CacheMethods = []string{"POST"}
+	o.MaxBodyBytes = 20
+	h := s.Cache.Cached(func(r *fastglue.Request) error {
+		atomic.AddInt32(&searches, 1)
+		return r.SendBytes(200, "text/plain", append([]byte("results for "), r.RequestCtx.PostBody()...))
+	}, &o, "search")
+	s.Glue.GET("/search", h)
+	s.Glue.POST("/search", h)
+	s.Glue.PUT("/search", h)
+
+	search := func(method, body string) string {
+		req, err := http.NewRequest(method, s.URL(t)+"/search", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		b, _ := io.ReadAll(resp.Body)
+		return string(b)
+	}
+	calls := func(exp int32) {
+		t.Helper()
+		if n := atomic.LoadInt32(&searches); n != exp {
+			t.Fatalf("expected %d handler calls but got %d", exp, n)
+		}
+	}
+
+	// The request body is part of the key.
+	for _, body := range []string{"a", "a", "b", "b"} {
+		if b := search(http.MethodPost, body); b != "results for "+body {
+			t.Fatalf("expected results for '%s' but got '%s'", body, b)
+		}
+	}
+	calls(2)
+
+	// Requests with bodies larger than MaxBodyBytes aren't cached.
+	for i := 0; i < 2; i++ {
+		search(http.MethodPost, strings.Repeat("c", 30))
+	}
+	calls(4)
+
+	// Methods that aren't in CacheMethods aren't cached.
+	for i := 0; i < 2; i++ {
+		if b := search(http.MethodPut, "a"); b != "results for a" {
+			t.Fatalf("expected results for 'a' but got '%s'", b)
+		}
+	}
+	calls(6)
+
+	// The method is part of the key, so GET and POST requests for the same
+	// URI don't collide.
+	for _, method := range []string{http.MethodGet, http.MethodPost, http.MethodGet, http.MethodPost} {
+		if b := search(method, ""); b != "results for " {
+			t.Fatalf("%s: expected empty results but got '%s'", method, b)
+		}
+	}
+	calls(8)
+}
+
+func TestHead(t *testing.T) {
+	var (
+		s, rd = newServer(t)
+		calls int32
+	)
+	h := s.Cache.Cached(func(r *fastglue.Request) error {
+		atomic.AddInt32(&calls, 1)
+		return r.SendBytes(200, "text/plain", content)
+	}, perUser, "head")
+	s.Glue.GET("/head", h)
+	s.Glue.HEAD("/head", h)
+
+	// Responses to HEAD requests aren't cached.
+	resp, err := http.Head(s.URL(t) + "/head")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if rd.Exists("CACHE:test:head") {
+		t.Fatal("expected HEAD response to not be cached")
+	}
+
+	r, _ := getServerReq(s, "/head", "", false, t)
+	etag := r.Header.Get("Etag")
+
+	// HEAD requests are served from the cached GET response.
+	resp, err = http.Head(s.URL(t) + "/head")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.Header.Get("Etag") != etag || len(b) != 0 {
+		t.Fatalf("expected cached headers without a body but got etag '%s' and body '%s'", resp.Header.Get("Etag"), b)
+	}
+	if resp.ContentLength != int64(len(content)) {
+		t.Fatalf("expected Content-Length %d but got %d", len(content), resp.ContentLength)
+	}
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Fatalf("expected 2 handler calls but got %d", n)
+	}
+}
+
+func TestIncludeMethod(t *testing.T) {
+	var (
+		s, _  = newServer(t)
+		calls int32
+	)
+	o := *perUser
+	o.IncludeMethod = true
+	h := s.Cache.Cached(func(r *fastglue.Request) error {
+		atomic.AddInt32(&calls, 1)
+		r.RequestCtx.Response.Header.Set("X-Method", string(r.RequestCtx.Method()))
+		return r.SendBytes(200, "text/plain", content)
+	}, &o, "head-method")
+	s.Glue.GET("/head-method", h)
+	s.Glue.HEAD("/head-method", h)
+
+	req := func(method string, exp int32) {
+		t.Helper()
+
+		req, err := http.NewRequest(method, s.URL(t)+"/head-method", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if m := resp.Header.Get("X-Method"); m != method {
+			t.Fatalf("%s: expected the response to the %s request but got that of %s", method, method, m)
+		}
+		if method == http.MethodGet && !bytes.Equal(b, content) {
+			t.Fatalf("GET: unexpected body '%s'", b)
+		}
+		if n := atomic.LoadInt32(&calls); n != exp {
+			t.Fatalf("%s: expected %d handler calls but got %d", method, exp, n)
+		}
+	}
+
+	// HEAD requests are neither served from the cache of GET requests nor
+	// overwrite it, and are cached under their own key.
+	req(http.MethodGet, 1)
+	req(http.MethodHead, 2)
+	req(http.MethodGet, 2)
+	req(http.MethodHead, 2)
+}
+
+func TestDelGroupGrace(t *testing.T) {
+	var (
+		s, rd = newServer(t)
+		calls int32
+
+		hash  = md5.Sum([]byte("/del-grace"))
+		field = "_staleat_" + hex.EncodeToString(hash[:])
+	)
+	swr := *perUser
+	swr.StaleWhileRevalidate = time.Second * 10
+	s.Cached("/del-grace", func(r *fastglue.Request) error {
+		// Refreshes are slow so that stale responses are served before
+		// they're refreshed.
+		n := atomic.AddInt32(&calls, 1)
+		if n > 1 {
+			time.Sleep(time.Millisecond * 50)
+		}
+		return r.SendBytes(200, "text/plain", []byte("version "+strconv.Itoa(int(n))))
+	}, &swr, "del-grace")
+
+	_, b := getServerReq(s, "/del-grace", "", false, t)
+	if string(b) != "version 1" {
+		t.Fatalf("expected version 1 but got '%s'", b)
+	}
+
+	s.Cache.SetDelGroupGrace(time.Second * 2)
+	if err := s.Cache.DelGroup("test", "del-grace"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The group is retained for the grace window.
+	if ttl := rd.TTL("CACHE:test:del-grace"); ttl != time.Second*2 {
+		t.Fatalf("expected TTL %v but got %v", time.Second*2, ttl)
+	}
+	staleAt := rd.HGet("CACHE:test:del-grace", field)
+
+	// The stale response is served while it's refreshed in the background.
+	_, b = getServerReq(s, "/del-grace", "", false, t)
+	if string(b) != "version 1" {
+		t.Fatalf("expected stale version 1 but got '%s'", b)
+	}
+
+	for i := 0; i < 100; i++ {
+		if rd.HGet("CACHE:test:del-grace", field) != staleAt {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	_, b = getServerReq(s, "/del-grace", "", false, t)
+	if string(b) != "version 2" {
+		t.Fatalf("expected refreshed version 2 but got '%s'", b)
+	}
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Fatalf("expected 2 handler calls but got %d", n)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	s, rd := newServer(t)
+	rt := s.Cached("/read-only", sendContent, perUser, "read-only")
+
+	s.Cache.SetReadOnly(true)
+	for i := 0; i < 2; i++ {
+		getServerReq(s, "/read-only", "", false, t)
+	}
+	if n := rt.Calls(); n != 2 {
+		t.Fatalf("expected 2 handler calls but got %d", n)
+	}
+	if rd.Exists("CACHE:test:read-only") {
+		t.Fatal("expected no cache writes in read-only mode")
+	}
+
+	s.Cache.SetReadOnly(false)
+	for i := 0; i < 2; i++ {
+		getServerReq(s, "/read-only", "", false, t)
+	}
+	if n := rt.Calls(); n != 3 {
+		t.Fatalf("expected 3 handler calls but got %d", n)
+	}
+}
+
+func TestRefreshAhead(t *testing.T) {
+	s, rd := newServer(t)
+	refreshAhead := *perUser
+	refreshAhead.RefreshAhead = 0.5
+	rt := s.Cached("/refresh-ahead", sendContent, &refreshAhead, "refresh-ahead")
+
+	// Hits early in the TTL don't refresh.
+	for i := 0; i < 2; i++ {
+		getServerReq(s, "/refresh-ahead", "", false, t)
+	}
+	if n := rt.Calls(); n != 1 {
+		t.Fatalf("expected 1 handler call but got %d", n)
+	}
+
+	// Hits in the last half of the TTL refresh in the background.
+	rd.SetTTL("CACHE:test:refresh-ahead", time.Second*2)
+	r, _ := getServerReq(s, "/refresh-ahead", "", false, t)
+	if r.StatusCode != 200 {
+		t.Fatalf("expected 200 but got %d", r.StatusCode)
+	}
+	for i := 0; i < 100 && rd.TTL("CACHE:test:refresh-ahead") != time.Second*5; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	if n := rt.Calls(); n != 2 {
+		t.Fatalf("expected 2 handler calls but got %d", n)
+	}
+	if ttl := rd.TTL("CACHE:test:refresh-ahead"); ttl != time.Second*5 {
+		t.Fatalf("expected refreshed TTL %v but got %v", time.Second*5, ttl)
+	}
+}
+
+func TestCoalesce(t *testing.T) {
+	s, _ := newServer(t)
+	coalesce := *perUser
+	coalesce.Coalesce = true
+	rt := s.Cached("/coalesce", func(r *fastglue.Request) error {
+		time.Sleep(time.Millisecond * 100)
+		return r.SendBytes(200, "text/plain", content)
+	}, &coalesce, "coalesce")
+
+	var (
+		u    = s.URL(t) + "/coalesce"
+		wg   sync.WaitGroup
+		errs = make(chan error, 5)
+	)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			resp, err := http.Get(u)
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer resp.Body.Close()
+
+			b, err := io.ReadAll(resp.Body)
+			if err == nil && (resp.StatusCode != 200 || !bytes.Equal(b, content)) {
+				err = fmt.Errorf("unexpected response %d: %s", resp.StatusCode, b)
+			}
+			if err != nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Fatal(err)
+	}
+	if n := rt.Calls(); n != 1 {
+		t.Fatalf("expected 1 handler call but got %d", n)
+	}
+}
+
+func TestGrace(t *testing.T) {
+	var (
+		s, rd  = newServer(t)
+		calls  int32
+		fail   int32
+		graces int32
+
+		hash  = md5.Sum([]byte("/grace"))
+		field = "_staleat_" + hex.EncodeToString(hash[:])
+	)
+	grace := *perUser
+	grace.Grace = time.Second * 10
+	grace.GraceLimit = 1
+	grace.Hooks.OnGrace = func(r *fastglue.Request, namespace, group string) {
+		atomic.AddInt32(&graces, 1)
+	}
+	s.Cached("/grace", func(r *fastglue.Request) error {
+		n := atomic.AddInt32(&calls, 1)
+		if atomic.LoadInt32(&fail) == 1 {
+			return errors.New("failed")
+		}
+		return r.SendBytes(200, "text/plain", []byte("version "+strconv.Itoa(int(n))))
+	}, &grace, "grace")
+
+	getServerReq(s, "/grace", "", false, t)
+	if ttl := rd.TTL("CACHE:test:grace"); ttl != time.Second*15 {
+		t.Fatalf("expected TTL %v but got %v", time.Second*15, ttl)
+	}
+
+	// The response is served in its grace window while the refresh fails.
+	rd.HSet("CACHE:test:grace", field, "1")
+	atomic.StoreInt32(&fail, 1)
+	_, b := getServerReq(s, "/grace", "", false, t)
+	if string(b) != "version 1" {
+		t.Fatalf("expected version 1 in grace but got '%s'", b)
+	}
+	for i := 0; i < 100 && atomic.LoadInt32(&calls) != 2; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	time.Sleep(time.Millisecond * 10)
+	atomic.StoreInt32(&fail, 0)
+
+	// Grace serves are capped.
+	_, b = getServerReq(s, "/grace", "", false, t)
+	if string(b) != "version 3" {
+		t.Fatalf("expected version 3 after the grace limit but got '%s'", b)
+	}
+	if n := atomic.LoadInt32(&graces); n != 1 {
+		t.Fatalf("expected 1 grace serve but got %d", n)
+	}
+}
+
+func TestCachedHeaders(t *testing.T) {
+	s, _ := newServer(t)
+	maxHeaders := *perUser
+	maxHeaders.IncludeQueryString = true
+	maxHeaders.MaxHeaderBytes = 100
+	rt := s.Cached("/max-headers", func(r *fastglue.Request) error {
+		r.RequestCtx.Response.Header.Set("X-Custom", "custom")
+		r.RequestCtx.Response.Header.Set("Keep-Alive", "timeout=5")
+		if r.RequestCtx.QueryArgs().Has("big") {
+			r.RequestCtx.Response.Header.Set("X-Big", strings.Repeat("a", 100))
+		}
+		return r.SendBytes(200, "text/plain", content)
+	}, &maxHeaders, "headers")
+
+	// Hop-by-hop headers aren't replayed.
+	for i := 0; i < 2; i++ {
+		r, _ := getServerReq(s, "/max-headers", "", false, t)
+		if r.Header.Get("X-Custom") != "custom" {
+			t.Fatalf("%d: expected X-Custom header but got %v", i, r.Header)
+		}
+		if i == 1 && r.Header.Get("Keep-Alive") != "" {
+			t.Fatalf("expected no Keep-Alive header but got '%s'", r.Header.Get("Keep-Alive"))
+		}
+	}
+	if n := rt.Calls(); n != 1 {
+		t.Fatalf("expected 1 handler call but got %d", n)
+	}
+
+	// Responses with headers larger than MaxHeaderBytes aren't cached.
+	for i := 0; i < 2; i++ {
+		getServerReq(s, "/max-headers?big", "", false, t)
+	}
+	if n := rt.Calls(); n != 3 {
+		t.Fatalf("expected 3 handler calls but got %d", n)
+	}
+}
+
+func TestEmitCacheControl(t *testing.T) {
+	s, rd := newServer(t)
+	emit := *perUser
+	emit.EmitCacheControl = true
+	s.Cached("/emit-cache-control", sendContent, &emit, "emit")
+
+	// Fresh response.
+	r, _ := getServerReq(s, "/emit-cache-control", "", false, t)
+	if r.Header.Get("Cache-Control") != "public, max-age=5" || r.Header.Get("Expires") == "" {
+		t.Fatalf("expected max-age=5 and Expires but got '%s' '%s'", r.Header.Get("Cache-Control"), r.Header.Get("Expires"))
+	}
+
+	// Cached response with the remaining TTL.
+	rd.SetTTL("CACHE:test:emit", time.Second*3)
+	r, _ = getServerReq(s, "/emit-cache-control", "", false, t)
+	if r.Header.Get("Cache-Control") != "public, max-age=3" || r.Header.Get("Expires") == "" {
+		t.Fatalf("expected max-age=3 and Expires but got '%s' '%s'", r.Header.Get("Cache-Control"), r.Header.Get("Expires"))
+	}
+}
+
+func TestRewriteMaxAge(t *testing.T) {
+	s, rd := newServer(t)
+	maxAge := *perUser
+	maxAge.IncludeQueryString = true
+	maxAge.RewriteMaxAge = true
+	s.Cached("/max-age", func(r *fastglue.Request) error {
+		if cc := r.RequestCtx.QueryArgs().Peek("cc"); len(cc) > 0 {
+			r.RequestCtx.Response.Header.SetBytesV("Cache-Control", cc)
+		}
+		return r.SendBytes(200, "text/plain", content)
+	}, &maxAge, "max-age")
+
+	for n, c := range []struct {
+		uri   string
+		fresh string
+		exp   string
+	}{
+		{"/max-age", "", "private, max-age=3"},
+		{"/max-age?cc=public,max-age=3600,must-revalidate", "public,max-age=3600,must-revalidate", "public, must-revalidate, max-age=3"},
+	} {
+		// Fresh responses are sent as they are.
+		r, _ := getServerReq(s, c.uri, "", false, t)
+		if cc := r.Header.Get("Cache-Control"); cc != c.fresh {
+			t.Fatalf("%d: expected fresh '%s' but got '%s'", n, c.fresh, cc)
+		}
+
+		// Cached responses get the remaining TTL.
+		rd.SetTTL("CACHE:test:max-age", time.Second*3)
+		r, _ = getServerReq(s, c.uri, "", false, t)
+		if cc := r.Header.Get("Cache-Control"); cc != c.exp {
+			t.Fatalf("%d: expected '%s' but got '%s'", n, c.exp, cc)
+		}
+	}
+}
+
+func TestRanges(t *testing.T) {
+	s, _ := newServer(t)
+	ranges := *perUser
+	ranges.Ranges = true
+	ranges.Compression.Enabled = false
+	s.Cached("/range", sendContent, &ranges, group)
+
+	// Miss.
+	r, b := getServerReqHeaders(s, "/range", map[string]string{"Range": "bytes=0-3"}, t)
+	if r.StatusCode != 200 || !bytes.Equal(b, content) {
+		t.Fatalf("expected 200 with content on miss but got %d '%s'", r.StatusCode, b)
+	}
+	etag := r.Header.Get("ETag")
+	size := strconv.Itoa(len(content))
+
+	for n, c := range []struct {
+		headers map[string]string
+		status  int
+		body    []byte
+		cr      string
+	}{
+		{map[string]string{"Range": "bytes=0-3"}, 206, content[:4], "bytes 0-3/" + size},
+		{map[string]string{"Range": "bytes=-7"}, 206, content[len(content)-7:], fmt.Sprintf("bytes %d-%d/%s", len(content)-7, len(content)-1, size)},
+		{map[string]string{"Range": "bytes=5-", "If-Range": etag}, 206, content[5:], fmt.Sprintf("bytes 5-%d/%s", len(content)-1, size)},
+		{map[string]string{"Range": "bytes=1000-"}, 416, nil, "bytes */" + size},
+		// Served whole.
+		{map[string]string{"Range": "bytes=0-1,3-4"}, 200, content, ""},
+		{map[string]string{"Range": "bytes=0-3", "If-Range": `"outdated"`}, 200, content, ""},
+		{nil, 200, content, ""},
+	} {
+		r, b := getServerReqHeaders(s, "/range", c.headers, t)
+		if r.StatusCode != c.status || !bytes.Equal(b, c.body) || r.Header.Get("Content-Range") != c.cr {
+			t.Fatalf("%d: expected %d '%s' (%s) but got %d '%s' (%s)", n, c.status, c.body, c.cr, r.StatusCode, b, r.Header.Get("Content-Range"))
+		}
+	}
+}
+
+func TestCacheStatusHeader(t *testing.T) {
+	s, _ := newServer(t)
+	xcache := *perUser
+	xcache.CacheStatusHeader = true
+	xcache.CacheHitsHeader = true
+	s.Cached("/x-cache", sendContent, &xcache, group)
+
+	r, _ := getServerReq(s, "/x-cache", "", false, t)
+	if r.Header.Get("X-Cache") != "MISS" || r.Header.Get("X-Cache-Hits") != "" {
+		t.Fatalf("expected X-Cache MISS but got '%s' (%s)", r.Header.Get("X-Cache"), r.Header.Get("X-Cache-Hits"))
+	}
+	etag := r.Header.Get("ETag")
+
+	for n, e := range []string{"", etag} {
+		r, _ := getServerReq(s, "/x-cache", e, false, t)
+		if r.Header.Get("X-Cache") != "HIT" || r.Header.Get("X-Cache-Hits") != strconv.Itoa(n+1) {
+			t.Fatalf("expected X-Cache HIT (%d) but got '%s' (%s)", n+1, r.Header.Get("X-Cache"), r.Header.Get("X-Cache-Hits"))
+		}
+	}
+}
+
+func TestDebugKey(t *testing.T) {
+	s, _ := newServer(t)
+	debug := *perUser
+	debug.DebugSecret = "debug"
+	s.Cached("/debug-key", sendContent, &debug, group)
+
+	key := "test/" + group + "/" + fastcache.HashURI("/debug-key")
+	for n, c := range []struct {
+		secret string
+		key    string
+	}{
+		{"", ""},
+		{"debug", key},
+		{"wrong", ""},
+		{"debug", key},
+	} {
+		var h map[string]string
+		if c.secret != "" {
+			h = map[string]string{"X-Cache-Debug": c.secret}
+		}
+		r, _ := getServerReqHeaders(s, "/debug-key", h, t)
+		if r.Header.Get("X-Cache-Key") != c.key {
+			t.Fatalf("%d: expected X-Cache-Key '%s' but got '%s'", n, c.key, r.Header.Get("X-Cache-Key"))
+		}
+	}
+}
+
+func TestClock(t *testing.T) {
+	s, _ := newServer(t)
+	clocked := *perUser
+	clocked.Clock = fixedClock{}
+	s.Cached("/clock", sendContent, &clocked, group)
+
+	getServerReq(s, "/clock", "", false, t)
+
+	hash := md5.Sum([]byte("/clock"))
+	item, err := s.Cache.Inspect("test", group, hex.EncodeToString(hash[:]))
+	if err != nil {
+		t.Fatalf("error inspecting item: %v", err)
+	}
+	if !item.CreatedAt.Equal(fixedTime) {
+		t.Fatalf("expected CreatedAt %v but got %v", fixedTime, item.CreatedAt)
+	}
+}
+
+func TestMaxQueryStringLength(t *testing.T) {
+	s, _ := newServer(t)
+	maxQuery := *perUser
+	maxQuery.IncludeQueryString = true
+	maxQuery.MaxQueryStringLength = 10
+	s.Cached("/max-query", sendContent, &maxQuery, group)
+
+	// Short query strings are cached.
+	r, _ := getServerReq(s, "/max-query?a=1", "", false, t)
+	r, _ = getServerReq(s, "/max-query?a=1", r.Header.Get("Etag"), false, t)
+	if r.StatusCode != 304 {
+		t.Fatalf("expected 304 but got %v", r.StatusCode)
+	}
+
+	// Long ones bypass the cache.
+	for n := 0; n < 2; n++ {
+		r, b := getServerReq(s, "/max-query?a=12345678901234567890", "", false, t)
+		if r.StatusCode != 200 {
+			t.Fatalf("expected 200 but got %v", r.StatusCode)
+		}
+		if r.Header.Get("Etag") != "" {
+			t.Fatal("there should be no etag for an uncached response")
+		}
+		if !bytes.Equal(b, content) {
+			t.Fatalf("expected test content in body but got %v", b)
+		}
+	}
+}
+
+func TestStreamingBypass(t *testing.T) {
+	var (
+		s, _ = newServer(t)
+
+		bypasses []string
+		mu       sync.Mutex
+	)
+	bypass := *perUser
+	bypass.Hooks.OnBypass = func(r *fastglue.Request, reason string) {
+		mu.Lock()
+		bypasses = append(bypasses, reason)
+		mu.Unlock()
+	}
+	s.Cached("/bypass", func(r *fastglue.Request) error {
+		if r.RequestCtx.QueryArgs().Has("sse") {
+			return r.SendBytes(200, "text/event-stream", []byte("data: test\n\n"))
+		}
+		return r.SendBytes(200, "text/plain", content)
+	}, &bypass, group)
+
+	for _, c := range []struct {
+		url     string
+		headers map[string]string
+		reason  string
+	}{
+		{"/bypass", map[string]string{"Connection": "Upgrade", "Upgrade": "websocket"}, fastcache.BypassUpgrade},
+		{"/bypass", map[string]string{"Accept": "text/event-stream"}, fastcache.BypassStream},
+		{"/bypass?sse=1", nil, fastcache.BypassStream},
+	} {
+		mu.Lock()
+		bypasses = nil
+		mu.Unlock()
+
+		for n := 0; n < 2; n++ {
+			r, _ := getServerReqHeaders(s, c.url, c.headers, t)
+			if r.StatusCode != 200 {
+				t.Fatalf("expected 200 but got %v", r.StatusCode)
+			}
+			if r.Header.Get("Etag") != "" {
+				t.Fatalf("%s %v: there should be no etag for a bypassed response", c.url, c.headers)
+			}
+		}
+
+		mu.Lock()
+		got := bypasses
+		mu.Unlock()
+		if len(got) != 2 || got[0] != c.reason || got[1] != c.reason {
+			t.Fatalf("%s %v: expected bypass reasons [%s %s] but got %v", c.url, c.headers, c.reason, c.reason, got)
+		}
+	}
+
+	// Streaming routes are refused at registration.
+	s.Cache.MarkStreaming("/events")
+	if _, err := s.Cache.CachedPath("/events", func(r *fastglue.Request) error { return nil }, &fastcache.Options{}, group); !errors.Is(err, fastcache.ErrStreamingRoute) {
+		t.Fatalf("expected ErrStreamingRoute but got %v", err)
+	}
+	if _, err := s.Cache.CachedPath("/orders", func(r *fastglue.Request) error { return nil }, &fastcache.Options{}, group); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestStalenessField(t *testing.T) {
+	s, _ := newServer(t)
+	staleness := *perUser
+	staleness.StalenessField = "_cache"
+	staleness.Clock = fixedClock{}
+	s.Cached("/staleness", func(r *fastglue.Request) error {
+		return r.SendBytes(200, "application/json", []byte(`{"data": [1, 2, 3]}`))
+	}, &staleness, group)
+
+	// Uncached responses are served as-is.
+	_, b := getServerReq(s, "/staleness", "", false, t)
+	if string(b) != `{"data": [1, 2, 3]}` {
+		t.Fatalf("unexpected body: %s", b)
+	}
+
+	// Cached responses have the metadata injected.
+	for _, gz := range []bool{false, true} {
+		_, b = getServerReq(s, "/staleness", "", gz, t)
+		exp := `{"_cache":{"cached_at":"2020-01-02T03:04:05Z","age":0},"data": [1, 2, 3]}`
+		if string(b) != exp {
+			t.Fatalf("expected %s but got %s", exp, b)
+		}
+	}
+}
+
+func TestEnvelope(t *testing.T) {
+	s, _ := newServer(t)
+	envelope := *perUser
+	envelope.CacheBodyIf = fastcache.AllBodyIf(fastcache.EnvelopeSuccess, fastcache.NotEmptyJSON)
+	s.Cached("/envelope", func(r *fastglue.Request) error {
+		if r.RequestCtx.QueryArgs().Has("err") {
+			return r.SendErrorEnvelope(200, "error", nil, "")
+		}
+		if r.RequestCtx.QueryArgs().Has("empty") {
+			return r.SendEnvelope([]int{})
+		}
+		return r.SendEnvelope([]int{1, 2, 3})
+	}, &envelope, group)
+
+	// Error envelopes with a 200 status are not cached.
+	r, b := getServerReq(s, "/envelope?err=1", "", false, t)
+	if r.StatusCode != 200 || r.Header.Get("Etag") != "" {
+		t.Fatalf("expected uncached 200 but got %v (etag '%s')", r.StatusCode, r.Header.Get("Etag"))
+	}
+	if !bytes.Contains(b, []byte(`"status":"error"`)) {
+		t.Fatalf("expected error envelope but got %s", b)
+	}
+
+	// Nor are empty ones.
+	r, b = getServerReq(s, "/envelope?empty=1", "", false, t)
+	if r.StatusCode != 200 || r.Header.Get("Etag") != "" {
+		t.Fatalf("expected uncached 200 but got %v (etag '%s')", r.StatusCode, r.Header.Get("Etag"))
+	}
+	if !bytes.Contains(b, []byte(`"data":[]`)) {
+		t.Fatalf("expected empty envelope but got %s", b)
+	}
+
+	// Success envelopes are.
+	r, b = getServerReq(s, "/envelope", "", false, t)
+	etag := r.Header.Get("Etag")
+	if etag == "" {
+		t.Fatal("expected etag for a cached envelope")
+	}
+
+	r, b2 := getServerReq(s, "/envelope", "", false, t)
+	if r.StatusCode != 200 || r.Header.Get("Etag") != etag || !bytes.Equal(b, b2) {
+		t.Fatalf("expected cached envelope %s but got %v %s", b, r.StatusCode, b2)
+	}
+}
+
+func TestContentETag(t *testing.T) {
+	s, _ := newServer(t)
+	contentETag := *perUser
+	contentETag.ContentETag = true
+	s.Cached("/content-etag", sendContent, &contentETag, "content-etag")
+
+	r, _ := getServerReq(s, "/content-etag", "", false, t)
+	etag := r.Header.Get("Etag")
+	if etag == "" {
+		t.Fatal("expected etag")
+	}
+
+	// The ETag is the same and is honored across cache clears.
+	if err := s.Cache.DelGroup("test", "content-etag"); err != nil {
+		t.Fatal(err)
+	}
+	r, b := getServerReq(s, "/content-etag", etag, false, t)
+	if r.StatusCode != 304 || len(b) != 0 {
+		t.Fatalf("expected 304 but got %v", r.StatusCode)
+	}
+	if r.Header.Get("Etag") != etag {
+		t.Fatalf("expected etag %s but got %s", etag, r.Header.Get("Etag"))
+	}
+
+	r, b = getServerReq(s, "/content-etag", "", false, t)
+	if r.StatusCode != 200 || r.Header.Get("Etag") != etag || !bytes.Equal(b, content) {
+		t.Fatalf("expected cached 200 with etag %s but got %v %s", etag, r.StatusCode, r.Header.Get("Etag"))
+	}
+}
+
+func TestLastModified(t *testing.T) {
+	s, _ := newServer(t)
+	lastMod := *perUser
+	lastMod.ETag = false
+	lastMod.LastModified = true
+	lastMod.Clock = fixedClock{}
+	s.Cached("/last-modified", sendContent, &lastMod, group)
+
+	modified := fixedTime.Format(http.TimeFormat)
+
+	r, _ := getServerReq(s, "/last-modified", "", false, t)
+	if r.StatusCode != 200 || r.Header.Get("Last-Modified") != modified {
+		t.Fatalf("expected 200 with Last-Modified %s but got %v '%s'", modified, r.StatusCode, r.Header.Get("Last-Modified"))
+	}
+
+	for _, c := range []struct {
+		since  time.Time
+		status int
+	}{
+		{fixedTime, 304},
+		{fixedTime.Add(time.Hour), 304},
+		{fixedTime.Add(-time.Hour), 200},
+	} {
+		r, b := getServerReqHeaders(s, "/last-modified", map[string]string{"If-Modified-Since": c.since.Format(http.TimeFormat)}, t)
+		if r.StatusCode != c.status {
+			t.Fatalf("If-Modified-Since %v: expected %d but got %d", c.since, c.status, r.StatusCode)
+		}
+		if r.Header.Get("Last-Modified") != modified {
+			t.Fatalf("expected Last-Modified %s but got '%s'", modified, r.Header.Get("Last-Modified"))
+		}
+		if c.status == 200 && !bytes.Equal(b, content) {
+			t.Fatalf("expected test content in body but got %v", b)
+		}
+	}
+}
+
+func TestVary(t *testing.T) {
+	s, _ := newServer(t)
+	rt := s.Cached("/vary", func(r *fastglue.Request) error {
+		r.RequestCtx.Response.Header.Set("Vary", "Accept-Language")
+		return r.SendBytes(200, "text/plain", append([]byte("hello "), r.RequestCtx.Request.Header.Peek("Accept-Language")...))
+	}, perUser, group)
+
+	for n, c := range []struct {
+		lang  string
+		calls int
+	}{
+		{"en", 1},
+		{"en", 1},
+		{"fr", 2},
+		{"fr", 2},
+		{"en", 2},
+	} {
+		r, b := getServerReqHeaders(s, "/vary", map[string]string{"Accept-Language": c.lang}, t)
+		if string(b) != "hello "+c.lang {
+			t.Fatalf("%d: expected 'hello %s' but got '%s'", n, c.lang, b)
+		}
+		if r.Header.Get("Vary") != "Accept-Language" && r.Header.Get("Vary") != "accept-language" {
+			t.Fatalf("%d: expected Vary header but got '%s'", n, r.Header.Get("Vary"))
+		}
+		if calls := rt.Calls(); calls != c.calls {
+			t.Fatalf("%d: expected %d handler calls but got %d", n, c.calls, calls)
+		}
+	}
+}
+
+// ttlStore is an in-memory fastcache.Store that records the TTLs of the
+// URIs put in it.
+type ttlStore struct {
+	*fctest.Store
+
+	mu   sync.Mutex
+	ttls map[string]time.Duration
+}
+
+func (s *ttlStore) Put(namespace, group, uri string, it fastcache.Item, ttl time.Duration) error {
+	s.mu.Lock()
+	s.ttls[uri] = ttl
+	s.mu.Unlock()
+	return s.Store.Put(namespace, group, uri, it, ttl)
+}
+
+func TestVaryTTL(t *testing.T) {
+	var (
+		st = &ttlStore{Store: fctest.NewStore(), ttls: make(map[string]time.Duration)}
+		s  = fctest.NewServer(t, st)
+	)
+	rt := s.Cached("/vary-ttl", func(r *fastglue.Request) error {
+		r.RequestCtx.Response.Header.Set("Vary", "Accept-Language")
+		r.RequestCtx.Response.Header.Set("X-Fastcache-TTL", "1h")
+		return r.SendBytes(200, "text/plain", content)
+	}, &fastcache.Options{TTL: time.Minute}, group)
+	rt.ExpectMiss(t, "/vary-ttl")
+
+	// The marker expires with the variant, not with the route's TTL.
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if ttl := st.ttls[fastcache.HashURI("/vary-ttl")]; ttl != time.Hour {
+		t.Fatalf("expected the marker's TTL to be 1h but got %v", ttl)
+	}
+}
+
+func TestIncludeHeaders(t *testing.T) {
+	s, _ := newServer(t)
+	headers := *perUser
+	headers.IncludeHeaders = []string{"X-Tenant-ID"}
+	s.Cached("/include-headers", func(r *fastglue.Request) error {
+		return r.SendBytes(200, "text/plain", append([]byte("tenant "), r.RequestCtx.Request.Header.Peek("X-Tenant-ID")...))
+	}, &headers, group)
+
+	for _, tenant := range []string{"a", "b", "a", "b"} {
+		_, b := getServerReqHeaders(s, "/include-headers", map[string]string{"X-Tenant-ID": tenant}, t)
+		if string(b) != "tenant "+tenant {
+			t.Fatalf("expected 'tenant %s' but got '%s'", tenant, b)
+		}
+	}
+
+	// The cached response is only valid for the same header value.
+	r, _ := getServerReqHeaders(s, "/include-headers", map[string]string{"X-Tenant-ID": "a"}, t)
+	etag := r.Header.Get("Etag")
+	r, _ = getServerReqHeaders(s, "/include-headers", map[string]string{"X-Tenant-ID": "a", "If-None-Match": etag}, t)
+	if r.StatusCode != 304 {
+		t.Fatalf("expected 304 but got %v", r.StatusCode)
+	}
+	r, _ = getServerReqHeaders(s, "/include-headers", map[string]string{"X-Tenant-ID": "b", "If-None-Match": etag}, t)
+	if r.StatusCode != 200 {
+		t.Fatalf("expected 200 but got %v", r.StatusCode)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	s, _ := newServer(t)
+	s.Cached("/cached", sendContent, perUser, group)
+	s.Glue.GET("/snapshot", s.Cache.SnapshotHandler("secret"))
+	s.Glue.POST("/snapshot", s.Cache.SnapshotHandler("secret"))
+
+	snapshot := func(method, query, body string) (int, []byte) {
+		req, err := http.NewRequest(method, s.URL(t)+"/snapshot?"+query, strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer secret")
+
+		r, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Body.Close()
+		b, _ := io.ReadAll(r.Body)
+		return r.StatusCode, b
+	}
+
+	r, body := getServerReq(s, "/cached", "", false, t)
+	etag := r.Header.Get("Etag")
+
+	// Export the cached response.
+	code, b := snapshot(http.MethodGet, "namespace=test&group=test&uri="+fastcache.HashURI("/cached"), "")
+	if code != 200 {
+		t.Fatalf("expected 200 but got %v: %s", code, b)
+	}
+	var env struct {
+		Data fastcache.Snapshot `json:"data"`
+	}
+	if err := json.Unmarshal(b, &env); err != nil {
+		t.Fatal(err)
+	}
+	if env.Data.Body != string(body) || `"`+env.Data.ETag+`"` != etag {
+		t.Fatalf("expected snapshot of the response but got %+v", env.Data)
+	}
+
+	// Import it after the cache is cleared and it's served as it was.
+	if err := s.Cache.Del("test", "test", fastcache.HashURI("/cached")); err != nil {
+		t.Fatal(err)
+	}
+	raw, _ := json.Marshal(env.Data)
+	if code, b := snapshot(http.MethodPost, "ttl=1m", string(raw)); code != 200 {
+		t.Fatalf("expected 200 but got %v: %s", code, b)
+	}
+	r, _ = getServerReq(s, "/cached", etag, false, t)
+	if r.StatusCode != 304 {
+		t.Fatalf("expected 304 for imported snapshot but got %v", r.StatusCode)
+	}
+
+	if code, _ := snapshot(http.MethodPost, "ttl=0", string(raw)); code != 400 {
+		t.Fatalf("expected 400 but got %v", code)
+	}
+	if code, _ := snapshot(http.MethodGet, "namespace=test&group=test&uri=missing", ""); code != 404 {
+		t.Fatalf("expected 404 but got %v", code)
+	}
+}
+
+func TestInvalidationHandler(t *testing.T) {
+	var (
+		s, _ = newServer(t)
+		keys = setCDN(t, s)
+	)
+	s.Cached("/cached", sendContent, perUser, group)
+	s.Glue.POST("/invalidate", s.Cache.InvalidationHandler("secret", perUser))
+
+	invalidate := func(secret, body string) int {
+		req, err := http.NewRequest(http.MethodPost, s.URL(t)+"/invalidate", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+secret)
+
+		r, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Body.Close()
+		return r.StatusCode
+	}
+
+	r, _ := getServerReq(s, "/cached", "", false, t)
+	etag := r.Header.Get("Etag")
+	r, _ = getServerReq(s, "/cached", etag, false, t)
+	if r.StatusCode != 304 {
+		t.Fatalf("expected 304 but got %v", r.StatusCode)
+	}
+
+	body := `{"purges": [{"namespace": "test", "uris": [{"group": "test", "uri": "/cached"}]}]}`
+	if code := invalidate("wrong", body); code != 401 {
+		t.Fatalf("expected 401 but got %v", code)
+	}
+	if code := invalidate("secret", `{"purges": [{}]}`); code != 400 {
+		t.Fatalf("expected 400 but got %v", code)
+	}
+
+	// Still cached.
+	r, _ = getServerReq(s, "/cached", etag, false, t)
+	if r.StatusCode != 304 {
+		t.Fatalf("expected 304 but got %v", r.StatusCode)
+	}
+
+	if code := invalidate("secret", body); code != 200 {
+		t.Fatalf("expected 200 but got %v", code)
+	}
+	r, _ = getServerReq(s, "/cached", etag, false, t)
+	if r.StatusCode != 200 {
+		t.Fatalf("expected 200 after invalidation but got %v", r.StatusCode)
+	}
+
+	// Tags are purged from the CDN.
+	if code := invalidate("secret", `{"purges": [{"namespace": "test", "tags": ["a", "b"]}]}`); code != 200 {
+		t.Fatalf("expected 200 but got %v", code)
+	}
+	if fmt.Sprint(*keys) != "[a b]" {
+		t.Fatalf("expected the purge of the tags but got %v", *keys)
+	}
+
+	// URIs with query strings are purged with their absolute URLs.
+	query := *perUser
+	query.IncludeQueryString = true
+	query.CacheStatusHeader = true
+	s.Cached("/query", sendContent, &query, group)
+	getServerReq(s, "/query?id=1", "", false, t)
+	if code := invalidate("secret", `{"purges": [{"namespace": "test", "uris": [{"group": "test", "uri": "/query?id=1"}]}]}`); code != 400 {
+		t.Fatalf("expected 400 for a relative URI with a query string but got %v", code)
+	}
+	if r, _ := getServerReq(s, "/query?id=1", "", false, t); r.Header.Get("X-Cache") != "HIT" {
+		t.Fatalf("expected X-Cache HIT but got '%s'", r.Header.Get("X-Cache"))
+	}
+	if code := invalidate("secret", `{"purges": [{"namespace": "test", "uris": [{"group": "test", "uri": "`+s.URL(t)+`/query?id=1"}]}]}`); code != 200 {
+		t.Fatalf("expected 200 but got %v", code)
+	}
+	if r, _ := getServerReq(s, "/query?id=1", "", false, t); r.Header.Get("X-Cache") == "HIT" {
+		t.Fatal("expected a miss after invalidation")
+	}
+}
+
+func TestInvalidationHandlerOptions(t *testing.T) {
+	var (
+		s = fctest.NewServer(t, nil)
+		o = &fastcache.Options{
+			TTL:           time.Minute,
+			KeyHasher:     fastcache.FNVHasher,
+			NormalizePath: fastcache.PathNormalization{Lowercase: true},
+		}
+	)
+	rt := s.Cached("/keyed", func(r *fastglue.Request) error {
+		return r.SendBytes(200, "text/plain", content)
+	}, o, group)
+	s.Glue.POST("/invalidate", s.Cache.InvalidationHandler("secret", o))
+
+	invalidate := func(body string) int {
+		req, err := http.NewRequest(http.MethodPost, s.URL(t)+"/invalidate", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer secret")
+
+		r, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Body.Close()
+		return r.StatusCode
+	}
+
+	// The key of the URI is computed with the route's Options.
+	rt.ExpectMiss(t, "/keyed")
+	rt.ExpectHit(t, "/keyed")
+	if code := invalidate(`{"purges": [{"namespace": "test", "uris": [{"group": "test", "uri": "/KEYED"}]}]}`); code != 200 {
+		t.Fatalf("expected 200 but got %v", code)
+	}
+	rt.ExpectMiss(t, "/keyed")
+
+	// Tags can't be purged without a CDN.
+	if code := invalidate(`{"purges": [{"namespace": "test", "tags": ["a"]}]}`); code != 400 {
+		t.Fatalf("expected 400 but got %v", code)
+	}
+}
+
+func TestCacheControl(t *testing.T) {
+	s, _ := newServer(t)
+
+	// Cached responses keep the handler's Cache-Control as it is.
+	cc := *perUser
+	cc.RewriteMaxAge = false
+	s.Cached("/cache-control", func(r *fastglue.Request) error {
+		r.RequestCtx.Response.Header.Set("Cache-Control", "public, max-age=60")
+		r.RequestCtx.Response.Header.Set("Expires", "Thu, 01 Jan 2099 00:00:00 GMT")
+		return r.SendBytes(200, "text/plain", content)
+	}, &cc, group)
+
+	// Miss and then hits, with and without ETag matches.
+	r, _ := getServerReq(s, "/cache-control", "", false, t)
+	etag := r.Header.Get("ETag")
+	for _, e := range []string{"", "", etag} {
+		r, _ := getServerReq(s, "/cache-control", e, false, t)
+		if r.Header.Get("Cache-Control") != "public, max-age=60" {
+			t.Fatalf("expected Cache-Control 'public, max-age=60' but got '%s'", r.Header.Get("Cache-Control"))
+		}
+		if r.Header.Get("Expires") != "Thu, 01 Jan 2099 00:00:00 GMT" {
+			t.Fatalf("expected Expires but got '%s'", r.Header.Get("Expires"))
+		}
+		if r.Header.Get("Age") == "" {
+			t.Fatal("expected Age header on hits")
+		}
+	}
+}
+
+func TestRevalidate(t *testing.T) {
+	var (
+		s, _ = newServer(t)
+
+		// version is the version of the content of the "upstream" and
+		// downloads counts its full (non-304) responses.
+		version   int32 = 1
+		downloads int32
+	)
+	revalidate := *perUser
+	revalidate.RevalidateAfter = time.Nanosecond
+	s.Cached("/revalidate", func(r *fastglue.Request) error {
+		// Emulate an upstream that supports conditional requests.
+		etag := fmt.Sprintf(`"v%d"`, atomic.LoadInt32(&version))
+		if string(r.RequestCtx.Request.Header.Peek("If-None-Match")) == etag {
+			r.RequestCtx.SetStatusCode(fasthttp.StatusNotModified)
+			return nil
+		}
+
+		atomic.AddInt32(&downloads, 1)
+		r.RequestCtx.Response.Header.Set("ETag", etag)
+		return r.SendBytes(200, "text/plain", []byte("content "+etag))
+	}, &revalidate, group)
+
+	for n, c := range []struct {
+		bump      bool
+		body      string
+		downloads int32
+	}{
+		{false, `content "v1"`, 1},
+		{false, `content "v1"`, 1},
+		{false, `content "v1"`, 1},
+		{true, `content "v2"`, 2},
+		{false, `content "v2"`, 2},
+	} {
+		if c.bump {
+			atomic.AddInt32(&version, 1)
+		}
+
+		r, b := getServerReq(s, "/revalidate", "", false, t)
+		if r.StatusCode != 200 || string(b) != c.body {
+			t.Fatalf("%d: expected 200 '%s' but got %d '%s'", n, c.body, r.StatusCode, b)
+		}
+		if d := atomic.LoadInt32(&downloads); d != c.downloads {
+			t.Fatalf("%d: expected %d upstream downloads but got %d", n, c.downloads, d)
+		}
+	}
+}
+
+func TestIncludeCookies(t *testing.T) {
+	s, _ := newServer(t)
+	cookies := *perUser
+	cookies.IncludeCookies = []string{"exp"}
+	cookies.CookiesTransformerHook = func(args *fasthttp.Args) {
+		// Bucket the experiment variants.
+		if string(args.Peek("exp")) != "b" {
+			args.Set("exp", "a")
+		}
+	}
+	s.Cached("/cookies", func(r *fastglue.Request) error {
+		return r.SendBytes(200, "text/plain", append([]byte("variant "), r.RequestCtx.Request.Header.Cookie("exp")...))
+	}, &cookies, group)
+
+	for _, c := range []struct {
+		cookie string
+		body   string
+	}{
+		{"exp=a", "variant a"},
+		{"exp=b", "variant b"},
+		{"exp=a", "variant a"},
+		{"exp=b; other=1", "variant b"},
+
+		// Bucketed with "a" by the hook.
+		{"exp=x", "variant a"},
+		{"", "variant a"},
+	} {
+		_, b := getServerReqHeaders(s, "/cookies", map[string]string{"Cookie": c.cookie}, t)
+		if string(b) != c.body {
+			t.Fatalf("cookie '%s': expected '%s' but got '%s'", c.cookie, c.body, b)
+		}
+	}
+}
+
+func TestCacheHeaders(t *testing.T) {
+	s, _ := newServer(t)
+	s.Cached("/headers", func(r *fastglue.Request) error {
+		r.RequestCtx.Response.Header.Set("Content-Disposition", `attachment; filename="test.txt"`)
+		r.RequestCtx.Response.Header.Add("X-Custom", "a")
+		r.RequestCtx.Response.Header.Add("X-Custom", "b")
+		c := fasthttp.AcquireCookie()
+		c.SetKey("session")
+		c.SetValue("secret")
+		r.RequestCtx.Response.Header.SetCookie(c)
+		fasthttp.ReleaseCookie(c)
+		return r.SendBytes(200, "text/plain", content)
+	}, perUser, group)
+
+	r, _ := getServerReq(s, "/headers", "", false, t)
+	etag := r.Header.Get("Etag")
+
+	// Hit.
+	r, b := getServerReq(s, "/headers", "", false, t)
+	if r.Header.Get("Etag") != etag || !bytes.Equal(b, content) {
+		t.Fatalf("expected cached response but got etag '%s'", r.Header.Get("Etag"))
+	}
+	if v := r.Header.Get("Content-Disposition"); v != `attachment; filename="test.txt"` {
+		t.Fatalf("unexpected Content-Disposition: '%s'", v)
+	}
+	if v := r.Header.Values("X-Custom"); len(v) != 2 || v[0] != "a" || v[1] != "b" {
+		t.Fatalf("unexpected X-Custom: %v", v)
+	}
+	if v := r.Header.Get("Set-Cookie"); v != "" {
+		t.Fatalf("cookies shouldn't be cached: '%s'", v)
+	}
+}
+
+func TestPreset(t *testing.T) {
+	s, rd := newServer(t)
+	private := fastcache.PresetPrivatePerUser(fctest.NamespaceKey, time.Second*5)
+	s.Cached("/preset", sendContent, private, group)
+
+	r, _ := getServerReq(s, "/preset?a=1", "", false, t)
+	if r.StatusCode != 200 {
+		t.Fatalf("expected 200 but got %v", r.StatusCode)
+	}
+
+	// Private responses are only cached by browsers.
+	etag := r.Header.Get("Etag")
+	r, _ = getServerReq(s, "/preset?a=1", etag, false, t)
+	if r.StatusCode != 304 {
+		t.Fatalf("expected 304 but got %v", r.StatusCode)
+	}
+	if cc := r.Header.Get("Cache-Control"); !strings.HasPrefix(cc, "private, max-age=") {
+		t.Fatalf("expected private Cache-Control but got '%s'", cc)
+	}
+
+	// The query string is part of the key.
+	r, _ = getServerReq(s, "/preset?a=2", etag, false, t)
+	if r.StatusCode != 200 {
+		t.Fatalf("expected 200 but got %v", r.StatusCode)
+	}
+
+	// API responses are public and cached under the shared namespace.
+	s.Glue.GET("/preset-api", s.Cache.Cached(sendContent, fastcache.PresetAPI(time.Second*5), group))
+	r, _ = getServerReq(s, "/preset-api", "", false, t)
+	if cc := r.Header.Get("Cache-Control"); !strings.HasPrefix(cc, "public, max-age=") {
+		t.Fatalf("expected public Cache-Control but got '%s'", cc)
+	}
+	if !rd.Exists("CACHE:public:" + group) {
+		t.Fatal("expected the response to be cached under the shared namespace")
+	}
+
+	// Static assets are keyed by their path and have content ETags and
+	// Last-Modified.
+	rt := s.Cached("/preset-asset", sendContent, fastcache.PresetStaticAsset(time.Second*5), group)
+	r, _ = getServerReq(s, "/preset-asset?v=1", "", false, t)
+	sum := sha1.Sum(content)
+	if etag := r.Header.Get("Etag"); etag != `"`+hex.EncodeToString(sum[:])+`"` {
+		t.Fatalf("expected the content ETag but got '%s'", etag)
+	}
+	if r.Header.Get("Last-Modified") == "" {
+		t.Fatal("expected Last-Modified")
+	}
+	rt.ExpectHit(t, "/preset-asset?v=2")
+}
+
+func TestTyped(t *testing.T) {
+	type quote struct {
+		Symbol string  `json:"symbol"`
+		Price  float64 `json:"price"`
+	}
+
+	var (
+		s, _ = newServer(t)
+		tc   = fastcache.NewTyped[quote](s.Cache, time.Second*5)
+	)
+	if err := tc.Put("test", "typed", "INFY", quote{"INFY", 1500.5}); err != nil {
+		t.Fatalf("error putting value: %v", err)
+	}
+
+	v, ok, err := tc.Get("test", "typed", "INFY")
+	if err != nil || !ok {
+		t.Fatalf("error getting value: %v, %v", ok, err)
+	}
+	if v.Symbol != "INFY" || v.Price != 1500.5 {
+		t.Fatalf("unexpected value: %v", v)
+	}
+
+	// Invalidate the group.
+	if err := s.Cache.DelGroup("test", "typed"); err != nil {
+		t.Fatalf("error deleting group: %v", err)
+	}
+	if _, ok, _ := tc.Get("test", "typed", "INFY"); ok {
+		t.Fatal("expected value to be deleted")
+	}
+}
+
+func TestTypedDelGroupGrace(t *testing.T) {
+	var (
+		rd = redistest.NewRedis(t)
+		f  = fastcache.New(rd.NewStore(t, cachestore.Config{Prefix: "TYPED:"}))
+		tc = fastcache.NewTyped[string](f, time.Second*5)
+	)
+	if err := tc.Put("test", "typed", "k", "v"); err != nil {
+		t.Fatalf("error putting value: %v", err)
+	}
+
+	// Values of groups marked stale by DelGroup() aren't served.
+	f.SetDelGroupGrace(time.Second * 2)
+	if err := f.DelGroup("test", "typed"); err != nil {
+		t.Fatal(err)
+	}
+	if rd.TTL("TYPED:test:typed") != time.Second*2 {
+		t.Fatal("expected the group to be retained for the grace window")
+	}
+	if _, ok, _ := tc.Get("test", "typed", "k"); ok {
+		t.Fatal("expected the stale value to be a miss")
+	}
+}
+
+func TestTypedClock(t *testing.T) {
+	var (
+		st = fctest.NewStore()
+		tc = fastcache.NewTyped[string](fastcache.New(st, &fastcache.Options{Clock: fixedClock{}}), time.Second*5)
+	)
+	if err := tc.Put("test", "typed", "k", "v"); err != nil {
+		t.Fatalf("error putting value: %v", err)
+	}
+
+	it, _ := st.Get("test", "typed", "k")
+	if !it.CreatedAt.Equal(fixedTime) {
+		t.Fatalf("expected CreatedAt %v but got %v", fixedTime, it.CreatedAt)
+	}
+}
+
+func TestGetOrFill(t *testing.T) {
+	var (
+		s, _  = newServer(t)
+		calls int32
+		wg    sync.WaitGroup
+	)
+	fill := func() (fastcache.Item, error) {
+		atomic.AddInt32(&calls, 1)
+		time.Sleep(time.Millisecond * 50)
+		return fastcache.Item{ContentType: "text/plain", Blob: content}, nil
+	}
+
+	for n := 0; n < 10; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			it, err := s.Cache.GetOrFill(context.Background(), "test", "fill", "/fill", time.Second*5, fill)
+			if err != nil {
+				t.Errorf("error filling: %v", err)
+				return
+			}
+			if !bytes.Equal(it.Blob, content) {
+				t.Errorf("unexpected blob: %s", it.Blob)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Subsequent calls are served from the store.
+	if _, err := s.Cache.GetOrFill(context.Background(), "test", "fill", "/fill", time.Second*5, fill); err != nil {
+		t.Fatalf("error filling: %v", err)
+	}
+	if calls != 1 {
+		t.Fatalf("expected fill to be invoked once but got %d", calls)
+	}
+}
+
+func TestGetOrFillPanic(t *testing.T) {
+	var (
+		f       = fastcache.New(fctest.NewStore())
+		release = make(chan struct{})
+		wg      sync.WaitGroup
+	)
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer func() {
+			if recover() == nil {
+				t.Error("expected the panic to be propagated to the caller that filled")
+			}
+		}()
+		f.GetOrFill(context.Background(), "test", "fill", "/panic", time.Second*5, func() (fastcache.Item, error) {
+			<-release
+			panic("fill panic")
+		})
+	}()
+	time.Sleep(time.Millisecond * 20)
+
+	// The concurrent callers get an error.
+	errs := make(chan error, 5)
+	for n := 0; n < 5; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := f.GetOrFill(context.Background(), "test", "fill", "/panic", time.Second*5, func() (fastcache.Item, error) {
+				return fastcache.Item{ContentType: "text/plain", Blob: content}, nil
+			})
+			errs <- err
+		}()
+	}
+	time.Sleep(time.Millisecond * 20)
+	close(release)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err == nil || !strings.Contains(err.Error(), "fill panic") {
+			t.Fatalf("expected the panic as an error but got %v", err)
+		}
+	}
+}
+
+func TestGetOrFillClock(t *testing.T) {
+	var (
+		f     = fastcache.New(fctest.NewStore(), &fastcache.Options{Clock: fixedClock{}})
+		calls int
+	)
+	fill := func() (fastcache.Item, error) {
+		calls++
+		return fastcache.Item{ContentType: "text/plain", Blob: content, StaleAt: fixedTime.Add(time.Second)}, nil
+	}
+
+	// Items are created and go stale as per the Clock of the defaults.
+	for i := 0; i < 2; i++ {
+		it, err := f.GetOrFill(context.Background(), "test", "fill", "/fill", time.Second*5, fill)
+		if err != nil {
+			t.Fatalf("error filling: %v", err)
+		}
+		if !it.CreatedAt.Equal(fixedTime) {
+			t.Fatalf("expected CreatedAt %v but got %v", fixedTime, it.CreatedAt)
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("expected fill to be invoked once but got %d", calls)
+	}
+}
+
+// sendCalls returns a handler that responds with the number of times it has
+// been invoked.
+func sendCalls() fastglue.FastRequestHandler {
+	var calls int32
+	return func(r *fastglue.Request) error {
+		n := atomic.AddInt32(&calls, 1)
+		return r.SendBytes(200, "text/plain", []byte(strconv.Itoa(int(n))))
+	}
+}
+
+func TestRespectNoCache(t *testing.T) {
+	s, _ := newServer(t)
+	noCache := *perUser
+	noCache.RespectNoCache = true
+	s.Cached("/respect-no-cache", sendCalls(), &noCache, group)
+
+	r, _ := getServerReq(s, "/respect-no-cache", "", false, t)
+	etag := r.Header.Get("ETag")
+
+	for n, c := range []struct {
+		headers map[string]string
+		status  int
+		body    string
+	}{
+		{nil, 200, "1"},
+		{map[string]string{"If-None-Match": etag}, 304, ""},
+		{map[string]string{"Cache-Control": "no-cache"}, 200, "2"},
+		{nil, 200, "2"},
+		{map[string]string{"Pragma": "no-cache"}, 200, "3"},
+		{map[string]string{"Cache-Control": "max-age=0, no-cache", "If-None-Match": etag}, 200, "4"},
+		{nil, 200, "4"},
+	} {
+		r, b := getServerReqHeaders(s, "/respect-no-cache", c.headers, t)
+		if r.StatusCode != c.status || string(b) != c.body {
+			t.Fatalf("%d: expected %d '%s' but got %d '%s'", n, c.status, c.body, r.StatusCode, b)
+		}
+	}
+}
+
+func TestContentLengthMismatch(t *testing.T) {
+	var (
+		s, _ = newServer(t)
+		errs int32
+	)
+	contentLength := *perUser
+	contentLength.Hooks.OnError = func(r *fastglue.Request, namespace, group string, err error) {
+		if errors.Is(err, fastcache.ErrContentLength) {
+			atomic.AddInt32(&errs, 1)
+		}
+	}
+	rt := s.Cached("/content-length/{n}", func(r *fastglue.Request) error {
+		n, _ := strconv.Atoi(r.RequestCtx.UserValue("n").(string))
+		r.RequestCtx.Response.Header.SetContentLength(n)
+		return r.SendBytes(200, "text/plain", content)
+	}, &contentLength, group)
+
+	for n, c := range []struct {
+		length int
+		calls  int
+		errs   int32
+	}{
+		{len(content), 1, 0},
+		{len(content), 1, 0},
+		// Truncated bodies aren't cached.
+		{len(content) + 10, 2, 1},
+		{len(content) + 10, 3, 2},
+	} {
+		getServerReq(s, "/content-length/"+strconv.Itoa(c.length), "", false, t)
+		if calls := rt.Calls(); calls != c.calls {
+			t.Fatalf("%d: expected %d handler calls but got %d", n, c.calls, calls)
+		}
+		if e := atomic.LoadInt32(&errs); e != c.errs {
+			t.Fatalf("%d: expected %d errors but got %d", n, c.errs, e)
+		}
+	}
+}
+
+func TestForceRefresh(t *testing.T) {
+	s, _ := newServer(t)
+	forceRefresh := *perUser
+	forceRefresh.ForceRefreshHeader = "X-Cache-Refresh"
+	forceRefresh.ForceRefreshSecret = "secret"
+	s.Cached("/force-refresh", sendCalls(), &forceRefresh, group)
+
+	for n, c := range []struct {
+		headers map[string]string
+		body    string
+	}{
+		{nil, "1"},
+		{nil, "1"},
+		// Plain no-cache requests and invalid secrets are ignored.
+		{map[string]string{"Cache-Control": "no-cache"}, "1"},
+		{map[string]string{"X-Cache-Refresh": "wrong"}, "1"},
+		{map[string]string{"X-Cache-Refresh": "secret"}, "2"},
+		{nil, "2"},
+	} {
+		r, b := getServerReqHeaders(s, "/force-refresh", c.headers, t)
+		if r.StatusCode != 200 || string(b) != c.body {
+			t.Fatalf("%d: expected 200 '%s' but got %d '%s'", n, c.body, r.StatusCode, b)
+		}
+	}
+}
+
+func TestNoBlobStatus(t *testing.T) {
+	s, _ := newServer(t)
+	noBlobStatus := *perUser
+	noBlobStatus.TTL = time.Second * 60
+	noBlobStatus.NoBlob = true
+	noBlobStatus.NegativeTTL = time.Second * 5
+	rt := s.Cached("/no-blob/{code}", func(r *fastglue.Request) error {
+		code, _ := strconv.Atoi(r.RequestCtx.UserValue("code").(string))
+		return r.SendBytes(code, "text/plain", content)
+	}, &noBlobStatus, "no-blob-status")
+
+	// Cached non-200 responses without blobs aren't replayed with empty
+	// bodies.
+	for i := 0; i < 2; i++ {
+		r := rt.ExpectMiss(t, "/no-blob/404")
+		if r.StatusCode != 404 || !bytes.Equal(r.Body, content) {
+			t.Fatalf("%d: unexpected response %d '%s'", i, r.StatusCode, r.Body)
+		}
+	}
+}
+
+func TestCachedBatch(t *testing.T) {
+	var (
+		s, rd = newServer(t)
+
+		// calls records the IDs the handler is invoked with.
+		calls [][]string
+	)
+	s.Glue.GET("/batch", s.Cache.CachedBatch(func(r *fastglue.Request, ids []string) (map[string][]byte, error) {
+		calls = append(calls, ids)
+		out := make(map[string][]byte, len(ids))
+		for _, id := range ids {
+			switch id {
+			case "bad":
+				out[id] = []byte("bad")
+			case "nostore":
+				r.RequestCtx.Response.Header.Set("Cache-Control", "no-store")
+				out[id] = []byte(`"` + id + `"`)
+			case "long":
+				r.RequestCtx.Response.Header.Set("X-Fastcache-TTL", "1h")
+				fallthrough
+			default:
+				out[id] = []byte(`"` + id + `"`)
+			}
+		}
+		return out, nil
+	}, perUser, "ids", "batch"))
+
+	r, b := getServerReq(s, "/batch?ids=a,b", "", false, t)
+	if r.StatusCode != 200 {
+		t.Fatalf("expected 200 but got %v", r.StatusCode)
+	}
+	if string(b) != `{"a":"a","b":"b"}` {
+		t.Fatalf("unexpected batch body: %s", b)
+	}
+
+	// Only the uncached ID should hit the handler.
+	r, b = getServerReq(s, "/batch?ids=b,c,a", "", false, t)
+	if r.StatusCode != 200 {
+		t.Fatalf("expected 200 but got %v", r.StatusCode)
+	}
+	if string(b) != `{"b":"b","c":"c","a":"a"}` {
+		t.Fatalf("unexpected batch body: %s", b)
+	}
+
+	if len(calls) != 2 || fmt.Sprint(calls[1]) != "[c]" {
+		t.Fatalf("unexpected batch handler calls: %v", calls)
+	}
+
+	// Invalid JSON bodies are omitted and aren't cached.
+	for i := 0; i < 2; i++ {
+		if _, b := getServerReq(s, "/batch?ids=a,bad", "", false, t); string(b) != `{"a":"a"}` {
+			t.Fatalf("%d: unexpected batch body: %s", i, b)
+		}
+	}
+	if len(calls) != 4 || fmt.Sprint(calls[3]) != "[bad]" {
+		t.Fatalf("unexpected batch handler calls: %v", calls)
+	}
+
+	// The TTL set by the handler applies to the cached IDs.
+	r, _ = getServerReq(s, "/batch?ids=long", "", false, t)
+	if ttl := rd.TTL("CACHE:test:batch"); ttl != time.Hour {
+		t.Fatalf("expected TTL 1h but got %v", ttl)
+	}
+	if r.Header.Get("X-Fastcache-TTL") != "" {
+		t.Fatal("expected the TTL header to be stripped")
+	}
+
+	// Stale IDs are fetched from the handler again.
+	rd.HSet("CACHE:test:batch", "_staleat_"+fastcache.HashURI(s.URL(t)+"/batch?ids=a"), "1")
+	if _, b := getServerReq(s, "/batch?ids=a,b", "", false, t); string(b) != `{"a":"a","b":"b"}` {
+		t.Fatalf("unexpected batch body: %s", b)
+	}
+	if n := len(calls); n != 6 || fmt.Sprint(calls[5]) != "[a]" {
+		t.Fatalf("unexpected batch handler calls: %v", calls)
+	}
+
+	// The other query params are part of the keys of the IDs.
+	for i, uri := range []string{"/batch?ids=a&mode=full", "/batch?ids=a&mode=ltp", "/batch?ids=b,a&mode=ltp"} {
+		if _, b := getServerReq(s, uri, "", false, t); !strings.Contains(string(b), `"a":"a"`) {
+			t.Fatalf("%d: unexpected batch body: %s", i, b)
+		}
+	}
+	if n := len(calls); n != 9 || fmt.Sprint(calls[6:]) != "[[a] [a] [b]]" {
+		t.Fatalf("unexpected batch handler calls: %v", calls)
+	}
+
+	// Responses that Cached() wouldn't cache aren't cached.
+	for i := 0; i < 2; i++ {
+		if _, b := getServerReq(s, "/batch?ids=nostore", "", false, t); string(b) != `{"nostore":"nostore"}` {
+			t.Fatalf("%d: unexpected batch body: %s", i, b)
+		}
+	}
+	if n := len(calls); n != 11 || fmt.Sprint(calls[10]) != "[nostore]" {
+		t.Fatalf("unexpected batch handler calls: %v", calls)
+	}
+}
+
 func decompressGzip(b []byte) ([]byte, error) {
 	r, err := gzip.NewReader(bytes.NewReader(b))
 	if err != nil {
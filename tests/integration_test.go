@@ -0,0 +1,339 @@
+//go:build integration
+// +build integration
+
+package tests
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/docker/go-connections/nat"
+	redis "github.com/redis/go-redis/v9"
+	"github.com/testcontainers/testcontainers-go"
+	"github.com/testcontainers/testcontainers-go/wait"
+	cachestore "github.com/zerodha/fastcache/stores/goredis/v9"
+	"github.com/zerodha/fastcache/v4"
+	"github.com/zerodha/fastcache/v4/fctest"
+	"github.com/zerodha/fastglue"
+)
+
+// The integration tests run the middleware and the goredis store end-to-end
+// against real Redis single node, sentinel and cluster setups started with
+// testcontainers. They require docker and are run with:
+//
+//	make test-integration
+const (
+	redisImage        = "docker.io/bitnami/redis:7.2"
+	redisSentinelImg  = "docker.io/bitnami/redis-sentinel:7.2"
+	redisClusterImage = "docker.io/bitnami/redis-cluster:7.2"
+
+	integrationTTL = time.Second * 2
+)
+
+func TestIntegrationSingleNode(t *testing.T) {
+	ctx := context.Background()
+	nw := newNetwork(t, "fc-integration-single")
+
+	c := startContainer(t, testcontainers.ContainerRequest{
+		Image:        redisImage,
+		ExposedPorts: []string{"6379/tcp"},
+		Networks:     []string{nw},
+		Env:          map[string]string{"ALLOW_EMPTY_PASSWORD": "yes"},
+		WaitingFor:   wait.ForLog("Ready to accept connections"),
+	})
+
+	client := redis.NewClient(&redis.Options{Addr: endpoint(t, c, "6379/tcp")})
+	t.Cleanup(func() { client.Close() })
+	if err := client.Ping(ctx).Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("sync", func(t *testing.T) { runSuite(t, client, false) })
+	t.Run("async", func(t *testing.T) { runSuite(t, client, true) })
+}
+
+func TestIntegrationSentinel(t *testing.T) {
+	ctx := context.Background()
+	nw := newNetwork(t, "fc-integration-sentinel")
+
+	master := startContainer(t, testcontainers.ContainerRequest{
+		Image:      redisImage,
+		Name:       "fc-redis-master",
+		Networks:   []string{nw},
+		Env:        map[string]string{"ALLOW_EMPTY_PASSWORD": "yes", "REDIS_REPLICATION_MODE": "master"},
+		WaitingFor: wait.ForLog("Ready to accept connections"),
+	})
+	startContainer(t, testcontainers.ContainerRequest{
+		Image:    redisImage,
+		Name:     "fc-redis-replica",
+		Networks: []string{nw},
+		Env: map[string]string{
+			"ALLOW_EMPTY_PASSWORD":   "yes",
+			"REDIS_REPLICATION_MODE": "slave",
+			"REDIS_MASTER_HOST":      "fc-redis-master",
+		},
+		WaitingFor: wait.ForLog("MASTER <-> REPLICA sync: Finished with success"),
+	})
+	sentinel := startContainer(t, testcontainers.ContainerRequest{
+		Image:        redisSentinelImg,
+		ExposedPorts: []string{"26379/tcp"},
+		Networks:     []string{nw},
+		Env: map[string]string{
+			"REDIS_MASTER_HOST":                      "fc-redis-master",
+			"REDIS_MASTER_SET":                       "fcmaster",
+			"REDIS_SENTINEL_QUORUM":                  "1",
+			"REDIS_SENTINEL_DOWN_AFTER_MILLISECONDS": "2000",
+			"REDIS_SENTINEL_FAILOVER_TIMEOUT":        "5000",
+		},
+		WaitingFor: wait.ForLog("+monitor master"),
+	})
+
+	// Sentinel reports the container IPs of the master which are
+	// reachable from a Linux docker host.
+	client := redis.NewFailoverClient(&redis.FailoverOptions{
+		MasterName:    "fcmaster",
+		SentinelAddrs: []string{endpoint(t, sentinel, "26379/tcp")},
+	})
+	t.Cleanup(func() { client.Close() })
+	if err := client.Ping(ctx).Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("sync", func(t *testing.T) { runSuite(t, client, false) })
+
+	// Fail the master over to the replica. Writes and reads should resume
+	// once the replica is promoted.
+	t.Run("failover", func(t *testing.T) {
+		store := cachestore.New(cachestore.Config{Prefix: "INTEGRATION:"}, client)
+		item := fastcache.Item{ContentType: "text/plain", Blob: content}
+
+		if err := master.Stop(ctx, nil); err != nil {
+			t.Fatal(err)
+		}
+
+		var err error
+		for n := 0; n < 30; n++ {
+			if err = store.Put("failover", "group", "/a", item, time.Minute); err == nil {
+				break
+			}
+			time.Sleep(time.Second)
+		}
+		if err != nil {
+			t.Fatalf("writes didn't resume after failover: %v", err)
+		}
+
+		got, err := store.Get("failover", "group", "/a")
+		if err != nil || string(got.Blob) != string(content) {
+			t.Fatalf("expected cached item after failover but got '%s': %v", got.Blob, err)
+		}
+	})
+}
+
+func TestIntegrationCluster(t *testing.T) {
+	const numNodes = 6
+
+	ctx := context.Background()
+	nw := newNetwork(t, "fc-integration-cluster")
+
+	var names string
+	for i := 0; i < numNodes; i++ {
+		names += fmt.Sprintf("fc-cluster-node-%d ", i)
+	}
+
+	nodes := make([]testcontainers.Container, numNodes)
+	for i := 0; i < numNodes; i++ {
+		env := map[string]string{
+			"ALLOW_EMPTY_PASSWORD": "yes",
+			"REDIS_NODES":          names,
+		}
+
+		// The last node creates the cluster once all the others are up.
+		waitFor := wait.ForLog("Ready to accept connections")
+		if i == numNodes-1 {
+			env["REDIS_CLUSTER_CREATOR"] = "yes"
+			env["REDIS_CLUSTER_REPLICAS"] = "1"
+			waitFor = wait.ForLog("Cluster correctly created")
+		}
+
+		nodes[i] = startContainer(t, testcontainers.ContainerRequest{
+			Image:      redisClusterImage,
+			Name:       fmt.Sprintf("fc-cluster-node-%d", i),
+			Networks:   []string{nw},
+			Env:        env,
+			WaitingFor: waitFor.WithStartupTimeout(time.Minute * 2),
+		})
+	}
+
+	// The cluster advertises the container IPs which are reachable from
+	// a Linux docker host.
+	var addrs []string
+	for _, n := range nodes {
+		ip, err := n.ContainerIP(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		addrs = append(addrs, ip+":6379")
+	}
+
+	client := redis.NewClusterClient(&redis.ClusterOptions{Addrs: addrs})
+	t.Cleanup(func() { client.Close() })
+	if err := client.Ping(ctx).Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("sync", func(t *testing.T) { runSuite(t, client, false) })
+	t.Run("async", func(t *testing.T) { runSuite(t, client, true) })
+}
+
+// runSuite exercises the middleware end-to-end with a goredis store on
+// the given client: caching, ETags, compression, group clearing and TTL expiry.
+func runSuite(t *testing.T, client redis.UniversalClient, async bool) {
+	var (
+		s = fctest.NewServer(t, cachestore.New(cachestore.Config{
+			Prefix:          "INTEGRATION:",
+			Async:           async,
+			AsyncCommitFreq: time.Millisecond * 50,
+		}, client))
+
+		// The runs share Redis, so each is in its own namespace.
+		ns = fmt.Sprintf("%s-%v", t.Name(), async)
+
+		o = &fastcache.Options{
+			NamespaceKey: fctest.NamespaceKey,
+			ETag:         true,
+			TTL:          integrationTTL,
+			Compression: fastcache.CompressionsOptions{
+				Enabled:        true,
+				MinLength:      10,
+				RespectHeaders: true,
+			},
+		}
+	)
+
+	item := s.Cached("/item", func(r *fastglue.Request) error {
+		return r.SendBytes(200, "text/plain", content)
+	}, o, "items")
+	s.Glue.DELETE("/item", s.Cache.ClearGroup(func(r *fastglue.Request) error {
+		return r.SendBytes(200, "text/plain", nil)
+	}, o, "items"))
+
+	// Async writes are committed every AsyncCommitFreq.
+	settle := func() {
+		if async {
+			time.Sleep(time.Millisecond * 200)
+		}
+	}
+	get := func(etag string, gzipped bool) *fctest.Response {
+		t.Helper()
+		h := map[string]string{fctest.HeaderNamespace: ns}
+		if etag != "" {
+			h["If-None-Match"] = etag
+		}
+		if gzipped {
+			h["Accept-Encoding"] = "gzip"
+		}
+		return s.Get(t, "/item", h)
+	}
+	expectCalls := func(n int) {
+		t.Helper()
+		if c := item.Calls(); c != n {
+			t.Fatalf("expected %d handler calls but got %d", n, c)
+		}
+	}
+
+	// Miss.
+	r := get("", false)
+	if r.StatusCode != 200 || string(r.Body) != string(content) {
+		t.Fatalf("expected 200 with content but got %v %s", r.StatusCode, r.Body)
+	}
+	etag := r.Header.Get("Etag")
+	settle()
+
+	// Hits.
+	r = get(etag, false)
+	if r.StatusCode != 304 {
+		t.Fatalf("expected 304 but got %v", r.StatusCode)
+	}
+
+	r = get("", true)
+	if r.Header.Get("Content-Encoding") != "gzip" {
+		t.Fatal("expected gzip encoded response")
+	}
+	if b, err := decompressGzip(r.Body); err != nil || string(b) != string(content) {
+		t.Fatalf("expected gzipped content but got %s: %v", b, err)
+	}
+	expectCalls(1)
+
+	// Clearing the group.
+	req, err := http.NewRequest(http.MethodDelete, s.URL(t)+"/item", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(fctest.HeaderNamespace, ns)
+	if r, err := http.DefaultClient.Do(req); err != nil || r.StatusCode != 200 {
+		t.Fatalf("error clearing group: %v", err)
+	}
+
+	r = get(etag, false)
+	if r.StatusCode != 200 {
+		t.Fatalf("expected 200 after clearing the group but got %v", r.StatusCode)
+	}
+	expectCalls(2)
+	settle()
+
+	// TTL expiry.
+	time.Sleep(integrationTTL + time.Millisecond*500)
+	get("", false)
+	expectCalls(3)
+}
+
+// newNetwork creates a docker network that is removed after the test.
+func newNetwork(t *testing.T, name string) string {
+	ctx := context.Background()
+	nw, err := testcontainers.GenericNetwork(ctx, testcontainers.GenericNetworkRequest{
+		NetworkRequest: testcontainers.NetworkRequest{
+			Name:   name,
+			Driver: "bridge",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { nw.Remove(ctx) })
+
+	return name
+}
+
+// startContainer starts a container that is terminated after the test.
+func startContainer(t *testing.T, req testcontainers.ContainerRequest) testcontainers.Container {
+	ctx := context.Background()
+	c, err := testcontainers.GenericContainer(ctx, testcontainers.GenericContainerRequest{
+		ContainerRequest: req,
+		Started:          true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Terminate(ctx) })
+
+	return c
+}
+
+// endpoint returns the host:port at which a container's port is exposed.
+func endpoint(t *testing.T, c testcontainers.Container, port string) string {
+	ctx := context.Background()
+	host, err := c.Host(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := c.MappedPort(ctx, nat.Port(port))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return net.JoinHostPort(host, p.Port())
+}
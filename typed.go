@@ -0,0 +1,65 @@
+package fastcache
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Typed caches Go values of type T, JSON encoded, in the same Store and with
+// the same namespace->group semantics as cached HTTP responses. This allows
+// computed values to be invalidated together with HTTP responses using
+// Del(), DelGroup() and the ClearGroup() middleware.
+type Typed[T any] struct {
+	f   *FastCache
+	ttl time.Duration
+}
+
+// NewTyped returns a Typed cache for values of type T that uses f's Store.
+// ttl is applied to all values. If it is 0, no TTL is applied.
+func NewTyped[T any](f *FastCache, ttl time.Duration) *Typed[T] {
+	return &Typed[T]{
+		f:   f,
+		ttl: ttl,
+	}
+}
+
+// Get gets the value cached under key in a namespace->group. The bool is
+// false if there's no cached value, or if it's stale, that is, marked stale
+// by DelGroup() with SetDelGroupGrace(). Some stores return an error for
+// values that aren't cached.
+func (t *Typed[T]) Get(namespace, group, key string) (T, bool, error) {
+	var out T
+
+	it, err := t.f.get(namespace, group, key)
+	if err != nil {
+		return out, false, err
+	}
+	if len(it.Blob) == 0 || it.stale(t.f.clock().Now()) {
+		return out, false, nil
+	}
+
+	if err := json.Unmarshal(it.Blob, &out); err != nil {
+		return out, false, err
+	}
+	return out, true, nil
+}
+
+// Put caches a value under key in a namespace->group. Its CreatedAt is as per
+// the Clock of the default Options passed to New().
+func (t *Typed[T]) Put(namespace, group, key string, v T) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return t.f.put(namespace, group, key, Item{
+		ContentType: "application/json",
+		Blob:        b,
+		CreatedAt:   t.f.clock().Now(),
+	}, t.ttl)
+}
+
+// Del deletes the value cached under key in a namespace->group.
+func (t *Typed[T]) Del(namespace, group, key string) error {
+	return t.f.s.Del(namespace, group, key)
+}
@@ -0,0 +1,122 @@
+package fastcache
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+	"github.com/zerodha/fastglue"
+)
+
+// WarmRequest is a request that is executed in-process to warm the cache.
+type WarmRequest struct {
+	// Namespace is set as the request's UserValue(NamespaceKey).
+	Namespace string
+
+	// Route is the route of the request with an optional query string, for
+	// instance, /orders/{id}?page=1.
+	Route string
+
+	// Params are the values of the route's params, for instance,
+	// {"id": "1"} for /orders/{id}. They're path escaped.
+	Params map[string]string
+
+	// Headers are the request headers, for instance, the credentials
+	// required by the router's middlewares.
+	Headers map[string]string
+
+	// Host is the request's host, which is part of the cache key of routes
+	// with IncludeQueryString. Default is localhost.
+	Host string
+}
+
+// Warm warms the cache by executing GET requests in-process against the
+// handlers of a fastglue router without going over the network. Responses go
+// through the Cached() middlewares of the routes like those of any other
+// request, so URIs that are already cached aren't refilled. The requests are
+// executed one by one so that warming doesn't load the handlers' upstreams
+// like a burst of traffic.
+//
+// The router's Before() middlewares (eg: auth) are applied. namespaceKey is
+// the Options.NamespaceKey of the routes.
+//
+// It returns the number of requests that succeeded (2xx and 3xx). Requests
+// that fail don't stop the warming and the first of their errors is returned.
+func (f *FastCache) Warm(g *fastglue.Fastglue, namespaceKey string, reqs []WarmRequest) (int, error) {
+	var (
+		h      = g.Handler()
+		n      int
+		failed int
+		first  error
+	)
+	for _, wr := range reqs {
+		err := warm(h, namespaceKey, wr)
+		if err == nil {
+			n++
+			continue
+		}
+
+		failed++
+		if first == nil {
+			first = err
+		}
+	}
+
+	if first != nil {
+		return n, fmt.Errorf("%d of %d warm requests failed: %w", failed, len(reqs), first)
+	}
+	return n, nil
+}
+
+// warm executes a WarmRequest.
+func warm(h fasthttp.RequestHandler, namespaceKey string, wr WarmRequest) error {
+	uri, err := routeURI(wr.Route, wr.Params)
+	if err != nil {
+		return err
+	}
+
+	var (
+		req fasthttp.Request
+		ctx fasthttp.RequestCtx
+	)
+	req.SetRequestURI(uri)
+	req.Header.SetMethod(fasthttp.MethodGet)
+	if wr.Host == "" {
+		wr.Host = "localhost"
+	}
+	req.Header.SetHost(wr.Host)
+	for k, v := range wr.Headers {
+		req.Header.Set(k, v)
+	}
+	ctx.Init(&req, nil, nil)
+	ctx.SetUserValue(namespaceKey, wr.Namespace)
+
+	h(&ctx)
+
+	if code := ctx.Response.StatusCode(); code < 200 || code >= 400 {
+		return fmt.Errorf("%s: %d", uri, code)
+	}
+	return nil
+}
+
+// routeURI substitutes the params of a route.
+func routeURI(route string, params map[string]string) (string, error) {
+	uri := route
+	for k, v := range params {
+		p := "{" + k + "}"
+		if !strings.Contains(uri, p) {
+			return "", fmt.Errorf("unknown param '%s' in route %s", k, route)
+		}
+		uri = strings.ReplaceAll(uri, p, url.PathEscape(v))
+	}
+
+	path := uri
+	if i := strings.IndexByte(path, '?'); i >= 0 {
+		path = path[:i]
+	}
+	if strings.ContainsAny(path, "{}") {
+		return "", fmt.Errorf("missing params in route %s", route)
+	}
+	return uri, nil
+}